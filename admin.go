@@ -0,0 +1,167 @@
+package kcp
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// SessionInfo describes a session for the operators of a listener
+type SessionInfo struct {
+	RemoteAddr    net.Addr
+	Conv          uint32
+	Age           time.Duration // since the session was created
+	BytesSent     uint64        // payload bytes written
+	BytesReceived uint64        // payload bytes read
+	RTT           time.Duration // smoothed round trip time, 0 until measured
+}
+
+// Info returns the description of the session
+func (s *UDPSession) Info() SessionInfo {
+	s.mu.Lock()
+	srtt := s.kcp.rx_srtt
+	s.mu.Unlock()
+	return SessionInfo{
+		RemoteAddr:    s.RemoteAddr(),
+		Conv:          s.GetConv(),
+		Age:           time.Since(s.created),
+		BytesSent:     atomic.LoadUint64(&s.bytesSent),
+		BytesReceived: atomic.LoadUint64(&s.bytesReceived),
+		RTT:           time.Duration(srtt) * time.Millisecond,
+	}
+}
+
+// Conv returns the conversation id of the session
+func (s *UDPSession) Conv() uint32 {
+	return s.GetConv()
+}
+
+// MSS returns the maximum segment size, the largest payload of a segment
+// with the current mtu
+func (s *UDPSession) MSS() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(s.kcp.mss)
+}
+
+// Cipher returns the name the crypt of the session is registered under,
+// see NewCryptByName, that of the crypt under the wrapping ones such as
+// HeaderCrypt or EpochCrypt, "noise-chacha20" after a Noise handshake, "" without
+// encryption, and the type of the crypt for the ones not registered.
+func (s *UDPSession) Cipher() string {
+	return cryptName(s.block)
+}
+
+// FECParameters returns the geometry of the fec of the packets sent, the
+// latest set by SetFECParameters, parityShards is 0 with fec disabled
+func (s *UDPSession) FECParameters() (dataShards, parityShards int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fec == nil {
+		return 0, 0
+	}
+	return s.fecTx.dataShards, s.fecTx.parityShards
+}
+
+// NoDelay returns the kcp parameters set by SetNoDelay
+func (s *UDPSession) NoDelay() (nodelay, interval, resend, nc int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return int(s.kcp.nodelay), int(s.kcp.interval), int(s.kcp.fastresend), int(s.kcp.nocwnd)
+}
+
+// cryptName returns the name of a crypt as Cipher does
+func cryptName(block BlockCrypt) string {
+	switch c := block.(type) {
+	case nil:
+		return ""
+	case *HeaderCrypt:
+		return cryptName(c.block)
+	case *EpochCrypt:
+		return c.name
+	case *SessionCrypt:
+		return c.name
+	case *sessionCrypt:
+		return cryptName(c.block)
+	case *ConvCrypt:
+		return cryptName(c.block)
+	case *autoCrypt:
+		return "auto"
+	case *aeadCrypt:
+		return "noise-chacha20" // of the Noise handshakes, unlike a pre-shared chacha20 key
+	case *AESGCMCrypt:
+		return "aes-gcm"
+	case *SM4GCMCrypt:
+		return "sm4-gcm"
+	case *ChaCha20Poly1305Crypt:
+		return "chacha20"
+	case *HMACCrypt:
+		return "hmac-sha256"
+	case *AESBlockCrypt:
+		return "aes"
+	case *SM4BlockCrypt:
+		return "sm4"
+	case *TEABlockCrypt:
+		return "tea"
+	case *Salsa20BlockCrypt:
+		return "salsa20"
+	case *XSalsa20BlockCrypt:
+		return "xsalsa20"
+	case *SimpleXORBlockCrypt:
+		return "xor"
+	case *NoneBlockCrypt:
+		return "none"
+	default:
+		return fmt.Sprintf("%T", block)
+	}
+}
+
+// Sessions returns the description of the sessions of the listener, the
+// ones waiting for Accept included, for an admin endpoint to list them. It
+// returns nil once the listener is closed.
+func (l *Listener) Sessions() []SessionInfo {
+	var sessions []*UDPSession
+	if !l.admin(func() {
+		for _, s := range l.sessions {
+			sessions = append(sessions, s)
+		}
+	}) {
+		return nil
+	}
+	infos := make([]SessionInfo, 0, len(sessions))
+	for _, s := range sessions {
+		infos = append(infos, s.Info())
+	}
+	return infos
+}
+
+// CloseSession closes the session of conv, so that operators can kick a
+// remote. The remote reads an eof, as the session lingers like with Close,
+// until the remote closes too or closeLinger passes, the data it writes
+// meanwhile acknowledged and dropped rather than opening a new session. Its
+// packets after that open a new session unless a filter of the listener
+// refuses them.
+func (l *Listener) CloseSession(conv uint32) error {
+	var s *UDPSession
+	if !l.admin(func() { s = l.convs[conv] }) || s == nil {
+		return errNoSession
+	}
+	s.mu.Lock()
+	s.kicked = true
+	s.mu.Unlock()
+	return s.Close()
+}
+
+// admin runs f on the goroutine of the listener, which owns the session
+// maps, false if the listener is closed
+func (l *Listener) admin(f func()) bool {
+	done := make(chan struct{})
+	select {
+	case l.chAdmin <- func() { f(); close(done) }:
+	case <-l.die:
+		return false
+	}
+	<-done
+	return true
+}
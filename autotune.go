@@ -0,0 +1,71 @@
+package kcp
+
+import "time"
+
+const (
+	autoTunePeriod = 100 * time.Millisecond // least time the rates are measured over
+	autoTuneMaxWnd = 65535                  // widest window the 16bit wnd of the header advertises
+)
+
+// autoTune measures the rates of a session to size its windows, see
+// SetWindowAutoTune
+type autoTune struct {
+	budget int       // bytes the windows may hold, 0 if disabled
+	ts     time.Time // start of the measurement
+	una    uint32    // snd_una at ts
+	rcvNxt uint32    // rcv_nxt at ts
+}
+
+// SetWindowAutoTune sizes the windows of the session from the bandwidth
+// delay product measured, instead of SetWindowSize, so that a session
+// fills a long fat pipe without the windows being tuned for each network.
+// Every rtt, or 100ms if longer, the send window doubles if it limited a
+// sender with more to send while the segments acked per rtt reached half
+// of it, and the receive window doubles if the segments received per rtt
+// reached half of it while the application reads them. The windows grow
+// up to budget bytes of segments of the mss together, and never shrink
+// below their size when tuning starts. budget 0 disables the tuning, the
+// windows keep their size.
+func (s *UDPSession) SetWindowAutoTune(budget int) error {
+	if budget < 0 {
+		return errWindowBudget
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.autoTune = autoTune{budget, time.Now(), s.kcp.snd_una, s.kcp.rcv_nxt}
+	return nil
+}
+
+// tuneWindows grows the windows once the rates of a measurement are known,
+// the caller holds mu
+func (s *UDPSession) tuneWindows(now time.Time) {
+	a := &s.autoTune
+	if a.budget == 0 {
+		return
+	}
+	rtt := time.Duration(s.kcp.rx_srtt) * time.Millisecond
+	elapsed := now.Sub(a.ts)
+	if elapsed < rtt || elapsed < autoTunePeriod {
+		return
+	}
+	if rtt == 0 { // nothing sent yet, the measurement stands for an rtt
+		rtt = elapsed
+	}
+	perRTT := func(segments uint32) uint32 {
+		return uint32(float64(segments) * float64(rtt) / float64(elapsed))
+	}
+
+	kcp := s.kcp
+	limit := uint32(a.budget / 2 / int(kcp.mss))
+	if limit > autoTuneMaxWnd {
+		limit = autoTuneMaxWnd
+	}
+	inflight := kcp.snd_nxt - kcp.snd_una
+	if len(kcp.snd_queue) > 0 && inflight >= kcp.snd_wnd*3/4 && 2*perRTT(kcp.snd_una-a.una) >= kcp.snd_wnd {
+		kcp.snd_wnd = _imax_(kcp.snd_wnd, _imin_(2*kcp.snd_wnd, limit))
+	}
+	if len(kcp.rcv_queue) < int(kcp.rcv_wnd/4) && 2*perRTT(kcp.rcv_nxt-a.rcvNxt) >= kcp.rcv_wnd {
+		kcp.rcv_wnd = _imax_(kcp.rcv_wnd, _imin_(2*kcp.rcv_wnd, limit))
+	}
+	a.ts, a.una, a.rcvNxt = now, kcp.snd_una, kcp.rcv_nxt
+}
@@ -0,0 +1,154 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// BacklogDropNew drops the first packets of the new sessions while the
+	// accept backlog is full, their remotes retransmit until Accept makes
+	// room (default)
+	BacklogDropNew = 0
+	// BacklogDropOldest closes the session waiting the longest for Accept
+	// to make room for the new one
+	BacklogDropOldest = 1
+	// BacklogReject answers the new sessions with a reset, the dialer
+	// closes its session and its reads and writes fail
+	BacklogReject = 2
+
+	defaultBacklog = 1024       // sessions waiting for Accept
+	resetMagic     = 0x74657372 // "rset", in front of reset packets
+	resetSize      = 4 + 4 + 8  // magic, conv, tag of the packet refused
+)
+
+// acceptBacklog holds the sessions waiting for Accept
+type acceptBacklog struct {
+	mu       sync.Mutex
+	sessions []*UDPSession
+	depth    int
+	policy   int
+	ready    chan struct{} // notified while sessions are waiting
+}
+
+// SetAcceptBacklog sets the number of new sessions waiting for Accept, and
+// what the listener does with the sessions beyond: BacklogDropNew,
+// BacklogDropOldest or BacklogReject. The packets of the sessions turned
+// away are counted in Snmp.AcceptOverflows. The listener neither blocks nor
+// stops serving the sessions accepted while the application is slow to
+// Accept. The backlog holds 1024 sessions by default.
+func (l *Listener) SetAcceptBacklog(depth int, policy int) error {
+	if depth <= 0 || policy < BacklogDropNew || policy > BacklogReject {
+		return errBacklogParams
+	}
+	b := &l.backlog
+	b.mu.Lock()
+	b.depth = depth
+	b.policy = policy
+	b.mu.Unlock()
+	return nil
+}
+
+// admit tells if a new session of conv is to be created for the remote,
+// applying the policy of the backlog if it is full. size is the size of the
+// packet of the remote, a reset is no larger, and tag its cookieTag.
+func (l *Listener) admit(conv uint32, from net.Addr, size int, tag uint64) bool {
+	b := &l.backlog
+	b.mu.Lock()
+	full := len(b.sessions) >= b.depth
+	policy := b.policy
+	var evicted []*UDPSession
+	if full && policy == BacklogDropOldest {
+		k := len(b.sessions) - b.depth + 1
+		evicted = append(evicted, b.sessions[:k]...)
+		b.sessions = append(b.sessions[:0], b.sessions[k:]...)
+	}
+	b.mu.Unlock()
+	if !full {
+		return true
+	}
+
+	atomic.AddUint64(&DefaultSnmp.AcceptOverflows, 1)
+	switch policy {
+	case BacklogDropOldest:
+		for _, s := range evicted {
+			s.Close()
+		}
+		return true
+	case BacklogReject:
+		l.sendReset(conv, from, size, tag)
+	}
+	return false
+}
+
+// push queues a new session for Accept
+func (b *acceptBacklog) push(s *UDPSession) {
+	b.mu.Lock()
+	b.sessions = append(b.sessions, s)
+	b.mu.Unlock()
+	b.notify()
+}
+
+// pop returns the session waiting the longest, nil if none is
+func (b *acceptBacklog) pop() *UDPSession {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.sessions) == 0 {
+		return nil
+	}
+	s := b.sessions[0]
+	b.sessions[0] = nil
+	b.sessions = b.sessions[1:]
+	if len(b.sessions) > 0 { // for the other goroutines accepting
+		b.notify()
+	}
+	return s
+}
+
+func (b *acceptBacklog) notify() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
+
+// sendReset refuses the session of conv to a remote, the reset carries the
+// tag of the packet refused and is padded to size to pass the checks of the
+// remote
+func (l *Listener) sendReset(conv uint32, to net.Addr, size int, tag uint64) {
+	if size < resetSize {
+		size = resetSize
+	}
+	reset := l.rxbuf.Get().([]byte)[:size]
+	binary.LittleEndian.PutUint32(reset, resetMagic)
+	binary.LittleEndian.PutUint32(reset[4:], conv)
+	binary.LittleEndian.PutUint64(reset[8:], tag)
+	padding := reset[resetSize:]
+	xorBytes(padding, padding, padding)
+	l.extension().writeTo(l.conn, reset, to)
+	l.rxbuf.Put(reset[:cap(reset)])
+}
+
+// isReset tells if data is a reset of the session of conv
+func isReset(data []byte, conv uint32) bool {
+	return len(data) >= resetSize && binary.LittleEndian.Uint32(data) == resetMagic &&
+		binary.LittleEndian.Uint32(data[4:]) == conv
+}
+
+// resetInput closes a dialed session refused by the listener. Resets are
+// sent in the clear, so they are only honored before the first packet of
+// the remote, a session under way can't be torn down by forged resets, and
+// only if they answer one of the packets of the session, as blind resets
+// would match the conv 0 of every dialer requesting its conv.
+func (s *UDPSession) resetInput(reset []byte) {
+	answered := s.cookieTags.answers(binary.LittleEndian.Uint64(reset[8:]))
+	s.mu.Lock()
+	refused := !s.established && answered
+	s.refused = refused
+	s.mu.Unlock()
+	if refused {
+		s.Close()
+	}
+}
@@ -0,0 +1,45 @@
+package kcp
+
+// WriteAvailable returns the bytes Write queues before blocking, as whole
+// segments of the mss. Write blocks once the segments waiting to be sent or
+// acknowledged reach twice the send window, applications pacing their
+// writes can thus hold back instead of blocking in Write.
+func (s *UDPSession) WriteAvailable() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	free := 2*int(s.kcp.snd_wnd) - s.kcp.WaitSnd()
+	if free < 0 {
+		return 0
+	}
+	return free * int(s.kcp.mss)
+}
+
+// SetWriteWatermark calls drained once the segments waiting to be sent or
+// acknowledged fall below watermark, after having reached it, so that
+// applications learn when to resume writing. drained is called by the
+// goroutine updating the session, it must not block. nil removes the
+// callback.
+func (s *UDPSession) SetWriteWatermark(watermark int, drained func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.watermark = watermark
+	s.onDrained = drained
+	s.pastWatermark = false
+}
+
+// checkWatermark returns the callback to call once the caller, which holds
+// mu, releases it, nil if the queue didn't just drain below the watermark
+func (s *UDPSession) checkWatermark() func() {
+	if s.onDrained == nil {
+		return nil
+	}
+	if s.kcp.WaitSnd() >= s.watermark {
+		s.pastWatermark = true
+		return nil
+	}
+	if s.pastWatermark {
+		s.pastWatermark = false
+		return s.onDrained
+	}
+	return nil
+}
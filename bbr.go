@@ -0,0 +1,261 @@
+package kcp
+
+import "time"
+
+const (
+	bbrHighGain      = 2.885 // 2/ln2, doubles the delivery rate every round in startup
+	bbrCwndGain      = 2     // window in bdps once the bottleneck is full
+	bbrMinWindow     = 4     // window of probe rtt, in segments
+	bbrInitWindow    = 16    // window until the first bandwidth sample, in segments
+	bbrBtlBwRounds   = 10    // rounds the bottleneck bandwidth is the max of
+	bbrFullBwGrowth  = 1.25  // growth of the bandwidth in a round while startup fills the pipe
+	bbrFullBwRounds  = 3     // rounds without growth ending startup
+	bbrRTpropExpiry  = 10 * time.Second
+	bbrProbeRTTTime  = 200 * time.Millisecond
+	bbrMinRoundTrip  = time.Millisecond // round of the rtprop below the clock resolution
+	bbrProbeBWPhases = 8
+	bbrRateSamples   = 64 // delivery history the rate samples are taken against
+)
+
+// bbrPacingGains are the gains of the phases of probe bandwidth, which probe
+// for more bandwidth, then drain the queue the probe built
+var bbrPacingGains = [bbrProbeBWPhases]float64{1.25, 0.75, 1, 1, 1, 1, 1, 1}
+
+// the modes of bbrControl
+const (
+	bbrStartup = iota
+	bbrDrain
+	bbrProbeBW
+	bbrProbeRTT
+)
+
+// bbrControl is a CongestionControl estimating the bottleneck bandwidth and
+// the round trip propagation time of the path, after BBR
+type bbrControl struct {
+	mss      int           // bytes of a segment
+	interval time.Duration // flush interval of kcp
+	mode     int
+
+	delivered int64 // segments acknowledged
+	inflight  int   // segments in flight at the latest ack
+	cwnd      int   // grows by the segments acked up to the window of the mode
+	roundEnd  int64 // delivered once the segments in flight at the start of the round are
+	rounds    int
+	history   [bbrRateSamples]bbrDelivery // of the latest acks, for the rate samples
+	acks      int                         // recorded in history
+
+	bw       [bbrBtlBwRounds]float64 // max delivery rates of the latest rounds, in segments per second
+	roundBw  float64                 // max delivery rate of the current round
+	btlBw    float64                 // max of bw and roundBw
+	rtprop   time.Duration           // min rtt
+	rtStamp  time.Time               // when rtprop was measured
+	phaseEnd time.Time               // of the phase of probe bandwidth, an rtprop and a flush interval long at least
+
+	fullBw       float64 // bandwidth startup last grew to
+	fullBwRounds int     // rounds since
+	filled       bool    // startup filled the pipe
+	phase        int     // of probe bandwidth
+	probeRTTEnd  time.Time
+}
+
+// bbrDelivery is the segments delivered by an ack
+type bbrDelivery struct {
+	at        time.Time
+	delivered int64
+}
+
+// NewBBRControl returns a congestion control after BBR, for
+// SetCongestionControl, which paces the segments at the bottleneck
+// bandwidth it measures, and keeps twice the bandwidth-delay product in
+// flight, the round trip propagation time being the least rtt of the last
+// 10s. Losses don't shrink its window, which suits bulk transfers over
+// lossy long fat links, where the builtin congestion control backs off on
+// random losses. mss is the segment size of the session, see
+// UDPSession.MSS. The window of the session must be set large enough for
+// the bandwidth-delay product of the path, see SetWindowSize.
+func NewBBRControl(mss int) CongestionControl {
+	return &bbrControl{mss: mss, cwnd: bbrInitWindow}
+}
+
+// setInterval implements intervalControl
+func (c *bbrControl) setInterval(interval time.Duration) { c.interval = interval }
+
+// OnAck samples the delivery rate on every ack, and advances the mode. A
+// round ends once the segments in flight at its start are delivered.
+func (c *bbrControl) OnAck(acked int, rtt time.Duration, inflight int) {
+	now := time.Now()
+	c.delivered += int64(acked)
+	c.inflight = inflight
+	if rtt > 0 && (c.rtprop == 0 || rtt <= c.rtprop || now.Sub(c.rtStamp) > bbrRTpropExpiry && c.mode != bbrProbeRTT) {
+		if c.rtprop != 0 && rtt > c.rtprop && c.mode != bbrProbeRTT {
+			// the rtprop expired, drain the queue to measure it again
+			c.mode = bbrProbeRTT
+			c.probeRTTEnd = now.Add(bbrProbeRTTTime)
+		}
+		c.rtprop, c.rtStamp = rtt, now
+	}
+
+	if rate, ok := c.sample(now, rtt); ok {
+		if rate > c.roundBw {
+			c.roundBw = rate
+		}
+		if rate > c.btlBw {
+			c.btlBw = rate
+		}
+	}
+	if c.delivered >= c.roundEnd {
+		c.newRound(now)
+		c.roundEnd = c.delivered + int64(inflight)
+	}
+
+	c.grow(acked)
+
+	switch c.mode {
+	case bbrDrain:
+		if float64(c.inflight) <= c.bdp() {
+			c.mode = bbrProbeBW
+			c.phaseEnd = now.Add(c.phaseTime())
+		}
+	case bbrProbeRTT:
+		if now.After(c.probeRTTEnd) {
+			c.rtStamp = now
+			if c.filled {
+				c.mode = bbrProbeBW
+				c.phaseEnd = now.Add(c.phaseTime())
+			} else {
+				c.mode = bbrStartup
+			}
+		}
+	}
+}
+
+// grow grows the window by the segments acked, up to the target of the
+// mode once startup filled the pipe, the window never shrinking in startup
+// so that a low bandwidth sample doesn't stall it
+func (c *bbrControl) grow(acked int) {
+	target := c.target()
+	switch {
+	case c.filled:
+		if c.cwnd += acked; c.cwnd > target {
+			c.cwnd = target
+		}
+	case c.cwnd < target || c.delivered < bbrInitWindow:
+		c.cwnd += acked
+	}
+}
+
+// sample records the delivery of an ack, and returns the delivery rate
+// since the segments acked were sent, about an rtt ago, false if the
+// history is too short
+func (c *bbrControl) sample(now time.Time, rtt time.Duration) (float64, bool) {
+	if rtt <= 0 {
+		rtt = c.rtprop
+	}
+	if rtt < bbrMinRoundTrip {
+		rtt = bbrMinRoundTrip
+	}
+	// the newest delivery an rtt old, the oldest one kept otherwise
+	var from *bbrDelivery
+	for k := 1; k <= c.acks && k <= bbrRateSamples; k++ {
+		from = &c.history[(c.acks-k)%bbrRateSamples]
+		if now.Sub(from.at) >= rtt {
+			break
+		}
+	}
+	c.history[c.acks%bbrRateSamples] = bbrDelivery{now, c.delivered}
+	c.acks++
+	if from == nil {
+		return 0, false
+	}
+	elapsed := now.Sub(from.at)
+	if elapsed < bbrMinRoundTrip {
+		return 0, false
+	}
+	return float64(c.delivered-from.delivered) / elapsed.Seconds(), true
+}
+
+// phaseTime returns the least duration of a phase of probe bandwidth, a
+// round trip and a flush interval, so that the pacing of the phase is
+// applied by a flush at least
+func (c *bbrControl) phaseTime() time.Duration {
+	if c.rtprop > c.interval {
+		return c.rtprop
+	}
+	return c.interval
+}
+
+// newRound records the max delivery rate of the round ending
+func (c *bbrControl) newRound(now time.Time) {
+	c.bw[c.rounds%bbrBtlBwRounds] = c.roundBw
+	c.rounds++
+	c.roundBw = 0
+	c.btlBw = 0
+	for _, bw := range c.bw {
+		if bw > c.btlBw {
+			c.btlBw = bw
+		}
+	}
+
+	switch c.mode {
+	case bbrStartup:
+		if c.btlBw >= c.fullBw*bbrFullBwGrowth {
+			c.fullBw, c.fullBwRounds = c.btlBw, 0
+		} else if c.fullBwRounds++; c.fullBwRounds >= bbrFullBwRounds {
+			c.mode, c.filled = bbrDrain, true
+		}
+	case bbrProbeBW:
+		if !now.Before(c.phaseEnd) {
+			c.phase = (c.phase + 1) % bbrProbeBWPhases
+			c.phaseEnd = now.Add(c.phaseTime())
+		}
+	}
+}
+
+// bdp returns the bandwidth-delay product, in segments, the delay being the
+// rtprop and the flush interval the acks of kcp wait for at most
+func (c *bbrControl) bdp() float64 {
+	return c.btlBw * (c.rtprop + c.interval).Seconds()
+}
+
+// OnLoss ignores the losses, the bandwidth samples account for them
+func (c *bbrControl) OnLoss(lost int, timeout bool, inflight int) {}
+
+// target returns the window the mode aims at, the bdp times its gain
+func (c *bbrControl) target() int {
+	if c.btlBw == 0 || c.rtprop == 0 {
+		return bbrInitWindow
+	}
+	gain := float64(bbrCwndGain)
+	if c.mode == bbrStartup {
+		gain = bbrHighGain
+	}
+	if w := int(gain*c.bdp()) + 1; w > bbrMinWindow {
+		return w
+	}
+	return bbrMinWindow
+}
+
+// Window returns the window of the mode
+func (c *bbrControl) Window() int {
+	if c.mode == bbrProbeRTT || c.cwnd < bbrMinWindow {
+		return bbrMinWindow
+	}
+	return c.cwnd
+}
+
+// PacingRate returns the bottleneck bandwidth times the gain of the mode
+func (c *bbrControl) PacingRate() int {
+	if c.btlBw == 0 {
+		return 0
+	}
+	gain := 1.0
+	switch c.mode {
+	case bbrStartup:
+		gain = bbrHighGain
+	case bbrDrain:
+		gain = 1 / bbrHighGain
+	case bbrProbeBW:
+		gain = bbrPacingGains[c.phase]
+	}
+	return int(gain * c.btlBw * float64(c.mss))
+}
@@ -0,0 +1,223 @@
+package kcp
+
+import "time"
+
+const (
+	hystartLowWindow = 16                    // window below which slow start isn't left early
+	hystartSamples   = 8                     // rtt samples taken at the start of a round
+	hystartMinEta    = 4 * time.Millisecond  // least rtt increase ending slow start
+	hystartMaxEta    = 16 * time.Millisecond // rtt increase always ending slow start
+	hystartAckDelta  = 2 * time.Millisecond  // spacing of the acks of a train
+)
+
+// CongestionControl decides the congestion window and the pacing of a
+// session from the events of its kcp, so that algorithms other than the
+// builtin one, that of TCP Reno, run without patching kcp. Its methods are
+// called with the session locked, they must not block nor call the
+// session. The window is ignored with the congestion control disabled by
+// the nc parameter of SetNoDelay, and never exceeds the send window nor the
+// window of the remote.
+type CongestionControl interface {
+	// OnAck is called once an input acknowledges the first acked segments in
+	// flight, with the latest rtt sample of the input, 0 if none, of a
+	// millisecond resolution, and the segments still in flight.
+	OnAck(acked int, rtt time.Duration, inflight int)
+
+	// OnLoss is called once a flush retransmits lost segments, on the expiry
+	// of their rto if timeout, by fast retransmit otherwise, with the
+	// segments in flight.
+	OnLoss(lost int, timeout bool, inflight int)
+
+	// Window returns the congestion window, in segments.
+	Window() int
+
+	// PacingRate returns the rate new segments are sent at, in bytes per
+	// second, 0 sends them as the window allows.
+	PacingRate() int
+}
+
+// LossUndoer is implemented by the CongestionControls able to revert their
+// reaction to a timeout found spurious, see SetFRTO. The others keep the
+// window of the timeout.
+type LossUndoer interface {
+	// UndoLoss restores the window as it was before the latest OnLoss of
+	// a timeout.
+	UndoLoss()
+}
+
+// intervalControl is implemented by the congestion controls timing their
+// phases against the flush interval of kcp
+type intervalControl interface {
+	setInterval(interval time.Duration)
+}
+
+// SetHyStart enables the hybrid slow start of the builtin congestion
+// control, so that the window of a session with large windows ramps up
+// without bursts of losses: slow start doubles the window every round up
+// to the send window, instead of stopping at 2 segments, and is left once
+// the rtt of a round grows by an eighth, or once the acks of a round arrive
+// in a train lasting half the least rtt, the signs of a queue building at
+// the bottleneck, rather than once packets are lost. It has no effect on
+// other congestion controls. Disabled by default.
+func (s *UDPSession) SetHyStart(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.kcp.cc.(*renoControl); ok {
+		c.hystart = enabled
+		if enabled && s.kcp.ssthresh < s.kcp.snd_wnd {
+			s.kcp.ssthresh = s.kcp.snd_wnd
+		}
+	}
+}
+
+// SetCongestionControl replaces the congestion control of the session by
+// cc, nil restores the builtin one. The state of the builtin one is lost
+// when replaced, and cc isn't kept by Export.
+func (s *UDPSession) SetCongestionControl(cc CongestionControl) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cc == nil {
+		cc = &renoControl{kcp: s.kcp}
+		s.kcp.cwnd, s.kcp.incr, s.kcp.ssthresh = 0, 0, IKCP_THRESH_INIT
+	}
+	s.kcp.cc = cc
+	if ic, ok := cc.(intervalControl); ok {
+		ic.setInterval(time.Duration(s.kcp.interval) * time.Millisecond)
+	}
+}
+
+// renoControl is the builtin congestion control of kcp, slow start and
+// congestion avoidance with the rate halving of fast retransmits, which
+// keeps its state in the cwnd, incr and ssthresh of kcp
+type renoControl struct {
+	kcp     *KCP
+	hystart bool // leave slow start once a queue builds, see SetHyStart
+
+	roundEnd     uint32        // snd_nxt at the start of the round, which ends once it's acked
+	roundMin     time.Duration // least rtt of the first samples of the round
+	lastRoundMin time.Duration // of the previous round
+	samples      int           // rtt samples of the round
+	minRTT       time.Duration // least rtt sampled
+	trainStart   time.Time     // of the ack train of the round
+	lastAck      time.Time     // of the ack train
+
+	undo [3]uint32 // cwnd, incr and ssthresh before the latest timeout
+}
+
+// OnAck grows the window, by a segment in slow start, by about a segment
+// every window in congestion avoidance, https://tools.ietf.org/html/rfc5681
+func (c *renoControl) OnAck(acked int, rtt time.Duration, inflight int) {
+	kcp := c.kcp
+	if rtt > 0 && (c.minRTT == 0 || rtt < c.minRTT) {
+		c.minRTT = rtt
+	}
+	if c.hystart && kcp.cwnd < kcp.ssthresh {
+		c.slowStart(rtt)
+	}
+	if kcp.cwnd >= kcp.rmt_wnd {
+		return
+	}
+	mss := kcp.mss
+	if kcp.cwnd < kcp.ssthresh {
+		kcp.cwnd++
+		kcp.incr += mss
+	} else {
+		if kcp.incr < mss {
+			kcp.incr = mss
+		}
+		kcp.incr += (mss*mss)/kcp.incr + (mss / 16)
+		if (kcp.cwnd+1)*mss <= kcp.incr {
+			kcp.cwnd++
+		}
+	}
+	if kcp.cwnd > kcp.rmt_wnd {
+		kcp.cwnd = kcp.rmt_wnd
+		kcp.incr = kcp.rmt_wnd * mss
+	}
+}
+
+// slowStart leaves slow start once the rtt of the round grows, or the acks
+// of the round arrive in a train as long as half the rtt, hybrid slow start
+// after https://doi.org/10.1016/j.comnet.2011.01.014
+func (c *renoControl) slowStart(rtt time.Duration) {
+	kcp := c.kcp
+	now := time.Now()
+	if _itimediff(kcp.snd_una, c.roundEnd) >= 0 {
+		c.roundEnd = kcp.snd_nxt
+		c.lastRoundMin, c.roundMin, c.samples = c.roundMin, 0, 0
+		c.trainStart, c.lastAck = now, now
+	}
+	if kcp.cwnd < hystartLowWindow {
+		return
+	}
+
+	if now.Sub(c.lastAck) <= hystartAckDelta {
+		c.lastAck = now
+		if c.minRTT > 0 && now.Sub(c.trainStart) >= c.minRTT/2 {
+			kcp.ssthresh = kcp.cwnd
+			return
+		}
+	}
+
+	if rtt > 0 && c.samples < hystartSamples {
+		c.samples++
+		if c.roundMin == 0 || rtt < c.roundMin {
+			c.roundMin = rtt
+		}
+		if c.samples == hystartSamples && c.lastRoundMin > 0 {
+			eta := c.lastRoundMin / 8
+			if eta < hystartMinEta {
+				eta = hystartMinEta
+			} else if eta > hystartMaxEta {
+				eta = hystartMaxEta
+			}
+			if c.roundMin >= c.lastRoundMin+eta {
+				kcp.ssthresh = kcp.cwnd
+			}
+		}
+	}
+}
+
+// OnLoss halves the window on a fast retransmit,
+// https://tools.ietf.org/html/rfc6937, and restarts slow start on a timeout
+func (c *renoControl) OnLoss(lost int, timeout bool, inflight int) {
+	kcp := c.kcp
+	if timeout {
+		c.undo = [3]uint32{kcp.cwnd, kcp.incr, kcp.ssthresh}
+		kcp.ssthresh = kcp.sendWindow() / 2
+		if kcp.ssthresh < IKCP_THRESH_MIN {
+			kcp.ssthresh = IKCP_THRESH_MIN
+		}
+		kcp.cwnd = 1
+		kcp.incr = kcp.mss
+		return
+	}
+
+	resent := uint32(kcp.fastresend)
+	if kcp.fastresend <= 0 {
+		resent = 0xffffffff
+	}
+	kcp.ssthresh = uint32(inflight) / 2
+	if kcp.ssthresh < IKCP_THRESH_MIN {
+		kcp.ssthresh = IKCP_THRESH_MIN
+	}
+	kcp.cwnd = kcp.ssthresh + resent
+	kcp.incr = kcp.cwnd * kcp.mss
+}
+
+// Window returns the cwnd of kcp
+func (c *renoControl) Window() int {
+	if c.kcp.cwnd < 1 {
+		c.kcp.cwnd = 1
+		c.kcp.incr = c.kcp.mss
+	}
+	return int(c.kcp.cwnd)
+}
+
+// PacingRate doesn't pace
+func (c *renoControl) PacingRate() int { return 0 }
+
+// UndoLoss restores the window before the latest timeout
+func (c *renoControl) UndoLoss() {
+	c.kcp.cwnd, c.kcp.incr, c.kcp.ssthresh = c.undo[0], c.undo[1], c.undo[2]
+}
@@ -0,0 +1,85 @@
+package kcp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+)
+
+// unreachLimit is the number of ICMP errors in a row, without a packet of
+// the remote in between, which closes an established connected session
+const unreachLimit = 3
+
+// connectedConn is a connected UDP socket seen as a net.PacketConn, every
+// packet goes to and comes from raddr
+type connectedConn struct {
+	*net.UDPConn
+	raddr net.Addr
+}
+
+// ReadFrom reads a packet of the remote.
+func (c *connectedConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.UDPConn.Read(b)
+	return n, c.raddr, err
+}
+
+// WriteTo writes a packet to the remote, addr is ignored.
+func (c *connectedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.UDPConn.Write(b)
+}
+
+// DialConnected connects like DialWithOptions over a connected UDP socket,
+// to which the kernel reports the ICMP errors of the remote, such as port
+// or host unreachable. The session then fails with the error reported,
+// which Read and Write return, instead of waiting for the dead link, at the
+// first error if it never heard of the remote, else once unreachLimit errors
+// came without a packet of the remote in between, so that a single forged
+// ICMP error doesn't tear an established session down. The socket only exchanges packets with raddr, the session can't
+// follow a remote changing address.
+func DialConnected(raddr string, block BlockCrypt, dataShards, parityShards int) (*UDPSession, error) {
+	udpaddr, err := resolveUDPAddr(context.Background(), raddr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := newSessionFEC(dataShards, parityShards); err != nil {
+		return nil, err
+	}
+	udpconn, err := net.DialUDP("udp", nil, udpaddr)
+	if err != nil {
+		return nil, err
+	}
+	udpconn.SetReadBuffer(soBuffer)
+	udpconn.SetWriteBuffer(soBuffer)
+	conn := &connectedConn{udpconn, udpaddr}
+	sess, err := NewConn(udpaddr, block, dataShards, parityShards, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sess, nil
+}
+
+// isUnreachable tells if err reports an ICMP error of the remote
+func isUnreachable(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EHOSTUNREACH) ||
+		errors.Is(err, syscall.ENETUNREACH)
+}
+
+// unreachable counts an ICMP error of the remote, and closes the dialed
+// session once the remote looks unreachable as DialConnected tells, the
+// reads and writes fail with err. It returns true if the session closed.
+func (s *UDPSession) unreachable(err error) bool {
+	s.mu.Lock()
+	s.unreachCount++
+	if s.established && s.unreachCount < unreachLimit {
+		s.mu.Unlock()
+		return false
+	}
+	if s.unreachErr == nil {
+		s.unreachErr = err
+	}
+	s.mu.Unlock()
+	s.Close()
+	return true
+}
@@ -0,0 +1,92 @@
+package kcp
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// RequestConv has the listener assign the conv of the session, so that the
+// dialers needn't agree on their convs out of band, nor collide behind the
+// same NAT. The session sends conv 0 until the first packet of the listener,
+// whose conv it adopts, GetConv returns 0 until then. It must be called
+// before the session sends anything. Sessions dialed with a ConvCrypt, whose
+// conv selects their key, can't request one.
+func (s *UDPSession) RequestConv() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if sc, ok := s.block.(*sessionCrypt); ok && len(sc.header) == convHeaderSize {
+		return errConvRequest
+	}
+	if s.l != nil || s.established || s.kcp.snd_nxt != 0 || len(s.kcp.snd_queue) != 0 {
+		return errConvRequest
+	}
+	atomic.StoreUint32(&s.kcp.conv, 0)
+	s.convPending = true
+	return nil
+}
+
+// convInput feeds a kcp packet to kcp. A dialer which requested its conv
+// adopts the conv of the listener, and a listener takes the conv 0 of the
+// dialers it assigned a conv for their conv. The caller holds mu.
+func (s *UDPSession) convInput(pkt []byte) {
+	if ts, ok := senderTs(pkt); ok && s.fresh(ts) {
+		s.rxTs, s.rxTsSeen = ts, true
+	}
+	if isDatagram(pkt) {
+		s.datagramInput(pkt)
+		return
+	}
+	if isPing(pkt) {
+		s.pingInput(pkt)
+		return
+	}
+	if isRekey(pkt) {
+		s.rekeyInput(pkt)
+		return
+	}
+	if s.convPending && len(pkt) >= IKCP_OVERHEAD {
+		if conv := binary.LittleEndian.Uint32(pkt); conv != 0 {
+			atomic.StoreUint32(&s.kcp.conv, conv)
+			for k := range s.kcp.snd_buf {
+				s.kcp.snd_buf[k].conv = conv
+			}
+			s.convPending = false
+		}
+	} else if s.convAssigned {
+		// the dialer sends conv 0 until it receives its conv
+		for seg := pkt; len(seg) >= IKCP_OVERHEAD; {
+			if binary.LittleEndian.Uint32(seg) == 0 {
+				binary.LittleEndian.PutUint32(seg, s.kcp.conv)
+			}
+			length := int(binary.LittleEndian.Uint32(seg[20:]))
+			if length > len(seg)-IKCP_OVERHEAD {
+				break
+			}
+			seg = seg[IKCP_OVERHEAD+length:]
+		}
+	}
+	s.kcp.Input(pkt)
+}
+
+// assignConv returns a conv for a dialer which requested one, unpredictable
+// and unused by the sessions of the listener
+func (l *Listener) assignConv() uint32 {
+	var b [4]byte
+	for {
+		crand.Read(b[:])
+		if conv := binary.LittleEndian.Uint32(b[:]); conv != 0 && l.convs[conv] == nil {
+			return conv
+		}
+	}
+}
+
+// randomConv returns the conv of a dialer, 0 is reserved for the dialers
+// requesting their conv
+func randomConv() uint32 {
+	for {
+		if conv := rng.Uint32(); conv != 0 {
+			return conv
+		}
+	}
+}
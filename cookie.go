@@ -0,0 +1,251 @@
+package kcp
+
+import (
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	cookieMarkerSize    = 4 // marker of the time slot, in front of cookie packets
+	cookieTagSize       = 8 // tag of the packet challenged
+	cookieMACSize       = 12
+	cookieSize          = cookieMarkerSize + cookieTagSize + cookieMACSize // marker, tag, mac
+	cookieLifetime      = 30 * time.Second                                 // a cookie expires after one to two lifetimes
+	cookieVerifiedLimit = 1024                                             // remotes which echoed a cookie, waiting for their session
+	cookieTagLimit      = 8                                                // packets of a handshake a dialer answers challenges of
+)
+
+// cookieKey computes the cookies of a listener, it is only used by the
+// goroutine of the listener
+type cookieKey struct {
+	mac     hash.Hash
+	slot    uint32    // time slot of markers
+	markers [2]uint32 // of slot and the one before
+}
+
+// cookieTags remembers the packets a dialer sent until it heard from the
+// listener, so that it only echoes the challenges and honors the resets
+// answering them
+type cookieTags struct {
+	mu   sync.Mutex
+	tags [cookieTagLimit]uint64
+	n    int
+	done uint32 // the remote was heard from, accessed atomically
+}
+
+// SetCookies makes the listener challenge remotes without session before
+// keeping any state for them, much like TCP SYN cookies. The first packet of
+// a remote is answered with a cookie bound to its address and to the packet,
+// and sessions are only created once the remote echoes it, so that a flood
+// of packets with spoofed source addresses can't exhaust the listener. The
+// challenge is no larger than the packet answered and starts with a marker
+// changing with the secret of the listener and over time. Dialers echo the
+// cookies answering their own packets until they hear from the listener,
+// the first packets of a session are delayed by a round trip and a kcp
+// retransmission.
+func (l *Listener) SetCookies(enabled bool) {
+	var key *cookieKey
+	if enabled {
+		secret := make([]byte, 32)
+		io.ReadFull(crand.Reader, secret)
+		key = newCookieKey(secret)
+	}
+	l.cookies.Store(key)
+}
+
+// newCookieKey returns the cookie key of a secret
+func newCookieKey(secret []byte) *cookieKey {
+	return &cookieKey{mac: hmac.New(sha256.New, secret)}
+}
+
+// compute fills in the mac of the cookie of a remote for a time slot and
+// the tag of the packet challenged, a marker with a nil tag and no remote
+func (k *cookieKey) compute(mac []byte, slot uint32, tag []byte, remote string) {
+	var b [5]byte
+	binary.LittleEndian.PutUint32(b[1:], slot)
+	if tag != nil {
+		b[0] = 1 // tells cookies from markers
+	}
+	k.mac.Reset()
+	k.mac.Write(b[:])
+	k.mac.Write(tag)
+	io.WriteString(k.mac, remote)
+	var sum [sha256.Size]byte
+	copy(mac, k.mac.Sum(sum[:0]))
+}
+
+// marker returns the marker of cookies issued in the current time slot and
+// the one before, the markers are cached for the slot
+func (k *cookieKey) marker(now time.Time) (slot uint32, markers [2]uint32) {
+	slot = cookieSlot(now)
+	if slot != k.slot || k.markers == [2]uint32{} {
+		var b [4]byte
+		for i := range k.markers {
+			k.compute(b[:], slot-uint32(i), nil, "")
+			k.markers[i] = binary.LittleEndian.Uint32(b[:])
+		}
+		k.slot = slot
+	}
+	return slot, k.markers
+}
+
+// issued tells the time slot a cookie was issued in by its marker, false if
+// it isn't a cookie of a slot still valid
+func (k *cookieKey) issued(cookie []byte, now time.Time) (uint32, bool) {
+	if len(cookie) < cookieSize {
+		return 0, false
+	}
+	slot, markers := k.marker(now)
+	switch binary.LittleEndian.Uint32(cookie) {
+	case markers[0]:
+		return slot, true
+	case markers[1]:
+		return slot - 1, true
+	}
+	return 0, false
+}
+
+// challenge writes the cookie of remote for packet to the head of dst, which
+// may be packet itself
+func (k *cookieKey) challenge(dst, packet []byte, remote string, now time.Time) {
+	var tag [cookieTagSize]byte
+	binary.LittleEndian.PutUint64(tag[:], cookieTag(packet))
+	slot, markers := k.marker(now)
+	binary.LittleEndian.PutUint32(dst, markers[0])
+	copy(dst[cookieMarkerSize:], tag[:])
+	k.compute(dst[cookieMarkerSize+cookieTagSize:cookieSize], slot, tag[:], remote)
+}
+
+// verify tells if an echoed cookie was issued to remote and hasn't expired
+func (k *cookieKey) verify(cookie []byte, remote string, now time.Time) bool {
+	slot, ok := k.issued(cookie, now)
+	if !ok {
+		return false
+	}
+	var mac [cookieMACSize]byte
+	k.compute(mac[:], slot, cookie[cookieMarkerSize:cookieMarkerSize+cookieTagSize], remote)
+	return macEqual(mac[:], cookie[cookieMarkerSize+cookieTagSize:cookieSize])
+}
+
+// cookieSlot returns the time slot cookies are issued in
+func cookieSlot(now time.Time) uint32 {
+	return uint32(now.Unix() / int64(cookieLifetime/time.Second))
+}
+
+// cookieTag returns the tag binding a challenge to the packet it answers,
+// FNV-1a of the packet, whose conv or crypt nonce off-path senders can't
+// guess
+func cookieTag(packet []byte) uint64 {
+	h := uint64(14695981039346656037)
+	for _, b := range packet {
+		h ^= uint64(b)
+		h *= 1099511628211
+	}
+	return h
+}
+
+// sent remembers a packet of the handshake, t may be nil
+func (t *cookieTags) sent(packet []byte) {
+	if t == nil || atomic.LoadUint32(&t.done) != 0 {
+		return
+	}
+	tag := cookieTag(packet)
+	t.mu.Lock()
+	t.tags[t.n%cookieTagLimit] = tag
+	t.n++
+	t.mu.Unlock()
+}
+
+// challenged tells if data is a challenge answering a packet of the
+// handshake, t may be nil
+func (t *cookieTags) challenged(data []byte) bool {
+	return len(data) >= cookieSize && t.answers(binary.LittleEndian.Uint64(data[cookieMarkerSize:]))
+}
+
+// answers tells if tag is the cookieTag of a packet of the handshake, t may
+// be nil
+func (t *cookieTags) answers(tag uint64) bool {
+	if t == nil || atomic.LoadUint32(&t.done) != 0 {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for k := 0; k < t.n && k < cookieTagLimit; k++ {
+		if t.tags[k] == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// finish ends the handshake once the remote was heard from, t may be nil
+func (t *cookieTags) finish() {
+	if t != nil {
+		atomic.StoreUint32(&t.done, 1)
+	}
+}
+
+// cookieInput challenges a remote without session, it returns true if the
+// remote echoed a cookie already and its packet is to be processed
+func (l *Listener) cookieInput(addr string, from net.Addr, data []byte) bool {
+	key, _ := l.cookies.Load().(*cookieKey)
+	if key == nil {
+		return true
+	}
+	if _, verified := l.cookieVerified[addr]; verified {
+		return !l.isCookieEcho(data)
+	}
+	now := time.Now()
+	if _, ok := key.issued(data, now); ok {
+		if !key.verify(data, addr, now) {
+			atomic.AddUint64(&DefaultSnmp.InAuthErrors, 1)
+			return false
+		}
+		if len(l.cookieVerified) >= cookieVerifiedLimit {
+			for k := range l.cookieVerified {
+				delete(l.cookieVerified, k)
+				break
+			}
+		}
+		l.cookieVerified[addr] = struct{}{}
+		return false
+	}
+
+	// the challenge has the size of the packet answered, which is large
+	// enough to pass the checks of the remote, the packet fills in the
+	// bytes after the cookie
+	if len(data) < cookieSize {
+		return false
+	}
+	challenge := l.rxbuf.Get().([]byte)[:len(data)]
+	copy(challenge, data)
+	key.challenge(challenge, data, addr, now)
+	l.extension().writeTo(l.conn, challenge, from)
+	l.rxbuf.Put(challenge[:cap(challenge)])
+	return false
+}
+
+// isCookieEcho tells if data is a cookie echoed to the listener, a remote
+// challenged more than once may echo after its session was created
+func (l *Listener) isCookieEcho(data []byte) bool {
+	key, _ := l.cookies.Load().(*cookieKey)
+	if key == nil {
+		return false
+	}
+	_, ok := key.issued(data, time.Now())
+	return ok
+}
+
+// echoCookie sends a cookie challenge received by a dialer back to the
+// listener as is, stamped by the header extension ext
+func echoCookie(conn net.PacketConn, ext *headerExtension, challenge []byte, remote net.Addr) {
+	ext.writeTo(conn, challenge, remote)
+}
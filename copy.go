@@ -0,0 +1,78 @@
+package kcp
+
+import (
+	"io"
+	"sync"
+)
+
+// copySegments is the size of the buffers of ReadFrom and WriteTo, in
+// segments
+const copySegments = 32
+
+// copyBuffers are the buffers of ReadFrom and WriteTo, large enough for
+// copySegments of the largest mss
+var copyBuffers = sync.Pool{
+	New: func() interface{} {
+		return make([]byte, mtuLimit*copySegments)
+	},
+}
+
+// ReadFrom implements io.ReaderFrom, it writes the data of r until io.EOF
+// through a pooled buffer of whole segments, so that io.Copy to the session
+// from a file or a TCP connection needs no buffer of its own and fills the
+// segments.
+func (s *UDPSession) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := s.copyBuffer()
+	defer copyBuffers.Put(buf[:cap(buf)])
+	for {
+		nr, rerr := r.Read(buf)
+		if nr > 0 {
+			nw, werr := s.Write(buf[:nr])
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// WriteTo implements io.WriterTo, it writes the data received to w until
+// the remote closes its write side, through a pooled buffer of whole
+// segments, so that io.Copy from the session needs no buffer of its own.
+func (s *UDPSession) WriteTo(w io.Writer) (n int64, err error) {
+	buf := s.copyBuffer()
+	defer copyBuffers.Put(buf[:cap(buf)])
+	for {
+		nr, rerr := s.Read(buf)
+		if nr > 0 {
+			nw, werr := w.Write(buf[:nr])
+			n += int64(nw)
+			if werr != nil {
+				return n, werr
+			}
+			if nw != nr {
+				return n, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return n, nil
+		}
+		if rerr != nil {
+			return n, rerr
+		}
+	}
+}
+
+// copyBuffer returns a pooled buffer of copySegments segments of the mss
+func (s *UDPSession) copyBuffer() []byte {
+	s.mu.Lock()
+	mss := int(s.kcp.mss)
+	s.mu.Unlock()
+	return copyBuffers.Get().([]byte)[:mss*copySegments]
+}
@@ -3,12 +3,175 @@ package kcp
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"hash"
+	"sync"
+	"sync/atomic"
 
+	"github.com/tjfoc/gmsm/sm4"
+	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/salsa20"
 	"golang.org/x/crypto/tea"
+	"golang.org/x/sys/cpu"
 )
 
+// cryptFactory creates a BlockCrypt from a key
+type cryptFactory func(key []byte) (BlockCrypt, error)
+
+var (
+	cryptsMu sync.RWMutex
+	crypts   = make(map[string]cryptFactory)
+)
+
+func init() {
+	RegisterCrypt("aes", NewAESBlockCrypt)
+	RegisterCrypt("aes-128", keyPrefix(16, NewAESBlockCrypt))
+	RegisterCrypt("aes-192", keyPrefix(24, NewAESBlockCrypt))
+	RegisterCrypt("aes-256", keyPrefix(32, NewAESBlockCrypt))
+	RegisterCrypt("aes-gcm", NewAESGCMCrypt)
+	RegisterCrypt("chacha20", keyPrefix(32, NewChaCha20Poly1305Crypt))
+	RegisterCrypt("hmac-sha256", NewHMACCrypt)
+	RegisterCrypt("salsa20", keyPrefix(32, NewSalsa20BlockCrypt))
+	RegisterCrypt("sm4", keyPrefix(16, NewSM4BlockCrypt))
+	RegisterCrypt("sm4-gcm", keyPrefix(16, NewSM4GCMCrypt))
+	RegisterCrypt("tea", keyPrefix(16, NewTEABlockCrypt))
+	RegisterCrypt("xor", NewSimpleXORBlockCrypt)
+	RegisterCrypt("xsalsa20", keyPrefix(32, NewXSalsa20BlockCrypt))
+	RegisterCrypt("none", NewNoneBlockCrypt)
+	RegisterCrypt("auto", keyPrefix(32, newAutoCrypt))
+}
+
+// AESImplementation reports how AES runs on this CPU: "aes-ni", "armv8" or
+// "s390x" for hardware instructions, "software" otherwise. The "auto" crypt
+// seals with AES-GCM on hardware AES, and with the constant time
+// ChaCha20-Poly1305 in software, and opens both, so that peers on different
+// hardware interoperate.
+func AESImplementation() string {
+	switch {
+	case cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ:
+		return "aes-ni"
+	case cpu.ARM64.HasAES && cpu.ARM64.HasPMULL:
+		return "armv8"
+	case cpu.S390X.HasAES && cpu.S390X.HasAESGCM:
+		return "s390x"
+	}
+	return "software"
+}
+
+// autoCipherBit is the bit of the salt of the "auto" crypt set for
+// ChaCha20-Poly1305, clear for AES-GCM
+const autoCipherBit = 0x80
+
+// autoCrypt seals with the fastest AEAD which runs in constant time on this
+// CPU, and opens the packets of both, the salt of a packet tells its
+// cipher. The nonces of both ciphers come from one state.
+type autoCrypt struct {
+	aeadCrypt
+	chacha bool // sealing with ChaCha20-Poly1305
+}
+
+// newAutoCrypt creates the "auto" crypt of a 32 bytes key
+func newAutoCrypt(key []byte) (BlockCrypt, error) {
+	return newAutoCryptFor(key, AESImplementation() != "software")
+}
+
+// newAutoCryptFor creates the "auto" crypt sealing with AES-GCM if hardware
+// is set, with ChaCha20-Poly1305 otherwise
+func newAutoCryptFor(key []byte, hardware bool) (*autoCrypt, error) {
+	if _, err := newAESGCM(key); err != nil {
+		return nil, err
+	}
+	c := &autoCrypt{chacha: !hardware}
+	newAEAD := newAESGCM
+	if c.chacha {
+		newAEAD = chacha20poly1305.New
+	}
+	if err := c.init(newAEAD, key, key); err != nil {
+		return nil, err
+	}
+	c.SetNonceState(c.NonceState())
+	return c, nil
+}
+
+// Open implements AEADCrypt, with the cipher the salt tells
+func (c *autoCrypt) Open(packet []byte) bool {
+	if len(packet) < aeadHeaderSize {
+		return false
+	}
+	if packet[0]&autoCipherBit != 0 {
+		return c.openWith(chacha20poly1305.New, packet)
+	}
+	return c.openWith(newAESGCM, packet)
+}
+
+// Decrypt implements Decrypt interface, dst is zeroed if src fails
+// authentication
+func (c *autoCrypt) Decrypt(dst, src []byte) {
+	copy(dst, src)
+	if !c.Open(dst) {
+		xorBytes(dst, dst, dst)
+	}
+}
+
+// SetNonceState implements NonceCrypt, the bit of the cipher sealing is
+// kept in the salt
+func (c *autoCrypt) SetNonceState(salt []byte, counter uint64) {
+	salt = append([]byte(nil), salt...)
+	salt[0] &^= autoCipherBit
+	if c.chacha {
+		salt[0] |= autoCipherBit
+	}
+	c.aeadCrypt.SetNonceState(salt, counter)
+}
+
+// restoreNonce implements nonceMover, the bit of the cipher sealing is kept
+// in the salt
+func (c *autoCrypt) restoreNonce(salt []byte, counter uint64) {
+	c.aeadCrypt.restoreNonce(salt, counter)
+	c.SetNonceState(c.NonceState())
+}
+
+// RegisterCrypt makes a BlockCrypt available by name to NewCryptByName.
+// It panics if factory is nil or the name is already registered.
+func RegisterCrypt(name string, factory func(key []byte) (BlockCrypt, error)) {
+	if factory == nil {
+		panic("kcp: RegisterCrypt factory is nil")
+	}
+	cryptsMu.Lock()
+	defer cryptsMu.Unlock()
+	if _, dup := crypts[name]; dup {
+		panic("kcp: RegisterCrypt called twice for " + name)
+	}
+	crypts[name] = factory
+}
+
+// NewCryptByName creates the BlockCrypt registered as name with the given key.
+// Ciphers with a fixed key size, such as "aes-128" or "chacha20", use the
+// beginning of a longer key.
+func NewCryptByName(name string, key []byte) (BlockCrypt, error) {
+	cryptsMu.RLock()
+	factory := crypts[name]
+	cryptsMu.RUnlock()
+	if factory == nil {
+		return nil, errCryptName
+	}
+	return factory(key)
+}
+
+// keyPrefix wraps a factory to use the first n bytes of the key
+func keyPrefix(n int, factory cryptFactory) cryptFactory {
+	return func(key []byte) (BlockCrypt, error) {
+		if len(key) < n {
+			return nil, errCryptKey
+		}
+		return factory(key[:n])
+	}
+}
+
 var (
 	initialVector = []byte{167, 115, 79, 156, 18, 172, 27, 1, 164, 21, 242, 193, 252, 120, 230, 107}
 	saltxor       = `sH3CIVoF#rWLtJo6`
@@ -25,6 +188,273 @@ type BlockCrypt interface {
 	Decrypt(dst, src []byte)
 }
 
+// AEADCrypt is a BlockCrypt which also authenticates the packets. Sessions
+// using one reserve Overhead bytes in front of each packet instead of the
+// nonce and checksum header, and drop the packets Open rejects.
+type AEADCrypt interface {
+	BlockCrypt
+
+	// Overhead returns the size of the header in front of each packet
+	Overhead() int
+
+	// Seal encrypts and authenticates the packet in place, the header is
+	// filled in. The capacity of packet beyond its length may be used as
+	// scratch space.
+	Seal(packet []byte)
+
+	// Open authenticates and decrypts the packet in place, it returns false
+	// if the packet was tampered with.
+	Open(packet []byte) bool
+}
+
+const (
+	aeadNonceSize   = aeadSaltSize + 8
+	aeadCipherNonce = 12 // nonce of the ciphers, the tail of the explicit nonce
+	aeadTagSize     = 16
+	aeadHeaderSize  = aeadNonceSize + aeadTagSize
+)
+
+// aeadFactory creates a cipher.AEAD from a key
+type aeadFactory func(key []byte) (cipher.AEAD, error)
+
+// aeadCrypt implements NonceCrypt on top of a cipher.AEAD, a packet starts
+// with its explicit nonce followed by the authentication tag. The packets
+// sent and received may be under different keys, a packet is sealed under
+// the subkey of the salt of its nonce, and the last 12 bytes of the explicit
+// nonce are the nonce of the cipher.
+type aeadCrypt struct {
+	newAEAD aeadFactory
+	sealKey []byte
+	openKey []byte
+	seal    cipher.AEAD // under the subkey of the salt
+	nonce   nonceState
+}
+
+// init sets the cipher and the keys of the crypt, and picks its salt
+func (c *aeadCrypt) init(newAEAD aeadFactory, sealKey, openKey []byte) error {
+	for _, key := range [][]byte{sealKey, openKey} {
+		if _, err := newAEAD(key); err != nil {
+			return err
+		}
+	}
+	c.newAEAD = newAEAD
+	c.sealKey = append([]byte(nil), sealKey...)
+	c.openKey = append([]byte(nil), openKey...)
+	c.nonce.init()
+	c.SetNonceState(c.NonceState())
+	return nil
+}
+
+// Overhead implements AEADCrypt
+func (c *aeadCrypt) Overhead() int { return aeadHeaderSize }
+
+// Seal implements AEADCrypt
+func (c *aeadCrypt) Seal(packet []byte) {
+	nonce := packet[:aeadNonceSize]
+	c.nonce.next(nonce)
+	payload := packet[aeadHeaderSize:]
+	// the payload is encrypted where it lies, the tag lands behind it
+	sealed := c.seal.Seal(payload[:0], nonce[aeadNonceSize-aeadCipherNonce:], payload, nil)
+	tag := sealed[len(payload):]
+	copy(packet[aeadNonceSize:], tag)
+	xorBytes(tag, tag, tag)
+}
+
+// Open implements AEADCrypt
+func (c *aeadCrypt) Open(packet []byte) bool {
+	if len(packet) < aeadHeaderSize {
+		return false
+	}
+	return c.openWith(c.newAEAD, packet)
+}
+
+// openWith opens a packet under the subkey of its salt, created by newAEAD
+// from the key opening. The subkey is kept once a packet opened under it, so
+// that forged salts cost a derivation each but fill no state.
+func (c *aeadCrypt) openWith(newAEAD aeadFactory, packet []byte) bool {
+	salt := packet[:aeadSaltSize]
+	if aead := c.nonce.opener(salt); aead != nil {
+		return openAEAD(aead, packet)
+	}
+	aead, err := newAEAD(aeadSubkey(c.openKey, salt))
+	if err != nil || !openAEAD(aead, packet) {
+		return false
+	}
+	c.nonce.remember(salt, aead)
+	return true
+}
+
+// openAEAD authenticates and decrypts a packet of aeadHeaderSize bytes or
+// more in place with aead
+func openAEAD(aead cipher.AEAD, packet []byte) bool {
+	// the tag is expected behind the ciphertext
+	payload := packet[aeadHeaderSize:]
+	sealed := append(payload, packet[aeadNonceSize:aeadHeaderSize]...)
+	_, err := aead.Open(payload[:0], packet[aeadNonceSize-aeadCipherNonce:aeadNonceSize], sealed, nil)
+	tag := sealed[len(payload):]
+	xorBytes(tag, tag, tag)
+	return err == nil
+}
+
+// fresh tells if the nonce of an opened packet wasn't received before
+func (c *aeadCrypt) fresh(packet []byte) bool {
+	return c.nonce.fresh(packet[:aeadNonceSize])
+}
+
+// Encrypt implements Encrypt interface, the first Overhead bytes of dst are
+// the header
+func (c *aeadCrypt) Encrypt(dst, src []byte) {
+	copy(dst, src)
+	c.Seal(dst)
+}
+
+// Decrypt implements Decrypt interface, dst is zeroed if src fails
+// authentication
+func (c *aeadCrypt) Decrypt(dst, src []byte) {
+	copy(dst, src)
+	if !c.Open(dst) {
+		xorBytes(dst, dst, dst)
+	}
+}
+
+// AESGCMCrypt implements AEADCrypt with AES-GCM
+type AESGCMCrypt struct {
+	aeadCrypt
+}
+
+// NewAESGCMCrypt initates AES-GCM AEADCrypt by the given key
+func NewAESGCMCrypt(key []byte) (BlockCrypt, error) {
+	c := new(AESGCMCrypt)
+	if err := c.init(newAESGCM, key, key); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newAESGCM creates the AES-GCM cipher of a key
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithTagSize(block, aeadTagSize)
+}
+
+// SM4GCMCrypt implements AEADCrypt with SM4 in GCM mode, the authenticated
+// counter mode of the Chinese national SM4 block cipher
+type SM4GCMCrypt struct {
+	aeadCrypt
+}
+
+// NewSM4GCMCrypt initates SM4-GCM AEADCrypt by the given 16 bytes key
+func NewSM4GCMCrypt(key []byte) (BlockCrypt, error) {
+	c := new(SM4GCMCrypt)
+	if err := c.init(newSM4GCM, key, key); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// newSM4GCM creates the SM4-GCM cipher of a key
+func newSM4GCM(key []byte) (cipher.AEAD, error) {
+	block, err := sm4.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCMWithTagSize(block, aeadTagSize)
+}
+
+// ChaCha20Poly1305Crypt implements AEADCrypt with ChaCha20-Poly1305, which
+// outruns AES on CPUs without AES instructions
+type ChaCha20Poly1305Crypt struct {
+	aeadCrypt
+}
+
+// NewChaCha20Poly1305Crypt initates ChaCha20-Poly1305 AEADCrypt by the given
+// 32 bytes key
+func NewChaCha20Poly1305Crypt(key []byte) (BlockCrypt, error) {
+	c := new(ChaCha20Poly1305Crypt)
+	if err := c.init(chacha20poly1305.New, key, key); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+const hmacTagSize = 16 // HMAC-SHA256 truncated to 128 bits
+
+// HMACCrypt implements AEADCrypt with HMAC-SHA256 alone, the packets are
+// authenticated but sent in the clear. It suits deployments encrypting above
+// kcp which still want forged packets dropped before they reach kcp. A packet
+// starts with its truncated tag.
+type HMACCrypt struct {
+	macs sync.Pool // hash.Hash keyed, the crypt is shared by sessions
+}
+
+// NewHMACCrypt initates HMAC-SHA256 AEADCrypt by the given key
+func NewHMACCrypt(key []byte) (BlockCrypt, error) {
+	c := new(HMACCrypt)
+	key = append([]byte(nil), key...)
+	c.macs.New = func() interface{} {
+		return hmac.New(sha256.New, key)
+	}
+	return c, nil
+}
+
+// tag computes the tag of a payload into dst
+func (c *HMACCrypt) tag(dst, payload []byte) {
+	mac := c.macs.Get().(hash.Hash)
+	mac.Reset()
+	mac.Write(payload)
+	var sum [sha256.Size]byte
+	copy(dst, mac.Sum(sum[:0]))
+	c.macs.Put(mac)
+}
+
+// Overhead implements AEADCrypt
+func (c *HMACCrypt) Overhead() int { return hmacTagSize }
+
+// Seal implements AEADCrypt
+func (c *HMACCrypt) Seal(packet []byte) {
+	c.tag(packet[:hmacTagSize], packet[hmacTagSize:])
+}
+
+// Open implements AEADCrypt
+func (c *HMACCrypt) Open(packet []byte) bool {
+	if len(packet) < hmacTagSize {
+		return false
+	}
+	var tag [hmacTagSize]byte
+	c.tag(tag[:], packet[hmacTagSize:])
+	return macEqual(tag[:], packet[:hmacTagSize])
+}
+
+// macCompares counts the calls to macEqual, so that SelfTest can tell the
+// MACs are compared through it
+var macCompares uint64
+
+// macEqual compares two MACs in constant time, all the MACs computed by this
+// package are compared through it
+func macEqual(a, b []byte) bool {
+	atomic.AddUint64(&macCompares, 1)
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// Encrypt implements Encrypt interface, the first Overhead bytes of dst are
+// the tag
+func (c *HMACCrypt) Encrypt(dst, src []byte) {
+	copy(dst, src)
+	c.Seal(dst)
+}
+
+// Decrypt implements Decrypt interface, dst is zeroed if src fails
+// authentication
+func (c *HMACCrypt) Decrypt(dst, src []byte) {
+	copy(dst, src)
+	if !c.Open(dst) {
+		xorBytes(dst, dst, dst)
+	}
+}
+
 // AESBlockCrypt implements BlockCrypt with AES
 type AESBlockCrypt struct {
 	encbuf []byte
@@ -55,6 +485,36 @@ func (c *AESBlockCrypt) Decrypt(dst, src []byte) {
 	decrypt(c.block, dst, src, c.decbuf)
 }
 
+// SM4BlockCrypt implements BlockCrypt with SM4
+type SM4BlockCrypt struct {
+	encbuf []byte
+	decbuf []byte
+	block  cipher.Block
+}
+
+// NewSM4BlockCrypt initates SM4 BlockCrypt by the given 16 bytes key
+func NewSM4BlockCrypt(key []byte) (BlockCrypt, error) {
+	c := new(SM4BlockCrypt)
+	block, err := sm4.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	c.block = block
+	c.encbuf = make([]byte, sm4.BlockSize)
+	c.decbuf = make([]byte, 2*sm4.BlockSize)
+	return c, nil
+}
+
+// Encrypt implements Encrypt interface
+func (c *SM4BlockCrypt) Encrypt(dst, src []byte) {
+	encrypt(c.block, dst, src, c.encbuf)
+}
+
+// Decrypt implements Decrypt interface
+func (c *SM4BlockCrypt) Decrypt(dst, src []byte) {
+	decrypt(c.block, dst, src, c.decbuf)
+}
+
 // TEABlockCrypt implements BlockCrypt with TEA
 type TEABlockCrypt struct {
 	encbuf []byte
@@ -85,6 +545,72 @@ func (c *TEABlockCrypt) Decrypt(dst, src []byte) {
 	decrypt(c.block, dst, src, c.decbuf)
 }
 
+// Salsa20BlockCrypt implements BlockCrypt with Salsa20, as the salsa20 crypt
+// of kcptun. The first 8 bytes of the random nonce of a packet are the Salsa20
+// nonce and stay in the clear, the rest of the packet is encrypted.
+type Salsa20BlockCrypt struct {
+	key [32]byte
+}
+
+// NewSalsa20BlockCrypt initates Salsa20 BlockCrypt by the first 32 bytes of key
+func NewSalsa20BlockCrypt(key []byte) (BlockCrypt, error) {
+	if len(key) < 32 {
+		return nil, errCryptKey
+	}
+	c := new(Salsa20BlockCrypt)
+	copy(c.key[:], key)
+	return c, nil
+}
+
+// Encrypt implements Encrypt interface
+func (c *Salsa20BlockCrypt) Encrypt(dst, src []byte) {
+	salsa20.XORKeyStream(dst[8:], src[8:], src[:8], &c.key)
+	copy(dst[:8], src[:8])
+}
+
+// Decrypt implements Decrypt interface
+func (c *Salsa20BlockCrypt) Decrypt(dst, src []byte) {
+	salsa20.XORKeyStream(dst[8:], src[8:], src[:8], &c.key)
+	copy(dst[:8], src[:8])
+}
+
+// XSalsa20BlockCrypt implements BlockCrypt with XSalsa20. The 16 bytes random
+// nonce of a packet, padded with zeros, is the XSalsa20 nonce and stays in
+// the clear, the rest of the packet is encrypted. Unlike the 8 bytes nonces
+// of Salsa20BlockCrypt, they don't collide after some 2^32 packets under a
+// key, but kcptun doesn't know this crypt.
+type XSalsa20BlockCrypt struct {
+	key [32]byte
+}
+
+// NewXSalsa20BlockCrypt initates XSalsa20 BlockCrypt by the first 32 bytes of key
+func NewXSalsa20BlockCrypt(key []byte) (BlockCrypt, error) {
+	if len(key) < 32 {
+		return nil, errCryptKey
+	}
+	c := new(XSalsa20BlockCrypt)
+	copy(c.key[:], key)
+	return c, nil
+}
+
+// Encrypt implements Encrypt interface
+func (c *XSalsa20BlockCrypt) Encrypt(dst, src []byte) {
+	c.xor(dst, src)
+}
+
+// Decrypt implements Decrypt interface
+func (c *XSalsa20BlockCrypt) Decrypt(dst, src []byte) {
+	c.xor(dst, src)
+}
+
+// xor applies the key stream of the nonce of a packet to the rest of it
+func (c *XSalsa20BlockCrypt) xor(dst, src []byte) {
+	var nonce [24]byte
+	copy(nonce[:], src[:nonceSize])
+	salsa20.XORKeyStream(dst[nonceSize:], src[nonceSize:], nonce[:], &c.key)
+	copy(dst[:nonceSize], src[:nonceSize])
+}
+
 // SimpleXORBlockCrypt implements BlockCrypt with simple xor to a table
 type SimpleXORBlockCrypt struct {
 	xortbl []byte
@@ -123,7 +649,9 @@ func (c *NoneBlockCrypt) Encrypt(dst, src []byte) {}
 // Decrypt implements Decrypt interface
 func (c *NoneBlockCrypt) Decrypt(dst, src []byte) {}
 
-// packet encryption with local CFB mode
+// packet encryption with local CFB mode, the IV is fixed but the packet
+// starts with its random nonce, so that the key stream of the payload is
+// randomized by the first 128 bits of ciphertext
 func encrypt(block cipher.Block, dst, src, buf []byte) {
 	blocksize := block.BlockSize()
 	tbl := buf[:blocksize]
@@ -1,10 +1,16 @@
 package kcp
 
 import (
+	"bytes"
 	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"strconv"
+	"sync/atomic"
 	"testing"
 
 	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/salsa20"
 )
 
 const crypt_key = "testkey"
@@ -25,6 +31,124 @@ func TestAES(t *testing.T) {
 	t.Log(data)
 }
 
+func TestSalsa20(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	bc, err := NewSalsa20BlockCrypt(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1400)
+	for i := range data {
+		data[i] = byte(i & 0xff)
+	}
+	enc := make([]byte, len(data))
+	bc.Encrypt(enc, data)
+
+	// the wire format of kcptun: the nonce prefix in the clear, the rest
+	// xored with the keystream it selects
+	var k [32]byte
+	copy(k[:], pass)
+	want := make([]byte, len(data))
+	copy(want, data[:8])
+	salsa20.XORKeyStream(want[8:], data[8:], data[:8], &k)
+	if !bytes.Equal(enc, want) {
+		t.Fatal("salsa20 packet mismatch")
+	}
+
+	bc.Decrypt(enc, enc)
+	if !bytes.Equal(enc, data) {
+		t.Fatal("salsa20 roundtrip mismatch")
+	}
+	if _, err := NewSalsa20BlockCrypt(pass[:16]); err != errCryptKey {
+		t.Fatal("short key", err)
+	}
+
+	// a packet of kcptun --crypt salsa20 --key "it's a secrect", keyed with
+	// the pbkdf2 salt of kcptun
+	kcptun, _ := NewSalsa20BlockCrypt(pbkdf2.Key([]byte("it's a secrect"), []byte("kcp-go"), 4096, 32, sha1.New))
+	packet := make([]byte, 32)
+	for i := range packet {
+		packet[i] = byte(i)
+	}
+	kcptun.Encrypt(packet, packet)
+	if hex.EncodeToString(packet) != "00010203040506079aaa6e7faf75365c40a4761a0c7be4446a8a411f62e5954a" {
+		t.Fatal("not the wire format of kcptun", hex.EncodeToString(packet))
+	}
+}
+
+func TestXSalsa20(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	bc, err := NewXSalsa20BlockCrypt(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 1400)
+	for i := range data {
+		data[i] = byte(i & 0xff)
+	}
+	enc := make([]byte, len(data))
+	bc.Encrypt(enc, data)
+
+	// the nonce in the clear, the rest xored with the XSalsa20 keystream it
+	// selects
+	var k [32]byte
+	copy(k[:], pass)
+	var nonce [24]byte
+	copy(nonce[:], data[:nonceSize])
+	want := make([]byte, len(data))
+	copy(want, data[:nonceSize])
+	salsa20.XORKeyStream(want[nonceSize:], data[nonceSize:], nonce[:], &k)
+	if !bytes.Equal(enc, want) {
+		t.Fatal("xsalsa20 packet mismatch")
+	}
+
+	bc.Decrypt(enc, enc)
+	if !bytes.Equal(enc, data) {
+		t.Fatal("xsalsa20 roundtrip mismatch")
+	}
+	if _, err := NewXSalsa20BlockCrypt(pass[:16]); err != errCryptKey {
+		t.Fatal("short key", err)
+	}
+}
+
+func TestSM4(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 16, sha1.New)
+	bc, err := NewSM4BlockCrypt(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 4096)
+	for i := 0; i < 4096; i++ {
+		data[i] = byte(i & 0xff)
+	}
+	enc := make([]byte, len(data))
+	bc.Encrypt(enc, data)
+	if bytes.Equal(enc, data) {
+		t.Fatal("sm4 left the data in the clear")
+	}
+	bc.Decrypt(enc, enc)
+	if !bytes.Equal(enc, data) {
+		t.Fatal("sm4 roundtrip mismatch")
+	}
+
+	// sm4-gcm drops tampered packets
+	bc, err = NewSM4GCMCrypt(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := make([]byte, aeadHeaderSize+100, mtuLimit)
+	copy(packet[aeadHeaderSize:], data)
+	sealPacket(bc, packet)
+	tampered := append([]byte(nil), packet...)
+	tampered[len(tampered)-1] ^= 1
+	if _, ok := decryptPacket(bc, tampered); ok {
+		t.Fatal("tampered sm4-gcm packet accepted")
+	}
+	if plain, ok := decryptPacket(bc, packet); !ok || !bytes.Equal(plain, data[:100]) {
+		t.Fatal("sm4-gcm roundtrip mismatch")
+	}
+}
+
 func TestTEA(t *testing.T) {
 	pass := pbkdf2.Key(key, []byte(salt), 4096, 16, sha1.New)
 	bc, err := NewTEABlockCrypt(pass)
@@ -54,3 +178,363 @@ func TestSimpleXOR(t *testing.T) {
 	bc.Decrypt(data, data)
 	t.Log(data)
 }
+
+func testAEAD(t *testing.T, bc BlockCrypt) {
+	aead := bc.(AEADCrypt)
+	packet := make([]byte, aead.Overhead()+1024, mtuLimit)
+	for i := aead.Overhead(); i < len(packet); i++ {
+		packet[i] = byte(i & 0xff)
+	}
+	plain := append([]byte(nil), packet[aead.Overhead():]...)
+	aead.Seal(packet)
+	sealed := append([]byte(nil), packet...)
+	if !aead.Open(packet) || !bytes.Equal(packet[aead.Overhead():], plain) {
+		t.Fatal("roundtrip mismatch")
+	}
+	for _, off := range []int{0, aeadNonceSize, len(sealed) - 1} {
+		copy(packet, sealed)
+		packet[off] ^= 1
+		if aead.Open(packet) {
+			t.Fatal("tampered byte", off, "authenticated")
+		}
+	}
+	if aead.Open(sealed[:aeadHeaderSize-1]) {
+		t.Fatal("truncated packet authenticated")
+	}
+}
+
+func TestAESGCM(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	bc, err := NewAESGCMCrypt(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAEAD(t, bc)
+}
+
+func TestChaCha20Poly1305(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	bc, err := NewChaCha20Poly1305Crypt(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAEAD(t, bc)
+}
+
+func TestHMAC(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	bc, err := NewHMACCrypt(pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAEAD(t, bc)
+
+	// integrity only, the payload is left in the clear
+	packet := make([]byte, hmacTagSize+16)
+	copy(packet[hmacTagSize:], "0123456789abcdef")
+	bc.(AEADCrypt).Seal(packet)
+	if string(packet[hmacTagSize:]) != "0123456789abcdef" {
+		t.Fatal("payload encrypted")
+	}
+}
+
+func TestNonceCrypt(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	bc, _ := NewAESGCMCrypt(pass)
+	nc := bc.(NonceCrypt)
+	seal := func() []byte {
+		packet := make([]byte, aeadHeaderSize+32, mtuLimit)
+		nc.Seal(packet)
+		return packet
+	}
+
+	// the nonce is the salt and the counter
+	p1, p2 := seal(), seal()
+	salt, counter := nc.NonceState()
+	if counter != 2 || !bytes.Equal(p1[:aeadSaltSize], salt) || binary.LittleEndian.Uint64(p2[aeadSaltSize:]) != 2 {
+		t.Fatal("nonce", salt, counter)
+	}
+
+	// crypts of a key pick their own salts, and open the packets of each
+	// other under the subkeys of the salts
+	other, _ := NewAESGCMCrypt(pass)
+	if s, _ := other.(NonceCrypt).NonceState(); bytes.Equal(s, salt) {
+		t.Fatal("salt shared")
+	}
+	if !other.(AEADCrypt).Open(append([]byte(nil), p2...)) {
+		t.Fatal("open under the subkey failed")
+	}
+
+	// a forged salt keeps no state
+	forged := append([]byte(nil), p2...)
+	forged[0] ^= 1
+	if other.(AEADCrypt).Open(forged) || len(other.(*AESGCMCrypt).nonce.windows) != 1 {
+		t.Fatal("forged salt kept")
+	}
+
+	// a replayed packet is dropped, unless the first one was only peeked at
+	if _, ok := openPacket(bc, append([]byte(nil), p1...), true); !ok {
+		t.Fatal("peek failed")
+	}
+	before := atomic.LoadUint64(&DefaultSnmp.InReplays)
+	for i := 0; i < 2; i++ {
+		if _, ok := decryptPacket(bc, append([]byte(nil), p1...)); ok != (i == 0) {
+			t.Fatal("open", i, ok)
+		}
+	}
+	if atomic.LoadUint64(&DefaultSnmp.InReplays)-before != 1 {
+		t.Fatal("replay not counted")
+	}
+
+	// the state restored continues the nonces
+	bc2, _ := NewAESGCMCrypt(pass)
+	bc2.(NonceCrypt).SetNonceState(salt, counter)
+	p3 := make([]byte, aeadHeaderSize+32, mtuLimit)
+	bc2.(AEADCrypt).Seal(p3)
+	if !bytes.Equal(p3[:aeadSaltSize], salt) || binary.LittleEndian.Uint64(p3[aeadSaltSize:]) != 3 {
+		t.Fatal("state not restored")
+	}
+	if _, ok := decryptPacket(bc, p3); !ok {
+		t.Fatal("restored nonce rejected")
+	}
+}
+
+func TestReplayWindow(t *testing.T) {
+	var w replayWindow
+	size := uint64(replayWords-1) * 64
+	for _, c := range []uint64{5, 3, 100, 4, size, 2 * size} {
+		if !w.check(c) {
+			t.Fatal("fresh counter", c, "rejected")
+		}
+	}
+	for _, c := range []uint64{5, 3, 2 * size, size} {
+		if w.check(c) {
+			t.Fatal("counter", c, "accepted twice or too old")
+		}
+	}
+	if !w.check(2*size - 1) {
+		t.Fatal("reordered counter rejected")
+	}
+}
+
+func benchmarkCrypt(b *testing.B, bc BlockCrypt) {
+	data := make([]byte, 1400, mtuLimit)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bc.Encrypt(data, data)
+	}
+}
+
+func BenchmarkAES128(b *testing.B) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 16, sha1.New)
+	bc, _ := NewAESBlockCrypt(pass)
+	benchmarkCrypt(b, bc)
+}
+
+func BenchmarkAESGCM(b *testing.B) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 16, sha1.New)
+	bc, _ := NewAESGCMCrypt(pass)
+	benchmarkCrypt(b, bc)
+}
+
+func BenchmarkChaCha20Poly1305(b *testing.B) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	bc, _ := NewChaCha20Poly1305Crypt(pass)
+	benchmarkCrypt(b, bc)
+}
+
+func BenchmarkSM4(b *testing.B) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 16, sha1.New)
+	bc, _ := NewSM4BlockCrypt(pass)
+	benchmarkCrypt(b, bc)
+}
+
+func BenchmarkSM4GCM(b *testing.B) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 16, sha1.New)
+	bc, _ := NewSM4GCMCrypt(pass)
+	benchmarkCrypt(b, bc)
+}
+
+func BenchmarkSalsa20(b *testing.B) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	bc, _ := NewSalsa20BlockCrypt(pass)
+	benchmarkCrypt(b, bc)
+}
+
+func BenchmarkHMAC(b *testing.B) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	bc, _ := NewHMACCrypt(pass)
+	benchmarkCrypt(b, bc)
+}
+
+func TestKeyFromPassphrase(t *testing.T) {
+	pass, salt := []byte("password"), []byte("salt")
+	vectors := []struct {
+		params KeyParams
+		want   string
+	}{
+		// RFC 6070
+		{KeyParams{KDF: KDFPBKDF2SHA1, Iterations: 4096, KeyLen: 20}, "4b007901b765489abead49d926f721d065a429c1"},
+		{KeyParams{KDF: KDFPBKDF2, Iterations: 4096}, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+	for _, v := range vectors {
+		if key, err := NewKeyFromPassphrase(pass, salt, v.params); err != nil || hex.EncodeToString(key) != v.want {
+			t.Fatal("kdf", v.params.KDF, "mismatch", err)
+		}
+	}
+	// RFC 7914
+	key, err := NewKeyFromPassphrase(pass, []byte("NaCl"), KeyParams{KDF: KDFScrypt, N: 1024, R: 8, P: 16, KeyLen: 64})
+	if err != nil || hex.EncodeToString(key) != "fdbabe1c9d3472007856e7190d01e9fe7c6ad7cbc8237830e77376634b3731622eaf30d92e22a3886ff109279d9830dac727afb94a83ee6d8360cbdfa2cc0640" {
+		t.Fatal("scrypt mismatch", err)
+	}
+
+	// kcptun derives its keys alike
+	key, _ = NewKeyFromPassphrase(pass, []byte("kcp-go"), KeyParamsKcptun)
+	if !bytes.Equal(key, pbkdf2.Key(pass, []byte("kcp-go"), 4096, 32, sha1.New)) {
+		t.Fatal("kcptun key mismatch")
+	}
+
+	argon := KeyParams{KDF: KDFArgon2id, Time: 1, Memory: 64, Threads: 1}
+	k1, err := NewKeyFromPassphrase(pass, salt, argon)
+	if err != nil || len(k1) != 32 {
+		t.Fatal("argon2id", err)
+	}
+	k2, _ := NewKeyFromPassphrase(pass, []byte("pepper"), argon)
+	if bytes.Equal(k1, k2) {
+		t.Fatal("argon2id ignored the salt")
+	}
+	if _, err := NewCryptByName("chacha20", k1); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, params := range []KeyParams{
+		{KDF: KDFPBKDF2},
+		{KDF: KDFScrypt, N: 1000, R: 8, P: 1},
+		{KDF: KDFScrypt, N: 1024, R: 0, P: 1},
+		{KDF: KDFArgon2id, Time: 1, Memory: 64},
+		{KDF: 99},
+		{KDF: KDFPBKDF2, Iterations: 1, KeyLen: -1},
+	} {
+		if _, err := NewKeyFromPassphrase(pass, salt, params); err != errKDFParams {
+			t.Fatal("invalid params accepted", params, err)
+		}
+	}
+}
+
+// brokenAEAD accepts tampered packets
+type brokenAEAD struct{ *HMACCrypt }
+
+func (c *brokenAEAD) Open(packet []byte) bool { return true }
+
+func TestSelfTest(t *testing.T) {
+	if err := SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+
+	pass := make([]byte, 32)
+	bc, _ := NewAESBlockCrypt(pass)
+	if err := selfTestCrypt("aes", bc, selfTestVectors["aes"], true); err == nil {
+		t.Fatal("wrong key passed the known-answer vector")
+	}
+	if err := selfTestCrypt("broken", new(NoneBlockCrypt), "", false); err == nil {
+		t.Fatal("crypt leaving packets in the clear passed")
+	}
+	hc, _ := NewHMACCrypt(pass)
+	if err := selfTestCrypt("broken", &brokenAEAD{hc.(*HMACCrypt)}, "", false); err == nil {
+		t.Fatal("crypt accepting tampered packets passed")
+	}
+}
+
+// benchmarkPacket seals and opens packets in place the way sessions do
+func benchmarkPacket(b *testing.B, bc BlockCrypt) {
+	packet := make([]byte, 1400, mtuLimit)
+	b.SetBytes(int64(len(packet)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sealPacket(bc, packet)
+		if _, ok := decryptPacket(bc, packet); !ok {
+			b.Fatal("packet rejected")
+		}
+	}
+}
+
+func BenchmarkPacketAES128(b *testing.B) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 16, sha1.New)
+	bc, _ := NewAESBlockCrypt(pass)
+	benchmarkPacket(b, bc)
+}
+
+func BenchmarkPacketAESGCM(b *testing.B) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 16, sha1.New)
+	bc, _ := NewAESGCMCrypt(pass)
+	benchmarkPacket(b, bc)
+}
+
+func BenchmarkPacketChaCha20Poly1305(b *testing.B) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	bc, _ := NewChaCha20Poly1305Crypt(pass)
+	benchmarkPacket(b, bc)
+}
+
+var testCrypts int
+
+func TestCryptByName(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	for _, name := range []string{"aes", "aes-128", "aes-192", "aes-256", "aes-gcm", "chacha20", "hmac-sha256", "salsa20", "sm4", "sm4-gcm", "tea", "xor", "xsalsa20", "none", "auto"} {
+		if _, err := NewCryptByName(name, pass); err != nil {
+			t.Fatal(name, err)
+		}
+	}
+	if _, err := NewCryptByName("rot13", pass); err != errCryptName {
+		t.Fatal("unknown crypt", err)
+	}
+	if _, err := NewCryptByName("chacha20", pass[:16]); err != errCryptKey {
+		t.Fatal("short key", err)
+	}
+
+	// names are unique across -count runs, registrations can't be undone
+	testCrypts++
+	name := "test-xor-" + strconv.Itoa(testCrypts)
+	RegisterCrypt(name, func(key []byte) (BlockCrypt, error) {
+		return NewSimpleXORBlockCrypt(key)
+	})
+	if bc, err := NewCryptByName(name, pass); err != nil {
+		t.Fatal(err)
+	} else if _, ok := bc.(*SimpleXORBlockCrypt); !ok {
+		t.Fatal("wrong crypt")
+	}
+	defer func() {
+		if recover() == nil {
+			t.Fatal("duplicated name accepted")
+		}
+	}()
+	RegisterCrypt(name, NewNoneBlockCrypt)
+}
+
+func TestAutoCrypt(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	bc, err := NewCryptByName("auto", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aes := !bc.(*autoCrypt).chacha
+	if impl := AESImplementation(); aes != (impl != "software") {
+		t.Fatal("auto picked", bc, "with", impl, "aes")
+	}
+	t.Log("aes implementation:", AESImplementation())
+	testAEAD(t, bc)
+
+	// peers on different hardware open the packets of each other
+	hardware, _ := newAutoCryptFor(pass, true)
+	software, _ := newAutoCryptFor(pass, false)
+	for _, pair := range [][2]*autoCrypt{{hardware, software}, {software, hardware}} {
+		packet := make([]byte, aeadHeaderSize+16, mtuLimit)
+		copy(packet[aeadHeaderSize:], "hello, auto!")
+		pair[0].Seal(packet)
+		if !pair[1].Open(packet) || string(packet[aeadHeaderSize:aeadHeaderSize+12]) != "hello, auto!" {
+			t.Fatal("packet of the other cipher not opened")
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package kcp
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	cubicC          = 0.4 // scaling constant of the cubic function, in segments per second cubed
+	cubicBeta       = 0.7 // multiplicative decrease on loss
+	cubicInitWindow = 2   // in segments
+	cubicMinWindow  = 2   // ssthresh floor, in segments
+)
+
+// cubicControl is a CongestionControl growing the window with the cubic
+// function of the time since the latest loss, after
+// https://tools.ietf.org/html/rfc8312
+type cubicControl struct {
+	cwnd       float64   // in segments
+	ssthresh   float64   // in segments
+	wMax       float64   // window at the latest loss
+	wLastMax   float64   // wMax before the latest loss
+	k          float64   // seconds the cubic function takes to reach wMax again
+	epochStart time.Time // of congestion avoidance, since the latest loss
+	minRTT     time.Duration
+
+	undo *cubicControl // state before the latest timeout
+}
+
+// NewCubicControl returns a congestion control growing the window like
+// CUBIC, the default congestion control of TCP on Linux, for
+// SetCongestionControl, so that the sessions share a bottleneck fairly
+// with TCP flows. The window grows by the cubic function of the time since
+// the latest loss, fast at first, slowly around the window of that loss,
+// then fast again, and never slower than Reno would, and shrinks by 30% on
+// a loss. It has no effect with the congestion control disabled by the nc
+// parameter of SetNoDelay.
+func NewCubicControl() CongestionControl {
+	return &cubicControl{cwnd: cubicInitWindow, ssthresh: math.Inf(1)}
+}
+
+// OnAck grows the window, exponentially in slow start, by the cubic
+// function in congestion avoidance
+func (c *cubicControl) OnAck(acked int, rtt time.Duration, inflight int) {
+	if rtt > 0 && (c.minRTT == 0 || rtt < c.minRTT) {
+		c.minRTT = rtt
+	}
+	if float64(inflight+acked) < c.cwnd/2 {
+		return // application limited, the window isn't probed
+	}
+	if c.cwnd < c.ssthresh {
+		c.cwnd += float64(acked)
+		return
+	}
+
+	now := time.Now()
+	if c.epochStart.IsZero() {
+		c.epochStart = now
+		if c.wMax <= c.cwnd {
+			c.k, c.wMax = 0, c.cwnd
+		} else {
+			c.k = math.Cbrt((c.wMax - c.cwnd) / cubicC)
+		}
+	}
+	t := now.Sub(c.epochStart) + c.minRTT
+	target := cubicC*math.Pow(t.Seconds()-c.k, 3) + c.wMax
+
+	// the window Reno would have, which CUBIC never falls behind
+	if c.minRTT > 0 {
+		reno := c.wMax*cubicBeta + 3*(1-cubicBeta)/(1+cubicBeta)*t.Seconds()/c.minRTT.Seconds()
+		if reno > target {
+			target = reno
+		}
+	}
+	if target > c.cwnd {
+		c.cwnd += (target - c.cwnd) / c.cwnd * float64(acked)
+	} else {
+		c.cwnd += 0.01 * float64(acked) / c.cwnd // probes slowly at wMax
+	}
+}
+
+// OnLoss shrinks the window by beta, to 1 segment on a timeout
+func (c *cubicControl) OnLoss(lost int, timeout bool, inflight int) {
+	if timeout {
+		undo := *c
+		undo.undo = nil
+		c.undo = &undo
+	}
+	c.epochStart = time.Time{}
+	// fast convergence, a flow whose window shrinks releases bandwidth
+	if c.cwnd < c.wLastMax {
+		c.wLastMax = c.cwnd
+		c.wMax = c.cwnd * (1 + cubicBeta) / 2
+	} else {
+		c.wLastMax, c.wMax = c.cwnd, c.cwnd
+	}
+	c.ssthresh = math.Max(c.cwnd*cubicBeta, cubicMinWindow)
+	if timeout {
+		c.cwnd = 1
+	} else {
+		c.cwnd = c.ssthresh
+	}
+}
+
+// Window returns the window in segments
+func (c *cubicControl) Window() int {
+	if c.cwnd < 1 {
+		return 1
+	}
+	if c.cwnd > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(c.cwnd)
+}
+
+// PacingRate doesn't pace
+func (c *cubicControl) PacingRate() int { return 0 }
+
+// UndoLoss restores the state before the latest timeout
+func (c *cubicControl) UndoLoss() {
+	if c.undo != nil {
+		*c = *c.undo
+	}
+}
@@ -0,0 +1,133 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// cmdDatagram is the 1 byte channel tag, after the conv where kcp
+	// headers have their cmd, of the unreliable datagrams multiplexed with
+	// the kcp segments, whose cmds are 81 to 84. The payload takes the rest
+	// of the packet.
+	cmdDatagram = 90
+	// cmdDatagramPadded tags a datagram shorter than a kcp header, which
+	// the receivers drop, padded with zeros up to it, its last byte counts
+	// the padding
+	cmdDatagramPadded  = 94
+	datagramHeaderSize = 5   // conv(4) + tag(1)
+	datagramQueue      = 256 // datagrams kept for ReadUnreliable, the oldest are dropped
+)
+
+// SendUnreliable sends b as a single datagram outside of kcp, which is never
+// retransmitted nor ordered with the stream, for payloads such as game state
+// or voice that are useless once late. It shares the crypt and the fec groups
+// of the session, but no congestion control. b must fit a packet, the mtu
+// less the crypt and fec headers and the 5 bytes conv and tag. It doesn't
+// block, the datagram is dropped if the output queue is full.
+func (s *UDPSession) SendUnreliable(b []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed() {
+		return s.closedErr()
+	}
+	if s.wrClosed {
+		return errBrokenPipe
+	}
+	if len(b) == 0 || len(b) > int(s.kcp.mss)+IKCP_OVERHEAD-datagramHeaderSize {
+		return errDatagramSize
+	}
+
+	size := datagramHeaderSize + len(b)
+	if size < IKCP_OVERHEAD {
+		size = IKCP_OVERHEAD
+	}
+	ext := s.xmitBuf.Get().([]byte)[:s.headerSize+size]
+	pkt := ext[s.headerSize:]
+	binary.LittleEndian.PutUint32(pkt, s.kcp.conv)
+	pkt[4] = cmdDatagram
+	n := copy(pkt[datagramHeaderSize:], b)
+	if padding := pkt[datagramHeaderSize+n:]; len(padding) > 0 {
+		pkt[4] = cmdDatagramPadded
+		xorBytes(padding, padding, padding)
+		padding[len(padding)-1] = byte(len(padding))
+	}
+	select {
+	case s.chUDPOutput <- ext:
+	default:
+		atomic.AddUint64(&DefaultSnmp.DatagramDrops, 1)
+		s.xmitBuf.Put(ext[:cap(ext)])
+		return nil
+	}
+	atomic.AddUint64(&DefaultSnmp.BytesSent, uint64(len(b)))
+	atomic.AddUint64(&s.bytesSent, uint64(len(b)))
+	return nil
+}
+
+// ReadUnreliable returns the next datagram sent by SendUnreliable on the
+// remote, in arrival order. Datagrams are dropped, the oldest first, if they
+// are not read quickly enough. It honors the read deadline, and returns
+// io.EOF once the reading side is closed.
+func (s *UDPSession) ReadUnreliable() ([]byte, error) {
+	for {
+		s.mu.Lock()
+		if s.closed() {
+			s.mu.Unlock()
+			return nil, s.closedErr()
+		}
+		if len(s.datagrams) > 0 {
+			b := s.datagrams[0]
+			s.datagrams[0] = nil
+			s.datagrams = s.datagrams[1:]
+			s.mu.Unlock()
+			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(len(b)))
+			atomic.AddUint64(&s.bytesReceived, uint64(len(b)))
+			return b, nil
+		}
+		if s.rdClosed {
+			s.mu.Unlock()
+			return nil, io.EOF
+		}
+		if !s.rd.IsZero() && time.Now().After(s.rd) {
+			s.mu.Unlock()
+			return nil, errTimeout
+		}
+		s.waitRead(s.chDatagram)
+	}
+}
+
+// isDatagram tells if a kcp packet is a datagram sent by SendUnreliable
+func isDatagram(pkt []byte) bool {
+	return len(pkt) > datagramHeaderSize && (pkt[4] == cmdDatagram || pkt[4] == cmdDatagramPadded)
+}
+
+// datagramInput queues the payload of a datagram for ReadUnreliable, the
+// caller holds mu
+func (s *UDPSession) datagramInput(pkt []byte) {
+	conv := binary.LittleEndian.Uint32(pkt)
+	if conv != s.kcp.conv && !(conv == 0 && s.convAssigned) {
+		return
+	}
+	payload := pkt[datagramHeaderSize:]
+	if pkt[4] == cmdDatagramPadded {
+		padding := int(payload[len(payload)-1])
+		if padding == 0 || padding >= len(payload) {
+			return
+		}
+		payload = payload[:len(payload)-padding]
+	}
+	if s.rdClosed {
+		return
+	}
+	if len(s.datagrams) == datagramQueue {
+		s.datagrams[0] = nil
+		s.datagrams = s.datagrams[1:]
+	}
+	s.datagrams = append(s.datagrams, append([]byte(nil), payload...))
+	select {
+	case s.chDatagram <- struct{}{}:
+	default:
+	}
+}
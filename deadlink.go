@@ -0,0 +1,30 @@
+package kcp
+
+import "fmt"
+
+// DeadLinkError reports the segment which reached the retransmission limit
+// of a session, see SetDeadLink.
+type DeadLinkError struct {
+	Sn   uint32 // sn of the segment
+	Xmit uint32 // times it was sent
+}
+
+func (e *DeadLinkError) Error() string {
+	return fmt.Sprintf("dead link: segment %d sent %d times", e.Sn, e.Xmit)
+}
+
+// SetDeadLink sets the times a segment is sent before the link is deemed
+// dead, 20 by default, then SessionEvents.DeadLink and DeadLinkSegment are
+// called. If fail, the session is also closed, its reads and writes
+// failing with the *DeadLinkError of the segment instead of going on
+// retransmitting.
+func (s *UDPSession) SetDeadLink(xmit int, fail bool) error {
+	if xmit < 1 {
+		return errDeadLink
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.dead_link = uint32(xmit)
+	s.deadLinkFail = fail
+	return nil
+}
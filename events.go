@@ -0,0 +1,116 @@
+package kcp
+
+import (
+	"net"
+	"time"
+)
+
+// SessionEvents are callbacks of the lifecycle of a session, so that
+// monitoring code reacts to it without polling. The nil ones are skipped.
+// They are called by the goroutines of the session and of its listener, or
+// by the one closing the session for Closed, and must not block.
+type SessionEvents struct {
+	Established       func(s *UDPSession)                    // the first packet of the remote arrived
+	Closed            func(s *UDPSession)                    // the session was closed
+	RTOSpike          func(s *UDPSession, rto time.Duration) // the rto reached twice its smoothed value
+	DeadLink          func(s *UDPSession)                    // a segment reached the retransmission limit
+	Recovered         func(s *UDPSession)                    // the rto fell back, or an ack came after a dead link
+	RemoteAddrChanged func(s *UDPSession, previous net.Addr) // the remote migrated to the address RemoteAddr returns, validated by a fresh packet, see Listener.SetMigration
+	DeadLinkSegment   func(s *UDPSession, e *DeadLinkError)  // like DeadLink, with the segment which reached the limit, see SetDeadLink
+}
+
+// SetEventHandler installs the callbacks of the lifecycle events of the
+// session, in addition to the ones of its listener. The zero SessionEvents
+// removes them.
+func (s *UDPSession) SetEventHandler(h SessionEvents) {
+	s.events.Store(&h)
+}
+
+// SetEventHandler installs the callbacks of the lifecycle events of all the
+// sessions of the listener, the ones accepted later included, Established
+// is thus seen for a session before it is accepted. The zero SessionEvents
+// removes them.
+func (l *Listener) SetEventHandler(h SessionEvents) {
+	l.events.Store(&h)
+}
+
+// emit calls event with the handlers of the session and of its listener
+func (s *UDPSession) emit(event func(h *SessionEvents)) {
+	if h, _ := s.events.Load().(*SessionEvents); h != nil {
+		event(h)
+	}
+	if s.l != nil {
+		if h, _ := s.l.events.Load().(*SessionEvents); h != nil {
+			event(h)
+		}
+	}
+}
+
+// checkHealth follows the rto and the dead link state of kcp, and returns
+// the event to emit once the caller, which holds mu, releases it, closing
+// the session if the dead link fails it, nil if the health of the link
+// didn't change
+func (s *UDPSession) checkHealth() func() {
+	rto := s.kcp.rx_rto
+	var event func(h *SessionEvents)
+	fail := false
+	switch {
+	case s.kcp.state != 0 && !s.linkDead:
+		s.linkDead, s.deadUna = true, s.kcp.snd_una
+		err := &DeadLinkError{Sn: s.kcp.dead_sn, Xmit: s.kcp.dead_xmit}
+		if s.deadLinkFail && s.deadLinkErr == nil {
+			s.deadLinkErr, fail = err, true
+		}
+		event = func(h *SessionEvents) {
+			if h.DeadLink != nil {
+				h.DeadLink(s)
+			}
+			if h.DeadLinkSegment != nil {
+				h.DeadLinkSegment(s, err)
+			}
+		}
+	case s.linkDead && s.kcp.snd_una != s.deadUna:
+		// kcp never leaves the dead link state, the next one is reported again
+		s.kcp.state = 0
+		s.linkDead, s.rtoSpiked = false, false
+		s.rtoBase = rto
+		event = recovered(s)
+	case !s.rtoSpiked && s.rtoBase > 0 && rto >= 2*s.rtoBase:
+		s.rtoSpiked = true
+		event = func(h *SessionEvents) {
+			if h.RTOSpike != nil {
+				h.RTOSpike(s, time.Duration(rto)*time.Millisecond)
+			}
+		}
+	case s.rtoSpiked && rto < 2*s.rtoBase:
+		s.rtoSpiked = false
+		if !s.linkDead {
+			event = recovered(s)
+		}
+	}
+	if !s.rtoSpiked && !s.linkDead {
+		if s.rtoBase == 0 {
+			s.rtoBase = rto
+		}
+		s.rtoBase = (7*s.rtoBase + rto) / 8
+	}
+
+	if event == nil {
+		return nil
+	}
+	return func() {
+		s.emit(event)
+		if fail {
+			s.Close()
+		}
+	}
+}
+
+// recovered returns the Recovered event of s
+func recovered(s *UDPSession) func(h *SessionEvents) {
+	return func(h *SessionEvents) {
+		if h.Recovered != nil {
+			h.Recovered(s)
+		}
+	}
+}
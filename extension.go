@@ -0,0 +1,81 @@
+package kcp
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// headerExtension stamps the packets sent and strips the packets received,
+// a nil one leaves them untouched
+type headerExtension struct {
+	writer func([]byte) []byte
+	reader func([]byte) ([]byte, error)
+}
+
+// SetHeaderExtension makes the session pass every packet it sends through
+// writer, and every packet it receives through reader, so that a relay
+// stamps routing tags or tenant IDs onto the datagrams and strips them,
+// without a net.PacketConn of its own. writer returns the packet to send,
+// it may prepend to or append to the packet it's given, which it must not
+// keep. reader returns the packet without the extension, a part of the
+// packet it's given or a copy of it no larger, the packets it fails are
+// dropped and counted as InErrs. They're called by the goroutines of the
+// session, they must not block. The packets of the handshake of
+// DialWithNoise are sent before the extension is set. The sessions of a
+// listener take the extension of the listener instead. nil removes the
+// extension.
+func (s *UDPSession) SetHeaderExtension(writer func([]byte) []byte, reader func([]byte) ([]byte, error)) {
+	s.ext.Store(newHeaderExtension(writer, reader))
+}
+
+// SetHeaderExtension makes the listener and its sessions pass every packet
+// through the hooks, as UDPSession.SetHeaderExtension does. nil removes the
+// extension.
+func (l *Listener) SetHeaderExtension(writer func([]byte) []byte, reader func([]byte) ([]byte, error)) {
+	l.ext.Store(newHeaderExtension(writer, reader))
+}
+
+// newHeaderExtension returns the extension of the hooks, nil without any
+func newHeaderExtension(writer func([]byte) []byte, reader func([]byte) ([]byte, error)) *headerExtension {
+	if writer == nil && reader == nil {
+		return nil
+	}
+	return &headerExtension{writer: writer, reader: reader}
+}
+
+// extension returns the header extension of the session
+func (s *UDPSession) extension() *headerExtension {
+	if s.l != nil {
+		return s.l.extension()
+	}
+	e, _ := s.ext.Load().(*headerExtension)
+	return e
+}
+
+// extension returns the header extension of the listener
+func (l *Listener) extension() *headerExtension {
+	e, _ := l.ext.Load().(*headerExtension)
+	return e
+}
+
+// writeTo sends a packet to addr over conn, stamped by the writer
+func (e *headerExtension) writeTo(conn net.PacketConn, b []byte, addr net.Addr) (int, error) {
+	if e != nil && e.writer != nil {
+		b = e.writer(b)
+	}
+	return conn.WriteTo(b, addr)
+}
+
+// strip strips the first n bytes of buf, a packet received, in place, and
+// returns the size of the packet left, false if the reader failed it
+func (e *headerExtension) strip(buf []byte, n int) (int, bool) {
+	if e == nil || e.reader == nil {
+		return n, true
+	}
+	pkt, err := e.reader(buf[:n])
+	if err != nil || len(pkt) > n {
+		atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+		return 0, false
+	}
+	return copy(buf, pkt), true
+}
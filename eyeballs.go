@@ -0,0 +1,151 @@
+package kcp
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+const (
+	eyeballsDelay = 250 * time.Millisecond // between two attempts, as RFC 8305 recommends
+	eyeballsProbe = 50 * time.Millisecond  // between two probes of an attempt
+	eyeballsPoll  = 10 * time.Millisecond  // between two looks for an answer
+)
+
+// DialHappyEyeballs connects like DialWithOptionsContext to the first of
+// raddrs to answer, so that a client with a broken IPv6 path, or facing a
+// dead endpoint, doesn't hang on it. The addresses of the hosts of raddrs
+// are tried in order, IPv6 and IPv4 interleaved as in RFC 8305, an attempt
+// starting every 250ms while the earlier ones go on. Each attempt probes
+// the listener with kcp window probes until it answers, the attempts which
+// lose the race are closed, which leaves their listener with a session
+// never sending data. It fails with the error of ctx once ctx is done, or
+// after 60s of silence if ctx has no deadline.
+func DialHappyEyeballs(ctx context.Context, raddrs []string, block BlockCrypt, dataShards, parityShards int) (*UDPSession, error) {
+	if _, err := newSessionFEC(dataShards, parityShards); err != nil {
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, connTimeout)
+		defer cancel()
+	}
+	candidates, err := resolveCandidates(ctx, raddrs)
+	if err != nil {
+		return nil, err
+	}
+
+	var attempts []*UDPSession
+	var winner *UDPSession
+	defer func() {
+		for _, s := range attempts {
+			if s != winner {
+				s.Close()
+			}
+		}
+	}()
+	next := time.NewTimer(0)
+	defer next.Stop()
+	poll := time.NewTicker(eyeballsPoll)
+	defer poll.Stop()
+	probed := time.Now()
+	for {
+		select {
+		case <-next.C:
+			conn := dialConn()
+			s, err := NewConn(candidates[0], block, dataShards, parityShards, conn)
+			if err != nil {
+				conn.Close()
+				return nil, err
+			}
+			s.probe()
+			attempts = append(attempts, s)
+			if candidates = candidates[1:]; len(candidates) > 0 {
+				next.Reset(eyeballsDelay)
+			}
+		case <-poll.C:
+			for _, s := range attempts {
+				if s.answered() {
+					winner = s
+					return s, nil
+				}
+			}
+			if time.Since(probed) >= eyeballsProbe {
+				for _, s := range attempts {
+					s.probe()
+				}
+				probed = time.Now()
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// resolveCandidates resolves the addresses of raddrs, and interleaves the
+// IPv6 and IPv4 ones in order, starting with IPv6
+func resolveCandidates(ctx context.Context, raddrs []string) ([]*net.UDPAddr, error) {
+	var v6, v4 []*net.UDPAddr
+	var lastErr error
+	for _, raddr := range raddrs {
+		host, service, err := net.SplitHostPort(raddr)
+		if err != nil {
+			return nil, err
+		}
+		port, err := net.DefaultResolver.LookupPort(ctx, "udp", service)
+		if err != nil {
+			return nil, err
+		}
+		if host == "" {
+			v4 = append(v4, &net.UDPAddr{Port: port})
+			continue
+		}
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			lastErr = err // the other hosts may resolve
+			continue
+		}
+		for _, a := range addrs {
+			addr := &net.UDPAddr{IP: a.IP, Port: port, Zone: a.Zone}
+			if a.IP.To4() != nil {
+				v4 = append(v4, addr)
+			} else {
+				v6 = append(v6, addr)
+			}
+		}
+	}
+
+	candidates := make([]*net.UDPAddr, 0, len(v6)+len(v4))
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			candidates, v6 = append(candidates, v6[0]), v6[1:]
+		}
+		if len(v4) > 0 {
+			candidates, v4 = append(candidates, v4[0]), v4[1:]
+		}
+	}
+	if len(candidates) == 0 {
+		if lastErr == nil {
+			lastErr = errNoAddress
+		}
+		return nil, lastErr
+	}
+	return candidates, nil
+}
+
+// probe sends a kcp window probe, which the listener answers, creating the
+// session of the remote if need be
+func (s *UDPSession) probe() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.probe |= IKCP_ASK_SEND
+	s.kcp.current = currentMs()
+	s.kcp.flush()
+}
+
+// answered tells if a packet of the remote was received
+func (s *UDPSession) answered() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.established
+}
@@ -2,241 +2,1008 @@ package kcp
 
 import (
 	"encoding/binary"
-	"log"
 	"sync"
+	"sync/atomic"
 
 	"github.com/klauspost/reedsolomon"
 )
 
 const (
-	fecHeaderSize      = 6
+	fecHeaderSize      = 9                 // seqid(4) + flag(1) + version(1) + filled(1) + dataShards(1) + parityShards(1), the layout of version 1
 	fecHeaderSizePlus2 = fecHeaderSize + 2 // plus 2B data size
 	typeData           = 0xf1
 	typeFEC            = 0xf2
-	fecExpire          = 30000 // 30s
+	typeFECXOR         = 0xf3  // parity shard made by xor
+	typeNoFEC          = 0xf4  // data shard sent outside of any group
+	typeFECLeopard     = 0xf5  // parity shard made by leopard-gf16
+	typeFECFountain    = 0xf6  // repair symbol of the fountain code
+	fecExpire          = 30000 // default age of an incomplete group in ms, 30s
+	fecMaxShards       = 0xff  // shard counts are carried in 1 byte each
+	fecFinishedGroups  = 16    // finished groups remembered to drop their late shards
+	fecMinVersion      = 1     // oldest header format understood
+	fecVersion         = 1     // newest header format understood
+	leopardShardAlign  = 64    // leopard-gf16 codes shards of a multiple of this size only
+	fountainIndexSize  = 2     // index of a fountain repair symbol, ahead of it
+	fecRxGeometries    = 8     // codecs of incoming geometries kept at once
+)
+
+// FEC parity codecs
+const (
+	FECCodecReedSolomon = iota // Reed-Solomon erasure code
+	FECCodecXOR                // single parity shard xor-ed from all data shards, cheap on low-end cpus
+	FECCodecLeopard            // Reed-Solomon over GF(2^16), much faster for large groups like 60+20, needs reedsolomon v1.11.0+
+	FECCodecFountain           // random linear fountain code, for one-way links needing many repair symbols
 )
 
 type (
-	// FEC defines forward error correction for packets
+	// fecCodec computes parity shards and recovers lost shards of a group,
+	// missing shards have zero length, their capacity may be reused.
+	fecCodec interface {
+		Encode(shards [][]byte) error
+		EncodeIdx(dataShard []byte, idx int, parity [][]byte) error
+		Reconstruct(shards [][]byte) error
+	}
+
+	// xorCodec implements fecCodec with exactly 1 parity shard
+	xorCodec struct{}
+
+	// leopardCodec implements fecCodec with leopard-gf16, which codes whole
+	// groups of shards of a multiple of leopardShardAlign bytes only, the
+	// shards are padded with zeros up to it
+	leopardCodec struct {
+		enc        reedsolomon.Encoder
+		dataShards int
+	}
+
+	// FECStats defines the statistics of fec decoding
+	FECStats struct {
+		ShardsReceived      uint64 // shards fed into the decoder
+		DuplicateShards     uint64 // shards dropped as duplicated or arriving after their group finished
+		GroupsRecovered     uint64 // groups whose lost data shards were reconstructed
+		GroupsUnrecoverable uint64 // groups dropped before enough shards arrived
+		BytesRecovered      uint64 // payload bytes reconstructed
+		BadVersions         uint64 // shards dropped for an unsupported header version
+		MalformedShards     uint64 // packets too short or with an unknown flag
+	}
+
+	// FEC defines forward error correction for packets, it is safe for
+	// concurrent use. The encoding and the decoding side are guarded by
+	// their own lock, so a session may encode and decode at the same time.
 	FEC struct {
-		rx           []fecPacket // ordered receive queue
-		rxlimit      int         // queue size limit
-		dataShards   int
+		txMu sync.Mutex // guards the geometry and seqid of outgoing groups
+		rxMu sync.Mutex // guards the queue of incoming groups and stats
+
+		rx           map[uint32]*fecGroup // incomplete groups by first seqid
+		rxHead       *fecGroup            // most recently updated group
+		rxTail       *fecGroup            // least recently updated group
+		rxFree       []*fecGroup          // recycled groups
+		rxCount      int                  // shards queued in rx
+		rxlimit      int                  // queue size limit
+		rxByteLimit  int                  // memory held by the queue, 0 for no limit
+		rxBytes      int
+		dataShards   int // geometry of outgoing groups
 		parityShards int
 		shardSize    int
 		next         uint32 // next seqid
-		enc          reedsolomon.Encoder
-		shards       [][]byte
-		shardsflag   []bool
-		paws         uint32 // Protect Against Wrapped Sequence numbers
-		lastCheck    uint32
-		xmitBuf      sync.Pool
+		codec        int
+		enc          fecCodec
+		codecs       *codecCache // shared by the sessions of a Listener, nil if not shared
+		paws         uint32      // Protect Against Wrapped Sequence numbers
+		rxExpire     uint32      // ms an incomplete group is kept without receiving a shard
+		xmitBuf      sync.Pool   // shard allocator of *[mtuLimit]byte, see getShard/putShard
+
+		// codecs of incoming groups by the geometry and codec of their
+		// headers, each group keeps the geometry it was sent with
+		rxCodecs    map[codecKey]fecCodec
+		zeros       []byte                    // stands for data shards never sent
+		finished    [fecFinishedGroups]uint32 // begin seqid + 1 of recently finished groups
+		finishedIdx int
+		stats       FECStats
+
+		// header version negotiation, each header carries the version it is
+		// encoded with in the low nibble and the newest version its sender
+		// understands in the high nibble, so both sides settle on the newest
+		// common version once the first packets are exchanged.
+		txVersion   uint32 // version of outgoing headers, accessed atomically
+		peerVersion uint8  // newest version the peer understands, 0 if not known yet
+	}
+
+	// fecGroup collects the shards of an incoming group, groups are
+	// linked from the most to the least recently updated one
+	fecGroup struct {
+		begin        uint32   // seqid of the first shard
+		shards       [][]byte // by seqid - begin, nil if not received
+		dataShards   int      // geometry the group was sent with
+		parityShards int
+		numShard     int
+		numData      int
+		filled       int    // data shards sent if closed early, 0 for a full group
+		parity       uint16 // flag of the parity shards
+		maxlen       int
+		ts           uint32   // arrival of the latest shard
+		repairs      [][]byte // fountain repair symbols of index parityShards and above
+		repairIdx    []int    // their indices
+		prev, next   *fecGroup
+	}
+
+	// codecCache shares codecs and the zero shard between the FECs of
+	// a Listener, codecs are safe for concurrent use so every session
+	// with the same geometry can use a single one
+	codecCache struct {
+		mu     sync.Mutex
+		codecs map[codecKey]fecCodec
+		zeros  []byte
+	}
+
+	codecKey struct {
+		codec        int
+		dataShards   int
+		parityShards int
+	}
+
+	// fecScratch holds the shard slices of a single encoding or decoding
+	// call, they are taken from scratchPool so that calls don't share them
+	fecScratch struct {
+		shards [][]byte
+		flags  []bool
 	}
 
 	fecPacket struct {
-		seqid uint32
-		flag  uint16
-		data  []byte
-		ts    uint32
+		seqid        uint32
+		flag         uint16
+		version      uint8 // header format version
+		peerVersion  uint8 // newest version the sender understands
+		filled       uint8 // data shards sent in a group closed early, 0 for a full group
+		dataShards   uint8
+		parityShards uint8
+		repair       uint16 // index of a fountain repair symbol
+		data         []byte
+		ts           uint32
 	}
 )
 
-func newFEC(rxlimit, dataShards, parityShards int) *FEC {
-	if dataShards <= 0 || parityShards <= 0 {
-		return nil
+var scratchPool = sync.Pool{
+	New: func() interface{} { return new(fecScratch) },
+}
+
+// getScratch returns the scratch of a call on n shards
+func getScratch(n int) *fecScratch {
+	sc := scratchPool.Get().(*fecScratch)
+	if cap(sc.shards) < n {
+		sc.shards = make([][]byte, n)
+		sc.flags = make([]bool, n)
+	}
+	sc.shards = sc.shards[:n]
+	sc.flags = sc.flags[:n]
+	return sc
+}
+
+func putScratch(sc *fecScratch) {
+	for k := range sc.shards {
+		sc.shards[k] = nil
+	}
+	scratchPool.Put(sc)
+}
+
+func newFEC(rxlimit, dataShards, parityShards int) (*FEC, error) {
+	return newSharedFEC(rxlimit, dataShards, parityShards, nil)
+}
+
+// newSharedFEC creates a FEC taking its codecs from codecs, which may be nil
+func newSharedFEC(rxlimit, dataShards, parityShards int, codecs *codecCache) (*FEC, error) {
+	if !validFECParameters(dataShards, parityShards) {
+		return nil, errFECParams
 	}
 	if rxlimit < dataShards+parityShards {
-		return nil
+		return nil, errFECParams
 	}
 
 	fec := new(FEC)
 	fec.rxlimit = rxlimit
+	fec.rxExpire = fecExpire
+	fec.txVersion = fecMinVersion
+	fec.codecs = codecs
+	if err := fec.setParameters(dataShards, parityShards, FECCodecReedSolomon); err != nil {
+		return nil, err
+	}
+	fec.rx = make(map[uint32]*fecGroup)
+	fec.rxCodecs = make(map[codecKey]fecCodec)
+	if codecs != nil {
+		fec.zeros = codecs.zeros
+	} else {
+		fec.zeros = make([]byte, mtuLimit)
+	}
+	fec.xmitBuf.New = func() interface{} {
+		return new([mtuLimit]byte)
+	}
+
+	return fec, nil
+}
+
+// validFECParameters checks if the geometry fits in the fec header
+func validFECParameters(dataShards, parityShards int) bool {
+	if dataShards <= 0 || parityShards <= 0 {
+		return false
+	}
+	if dataShards > fecMaxShards || parityShards > fecMaxShards {
+		return false
+	}
+	return true
+}
+
+// newCodec creates a codec for the given geometry
+func newCodec(codec, dataShards, parityShards int) (fecCodec, error) {
+	switch codec {
+	case FECCodecReedSolomon:
+		return reedsolomon.New(dataShards, parityShards)
+	case FECCodecXOR:
+		if parityShards != 1 {
+			return nil, errFECParams
+		}
+		return xorCodec{}, nil
+	case FECCodecLeopard:
+		enc, err := reedsolomon.New(dataShards, parityShards, reedsolomon.WithLeopardGF16(true))
+		if err != nil {
+			return nil, err
+		}
+		return leopardCodec{enc, dataShards}, nil
+	case FECCodecFountain:
+		return newFountainCodec(dataShards, parityShards)
+	}
+	return nil, errFECParams
+}
+
+func newCodecCache() *codecCache {
+	c := new(codecCache)
+	c.codecs = make(map[codecKey]fecCodec)
+	c.zeros = make([]byte, mtuLimit)
+	return c
+}
+
+// get returns the codec for the given geometry, creating it on first use
+func (c *codecCache) get(codec, dataShards, parityShards int) (fecCodec, error) {
+	key := codecKey{codec, dataShards, parityShards}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if enc, ok := c.codecs[key]; ok {
+		return enc, nil
+	}
+	enc, err := newCodec(codec, dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	c.codecs[key] = enc
+	return enc, nil
+}
+
+// newCodec creates a codec, or takes it from the shared cache if any
+func (fec *FEC) newCodec(codec, dataShards, parityShards int) (fecCodec, error) {
+	if fec.codecs != nil {
+		return fec.codecs.get(codec, dataShards, parityShards)
+	}
+	return newCodec(codec, dataShards, parityShards)
+}
+
+// setParameters switches the geometry of outgoing groups, it must be
+// called at a group boundary, the next seqid is aligned to the new group size
+func (fec *FEC) setParameters(dataShards, parityShards, codec int) error {
+	fec.txMu.Lock()
+	defer fec.txMu.Unlock()
+	enc, err := fec.newCodec(codec, dataShards, parityShards)
+	if err != nil {
+		return err
+	}
+	fec.codec = codec
+	fec.enc = enc
 	fec.dataShards = dataShards
 	fec.parityShards = parityShards
 	fec.shardSize = dataShards + parityShards
-	fec.paws = (0xffffffff/uint32(fec.shardSize) - 1) * uint32(fec.shardSize)
-	enc, err := reedsolomon.New(dataShards, parityShards)
-	if err != nil {
-		log.Println(err)
-		return nil
+	fec.paws = fecPaws(fec.shardSize)
+	if rem := fec.next % uint32(fec.shardSize); rem != 0 {
+		fec.next += uint32(fec.shardSize) - rem
 	}
-	fec.enc = enc
-	fec.shards = make([][]byte, fec.shardSize)
-	fec.shardsflag = make([]bool, fec.shardSize)
-	fec.xmitBuf.New = func() interface{} {
-		return make([]byte, mtuLimit)
+	if fec.next >= fec.paws {
+		fec.next = 0
+	}
+	return nil
+}
+
+// fecPaws returns where seqids wrap for a group size, a multiple of
+// the group size so that no group straddles the wrap
+func fecPaws(shardSize int) uint32 {
+	return (0xffffffff/uint32(shardSize) - 1) * uint32(shardSize)
+}
+
+// negotiate checks the header version of an incoming packet and settles
+// the version of outgoing headers on the newest one both sides understand.
+// The caller holds rxMu.
+func (fec *FEC) negotiate(pkt fecPacket) error {
+	if pkt.version < fecMinVersion || pkt.version > fecVersion || pkt.peerVersion < pkt.version {
+		fec.stats.BadVersions++
+		return errFECVersion
+	}
+	if pkt.peerVersion != fec.peerVersion {
+		fec.peerVersion = pkt.peerVersion
+		txVersion := uint32(fecVersion)
+		if pkt.peerVersion < fecVersion {
+			txVersion = uint32(pkt.peerVersion)
+		}
+		atomic.StoreUint32(&fec.txVersion, txVersion)
 	}
+	return nil
+}
 
-	return fec
+// isFECPacket tells fec packets from the plain kcp packets of a remote with
+// parityShards 0, byte 4 is the fec flag or the kcp cmd respectively.
+func isFECPacket(data []byte) bool {
+	return len(data) > 4 && data[4] >= typeData
 }
 
-// decode a fec packet
-func (fec *FEC) decode(data []byte) fecPacket {
-	var pkt fecPacket
+// decode a fec packet, malformed packets are counted and rejected
+func (fec *FEC) decode(data []byte) (pkt fecPacket, err error) {
+	err = fec.decodeInto(data, &pkt)
+	return
+}
+
+// decodeInto is decode into a caller owned packet, so the hot path doesn't
+// allocate per packet. The payload is copied into a pooled shard, pkt is
+// left untouched if an error is returned.
+func (fec *FEC) decodeInto(data []byte, pkt *fecPacket) error {
+	if len(data) < fecHeaderSizePlus2 {
+		fec.malformed()
+		return errFECPacket
+	}
+	switch data[4] {
+	case typeData, typeFEC, typeFECXOR, typeNoFEC, typeFECLeopard, typeFECFountain:
+	default:
+		fec.malformed()
+		return errFECPacket
+	}
+	pkt.flag = uint16(data[4])
 	pkt.seqid = binary.LittleEndian.Uint32(data)
-	pkt.flag = binary.LittleEndian.Uint16(data[4:])
+	pkt.version = data[5] & 0xf
+	pkt.peerVersion = data[5] >> 4
+	pkt.filled = data[6]
+	pkt.dataShards = data[7]
+	pkt.parityShards = data[8]
 	pkt.ts = currentMs()
+	payload := data[fecHeaderSize:]
+	pkt.repair = 0
+	if pkt.flag == typeFECFountain {
+		if len(payload) < fountainIndexSize+2 {
+			fec.malformed()
+			return errFECPacket
+		}
+		pkt.repair = binary.LittleEndian.Uint16(payload)
+		payload = payload[fountainIndexSize:]
+	}
 	// allocate memory & copy
-	buf := fec.xmitBuf.Get().([]byte)
+	buf := fec.getShard()
 	xorBytes(buf, buf, buf)
-	copy(buf, data[6:])
-	pkt.data = buf
-	return pkt
+	n := copy(buf, payload)
+	pkt.data = buf[:n]
+	return nil
+}
+
+func (fec *FEC) malformed() {
+	fec.rxMu.Lock()
+	fec.stats.MalformedShards++
+	fec.rxMu.Unlock()
 }
 
 func (fec *FEC) markData(data []byte) {
-	binary.LittleEndian.PutUint32(data, fec.next)
-	binary.LittleEndian.PutUint16(data[4:], typeData)
-	fec.next++
+	fec.txMu.Lock()
+	defer fec.txMu.Unlock()
+	fec.mark(data, typeData)
+}
+
+func (fec *FEC) markFEC(data []byte) {
+	fec.markParity(data, 0)
+}
+
+// markPartialFEC marks a parity shard of a group closed early by the flush timer,
+// the data shards after filled are zero and never sent.
+func (fec *FEC) markPartialFEC(data []byte, filled int) {
+	fec.markParity(data, filled)
+}
+
+func (fec *FEC) markParity(data []byte, filled int) {
+	fec.txMu.Lock()
+	defer fec.txMu.Unlock()
+	switch fec.codec {
+	case FECCodecXOR:
+		fec.mark(data, typeFECXOR)
+	case FECCodecLeopard:
+		fec.mark(data, typeFECLeopard)
+	case FECCodecFountain:
+		fec.mark(data, typeFECFountain)
+	default:
+		fec.mark(data, typeFEC)
+	}
+	data[6] = byte(filled)
+}
+
+// skip advances the seqid over the data shards never sent
+func (fec *FEC) skip(n int) {
+	fec.txMu.Lock()
+	defer fec.txMu.Unlock()
+	fec.next += uint32(n)
 	if fec.next >= fec.paws {
 		fec.next = 0
 	}
 }
 
-func (fec *FEC) markFEC(data []byte) {
-	binary.LittleEndian.PutUint32(data, fec.next)
-	binary.LittleEndian.PutUint16(data[4:], typeFEC)
+// markNoFEC marks a packet which bypasses fec grouping, it takes no seqid
+func (fec *FEC) markNoFEC(data []byte) {
+	fec.txMu.Lock()
+	defer fec.txMu.Unlock()
+	fec.header(data, 0, typeNoFEC)
+}
+
+// header writes a fec header, the caller holds txMu
+func (fec *FEC) header(data []byte, seqid uint32, flag uint16) {
+	binary.LittleEndian.PutUint32(data, seqid)
+	data[4] = byte(flag)
+	data[5] = fecVersion<<4 | byte(atomic.LoadUint32(&fec.txVersion))
+	data[6] = 0
+	data[7] = byte(fec.dataShards)
+	data[8] = byte(fec.parityShards)
+}
+
+// mark writes a fec header taking the next seqid, the caller holds txMu
+func (fec *FEC) mark(data []byte, flag uint16) {
+	fec.header(data, fec.next, flag)
 	fec.next++
 	if fec.next >= fec.paws {
 		fec.next = 0
 	}
 }
 
-// input a fec packet
-func (fec *FEC) input(pkt fecPacket) (recovered [][]byte) {
-	// expiration
-	now := currentMs()
-	if now-fec.lastCheck >= fecExpire {
-		var rx []fecPacket
-		for k := range fec.rx {
-			if now-fec.rx[k].ts < fecExpire {
-				rx = append(rx, fec.rx[k])
-			} else {
-				fec.xmitBuf.Put(fec.rx[k].data)
-			}
-		}
-		fec.rx = rx
-		fec.lastCheck = now
+// inputNoFEC checks a packet which bypassed fec grouping, the packet is consumed
+// and its payload can be delivered if no error is returned
+func (fec *FEC) inputNoFEC(pkt fecPacket) error {
+	fec.putShard(pkt.data)
+	fec.rxMu.Lock()
+	defer fec.rxMu.Unlock()
+	return fec.negotiate(pkt)
+}
+
+// input a fec packet, the packet is consumed even if an error is returned.
+// Recovered data shards start with their 2 bytes size and are trimmed to it.
+func (fec *FEC) input(pkt fecPacket) (recovered [][]byte, err error) {
+	fec.rxMu.Lock()
+	defer fec.rxMu.Unlock()
+	fec.stats.ShardsReceived++
+	if err := fec.negotiate(pkt); err != nil {
+		fec.putShard(pkt.data)
+		return nil, err
 	}
 
-	// insertion
-	n := len(fec.rx) - 1
-	insertIdx := 0
-	for i := n; i >= 0; i-- {
-		if pkt.seqid == fec.rx[i].seqid { // de-duplicate
-			fec.xmitBuf.Put(pkt.data)
-			return nil
-		} else if pkt.seqid > fec.rx[i].seqid { // insertion
-			insertIdx = i + 1
-			break
+	// every packet carries the geometry of its group, the groups queued
+	// before the sender switched geometry are kept until they complete
+	dataShards, parityShards := int(pkt.dataShards), int(pkt.parityShards)
+	if !validFECParameters(dataShards, parityShards) || dataShards+parityShards > fec.rxlimit {
+		fec.putShard(pkt.data)
+		return nil, errFECParams
+	}
+
+	fec.expire(pkt.ts)
+
+	shardBegin := pkt.seqid - pkt.seqid%uint32(dataShards+parityShards)
+
+	// late shards of a finished group
+	for k := range fec.finished {
+		if fec.finished[k] == shardBegin+1 {
+			fec.stats.DuplicateShards++
+			fec.putShard(pkt.data)
+			return nil, nil
 		}
 	}
 
-	// insert into ordered rx queue
-	if insertIdx == n+1 {
-		fec.rx = append(fec.rx, pkt)
+	// insertion
+	g := fec.rx[shardBegin]
+	if g != nil && (g.dataShards != dataShards || g.parityShards != parityShards) {
+		// a stale group of another geometry at the same seqid, after a wrap
+		fec.free(g)
+		fec.stats.GroupsUnrecoverable++
+		g = nil
+	}
+	if g == nil {
+		g = fec.newGroup(shardBegin, dataShards, parityShards)
+	}
+	idx := pkt.seqid - shardBegin
+	extra := pkt.flag == typeFECFountain && int(pkt.repair) >= parityShards
+	if extra && g.hasRepair(int(pkt.repair)) || !extra && g.shards[idx] != nil { // de-duplicate
+		fec.stats.DuplicateShards++
+		fec.putShard(pkt.data)
+		return nil, nil
+	}
+	if extra {
+		// a repair symbol sent on demand, beyond the slots of the group
+		g.repairs = append(g.repairs, pkt.data)
+		g.repairIdx = append(g.repairIdx, int(pkt.repair))
 	} else {
-		fec.rx = append(fec.rx, fecPacket{})
-		copy(fec.rx[insertIdx+1:], fec.rx[insertIdx:])
-		fec.rx[insertIdx] = pkt
-	}
-
-	shardBegin := pkt.seqid - pkt.seqid%uint32(fec.shardSize)
-	shardEnd := shardBegin + uint32(fec.shardSize) - 1
-
-	searchBegin := insertIdx - fec.shardSize
-	if searchBegin < 0 {
-		searchBegin = 0
-	}
-
-	searchEnd := insertIdx + fec.shardSize
-	if searchEnd >= len(fec.rx) {
-		searchEnd = len(fec.rx) - 1
-	}
-
-	if len(fec.rx) >= fec.dataShards && shardBegin < shardEnd {
-		numshard := 0
-		numDataShard := 0
-		first := -1
-		maxlen := 0
-		shards := fec.shards
-		shardsflag := fec.shardsflag
-		for k := range fec.shards {
-			shards[k] = nil
-			shardsflag[k] = false
-		}
-
-		for i := searchBegin; i <= searchEnd; i++ {
-			seqid := fec.rx[i].seqid
-			if seqid > shardEnd {
-				break
-			} else if seqid >= shardBegin {
-				shards[seqid%uint32(fec.shardSize)] = fec.rx[i].data
-				shardsflag[seqid%uint32(fec.shardSize)] = true
-				numshard++
-				if fec.rx[i].flag == typeData {
-					numDataShard++
-				}
-				if numshard == 1 {
-					first = i
-				}
-				if len(fec.rx[i].data) > maxlen {
-					maxlen = len(fec.rx[i].data)
-				}
+		g.shards[idx] = pkt.data
+	}
+	g.numShard++
+	if pkt.flag == typeData {
+		g.numData++
+	} else {
+		g.parity = pkt.flag
+	}
+	if pkt.filled > 0 {
+		g.filled = int(pkt.filled)
+	}
+	if len(pkt.data) > g.maxlen {
+		g.maxlen = len(pkt.data)
+	}
+	fec.rxCount++
+	fec.rxBytes += cap(pkt.data)
+	fec.touch(g, pkt.ts)
+
+	// the data shards never sent in a group closed early are known to be zero
+	numVirtual := 0
+	if g.filled > 0 {
+		for k := g.filled; k < dataShards; k++ {
+			if g.shards[k] == nil {
+				numVirtual++
 			}
 		}
+	}
 
-		if numDataShard == fec.dataShards { // no lost
-			for i := first; i < first+numshard; i++ { // free
-				fec.xmitBuf.Put(fec.rx[i].data)
+	if g.numData+numVirtual == dataShards { // no lost
+		fec.free(g)
+		fec.finish(shardBegin)
+	} else if g.numShard+numVirtual >= dataShards { // recoverable
+		// missing shards are empty slices of pooled buffers, which the codec fills in
+		sc := getScratch(dataShards + parityShards)
+		shards, shardsflag := sc.shards, sc.flags
+		for k := range shards {
+			if g.shards[k] != nil {
+				shards[k] = g.shards[k][:g.maxlen]
+				shardsflag[k] = true
+			} else if g.filled > 0 && k >= g.filled && k < dataShards {
+				shards[k] = fec.zeros[:g.maxlen]
+				shardsflag[k] = true
+			} else {
+				shards[k] = fec.getShard()[:0]
+				shardsflag[k] = false
 			}
-			copy(fec.rx[first:], fec.rx[first+numshard:])
-			fec.rx = fec.rx[:len(fec.rx)-numshard]
-		} else if numshard >= fec.dataShards { // recoverable
-			for k := range shards {
-				if shards[k] != nil {
-					shards[k] = shards[k][:maxlen]
-				}
+		}
+		var codec fecCodec
+		codec, err = fec.rxCodec(g.parity, dataShards, parityShards)
+		if fc, ok := codec.(*fountainCodec); ok && len(g.repairs) > 0 {
+			repairs := make([][]byte, len(g.repairs))
+			for k := range repairs {
+				repairs[k] = g.repairs[k][:g.maxlen]
 			}
-			if err := fec.enc.Reconstruct(shards); err == nil {
-				for k := range shards[:fec.dataShards] {
-					if !shardsflag[k] {
-						recovered = append(recovered, shards[k])
+			err = fc.reconstructWith(shards, repairs, g.repairIdx)
+		} else if err == nil {
+			err = codec.Reconstruct(shards)
+		}
+		if err == nil {
+			for k := range shards {
+				if !shardsflag[k] {
+					if k < dataShards {
+						if shard, ok := fec.trim(shards[k]); ok {
+							recovered = append(recovered, shard)
+						} else {
+							fec.putShard(shards[k])
+						}
+					} else {
+						fec.putShard(shards[k])
 					}
 				}
-			} else {
-				log.Println(err)
 			}
-
-			for i := first; i < first+numshard; i++ { // free
-				fec.xmitBuf.Put(fec.rx[i].data)
+			fec.stats.GroupsRecovered++
+		} else {
+			for k := range shards {
+				if !shardsflag[k] {
+					fec.putShard(shards[k])
+				}
 			}
-			copy(fec.rx[first:], fec.rx[first+numshard:])
-			fec.rx = fec.rx[:len(fec.rx)-numshard]
+			fec.stats.GroupsUnrecoverable++
 		}
+		putScratch(sc)
+
+		fec.free(g)
+		fec.finish(shardBegin)
 	}
 
 	// keep rxlimit
-	if len(fec.rx) > fec.rxlimit {
-		fec.xmitBuf.Put(fec.rx[0].data) // free
-		fec.rx = fec.rx[1:]
-	}
+	fec.evict()
 	return
 }
 
-func (fec *FEC) calcECC(data [][]byte, offset, maxlen int) (ecc [][]byte) {
-	if len(data) != fec.shardSize {
-		println("mismatch", len(data), fec.shardSize)
-		return nil
+// snapshot returns a copy of the decoding statistics
+func (fec *FEC) snapshot() FECStats {
+	fec.rxMu.Lock()
+	defer fec.rxMu.Unlock()
+	return fec.stats
+}
+
+// setRxByteLimit caps the memory held by incomplete groups, 0 for no limit
+func (fec *FEC) setRxByteLimit(bytes int) {
+	fec.rxMu.Lock()
+	defer fec.rxMu.Unlock()
+	fec.rxByteLimit = bytes
+	fec.evict()
+}
+
+// trim cuts a reconstructed data shard to the size carried in its first 2
+// bytes, parity is computed over the longest shard of a group so shorter
+// shards come back padded with zeros.
+func (fec *FEC) trim(shard []byte) ([]byte, bool) {
+	if len(shard) < 2 {
+		fec.stats.MalformedShards++
+		return nil, false
+	}
+	sz := int(binary.LittleEndian.Uint16(shard) & fecSizeMask)
+	if sz < 2 || sz > len(shard) {
+		fec.stats.MalformedShards++
+		return nil, false
+	}
+	fec.stats.BytesRecovered += uint64(sz - 2)
+	return shard[:sz], true
+}
+
+// rxCodec returns the codec of an incoming group by the flag of its parity
+// shards and its geometry, creating it on first use. At most
+// fecRxGeometries codecs are kept, the others are created again if needed.
+func (fec *FEC) rxCodec(flag uint16, dataShards, parityShards int) (fecCodec, error) {
+	codec := FECCodecReedSolomon
+	switch flag {
+	case typeFECXOR:
+		return xorCodec{}, nil
+	case typeFECLeopard:
+		codec = FECCodecLeopard
+	case typeFECFountain:
+		codec = FECCodecFountain
+	}
+	key := codecKey{codec, dataShards, parityShards}
+	if enc, ok := fec.rxCodecs[key]; ok {
+		return enc, nil
+	}
+	enc, err := fec.newCodec(codec, dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	if len(fec.rxCodecs) >= fecRxGeometries {
+		fec.rxCodecs = make(map[codecKey]fecCodec)
+	}
+	fec.rxCodecs[key] = enc
+	return enc, nil
+}
+
+// getShard allocates a mtuLimit sized shard buffer, its content is undefined.
+func (fec *FEC) getShard() []byte {
+	return fec.xmitBuf.Get().(*[mtuLimit]byte)[:]
+}
+
+// putShard returns a shard buffer to the allocator, shards recovered by
+// input must be returned by the caller once consumed. The pool holds array
+// pointers, which unlike slices are stored without allocating.
+func (fec *FEC) putShard(shard []byte) {
+	fec.xmitBuf.Put((*[mtuLimit]byte)(shard[:mtuLimit]))
+}
+
+// newGroup queues an empty incoming group of the given geometry
+func (fec *FEC) newGroup(begin uint32, dataShards, parityShards int) *fecGroup {
+	var g *fecGroup
+	if n := len(fec.rxFree); n > 0 {
+		g = fec.rxFree[n-1]
+		fec.rxFree = fec.rxFree[:n-1]
+	} else {
+		g = new(fecGroup)
+	}
+	if cap(g.shards) < dataShards+parityShards {
+		g.shards = make([][]byte, dataShards+parityShards)
+	}
+	g.shards = g.shards[:dataShards+parityShards]
+	g.begin = begin
+	g.dataShards, g.parityShards = dataShards, parityShards
+	fec.rx[begin] = g
+	return g
+}
+
+// hasRepair tells if the fountain repair symbol of index r beyond the slots
+// of the group was received
+func (g *fecGroup) hasRepair(r int) bool {
+	for _, idx := range g.repairIdx {
+		if idx == r {
+			return true
+		}
+	}
+	return false
+}
+
+// touch moves a group to the head of the lru list
+func (fec *FEC) touch(g *fecGroup, ts uint32) {
+	g.ts = ts
+	if fec.rxHead == g {
+		return
+	}
+	fec.unlink(g)
+	g.next = fec.rxHead
+	if fec.rxHead != nil {
+		fec.rxHead.prev = g
+	}
+	fec.rxHead = g
+	if fec.rxTail == nil {
+		fec.rxTail = g
+	}
+}
+
+func (fec *FEC) unlink(g *fecGroup) {
+	if g.prev != nil {
+		g.prev.next = g.next
+	} else if fec.rxHead == g {
+		fec.rxHead = g.next
+	}
+	if g.next != nil {
+		g.next.prev = g.prev
+	} else if fec.rxTail == g {
+		fec.rxTail = g.prev
+	}
+	g.prev, g.next = nil, nil
+}
+
+// free releases the shards of a group and recycles it
+func (fec *FEC) free(g *fecGroup) {
+	for k := range g.shards {
+		if g.shards[k] != nil {
+			fec.rxCount--
+			fec.rxBytes -= cap(g.shards[k])
+			fec.putShard(g.shards[k])
+			g.shards[k] = nil
+		}
+	}
+	for _, shard := range g.repairs {
+		fec.rxCount--
+		fec.rxBytes -= cap(shard)
+		fec.putShard(shard)
+	}
+	fec.unlink(g)
+	delete(fec.rx, g.begin)
+	*g = fecGroup{shards: g.shards}
+	fec.rxFree = append(fec.rxFree, g)
+}
+
+// evict frees whole groups while the rx queue exceeds its limits. Groups
+// whose data shards are all delivered are freed as soon as they finish,
+// the victim is the group least likely to complete: the one whose shards
+// stopped arriving the longest ago. The most recently updated group is
+// spared unless it is the only one, as its shards are still arriving.
+func (fec *FEC) evict() {
+	for fec.rxCount > fec.rxlimit || (fec.rxByteLimit > 0 && fec.rxBytes > fec.rxByteLimit) {
+		if fec.rxTail == nil {
+			return
+		}
+		fec.free(fec.rxTail)
+		fec.stats.GroupsUnrecoverable++
+	}
+}
+
+// expire frees the groups which received no shard for rxExpire, their
+// remaining shards are not coming anymore. The lru list is ordered by
+// arrival, so only its tail has to be checked.
+func (fec *FEC) expire(now uint32) {
+	for fec.rxTail != nil && int32(now-fec.rxTail.ts) >= int32(fec.rxExpire) {
+		fec.free(fec.rxTail)
+		fec.stats.GroupsUnrecoverable++
+	}
+}
+
+// setRxExpire sets the age of incomplete groups in ms
+func (fec *FEC) setRxExpire(age uint32) {
+	fec.rxMu.Lock()
+	defer fec.rxMu.Unlock()
+	fec.rxExpire = age
+	fec.expire(currentMs())
+}
+
+// finish remembers a group whose data shards have all been delivered
+func (fec *FEC) finish(shardBegin uint32) {
+	fec.finished[fec.finishedIdx] = shardBegin + 1
+	fec.finishedIdx = (fec.finishedIdx + 1) % fecFinishedGroups
+}
+
+func (fec *FEC) calcECC(data [][]byte, offset, maxlen int) (ecc [][]byte, err error) {
+	fec.txMu.Lock()
+	enc, dataShards := fec.enc, fec.dataShards
+	shardSize := fec.shardSize
+	fec.txMu.Unlock()
+	if len(data) != shardSize {
+		return nil, errTooFewShards
 	}
-	shards := make([][]byte, fec.shardSize)
+	sc := getScratch(shardSize)
+	defer putScratch(sc)
+	shards := sc.shards
 	for k := range shards {
 		shards[k] = data[k][offset:maxlen]
 	}
 
-	if err := fec.enc.Encode(shards); err != nil {
-		log.Println(err)
+	if err := enc.Encode(shards); err != nil {
+		return nil, err
+	}
+	return data[dataShards:], nil
+}
+
+// encodeIdx accumulates data shard idx of the outgoing group into parity,
+// so the parity is complete as soon as the last data shard is written.
+func (fec *FEC) encodeIdx(data []byte, idx int, parity [][]byte, offset int) error {
+	fec.txMu.Lock()
+	enc, parityShards := fec.enc, fec.parityShards
+	fec.txMu.Unlock()
+	if len(parity) != parityShards {
+		return errTooFewShards
+	}
+	return encodeParity(enc, data, idx, parity, offset)
+}
+
+// encoder returns the codec of outgoing groups
+func (fec *FEC) encoder() fecCodec {
+	fec.txMu.Lock()
+	defer fec.txMu.Unlock()
+	return fec.enc
+}
+
+// encodeParity accumulates data shard idx into parity with enc. parity is
+// cleared by the first data shard of a group, data[offset:] only touches
+// the parity bytes it covers, so the data shards may differ in size.
+func encodeParity(enc fecCodec, data []byte, idx int, parity [][]byte, offset int) error {
+	sc := getScratch(len(parity))
+	defer putScratch(sc)
+	shards := sc.shards
+	for k := range parity {
+		if idx == 0 {
+			xorBytes(parity[k], parity[k], parity[k])
+		}
+		shards[k] = parity[k][offset:len(data)]
+	}
+	return enc.EncodeIdx(data[offset:], idx, shards)
+}
+
+// leopardZeros stands for the data shards never sent of a leopard group
+// closed early, it is never written
+var leopardZeros [mtuLimit]byte
+
+// padShards pads the shards which aren't missing with zeros to the length
+// of the longest one rounded up to leopardShardAlign, within their capacity
+func padShards(shards [][]byte) error {
+	size := 0
+	for _, shard := range shards {
+		if len(shard) > size {
+			size = len(shard)
+		}
+	}
+	size = (size + leopardShardAlign - 1) / leopardShardAlign * leopardShardAlign
+	for k, shard := range shards {
+		if len(shard) == 0 || len(shard) == size {
+			continue
+		}
+		if cap(shard) < size {
+			return errShardSize
+		}
+		shards[k] = shard[:size]
+		tail := shards[k][len(shard):]
+		xorBytes(tail, tail, tail)
+	}
+	return nil
+}
+
+// Encode implements fecCodec, the shards are padded as for leopard-gf16
+func (c leopardCodec) Encode(shards [][]byte) error {
+	if err := padShards(shards); err != nil {
+		return err
+	}
+	return c.enc.Encode(shards)
+}
+
+// EncodeIdx implements fecCodec, leopard-gf16 can't accumulate a group shard
+// by shard, see encodeGroup
+func (c leopardCodec) EncodeIdx(dataShard []byte, idx int, parity [][]byte) error {
+	return reedsolomon.ErrNotSupported
+}
+
+// Reconstruct implements fecCodec, the shards received are padded as for
+// leopard-gf16, which the parity shards already are
+func (c leopardCodec) Reconstruct(shards [][]byte) error {
+	if err := padShards(shards); err != nil {
+		return err
+	}
+	return c.enc.Reconstruct(shards)
+}
+
+// encodeGroup computes the parity of a group closed by outputTask at once,
+// the data shards missing from a group closed early being zero, and
+// returns the length of the parity shards, the longest data shard padded
+// to leopardShardAlign
+func (c leopardCodec) encodeGroup(data, parity [][]byte) (int, error) {
+	sc := getScratch(c.dataShards + len(parity))
+	defer putScratch(sc)
+	shards := sc.shards
+	size := 0
+	for _, shard := range data {
+		if len(shard) > size {
+			size = len(shard)
+		}
+	}
+	size = (size + leopardShardAlign - 1) / leopardShardAlign * leopardShardAlign
+	for k := range shards {
+		switch {
+		case k < len(data):
+			shards[k] = data[k]
+		case k < c.dataShards:
+			shards[k] = leopardZeros[:size]
+		case cap(parity[k-c.dataShards]) < size:
+			return 0, errShardSize
+		default:
+			shards[k] = parity[k-c.dataShards][:size]
+		}
+	}
+	if err := c.Encode(shards); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// Encode implements fecCodec, the last shard is the parity
+func (xorCodec) Encode(shards [][]byte) error {
+	parity := shards[len(shards)-1]
+	copy(parity, shards[0])
+	for _, shard := range shards[1 : len(shards)-1] {
+		if len(shard) != len(parity) {
+			return errShardSize
+		}
+		xorBytes(parity, parity, shard)
+	}
+	return nil
+}
+
+// EncodeIdx implements fecCodec, xor-ing a data shard into the parity
+func (xorCodec) EncodeIdx(dataShard []byte, idx int, parity [][]byte) error {
+	if len(parity) != 1 || len(parity[0]) != len(dataShard) {
+		return errShardSize
+	}
+	xorBytes(parity[0], parity[0], dataShard)
+	return nil
+}
+
+// Reconstruct implements fecCodec, at most 1 shard can be recovered,
+// the capacity of the missing shard is reused if possible.
+func (xorCodec) Reconstruct(shards [][]byte) error {
+	lost := -1
+	size := 0
+	for k := range shards {
+		if len(shards[k]) == 0 {
+			if lost != -1 {
+				return errTooFewShards
+			}
+			lost = k
+		} else {
+			size = len(shards[k])
+		}
+	}
+	if lost == -1 {
 		return nil
 	}
-	return data[fec.dataShards:]
+
+	recovered := shards[lost]
+	if cap(recovered) >= size {
+		recovered = recovered[:size]
+		xorBytes(recovered, recovered, recovered)
+	} else {
+		recovered = make([]byte, size)
+	}
+	for k := range shards {
+		if k != lost {
+			if len(shards[k]) != size {
+				return errShardSize
+			}
+			xorBytes(recovered, recovered, shards[k])
+		}
+	}
+	shards[lost] = recovered
+	return nil
 }
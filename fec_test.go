@@ -1,43 +1,48 @@
 package kcp
 
 import (
+	"bytes"
 	"encoding/binary"
 	"math/rand"
+	"net"
+	"sync"
 	"testing"
+
+	"github.com/xtaci/kcp-go/netsim"
 )
 
 func TestFECOther(t *testing.T) {
-	if newFEC(128, 0, 1) != nil {
+	if _, err := newFEC(128, 0, 1); err != errFECParams {
 		t.Fail()
 	}
-	if newFEC(128, 0, 0) != nil {
+	if _, err := newFEC(128, 0, 0); err != errFECParams {
 		t.Fail()
 	}
-	if newFEC(1, 10, 10) != nil {
+	if _, err := newFEC(1, 10, 10); err != errFECParams {
 		t.Fail()
 	}
 }
 
 func TestFECNoLost(t *testing.T) {
-	fec := newFEC(128, 10, 3)
+	fec, _ := newFEC(128, 10, 3)
 	for i := 0; i < 100; i += 10 {
 		data := makefecgroup(i, 13)
-		for k := range data[fec.dataShards] {
+		for k := range data[:fec.dataShards] {
 			fec.markData(data[k])
 			t.Log("input:", data[k])
 		}
 
-		ecc := fec.calcECC(data, fecHeaderSize, fecHeaderSize+4)
+		ecc, _ := fec.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4)
 		for k := range ecc {
 			fec.markFEC(ecc[k])
 		}
 		t.Log("  ecc:", ecc)
 		data = append(data, ecc...)
 		for k := range data {
-			f := fec.decode(data[k])
-			if recovered := fec.input(f); recovered != nil {
+			f := mustDecode(t, fec, data[k])
+			if recovered, _ := fec.input(f); recovered != nil {
 				for k := range recovered {
-					t.Log("recovered:", binary.LittleEndian.Uint32(recovered[k]))
+					t.Log("recovered:", shardID(recovered[k]))
 				}
 			}
 		}
@@ -45,16 +50,16 @@ func TestFECNoLost(t *testing.T) {
 }
 
 func TestFECLost1(t *testing.T) {
-	fec := newFEC(128, 10, 3)
+	fec, _ := newFEC(128, 10, 3)
 	println(fec.paws, fec.paws%13)
 	fec.next = fec.paws - 13
 	for i := 0; i < 100; i += 10 {
 		data := makefecgroup(i, 13)
-		for k := range data[fec.dataShards] {
+		for k := range data[:fec.dataShards] {
 			fec.markData(data[k])
 			t.Log("input:", data[k])
 		}
-		ecc := fec.calcECC(data, fecHeaderSize, fecHeaderSize+4)
+		ecc, _ := fec.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4)
 		for k := range ecc {
 			fec.markFEC(ecc[k])
 		}
@@ -63,10 +68,10 @@ func TestFECLost1(t *testing.T) {
 		t.Log("lost:", data[lost])
 		for k := range data {
 			if k != lost {
-				f := fec.decode(data[k])
-				if recovered := fec.input(f); recovered != nil {
+				f := mustDecode(t, fec, data[k])
+				if recovered, _ := fec.input(f); recovered != nil {
 					for i := range recovered {
-						t.Log("recovered:", binary.LittleEndian.Uint32(recovered[i]))
+						t.Log("recovered:", shardID(recovered[i]))
 					}
 				}
 			}
@@ -75,14 +80,14 @@ func TestFECLost1(t *testing.T) {
 }
 
 func TestFECLost2(t *testing.T) {
-	fec := newFEC(128, 10, 3)
+	fec, _ := newFEC(128, 10, 3)
 	for i := 0; i < 100; i += 10 {
 		data := makefecgroup(i, 13)
-		for k := range data[fec.dataShards] {
+		for k := range data[:fec.dataShards] {
 			fec.markData(data[k])
 			t.Log("input:", data[k])
 		}
-		ecc := fec.calcECC(data, fecHeaderSize, fecHeaderSize+4)
+		ecc, _ := fec.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4)
 		for k := range ecc {
 			fec.markFEC(ecc[k])
 		}
@@ -92,10 +97,10 @@ func TestFECLost2(t *testing.T) {
 		t.Log(" lost2:", data[lost2])
 		for k := range data {
 			if k != lost1 && k != lost2 {
-				f := fec.decode(data[k])
-				if recovered := fec.input(f); recovered != nil {
+				f := mustDecode(t, fec, data[k])
+				if recovered, _ := fec.input(f); recovered != nil {
 					for i := range recovered {
-						t.Log("recovered:", binary.LittleEndian.Uint32(recovered[i]))
+						t.Log("recovered:", shardID(recovered[i]))
 					}
 				}
 			}
@@ -103,11 +108,1058 @@ func TestFECLost2(t *testing.T) {
 	}
 }
 
+// shardID returns the number a shard made by makefecgroup carries
+func shardID(shard []byte) uint32 {
+	return binary.LittleEndian.Uint32(shard[2:])
+}
+
+// mustDecode decodes a packet built by the tests, which must be well-formed
+func mustDecode(t testing.TB, fec *FEC, data []byte) fecPacket {
+	pkt, err := fec.decode(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkt
+}
+
 func makefecgroup(start, size int) (group [][]byte) {
 	for i := 0; i < size; i++ {
-		data := make([]byte, fecHeaderSize+4)
-		binary.LittleEndian.PutUint32(data[fecHeaderSize:], uint32(start+i))
+		data := make([]byte, fecHeaderSizePlus2+4)
+		binary.LittleEndian.PutUint16(data[fecHeaderSize:], 6)
+		binary.LittleEndian.PutUint32(data[fecHeaderSizePlus2:], uint32(start+i))
 		group = append(group, data)
 	}
 	return
 }
+
+func TestFECInputError(t *testing.T) {
+	rx, _ := newFEC(16, 10, 3)
+	data := makefecgroup(0, 1)[0]
+	rx.markData(data)
+	data[7] = 20 // 20+3 shards exceed rxlimit
+	if _, err := rx.input(mustDecode(t, rx, data)); err != errFECParams {
+		t.Fatal("expected errFECParams, got", err)
+	}
+	data[7] = 0
+	if _, err := rx.input(mustDecode(t, rx, data)); err != errFECParams {
+		t.Fatal("expected errFECParams, got", err)
+	}
+}
+
+func TestFECVersion(t *testing.T) {
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(128, 10, 3)
+	data := makefecgroup(0, 1)[0]
+	tx.markData(data)
+	if data[5] != fecVersion<<4|fecMinVersion {
+		t.Fatal("unexpected version byte", data[5])
+	}
+	if _, err := rx.input(mustDecode(t, rx, data)); err != nil {
+		t.Fatal(err)
+	}
+	if rx.peerVersion != fecVersion || rx.txVersion != fecVersion {
+		t.Fatal("negotiation failed", rx.peerVersion, rx.txVersion)
+	}
+
+	// a header from a newer build
+	data = makefecgroup(1, 1)[0]
+	tx.markData(data)
+	data[5] = (fecVersion+1)<<4 | (fecVersion + 1)
+	if _, err := rx.input(mustDecode(t, rx, data)); err != errFECVersion {
+		t.Fatal("expected errFECVersion, got", err)
+	}
+	// a header without version
+	data[5] = 0
+	if _, err := rx.input(mustDecode(t, rx, data)); err != errFECVersion {
+		t.Fatal("expected errFECVersion, got", err)
+	}
+	if rx.stats.BadVersions != 2 {
+		t.Fatal("bad versions not counted", rx.stats.BadVersions)
+	}
+}
+
+func TestFECEncodeIdx(t *testing.T) {
+	for _, codec := range []int{FECCodecReedSolomon, FECCodecXOR} {
+		parityShards := 3
+		if codec == FECCodecXOR {
+			parityShards = 1
+		}
+		fec, _ := newFEC(128, 10, 3)
+		if err := fec.setParameters(10, parityShards, codec); err != nil {
+			t.Fatal(err)
+		}
+
+		// data shards of different sizes
+		data := makefecgroup(0, fec.shardSize)
+		maxlen := 0
+		for k := range data[:fec.dataShards] {
+			data[k] = append(data[k], make([]byte, rand.Intn(100))...)
+			if len(data[k]) > maxlen {
+				maxlen = len(data[k])
+			}
+		}
+		parity := make([][]byte, fec.parityShards)
+		for k := range parity {
+			parity[k] = make([]byte, mtuLimit)
+			parity[k][0] = 0xff // cleared by the first data shard
+		}
+		for k := range data[:fec.dataShards] {
+			if err := fec.encodeIdx(data[k], k, parity, fecHeaderSize); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for k := range data {
+			shard := make([]byte, maxlen)
+			copy(shard, data[k])
+			data[k] = shard
+		}
+		ecc, err := fec.calcECC(data, fecHeaderSize, maxlen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k := range ecc {
+			if !bytes.Equal(ecc[k][fecHeaderSize:], parity[k][fecHeaderSize:maxlen]) {
+				t.Fatal("parity mismatch", codec, k)
+			}
+			if parity[k][0] != 0 {
+				t.Fatal("parity not cleared", codec, k)
+			}
+		}
+	}
+}
+
+func TestFECNoFEC(t *testing.T) {
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(128, 10, 3)
+	data := makefecgroup(0, 1)[0]
+	tx.markNoFEC(data)
+	if tx.next != 0 {
+		t.Fatal("seqid taken by a packet outside of groups")
+	}
+	pkt := mustDecode(t, rx, data)
+	if pkt.flag != typeNoFEC {
+		t.Fatal("unexpected flag", pkt.flag)
+	}
+	if err := rx.inputNoFEC(pkt); err != nil {
+		t.Fatal(err)
+	}
+	if rx.rxCount != 0 {
+		t.Fatal("packet queued for recovery")
+	}
+}
+
+func TestFECDecodeMalformed(t *testing.T) {
+	rx, _ := newFEC(128, 10, 3)
+	data := makefecgroup(0, 1)[0]
+	rx.markData(data)
+	for _, bad := range [][]byte{nil, data[:4], data[:fecHeaderSizePlus2-1]} {
+		if _, err := rx.decode(bad); err != errFECPacket {
+			t.Fatal("expected errFECPacket, got", err)
+		}
+	}
+	data[4] = 0
+	if _, err := rx.decode(data); err != errFECPacket {
+		t.Fatal("expected errFECPacket, got", err)
+	}
+	if rx.stats.MalformedShards != 4 {
+		t.Fatal("malformed packets not counted", rx.stats.MalformedShards)
+	}
+}
+
+func TestFECDecodeInto(t *testing.T) {
+	rx, _ := newFEC(128, 10, 3)
+	data := makefecgroup(0, 1)[0]
+	rx.markData(data)
+	var pkt fecPacket
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := rx.decodeInto(data, &pkt); err != nil {
+			t.Fatal(err)
+		}
+		rx.putShard(pkt.data)
+	})
+	if allocs != 0 {
+		t.Fatal("decodeInto allocates", allocs)
+	}
+	if pkt.flag != typeData || shardID(pkt.data) != 0 || len(pkt.data) != 6 {
+		t.Fatalf("%+v", pkt)
+	}
+	if rx.decodeInto(data[:4], &pkt) != errFECPacket || pkt.flag != typeData {
+		t.Fatal("malformed packet decoded")
+	}
+}
+
+func TestFECMixedSizes(t *testing.T) {
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(128, 10, 3)
+	for i := 0; i < 10; i++ {
+		data := make([][]byte, tx.shardSize)
+		maxlen := 0
+		for k := range data[:tx.dataShards] {
+			data[k] = make([]byte, fecHeaderSizePlus2+1+rand.Intn(1000))
+			binary.LittleEndian.PutUint16(data[k][fecHeaderSize:], uint16(len(data[k])-fecHeaderSize))
+			rand.Read(data[k][fecHeaderSizePlus2:])
+			tx.markData(data[k])
+			if len(data[k]) > maxlen {
+				maxlen = len(data[k])
+			}
+		}
+		parity := make([][]byte, tx.parityShards)
+		for k := range parity {
+			parity[k] = make([]byte, mtuLimit)
+		}
+		for k := range data[:tx.dataShards] {
+			if err := tx.encodeIdx(data[k], k, parity, fecHeaderSize); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for k := range parity {
+			data[tx.dataShards+k] = parity[k][:maxlen]
+			tx.markFEC(data[tx.dataShards+k])
+		}
+
+		lost1, lost2 := rand.Intn(10), rand.Intn(10)
+		var recovered [][]byte
+		for k := range data {
+			if k != lost1 && k != lost2 {
+				shards, err := rx.input(mustDecode(t, rx, data[k]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				recovered = append(recovered, shards...)
+			}
+		}
+		lost := []int{lost1, lost2}
+		if lost1 > lost2 {
+			lost = []int{lost2, lost1}
+		} else if lost1 == lost2 {
+			lost = lost[:1]
+		}
+		if len(recovered) != len(lost) {
+			t.Fatal("recovery failed", len(recovered))
+		}
+		for k := range lost {
+			if !bytes.Equal(recovered[k], data[lost[k]][fecHeaderSize:]) {
+				t.Fatal("shard not recovered to its true length", len(recovered[k]), len(data[lost[k]][fecHeaderSize:]))
+			}
+		}
+	}
+}
+
+func TestIsFECPacket(t *testing.T) {
+	tx, _ := newFEC(128, 10, 3)
+	data := makefecgroup(0, 1)[0]
+	tx.markData(data)
+	if !isFECPacket(data) {
+		t.Fatal("fec packet not detected")
+	}
+	seg := Segment{conv: 1, cmd: IKCP_CMD_PUSH}
+	raw := make([]byte, IKCP_OVERHEAD)
+	seg.encode(raw)
+	if isFECPacket(raw) {
+		t.Fatal("plain kcp packet detected as fec")
+	}
+}
+
+func TestFECParameters(t *testing.T) {
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(128, 10, 3)
+	send := func(start, lost int) (nrecovered int) {
+		data := makefecgroup(start, tx.shardSize)
+		for k := range data[:tx.dataShards] {
+			tx.markData(data[k])
+		}
+		ecc, _ := tx.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4)
+		for k := range ecc {
+			tx.markFEC(ecc[k])
+		}
+		for k := range data {
+			if k != lost {
+				recovered, err := rx.input(mustDecode(t, rx, data[k]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				nrecovered += len(recovered)
+			}
+		}
+		return
+	}
+
+	if send(0, 1) != 1 {
+		t.Fatal("recovery failed with initial geometry")
+	}
+	if tx.setParameters(5, 2, FECCodecReedSolomon) != nil {
+		t.Fatal("setParameters failed")
+	}
+	if tx.next%uint32(tx.shardSize) != 0 {
+		t.Fatal("next seqid not aligned to group size", tx.next)
+	}
+	for i := 0; i < 10; i++ {
+		if send(i*10, i%5) != 1 {
+			t.Fatal("recovery failed with new geometry")
+		}
+	}
+	if _, ok := rx.rxCodecs[codecKey{FECCodecReedSolomon, 5, 2}]; !ok {
+		t.Fatal("geometry not detected", rx.rxCodecs)
+	}
+}
+
+func TestFECGeometryReorder(t *testing.T) {
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(128, 10, 3)
+	group := func(start, lost int) (packets [][]byte) {
+		data := makefecgroup(start, tx.shardSize)
+		for k := range data[:tx.dataShards] {
+			tx.markData(data[k])
+		}
+		ecc, _ := tx.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4)
+		for k := range ecc {
+			tx.markFEC(ecc[k])
+		}
+		return append(data[:lost:lost], data[lost+1:]...)
+	}
+
+	var recovered [][]byte
+	input := func(packets [][]byte) {
+		for _, data := range packets {
+			shards, err := rx.input(mustDecode(t, rx, data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			recovered = append(recovered, shards...)
+		}
+	}
+
+	// the shards of the groups on both sides of each geometry change
+	// arrive interleaved
+	geometries := [][2]int{{5, 2}, {10, 3}, {4, 1}, {10, 3}}
+	before := group(0, 0)
+	for i, geometry := range geometries {
+		if err := tx.setParameters(geometry[0], geometry[1], FECCodecReedSolomon); err != nil {
+			t.Fatal(err)
+		}
+		after := group((i+1)*100, 1)
+		half := len(before) / 2
+		input(before[:half])
+		input(after[:2])
+		input(before[half:])
+		before = after[2:]
+	}
+	input(before)
+
+	if len(recovered) != len(geometries)+1 {
+		t.Fatal("groups dropped across geometry changes", len(recovered), rx.stats)
+	}
+	ids := make(map[uint32]bool)
+	for _, shard := range recovered {
+		ids[shardID(shard)] = true
+	}
+	for i := range geometries {
+		if !ids[0] || !ids[uint32(i+1)*100+1] {
+			t.Fatal("unexpected shards recovered", ids)
+		}
+	}
+	if rx.stats.GroupsUnrecoverable != 0 || rx.rxCount != 0 {
+		t.Fatal("groups not completed", rx.stats, rx.rxCount)
+	}
+}
+
+func TestFECXOR(t *testing.T) {
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(128, 10, 3)
+	if tx.setParameters(10, 1, FECCodecXOR) != nil {
+		t.Fatal("setParameters failed")
+	}
+	if tx.setParameters(10, 2, FECCodecXOR) == nil {
+		t.Fatal("xor codec accepted 2 parity shards")
+	}
+	for i := 0; i < 100; i += 10 {
+		data := makefecgroup(i, 11)
+		for k := range data[:tx.dataShards] {
+			tx.markData(data[k])
+		}
+		ecc, _ := tx.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4)
+		for k := range ecc {
+			tx.markFEC(ecc[k])
+		}
+		lost := rand.Intn(10)
+		var recovered [][]byte
+		for k := range data {
+			if k != lost {
+				shards, err := rx.input(mustDecode(t, rx, data[k]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				recovered = append(recovered, shards...)
+			}
+		}
+		if len(recovered) != 1 || shardID(recovered[0]) != uint32(i+lost) {
+			t.Fatal("xor recovery failed", lost, len(recovered))
+		}
+	}
+}
+
+func TestFECLeopard(t *testing.T) {
+	tx, _ := newFEC(256, 10, 3)
+	rx, _ := newFEC(256, 10, 3)
+	if err := tx.setParameters(60, 20, FECCodecLeopard); err != nil {
+		t.Fatal(err)
+	}
+	lc, ok := tx.encoder().(leopardCodec)
+	if !ok {
+		t.Fatal("not a leopard codec")
+	}
+
+	// a full group, then one closed early after 30 data shards, shards of
+	// sizes which aren't multiples of 64 bytes, coded as parityTask does
+	for _, filled := range []int{60, 30} {
+		var packets, shards [][]byte
+		for k := 0; k < filled; k++ {
+			pkt := make([]byte, fecHeaderSize, mtuLimit)
+			tx.markData(pkt)
+			shard := make([]byte, 2+100+k, mtuLimit)
+			binary.LittleEndian.PutUint16(shard, uint16(len(shard)))
+			for b := range shard[2:] {
+				shard[2+b] = byte(k + b)
+			}
+			packets = append(packets, append(pkt, shard...))
+			shards = append(shards, shard)
+		}
+		if filled < tx.dataShards {
+			tx.skip(tx.dataShards - filled)
+		}
+		parity := make([][]byte, tx.parityShards)
+		for k := range parity {
+			parity[k] = make([]byte, 0, mtuLimit)
+		}
+		size, err := lc.encodeGroup(shards, parity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size%leopardShardAlign != 0 {
+			t.Fatal("parity not padded", size)
+		}
+		for k := range parity {
+			pkt := make([]byte, fecHeaderSize, mtuLimit)
+			if filled < tx.dataShards {
+				tx.markPartialFEC(pkt, filled)
+			} else {
+				tx.markFEC(pkt)
+			}
+			if pkt[4] != typeFECLeopard {
+				t.Fatal("unexpected parity flag", pkt[4])
+			}
+			packets = append(packets, append(pkt, parity[k][:size]...))
+		}
+
+		// lose the first 20 data shards
+		var recovered [][]byte
+		for _, pkt := range packets[20:] {
+			shards, err := rx.input(mustDecode(t, rx, pkt))
+			if err != nil {
+				t.Fatal(err)
+			}
+			recovered = append(recovered, shards...)
+		}
+		if len(recovered) != 20 {
+			t.Fatal("leopard recovery failed", filled, len(recovered))
+		}
+		for k := range recovered {
+			if !bytes.Equal(recovered[k], packets[k][fecHeaderSize:]) {
+				t.Fatal("wrong shard recovered", filled, k)
+			}
+		}
+	}
+}
+
+// fountainPacket returns the packet of repair symbol r of the data
+// packets, behind the fec header hdr
+func fountainPacket(codec *fountainCodec, data [][]byte, hdr []byte, r int) []byte {
+	shards := make([][]byte, len(data))
+	maxlen := 0
+	for k := range data {
+		shards[k] = data[k][fecHeaderSize:]
+		if len(shards[k]) > maxlen {
+			maxlen = len(shards[k])
+		}
+	}
+	pkt := make([]byte, fecHeaderSize+fountainIndexSize+maxlen)
+	copy(pkt, hdr)
+	binary.LittleEndian.PutUint16(pkt[fecHeaderSize:], uint16(r))
+	codec.Repair(shards, r, pkt[fecHeaderSize+fountainIndexSize:])
+	return pkt
+}
+
+func TestFECFountain(t *testing.T) {
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(128, 10, 3)
+	if err := tx.setParameters(10, 4, FECCodecFountain); err != nil {
+		t.Fatal(err)
+	}
+	codec := tx.encoder().(*fountainCodec)
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		data := makefecgroup(i*14, 10)
+		for k := range data {
+			tx.markData(data[k])
+		}
+		var ecc [][]byte
+		for r := 0; r < tx.parityShards; r++ {
+			hdr := make([]byte, fecHeaderSize)
+			tx.markFEC(hdr)
+			ecc = append(ecc, fountainPacket(codec, data, hdr, r))
+		}
+		if ecc[0][4] != typeFECFountain {
+			t.Fatal("unexpected flag", ecc[0][4])
+		}
+
+		// the code isn't MDS, a few patterns of as many lost data shards as
+		// repair symbols can't be decoded, with one symbol to spare all can.
+		// Odd groups lose more data shards than the group has parity
+		// shards, the repair symbols sent on demand make up for them.
+		lose := tx.parityShards - 1
+		if i%2 == 1 {
+			lose = tx.parityShards + 2
+			for r := tx.parityShards; r < lose+1; r++ {
+				ecc = append(ecc, fountainPacket(codec, data, ecc[0], r))
+			}
+		}
+		lost := rng.Perm(tx.dataShards)[:lose]
+		var recovered [][]byte
+		for k, pkt := range append(data, ecc...) {
+			drop := false
+			for _, l := range lost {
+				drop = drop || k == l
+			}
+			if !drop {
+				shards, err := rx.input(mustDecode(t, rx, pkt))
+				if err != nil {
+					t.Fatal(err)
+				}
+				recovered = append(recovered, shards...)
+			}
+		}
+		if len(recovered) != len(lost) {
+			t.Fatal("group", i, "lost", lost, "recovered", len(recovered), rx.stats)
+		}
+		for _, shard := range recovered {
+			if id := shardID(shard); id < uint32(i*14) || id >= uint32(i*14+10) {
+				t.Fatal("bad recovery", id)
+			}
+		}
+	}
+	if rx.rxCount != 0 {
+		t.Fatal("shards left queued", rx.rxCount)
+	}
+}
+
+func TestFountainCodecRepair(t *testing.T) {
+	const dataShards, parityShards = 10, 30
+	codec, _ := newFountainCodec(dataShards, parityShards)
+	shards := make([][]byte, dataShards+parityShards)
+	for k := range shards {
+		shards[k] = make([]byte, 100)
+		if k < dataShards {
+			rand.Read(shards[k])
+		}
+	}
+	if err := codec.Encode(shards); err != nil {
+		t.Fatal(err)
+	}
+	// repair symbols don't depend on the geometry, so a smaller codec
+	// generates the later ones on demand
+	small, _ := newFountainCodec(dataShards, 1)
+	extra := make([]byte, 100)
+	small.(*fountainCodec).Repair(shards[:dataShards], parityShards-1, extra)
+	if !bytes.Equal(extra, shards[len(shards)-1]) {
+		t.Fatal("repair symbol mismatch")
+	}
+
+	// all the data shards lost, decoded from later repair symbols
+	orig := make([][]byte, len(shards))
+	for k := range shards {
+		orig[k] = append([]byte(nil), shards[k]...)
+	}
+	for k := 0; k < dataShards+parityShards/2; k++ {
+		shards[k] = shards[k][:0]
+	}
+	if err := codec.Reconstruct(shards); err != nil {
+		t.Fatal(err)
+	}
+	for k := range shards {
+		if !bytes.Equal(shards[k], orig[k]) {
+			t.Fatal("shard", k, "not reconstructed")
+		}
+	}
+	for k := 0; k < parityShards+1; k++ {
+		shards[k] = shards[k][:0]
+	}
+	if codec.Reconstruct(shards) != errTooFewShards {
+		t.Fatal("reconstructed from too few shards")
+	}
+}
+
+func TestFECPartialGroup(t *testing.T) {
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(128, 10, 3)
+	for i := 0; i < 100; i += 10 {
+		// only 2 data shards sent before the flush timer expires
+		data := makefecgroup(i, 13)
+		for k := range data[2:tx.dataShards] {
+			data[2+k] = make([]byte, fecHeaderSizePlus2+4)
+		}
+		for k := range data[:2] {
+			tx.markData(data[k])
+		}
+		tx.skip(tx.dataShards - 2)
+		ecc, _ := tx.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4)
+		for k := range ecc {
+			tx.markPartialFEC(ecc[k], 2)
+		}
+
+		lost := rand.Intn(2)
+		var recovered [][]byte
+		for k := range data {
+			if k != lost && (k < 2 || k >= tx.dataShards) {
+				shards, err := rx.input(mustDecode(t, rx, data[k]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				recovered = append(recovered, shards...)
+			}
+		}
+		if len(recovered) != 1 || shardID(recovered[0]) != uint32(i+lost) {
+			t.Fatal("partial group recovery failed", lost, len(recovered))
+		}
+		if rx.rxCount != 0 {
+			t.Fatal("partial group not freed", rx.rxCount)
+		}
+	}
+}
+
+func TestFECPaws(t *testing.T) {
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(20, 10, 3)
+	tx.next = tx.paws - uint32(tx.shardSize)
+	var groups [][][]byte
+	for i := 0; i < 3; i++ {
+		data := makefecgroup(i*tx.shardSize, tx.shardSize)
+		for k := range data[:tx.dataShards] {
+			tx.markData(data[k])
+		}
+		ecc, _ := tx.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4)
+		for k := range ecc {
+			tx.markFEC(ecc[k])
+		}
+		groups = append(groups, data)
+	}
+	if mustDecode(t, rx, groups[1][0]).seqid != 0 {
+		t.Fatal("seqid did not wrap")
+	}
+
+	var recovered [][]byte
+	feed := func(data []byte) {
+		shards, err := rx.input(mustDecode(t, rx, data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		recovered = append(recovered, shards...)
+	}
+
+	// the group before the wrap can't complete and must be evicted
+	// before the groups after the wrap
+	for k := 1; k < 10; k++ {
+		feed(groups[0][k])
+	}
+	// the groups after the wrap arrive interleaved
+	for k := 1; k < tx.shardSize; k++ {
+		feed(groups[2][k])
+		feed(groups[1][k])
+	}
+	if len(recovered) != 2 {
+		t.Fatal("recovery across the wrap failed", len(recovered))
+	}
+	for k, start := range []uint32{uint32(2 * tx.shardSize), uint32(tx.shardSize)} {
+		if shardID(recovered[k]) != start {
+			t.Fatal("wrong shard recovered", k, shardID(recovered[k]))
+		}
+	}
+}
+
+func TestFECStats(t *testing.T) {
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(16, 10, 3)
+	send := func(start int, lost map[int]bool, dup bool) {
+		data := makefecgroup(start, 13)
+		for k := range data[:tx.dataShards] {
+			tx.markData(data[k])
+		}
+		ecc, _ := tx.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4)
+		for k := range ecc {
+			tx.markFEC(ecc[k])
+		}
+		for k := range data {
+			if !lost[k] {
+				rx.input(mustDecode(t, rx, data[k]))
+				if dup {
+					rx.input(mustDecode(t, rx, data[k]))
+				}
+			}
+		}
+	}
+
+	send(0, map[int]bool{3: true}, false)
+	if rx.stats.GroupsRecovered != 1 || rx.stats.ShardsReceived != 12 {
+		t.Fatalf("%+v", rx.stats)
+	}
+	// 2 late parity shards of the previous group, 16 shards after the group finished
+	send(10, nil, true)
+	if rx.stats.DuplicateShards != 18 {
+		t.Fatalf("%+v", rx.stats)
+	}
+	// 9 shards queued per group, rxlimit evicts all groups but the newest
+	lost4 := map[int]bool{1: true, 2: true, 3: true, 4: true}
+	for i := 20; i < 60; i += 10 {
+		send(i, lost4, false)
+	}
+	if rx.stats.GroupsUnrecoverable != 3 || rx.rxCount != 9 {
+		t.Fatalf("%+v", rx.stats)
+	}
+}
+
+func TestFECRxExpire(t *testing.T) {
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(128, 10, 3)
+	rx.setRxExpire(100)
+	data := makefecgroup(0, 13)
+	for k := range data[:tx.dataShards] {
+		tx.markData(data[k])
+	}
+
+	// a group whose shards stopped arriving long ago
+	for k := 0; k < 5; k++ {
+		pkt := mustDecode(t, rx, data[k])
+		pkt.ts -= 1000
+		rx.input(pkt)
+	}
+	if rx.rxCount != 5 {
+		t.Fatal("shards not queued", rx.rxCount)
+	}
+	data = makefecgroup(10, 13)
+	for k := range data[:tx.dataShards] {
+		tx.markData(data[k])
+	}
+	rx.input(mustDecode(t, rx, data[0]))
+	if rx.rxCount != 1 || rx.stats.GroupsUnrecoverable != 1 {
+		t.Fatalf("stale group not expired %v %+v", rx.rxCount, rx.stats)
+	}
+
+	// the fresh group is expired once the age shrinks below its own
+	rx.rxTail.ts -= 50
+	rx.setRxExpire(10)
+	if rx.rxCount != 0 || rx.stats.GroupsUnrecoverable != 2 {
+		t.Fatalf("group not expired %v %+v", rx.rxCount, rx.stats)
+	}
+}
+
+func TestFECRxByteLimit(t *testing.T) {
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(128, 10, 3)
+	rx.rxByteLimit = 15 * mtuLimit
+	var recovered [][]byte
+	send := func(lost map[int]bool) {
+		data := makefecgroup(0, 13)
+		for k := range data[:tx.dataShards] {
+			tx.markData(data[k])
+		}
+		ecc, _ := tx.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4)
+		for k := range ecc {
+			tx.markFEC(ecc[k])
+		}
+		for k := range data {
+			if !lost[k] {
+				shards, _ := rx.input(mustDecode(t, rx, data[k]))
+				recovered = append(recovered, shards...)
+			}
+		}
+	}
+
+	// the stale group is evicted as a whole, the newest one recovers
+	send(map[int]bool{1: true, 2: true, 3: true, 4: true})
+	send(map[int]bool{0: true})
+	if rx.stats.GroupsUnrecoverable != 1 || len(recovered) != 1 {
+		t.Fatalf("%+v", rx.stats)
+	}
+	if rx.rxCount != 0 || rx.rxBytes != 0 {
+		t.Fatal("rx queue not freed", rx.rxCount, rx.rxBytes)
+	}
+}
+
+func TestFECSharedCodecs(t *testing.T) {
+	codecs := newCodecCache()
+	tx, _ := newSharedFEC(128, 10, 3, codecs)
+	rx, _ := newSharedFEC(128, 10, 3, codecs)
+	if tx.enc != rx.enc {
+		t.Fatal("codec not shared")
+	}
+	if err := tx.setParameters(5, 2, FECCodecReedSolomon); err != nil {
+		t.Fatal(err)
+	}
+	if tx.enc == rx.enc || len(codecs.codecs) != 2 {
+		t.Fatal("geometry not keyed", len(codecs.codecs))
+	}
+	if err := tx.setParameters(10, 3, FECCodecReedSolomon); err != nil {
+		t.Fatal(err)
+	}
+
+	data := makefecgroup(0, 13)
+	for k := range data[:tx.dataShards] {
+		tx.markData(data[k])
+	}
+	ecc, _ := tx.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4)
+	for k := range ecc {
+		tx.markFEC(ecc[k])
+	}
+	var recovered [][]byte
+	for k := range data {
+		if k != 0 {
+			shards, _ := rx.input(mustDecode(t, rx, data[k]))
+			recovered = append(recovered, shards...)
+		}
+	}
+	if len(recovered) != 1 || shardID(recovered[0]) != 0 {
+		t.Fatal("recovery failed", recovered)
+	}
+	if rx.rxCodecs[codecKey{FECCodecReedSolomon, 10, 3}] != tx.enc {
+		t.Fatal("codec of incoming groups not shared")
+	}
+}
+
+func TestFECConcurrent(t *testing.T) {
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(1024, 10, 3)
+	const groups = 200
+	var packets [][]byte
+	for i := 0; i < groups; i++ {
+		data := makefecgroup(i*10, 13)
+		for k := range data[:tx.dataShards] {
+			tx.markData(data[k])
+		}
+		for k := range data[tx.dataShards:] {
+			tx.markFEC(data[tx.dataShards+k])
+		}
+		packets = append(packets, data[1:]...) // data shard 0 of each group is lost
+	}
+
+	// parity is encoded, then shards are decoded by several goroutines at once
+	const par = 4
+	parallel := func(f func(p int)) {
+		var wg sync.WaitGroup
+		wg.Add(par)
+		for p := 0; p < par; p++ {
+			go func(p int) {
+				defer wg.Done()
+				f(p)
+			}(p)
+		}
+		wg.Wait()
+	}
+	parallel(func(p int) {
+		for i := p; i < groups; i += par {
+			data := append([][]byte{makefecgroup(i*10, 1)[0]}, packets[i*12:i*12+12]...)
+			if _, err := tx.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4); err != nil {
+				t.Error(err)
+			}
+		}
+	})
+	var mu sync.Mutex
+	recovered := make(map[uint32]bool)
+	parallel(func(p int) {
+		for i := p; i < groups; i += par {
+			for _, packet := range packets[i*12 : i*12+12] {
+				shards, err := rx.input(mustDecode(t, rx, packet))
+				if err != nil {
+					t.Error(err)
+				}
+				mu.Lock()
+				for _, shard := range shards {
+					recovered[shardID(shard)] = true
+				}
+				mu.Unlock()
+			}
+		}
+	})
+
+	if len(recovered) != groups {
+		t.Fatal("recovered", len(recovered), "of", groups, rx.snapshot())
+	}
+	for i := 0; i < groups; i++ {
+		if !recovered[uint32(i*10)] {
+			t.Fatal("group not recovered", i)
+		}
+	}
+}
+
+// fecSink is a PacketConn feeding the packets written to it to a FEC
+type fecSink struct {
+	net.PacketConn
+	t         *testing.T
+	rx        *FEC
+	received  map[uint32]bool
+	recovered int
+}
+
+func (s *fecSink) WriteTo(b []byte, addr net.Addr) (int, error) {
+	pkt := mustDecode(s.t, s.rx, b)
+	if pkt.flag == typeData {
+		s.received[shardID(pkt.data)] = true
+	}
+	shards, _ := s.rx.input(pkt)
+	for _, shard := range shards {
+		s.received[shardID(shard)] = true
+		s.recovered++
+	}
+	return len(b), nil
+}
+
+func TestFECGilbertElliott(t *testing.T) {
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(128, 10, 3)
+	sink := &fecSink{t: t, rx: rx, received: make(map[uint32]bool)}
+	conn := netsim.New(sink, netsim.Config{P: 0.02, R: 0.5, LossGood: 0.01, LossBad: 0.5, Seed: 1})
+	const N = 10000
+	for i := 0; i < N; i += 10 {
+		data := makefecgroup(i, 13)
+		for k := range data[:tx.dataShards] {
+			tx.markData(data[k])
+		}
+		ecc, _ := tx.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4)
+		for k := range ecc {
+			tx.markFEC(ecc[k])
+		}
+		for k := range data {
+			conn.WriteTo(data[k], nil)
+		}
+	}
+
+	// most of the data shards lost in bursts are recovered
+	stats := conn.Stats()
+	missing := N - len(sink.received)
+	t.Logf("lost: %v recovered: %v missing: %v", stats.Lost, sink.recovered, missing)
+	if stats.Bursts == 0 || sink.recovered == 0 || missing*5 > int(stats.Lost) {
+		t.Fatalf("%+v %+v", stats, rx.stats)
+	}
+}
+
+func BenchmarkFECDecode(b *testing.B) {
+	rx, _ := newFEC(128, 10, 3)
+	data := makefecgroup(0, 1)[0]
+	rx.markData(data)
+	var pkt fecPacket
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rx.decodeInto(data, &pkt)
+		rx.putShard(pkt.data)
+	}
+}
+
+func BenchmarkFECInput(b *testing.B) {
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(128, 10, 3)
+	data := makefecgroup(0, 13)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for k := range data[:tx.dataShards] {
+			tx.markData(data[k])
+		}
+		ecc, _ := tx.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4)
+		for k := range ecc {
+			tx.markFEC(ecc[k])
+		}
+		for k := range data {
+			if k != i%10 {
+				shards, _ := rx.input(mustDecode(b, rx, data[k]))
+				for _, shard := range shards {
+					rx.putShard(shard)
+				}
+			}
+		}
+	}
+}
+
+// BenchmarkFECInputReordered feeds groups behind a deep queue of incomplete
+// groups received ahead of them, like a burst reordered on the path.
+func BenchmarkFECInputReordered(b *testing.B) {
+	ahead, _ := newFEC(8192, 10, 3)
+	tx, _ := newFEC(8192, 10, 3)
+	rx, _ := newFEC(8192, 10, 3)
+	ahead.next = 1 << 20
+	data := makefecgroup(0, 13)
+	for i := 0; i < 600; i++ {
+		for k := range data[:ahead.dataShards] {
+			ahead.markData(data[k])
+		}
+		ecc, _ := ahead.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4)
+		for k := range ecc {
+			ahead.markFEC(ecc[k])
+		}
+		for k := range data[:6] {
+			rx.input(mustDecode(b, rx, data[k]))
+		}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for k := range data[:tx.dataShards] {
+			tx.markData(data[k])
+		}
+		ecc, _ := tx.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4)
+		for k := range ecc {
+			tx.markFEC(ecc[k])
+		}
+		for k := range data {
+			if k != i%10 {
+				shards, _ := rx.input(mustDecode(b, rx, data[k]))
+				for _, shard := range shards {
+					rx.putShard(shard)
+				}
+			}
+		}
+	}
+}
+
+func FuzzFECInput(f *testing.F) {
+	tx, _ := newFEC(128, 10, 3)
+	data := makefecgroup(0, 13)
+	for k := range data[:tx.dataShards] {
+		tx.markData(data[k])
+	}
+	ecc, _ := tx.calcECC(data, fecHeaderSize, fecHeaderSizePlus2+4)
+	for k := range ecc {
+		tx.markPartialFEC(ecc[k], 3)
+	}
+	for k := range data {
+		f.Add(data[k])
+	}
+	f.Add([]byte{})
+	f.Add(data[0][:fecHeaderSize])
+
+	rx, _ := newFEC(128, 10, 3)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		pkt, err := rx.decode(data)
+		if err != nil {
+			return
+		}
+		if pkt.flag == typeNoFEC {
+			rx.inputNoFEC(pkt)
+			return
+		}
+		shards, _ := rx.input(pkt)
+		for _, shard := range shards {
+			rx.putShard(shard)
+		}
+	})
+}
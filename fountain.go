@@ -0,0 +1,241 @@
+package kcp
+
+// fountainCodec implements fecCodec with a random linear fountain code over
+// GF(2^8). Repair symbol r is the sum of the data shards weighted by
+// coefficients derived from r alone, so a sender can generate as many repair
+// symbols as a link needs, and any dataShards symbols of a group decode it
+// with high probability. Unlike Reed-Solomon it isn't MDS, a group now and
+// then needs one symbol more than its lost data shards. The symbols are sent
+// behind their index, those of index parityShards and above are generated
+// on demand, see SendFECRepair.
+type fountainCodec struct {
+	dataShards   int
+	parityShards int
+}
+
+var (
+	gfExp [510]byte // generator powers, doubled to skip the modulo in gfMul
+	gfLog [256]byte
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+// gfMulAdd adds c * src to dst
+func gfMulAdd(dst, src []byte, c byte) {
+	switch c {
+	case 0:
+	case 1:
+		xorBytes(dst, dst, src)
+	default:
+		t := &gfMul[c]
+		for i, b := range src {
+			dst[i] ^= t[b]
+		}
+	}
+}
+
+// gfScale multiplies dst by c
+func gfScale(dst []byte, c byte) {
+	t := &gfMul[c]
+	for i, b := range dst {
+		dst[i] = t[b]
+	}
+}
+
+// fountainCoef returns the weight of data shard j in repair symbol r, the
+// first repair symbol is the plain xor of the data shards.
+func fountainCoef(r, j int) byte {
+	if r == 0 {
+		return 1
+	}
+	h := (uint32(r)<<16 | uint32(j)) * 0x9e3779b1
+	h ^= h >> 15
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	if c := byte(h >> 24); c != 0 {
+		return c
+	}
+	return 1
+}
+
+func newFountainCodec(dataShards, parityShards int) (fecCodec, error) {
+	if dataShards <= 0 || parityShards <= 0 {
+		return nil, errFECParams
+	}
+	return &fountainCodec{dataShards, parityShards}, nil
+}
+
+// Repair computes repair symbol r of the data shards into out, r isn't
+// bounded by parityShards. The data shards shorter than out are padded with
+// zeros, those missing from a group closed early are zero.
+func (c *fountainCodec) Repair(data [][]byte, r int, out []byte) error {
+	xorBytes(out, out, out)
+	for j, shard := range data {
+		if len(shard) > len(out) {
+			return errShardSize
+		}
+		gfMulAdd(out[:len(shard)], shard, fountainCoef(r, j))
+	}
+	return nil
+}
+
+// Encode implements fecCodec, the shards after dataShards are the repair symbols
+func (c *fountainCodec) Encode(shards [][]byte) error {
+	if len(shards) != c.dataShards+c.parityShards {
+		return errTooFewShards
+	}
+	for r := 0; r < c.parityShards; r++ {
+		if err := c.Repair(shards[:c.dataShards], r, shards[c.dataShards+r]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EncodeIdx implements fecCodec, adding the weighted data shard into the parity
+func (c *fountainCodec) EncodeIdx(dataShard []byte, idx int, parity [][]byte) error {
+	if len(parity) != c.parityShards {
+		return errTooFewShards
+	}
+	for r := range parity {
+		if len(parity[r]) != len(dataShard) {
+			return errShardSize
+		}
+		gfMulAdd(parity[r], dataShard, fountainCoef(r, idx))
+	}
+	return nil
+}
+
+// Reconstruct implements fecCodec. Every repair symbol received, once the
+// known data shards are subtracted from it, is an equation over the lost
+// data shards, which are solved for by gaussian elimination.
+func (c *fountainCodec) Reconstruct(shards [][]byte) error {
+	return c.reconstructWith(shards, nil, nil)
+}
+
+// reconstructWith is Reconstruct with the repair symbols extra of the
+// indices idx too, those of index parityShards and above, which have no
+// slot in shards.
+func (c *fountainCodec) reconstructWith(shards, extra [][]byte, idx []int) error {
+	if len(shards) != c.dataShards+c.parityShards {
+		return errTooFewShards
+	}
+	size := 0
+	var lost []int
+	for k := range shards {
+		if len(shards[k]) != 0 {
+			if size != 0 && len(shards[k]) != size {
+				return errShardSize
+			}
+			size = len(shards[k])
+		} else if k < c.dataShards {
+			lost = append(lost, k)
+		}
+	}
+	for _, symbol := range extra {
+		if size != 0 && len(symbol) != size {
+			return errShardSize
+		}
+		size = len(symbol)
+	}
+
+	if len(lost) > 0 {
+		var rows, values [][]byte
+		for n := 0; n < c.parityShards+len(extra); n++ {
+			r, symbol := n, []byte(nil)
+			if n < c.parityShards {
+				symbol = shards[c.dataShards+n]
+			} else {
+				r, symbol = idx[n-c.parityShards], extra[n-c.parityShards]
+			}
+			if len(symbol) == 0 {
+				continue
+			}
+			value := make([]byte, size)
+			copy(value, symbol)
+			for j := 0; j < c.dataShards; j++ {
+				if len(shards[j]) != 0 {
+					gfMulAdd(value, shards[j], fountainCoef(r, j))
+				}
+			}
+			row := make([]byte, len(lost))
+			for i, j := range lost {
+				row[i] = fountainCoef(r, j)
+			}
+			rows = append(rows, row)
+			values = append(values, value)
+		}
+		if len(rows) < len(lost) {
+			return errTooFewShards
+		}
+
+		for col := range lost {
+			pivot := col
+			for pivot < len(rows) && rows[pivot][col] == 0 {
+				pivot++
+			}
+			if pivot == len(rows) {
+				return errTooFewShards
+			}
+			rows[col], rows[pivot] = rows[pivot], rows[col]
+			values[col], values[pivot] = values[pivot], values[col]
+			inv := gfInv(rows[col][col])
+			gfScale(rows[col], inv)
+			gfScale(values[col], inv)
+			for i := range rows {
+				if f := rows[i][col]; i != col && f != 0 {
+					gfMulAdd(rows[i], rows[col], f)
+					gfMulAdd(values[i], values[col], f)
+				}
+			}
+		}
+
+		for i, j := range lost {
+			shard := shards[j]
+			if cap(shard) >= size {
+				shard = shard[:size]
+			} else {
+				shard = make([]byte, size)
+			}
+			copy(shard, values[i])
+			shards[j] = shard
+		}
+	}
+
+	// the lost repair symbols are generated again
+	for r := 0; r < c.parityShards; r++ {
+		if shard := shards[c.dataShards+r]; len(shard) == 0 {
+			if cap(shard) >= size {
+				shard = shard[:size]
+			} else {
+				shard = make([]byte, size)
+			}
+			if err := c.Repair(shards[:c.dataShards], r, shard); err != nil {
+				return err
+			}
+			shards[c.dataShards+r] = shard
+		}
+	}
+	return nil
+}
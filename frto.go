@@ -0,0 +1,85 @@
+package kcp
+
+// SetFRTO detects the spurious timeouts of the session, as F-RTO does in
+// RFC 5682, so that a delay spike of a cellular link doesn't cost a
+// collapse of the window and the retransmission of everything in flight.
+// Once the rto fires, only the first segment expired is sent again, the
+// others sent before wait. If the acks which follow are those of two
+// original transmissions, told apart from the one sent again by the ts
+// they echo, the timeout was spurious: the congestion control is restored
+// if it's a LossUndoer, as the builtin ones are, and the segments waiting
+// are given a new rto. Otherwise they're sent again at once.
+func (s *UDPSession) SetFRTO(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.SetFRTO(enabled)
+}
+
+// SetFRTO enables the detection of the spurious timeouts, see
+// UDPSession.SetFRTO.
+func (kcp *KCP) SetFRTO(enabled bool) {
+	if !enabled && kcp.frto_state != 0 {
+		kcp.frto_end(false)
+	}
+	kcp.frto = enabled
+}
+
+// frto_holds tells if the expired seg waits for F-RTO to tell if the
+// timeout was spurious, sent before it fired
+func (kcp *KCP) frto_holds(seg *Segment) bool {
+	return kcp.frto_state != 0 && _itimediff(seg.ts, kcp.frto_ts) < 0
+}
+
+// frto_timeout handles the timeout of seg, which flush sends again, and
+// tells if the congestion control reacts to it: not if seg is one of the
+// segments of a timeout already reacted to
+func (kcp *KCP) frto_timeout(seg *Segment) bool {
+	if !kcp.frto {
+		return true
+	}
+	if kcp.frto_state != 0 { // the segment sent again expired too
+		kcp.frto_end(false)
+		return true
+	}
+	if kcp.frto_rexmit != 0 && _itimediff(seg.ts, kcp.frto_rexmit) < 0 {
+		return false
+	}
+	kcp.frto_state, kcp.frto_ts = 1, kcp.current
+	return true
+}
+
+// frto_ack handles the ack of a segment sent at ts while the outcome of a
+// timeout is unknown
+func (kcp *KCP) frto_ack(ts uint32) {
+	switch {
+	case _itimediff(ts, kcp.frto_ts) >= 0: // the segment sent again arrived
+		kcp.frto_end(false)
+	case kcp.frto_state == 1:
+		kcp.frto_state = 2
+	default:
+		kcp.frto_end(true)
+	}
+}
+
+// frto_end ends the wait of the segments held since the timeout, undoing
+// the timeout if spurious, sending them again otherwise
+func (kcp *KCP) frto_end(spurious bool) {
+	for k := range kcp.snd_buf {
+		seg := &kcp.snd_buf[k]
+		if kcp.frto_holds(seg) {
+			if spurious {
+				seg.resendts = kcp.current + seg.rto
+			} else {
+				seg.resendts = kcp.current
+			}
+		}
+	}
+	kcp.frto_state = 0
+	if !spurious {
+		kcp.frto_rexmit = kcp.frto_ts
+		return
+	}
+	if u, ok := kcp.cc.(LossUndoer); ok {
+		u.UndoLoss()
+	}
+}
@@ -0,0 +1,416 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+type (
+	// sessionState is the state of a session moved to another process by
+	// Export and Import, gob encoded
+	sessionState struct {
+		Remote           string
+		Header           []byte // clear header of a SessionCrypt or ConvCrypt session
+		Layers           uint32
+		TxEpoch, RxEpoch uint32
+		SealKey, OpenKey []byte // keys of a noise session
+		Salt             []byte // of the nonces sealed, then their counter
+		Counter          uint64
+		Replay           *replayState // window of the nonces of the remote
+
+		DataShards, ParityShards, Codec int
+		FECNext                         uint32
+
+		Established, ConvPending, ConvAssigned bool
+		RdClosed, WrClosed, RdEOF              bool
+		AckNoDelay                             bool
+		Sockbuff                               []byte
+		BytesSent, BytesReceived               uint64
+
+		KCP kcpState
+	}
+
+	// kcpState is the state of the kcp of a session, the timers aside
+	kcpState struct {
+		Conv, Mtu, State                        uint32
+		SndUna, SndNxt, RcvNxt                  uint32
+		TsRecent, TsLastack, Ssthresh           uint32
+		RxRttval, RxSrtt, RxRto, RxMinrto       uint32
+		SndWnd, RcvWnd, RmtWnd, Cwnd            uint32
+		Interval, Xmit, Nodelay, DeadLink, Incr uint32
+		Fastresend, Nocwnd, Stream              int32
+		RxMaxrto, MinrtoSet                     uint32
+		RtoBackoff                              float64
+		SndCont, Rack, Sack, SackPeer, Frto     bool
+		SndQueue, RcvQueue, SndBuf, RcvBuf      []segmentState
+		Acklist                                 []uint32
+	}
+
+	// segmentState is a kcp segment
+	segmentState struct {
+		Conv, Cmd, Frg, Wnd, Ts, Sn, Una uint32
+		Resendts, Rto, Fastack, Xmit     uint32
+		Prio                             int32
+		Data                             []byte
+	}
+)
+
+// Export closes the session and returns its state, conv, crypt header, kcp
+// sequence numbers, windows, rtt estimators and queued data, for a
+// restarting process to hand the session over to its successor, which
+// resumes it with Listener.Import or ImportConn without the remote noticing.
+// The socket is handed over by the application, as a file descriptor sent
+// over a unix socket: a dialer dups it with File before the export, as
+// Export closes it, a listener is closed before its sessions are exported,
+// so that it doesn't open new sessions for their packets. The successor
+// holds the crypt the session was dialed or accepted with, the state
+// carries the nonces sealed and the replay window of the remote under it,
+// and the keys of the sessions keyed by a noise handshake, which must be
+// kept as secret as the keys. The options of the session, such as its
+// deadlines, events and packet shaping, are set again on the imported
+// session.
+func (s *UDPSession) Export() ([]byte, error) {
+	if err := s.close(false); err != nil {
+		return nil, err
+	}
+
+	// the packets received from now on are dropped, none is acknowledged
+	// out of the state
+	s.mu.Lock()
+	s.exported = true
+	st := sessionState{
+		Remote:        s.RemoteAddr().String(),
+		Layers:        atomic.LoadUint32(&s.layers),
+		TxEpoch:       atomic.LoadUint32(&s.epoch.tx),
+		RxEpoch:       atomic.LoadUint32(&s.epoch.rx),
+		DataShards:    s.fecTx.dataShards,
+		ParityShards:  s.fecTx.parityShards,
+		Codec:         s.fecTx.codec,
+		Established:   s.established,
+		ConvPending:   s.convPending,
+		ConvAssigned:  s.convAssigned,
+		RdClosed:      s.rdClosed,
+		WrClosed:      s.wrClosed,
+		RdEOF:         s.rdEOF,
+		AckNoDelay:    s.ackNoDelay,
+		Sockbuff:      s.sockbuff,
+		BytesSent:     atomic.LoadUint64(&s.bytesSent),
+		BytesReceived: atomic.LoadUint64(&s.bytesReceived),
+		KCP:           exportKCP(s.kcp),
+	}
+	if sc, ok := s.block.(*sessionCrypt); ok {
+		st.Header = sc.header
+	}
+	if c, ok := s.block.(*aeadCrypt); ok { // keyed by a noise handshake
+		st.SealKey, st.OpenKey = c.sealKey, c.openKey
+	}
+	if c := nonceMoverOf(s.block, st.TxEpoch); c != nil {
+		st.Salt, st.Counter = c.NonceState()
+	}
+	if c := nonceMoverOf(s.block, st.RxEpoch); c != nil {
+		if salt, ok := s.rxSalt.Load().([]byte); ok {
+			st.Replay = c.replay(salt)
+		}
+	}
+	if s.fec != nil {
+		s.fec.txMu.Lock()
+		st.FECNext = s.fec.next
+		s.fec.txMu.Unlock()
+	}
+	s.mu.Unlock()
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&st); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Import resumes a session of the listener exported by Export in another
+// process, block is the crypt of the listener there. The session isn't
+// queued for Accept.
+func (l *Listener) Import(state []byte, block BlockCrypt) (*UDPSession, error) {
+	st, remote, err := decodeState(state)
+	if err != nil {
+		return nil, err
+	}
+	if block, err = importCrypt(st, block); err != nil {
+		return nil, err
+	}
+	fec, err := importFEC(st, l.codecs)
+	if err != nil {
+		return nil, err
+	}
+	s := newUDPSession(st.KCP.Conv, fec, l, l.conn, remote, block)
+	s.handshaken = st.SealKey != nil
+	s.restore(st)
+	if !l.admin(func() {
+		l.sessions[remote.String()] = s
+		if l.convs[s.GetConv()] == nil {
+			l.convs[s.GetConv()] = s
+		}
+	}) {
+		s.Close()
+		return nil, errBrokenPipe
+	}
+	return s, nil
+}
+
+// ImportConn resumes a dialed session exported by Export in another process
+// over conn, its socket handed over, block is the crypt it was dialed with.
+// The session owns conn, which it closes with itself.
+func ImportConn(state []byte, block BlockCrypt, conn net.PacketConn) (*UDPSession, error) {
+	st, remote, err := decodeState(state)
+	if err != nil {
+		return nil, err
+	}
+	if block, err = importCrypt(st, block); err != nil {
+		return nil, err
+	}
+	fec, err := importFEC(st, nil)
+	if err != nil {
+		return nil, err
+	}
+	s := newUDPSession(st.KCP.Conv, fec, nil, conn, remote, block)
+	s.handshaken = st.SealKey != nil
+	s.restore(st)
+	return s, nil
+}
+
+// decodeState decodes the state of an exported session and its remote
+func decodeState(state []byte) (*sessionState, net.Addr, error) {
+	st := new(sessionState)
+	if err := gob.NewDecoder(bytes.NewReader(state)).Decode(st); err != nil {
+		return nil, nil, err
+	}
+	remote, err := net.ResolveUDPAddr("udp", st.Remote)
+	if err != nil {
+		return nil, nil, err
+	}
+	if st.KCP.Mtu < 50 || st.KCP.Mtu > mtuLimit {
+		return nil, nil, errExport
+	}
+	return st, remote, nil
+}
+
+// importCrypt returns the crypt of an exported session from the crypt it
+// was dialed or accepted with, or from the keys of its noise handshake, and
+// restores the nonces sealed and received under it
+func importCrypt(st *sessionState, block BlockCrypt) (BlockCrypt, error) {
+	switch c := block.(type) {
+	case *SessionCrypt:
+		if len(st.Header) != sessionHeaderSize {
+			return nil, errExport
+		}
+		sc, err := c.derive(st.Header)
+		if err != nil {
+			return nil, err
+		}
+		block = sc
+	case *ConvCrypt:
+		block = c.session()
+	}
+	if st.SealKey != nil {
+		c := new(aeadCrypt)
+		if err := c.init(chacha20poly1305.New, st.SealKey, st.OpenKey); err != nil {
+			return nil, errExport
+		}
+		block = c
+	}
+	if c := nonceMoverOf(block, st.TxEpoch); c != nil && len(st.Salt) == aeadSaltSize {
+		c.restoreNonce(st.Salt, st.Counter)
+	}
+	if c := nonceMoverOf(block, st.RxEpoch); c != nil && st.Replay != nil {
+		c.restoreReplay(st.Replay)
+	}
+	return block, nil
+}
+
+// nonceMoverOf returns the crypt sealing the nonces of block in an epoch, nil
+// if block keeps no nonces
+func nonceMoverOf(block BlockCrypt, epoch uint32) nonceMover {
+	switch c := block.(type) {
+	case *EpochCrypt:
+		bc, err := c.crypt(epoch)
+		if err != nil {
+			return nil
+		}
+		return nonceMoverOf(bc, epoch)
+	case *sessionCrypt:
+		return nonceMoverOf(c.block, epoch)
+	case *HeaderCrypt:
+		return nonceMoverOf(c.block, epoch)
+	case nonceMover:
+		return c
+	}
+	return nil
+}
+
+// nonceSalt returns the salt of the nonce of a packet opened in place by
+// block, nil if block keeps no nonces
+func nonceSalt(block BlockCrypt, packet []byte) []byte {
+	switch c := block.(type) {
+	case *EpochCrypt:
+		if len(packet) < epochSize || !c.cached(binary.LittleEndian.Uint32(packet)) {
+			return nil
+		}
+		bc, _ := c.crypt(binary.LittleEndian.Uint32(packet))
+		return nonceSalt(bc, packet[epochSize:])
+	case *sessionCrypt:
+		if len(packet) < len(c.header) {
+			return nil
+		}
+		return nonceSalt(c.block, packet[len(c.header):])
+	case *HeaderCrypt:
+		return nonceSalt(c.block, packet)
+	case nonceMover:
+		if len(packet) < aeadSaltSize {
+			return nil
+		}
+		return packet[:aeadSaltSize]
+	}
+	return nil
+}
+
+// rxOpened tells if the session accepts a packet opened in place, as
+// rxEpoch, and keeps the salt of the nonces of the remote for Export. It is
+// called by the goroutine receiving the packets of the session.
+func (s *UDPSession) rxOpened(packet []byte) bool {
+	if !s.rxEpoch(packet) {
+		return false
+	}
+	if salt := nonceSalt(s.block, packet); salt != nil {
+		if last, _ := s.rxSalt.Load().([]byte); !bytes.Equal(last, salt) {
+			s.rxSalt.Store(append([]byte(nil), salt...))
+		}
+	}
+	return true
+}
+
+// importFEC returns the fec of an exported session, its groups following
+// the last one sent
+func importFEC(st *sessionState, codecs *codecCache) (*FEC, error) {
+	if st.DataShards == 0 {
+		return nil, nil
+	}
+	fec, err := newSharedFEC(rxFecLimit, st.DataShards, st.ParityShards, codecs)
+	if err != nil {
+		return nil, err
+	}
+	fec.next = st.FECNext
+	if err := fec.setParameters(st.DataShards, st.ParityShards, st.Codec); err != nil {
+		return nil, err
+	}
+	return fec, nil
+}
+
+// restore sets the state of a new session to the exported st
+func (s *UDPSession) restore(st *sessionState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	atomic.StoreUint32(&s.layers, st.Layers)
+	atomic.StoreUint32(&s.epoch.tx, st.TxEpoch)
+	atomic.StoreUint32(&s.epoch.rx, st.RxEpoch)
+	if s.fec != nil {
+		s.fecTx.parityShards = st.ParityShards
+		s.fecTx.codec = st.Codec
+	}
+	s.established = st.Established
+	if s.established {
+		s.cookieTags.finish()
+	}
+	s.convPending = st.ConvPending
+	s.convAssigned = st.ConvAssigned
+	s.rdClosed = st.RdClosed
+	s.wrClosed = st.WrClosed
+	s.rdEOF = st.RdEOF
+	s.ackNoDelay = st.AckNoDelay
+	s.sockbuff = st.Sockbuff
+	atomic.StoreUint64(&s.bytesSent, st.BytesSent)
+	atomic.StoreUint64(&s.bytesReceived, st.BytesReceived)
+	importKCP(s.kcp, &st.KCP)
+	atomic.StoreInt32(&s.mtu, int32(s.kcp.mtu))
+	s.wakeUpdate()
+}
+
+// exportKCP returns the state of kcp
+func exportKCP(kcp *KCP) kcpState {
+	return kcpState{
+		Conv: atomic.LoadUint32(&kcp.conv), Mtu: kcp.mtu, State: kcp.state,
+		SndUna: kcp.snd_una, SndNxt: kcp.snd_nxt, RcvNxt: kcp.rcv_nxt,
+		TsRecent: kcp.ts_recent, TsLastack: kcp.ts_lastack, Ssthresh: kcp.ssthresh,
+		RxRttval: kcp.rx_rttval, RxSrtt: kcp.rx_srtt, RxRto: kcp.rx_rto, RxMinrto: kcp.rx_minrto,
+		SndWnd: kcp.snd_wnd, RcvWnd: kcp.rcv_wnd, RmtWnd: kcp.rmt_wnd, Cwnd: kcp.cwnd,
+		Interval: kcp.interval, Xmit: kcp.xmit, Nodelay: kcp.nodelay, DeadLink: kcp.dead_link, Incr: kcp.incr,
+		Fastresend: kcp.fastresend, Nocwnd: kcp.nocwnd, Stream: kcp.stream,
+		RxMaxrto: kcp.rx_maxrto, MinrtoSet: kcp.minrto_set, RtoBackoff: kcp.rto_backoff, Rack: kcp.rack,
+		Sack: kcp.sack, SackPeer: kcp.sack_peer, Frto: kcp.frto,
+		SndCont:  kcp.snd_cont,
+		SndQueue: exportSegments(kcp.snd_queue),
+		RcvQueue: exportSegments(kcp.rcv_queue),
+		SndBuf:   exportSegments(kcp.snd_buf),
+		RcvBuf:   exportSegments(kcp.rcv_buf),
+		Acklist:  kcp.acklist,
+	}
+}
+
+// importKCP sets the state of kcp to st, the timers restart
+func importKCP(kcp *KCP, st *kcpState) {
+	atomic.StoreUint32(&kcp.conv, st.Conv)
+	kcp.mtu, kcp.mss = st.Mtu, st.Mtu-IKCP_OVERHEAD
+	if size := int(st.Mtu+IKCP_OVERHEAD) * 3; size > len(kcp.buffer) {
+		kcp.buffer = make([]byte, size)
+	}
+	kcp.state = st.State
+	kcp.snd_una, kcp.snd_nxt, kcp.rcv_nxt = st.SndUna, st.SndNxt, st.RcvNxt
+	kcp.ts_recent, kcp.ts_lastack, kcp.ssthresh = st.TsRecent, st.TsLastack, st.Ssthresh
+	kcp.rx_rttval, kcp.rx_srtt, kcp.rx_rto, kcp.rx_minrto = st.RxRttval, st.RxSrtt, st.RxRto, st.RxMinrto
+	kcp.snd_wnd, kcp.rcv_wnd, kcp.rmt_wnd, kcp.cwnd = st.SndWnd, st.RcvWnd, st.RmtWnd, st.Cwnd
+	kcp.interval, kcp.xmit, kcp.nodelay, kcp.dead_link, kcp.incr = st.Interval, st.Xmit, st.Nodelay, st.DeadLink, st.Incr
+	kcp.fastresend, kcp.nocwnd, kcp.stream = st.Fastresend, st.Nocwnd, st.Stream
+	if st.RxMaxrto != 0 { // exported before the ceiling was configurable
+		kcp.rx_maxrto, kcp.minrto_set, kcp.rto_backoff = st.RxMaxrto, st.MinrtoSet, st.RtoBackoff
+	}
+	kcp.snd_cont, kcp.rack = st.SndCont, st.Rack
+	kcp.sack, kcp.sack_peer, kcp.frto = st.Sack, st.SackPeer, st.Frto
+	kcp.snd_queue = importSegments(st.SndQueue)
+	kcp.rcv_queue = importSegments(st.RcvQueue)
+	kcp.snd_buf = importSegments(st.SndBuf)
+	kcp.rcv_buf = importSegments(st.RcvBuf)
+	kcp.acklist = st.Acklist
+}
+
+// exportSegments returns the state of segs
+func exportSegments(segs []Segment) []segmentState {
+	states := make([]segmentState, len(segs))
+	for k := range segs {
+		seg := &segs[k]
+		states[k] = segmentState{
+			Conv: seg.conv, Cmd: seg.cmd, Frg: seg.frg, Wnd: seg.wnd, Ts: seg.ts, Sn: seg.sn, Una: seg.una,
+			Resendts: seg.resendts, Rto: seg.rto, Fastack: seg.fastack, Xmit: seg.xmit,
+			Prio: seg.prio,
+			Data: seg.data,
+		}
+	}
+	return states
+}
+
+// importSegments returns the segments of states
+func importSegments(states []segmentState) []Segment {
+	segs := make([]Segment, len(states))
+	for k := range states {
+		st := &states[k]
+		segs[k] = Segment{
+			conv: st.Conv, cmd: st.Cmd, frg: st.Frg, wnd: st.Wnd, ts: st.Ts, sn: st.Sn, una: st.Una,
+			resendts: st.Resendts, rto: st.Rto, fastack: st.Fastack, xmit: st.Xmit,
+			prio: st.Prio,
+			data: st.Data,
+		}
+	}
+	return segs
+}
@@ -0,0 +1,101 @@
+package kcp
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	headerSampleSize = aes.BlockSize // ciphertext sampled for the mask
+	headerKeySize    = 16            // AES-128 header protection key
+	headerPacketKey  = 32            // size of the key derived for the packets
+	// bytes after the crypt header masked, enough to cover the padding, fec,
+	// span and kcp headers
+	headerProtectSize = paddingHeaderSize + fecHeaderSizePlus2 + spanHeaderSize + IKCP_OVERHEAD
+)
+
+// HeaderCrypt implements BlockCrypt with header protection in the manner of
+// QUIC: the packets are sealed by the crypt registered by name, then the
+// bytes the crypt leaves readable in front of the payload, such as the
+// nonce counters of AEADs and the fec and kcp headers of HMAC-SHA256, are
+// masked with AES-CTR under a header key, seeded by the last 16 bytes of the
+// crypt header. On-path observers thus see neither the conv, sn and seqid of
+// the packets nor gaps in the nonces sent. The keys of the packets and the
+// headers are derived from the key with HKDF. The crypt must have a header of
+// at least 16 bytes, which all the builtin crypts have. The fec headers sent
+// in the clear by EncryptThenFEC stay readable.
+type HeaderCrypt struct {
+	block    BlockCrypt
+	hp       cipher.Block
+	overhead int
+}
+
+// NewHeaderCrypt initiates HeaderCrypt over the crypt registered as name,
+// with the key the packet and header keys are derived from
+func NewHeaderCrypt(name string, key []byte) (BlockCrypt, error) {
+	packetKey := make([]byte, headerPacketKey)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("kcp-go packet")), packetKey); err != nil {
+		return nil, err
+	}
+	headerKey := make([]byte, headerKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, nil, []byte("kcp-go header")), headerKey); err != nil {
+		return nil, err
+	}
+	bc, err := NewCryptByName(name, packetKey)
+	if err != nil {
+		return nil, err
+	}
+	c := &HeaderCrypt{block: bc, overhead: cryptOverhead(bc)}
+	if c.overhead < headerSampleSize {
+		return nil, errHeaderSample
+	}
+	if c.hp, err = aes.NewCipher(headerKey); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// mask xors the header mask over a sealed packet, masking twice restores
+// the packet as the sample is left untouched
+func (c *HeaderCrypt) mask(packet []byte) {
+	if len(packet) < c.overhead {
+		return
+	}
+	sample := c.overhead - headerSampleSize
+	end := c.overhead + headerProtectSize
+	if end > len(packet) {
+		end = len(packet)
+	}
+
+	var counter, stream [aes.BlockSize]byte
+	copy(counter[:], packet[sample:c.overhead])
+	k := 0
+	for _, region := range [2][2]int{{0, sample}, {c.overhead, end}} {
+		for i := region[0]; i < region[1]; i++ {
+			if k%aes.BlockSize == 0 {
+				c.hp.Encrypt(stream[:], counter[:])
+				binary.BigEndian.PutUint32(counter[12:], binary.BigEndian.Uint32(counter[12:])+1)
+			}
+			packet[i] ^= stream[k%aes.BlockSize]
+			k++
+		}
+	}
+}
+
+// Encrypt implements Encrypt interface
+func (c *HeaderCrypt) Encrypt(dst, src []byte) {
+	c.block.Encrypt(dst, src)
+	c.mask(dst)
+}
+
+// Decrypt implements Decrypt interface
+func (c *HeaderCrypt) Decrypt(dst, src []byte) {
+	copy(dst, src)
+	c.mask(dst)
+	c.block.Decrypt(dst, dst)
+}
@@ -0,0 +1,44 @@
+package kcp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// idleReaper closes the sessions of a listener which received nothing for a
+// while
+type idleReaper struct {
+	timeout time.Duration
+	evicted func(s *UDPSession)
+}
+
+// SetIdleTimeout makes the listener close the sessions which received no
+// packet for timeout, so that the sessions of remotes which disappeared
+// without closing don't pile up. evicted, if not nil, is called with each
+// session closed this way, by the goroutine of the listener, it must not
+// block. The sessions are checked every 10ms. 0 disables the timeout
+// (default).
+func (l *Listener) SetIdleTimeout(timeout time.Duration, evicted func(s *UDPSession)) {
+	var r *idleReaper
+	if timeout > 0 {
+		r = &idleReaper{timeout: timeout, evicted: evicted}
+	}
+	l.idle.Store(r)
+}
+
+// reapIdle closes the idle sessions, they leave the session map through
+// chDeadlinks like the sessions closed by the application
+func (l *Listener) reapIdle(now time.Time) {
+	r, _ := l.idle.Load().(*idleReaper)
+	if r == nil {
+		return
+	}
+	for _, s := range l.sessions {
+		if s.Paused() || now.Sub(time.Unix(0, atomic.LoadInt64(&s.lastInput))) < r.timeout {
+			continue
+		}
+		if s.close(false) == nil && r.evicted != nil {
+			r.evicted(s)
+		}
+	}
+}
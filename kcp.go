@@ -4,6 +4,7 @@ package kcp
 import (
 	"encoding/binary"
 	"sync/atomic"
+	"time"
 )
 
 const (
@@ -15,6 +16,7 @@ const (
 	IKCP_CMD_ACK     = 82 // cmd: ack
 	IKCP_CMD_WASK    = 83 // cmd: window probe (ask)
 	IKCP_CMD_WINS    = 84 // cmd: window size (tell)
+	IKCP_CMD_SACK    = 85 // cmd: ack of ranges, see SetSACK
 	IKCP_ASK_SEND    = 1  // need to send IKCP_CMD_WASK
 	IKCP_ASK_TELL    = 2  // need to send IKCP_CMD_WINS
 	IKCP_WND_SND     = 32
@@ -106,6 +108,7 @@ type Segment struct {
 	rto      uint32
 	fastack  uint32
 	xmit     uint32
+	prio     int32 // priority of the write, the higher ones leave snd_queue first
 	data     []byte
 }
 
@@ -122,6 +125,21 @@ func (seg *Segment) encode(ptr []byte) []byte {
 	return ptr
 }
 
+// hasPush reports whether an encoded kcp packet carries a data segment
+func hasPush(data []byte) bool {
+	for len(data) >= IKCP_OVERHEAD {
+		length := binary.LittleEndian.Uint32(data[20:])
+		if uint32(len(data)-IKCP_OVERHEAD) < length {
+			return false
+		}
+		if data[4] == IKCP_CMD_PUSH {
+			return true
+		}
+		data = data[IKCP_OVERHEAD+length:]
+	}
+	return false
+}
+
 // NewSegment creates a KCP segment
 func NewSegment(size int) *Segment {
 	seg := new(Segment)
@@ -153,6 +171,37 @@ type KCP struct {
 	nocwnd, stream int32
 	logmask        int32
 	output         Output
+	rexmit         bool // the packet being output carries retransmitted segments
+	snd_cont       bool // snd_queue starts with the rest of a message partly in snd_buf
+
+	cc          CongestionControl // decides cwnd, renoControl by default
+	pace_rate   int64             // bytes per second SetPacing spreads the segments at, without a pacing rate of cc
+	pace_credit int64             // bytes the pacing lets flush send
+	ts_pace     uint32            // when pace_credit was replenished
+	ts_pace_due uint32            // when the pacing lets flush send the segments held back, 0 if none is
+
+	rx_maxrto   uint32  // ceiling of rx_rto
+	minrto_set  uint32  // floor of rx_rto set by SetRTO, 0 for the one of nodelay
+	rto_backoff float64 // growth of the rto of a retransmission set by SetRTO, 0 for the one of nodelay
+
+	rack        bool   // detect losses by RACK instead of duplicate acks, see SetRACK
+	rack_tlp    bool   // a tail loss probe awaits an ack
+	rack_ts     uint32 // when the latest segment known delivered was sent
+	rack_sn     uint32 // sn of that segment, orders the ones sent within a millisecond
+	rack_rtt    uint32 // rtt of that segment
+	rack_minrtt uint32 // lowest rtt seen, scales the reordering window
+
+	sack       bool   // acknowledge by ranges once the remote can, see SetSACK
+	sack_peer  bool   // the remote advertised the capability
+	sack_acked bool   // a SACK arrived, the remote knows the capability
+	ts_sack    uint32 // when the capability is advertised again
+
+	dead_sn, dead_xmit uint32 // segment which reached dead_link, and its transmissions
+
+	frto        bool   // detect the spurious timeouts by F-RTO, see SetFRTO
+	frto_state  uint8  // 1 once the rto fired, 2 once an original transmission was acked since
+	frto_ts     uint32 // when the rto fired
+	frto_rexmit uint32 // frto_ts of the latest timeout found genuine
 }
 
 // NewKCP create a new kcp control object, 'conv' must equal in two endpoint
@@ -168,11 +217,13 @@ func NewKCP(conv uint32, output Output) *KCP {
 	kcp.buffer = make([]byte, (kcp.mtu+IKCP_OVERHEAD)*3)
 	kcp.rx_rto = IKCP_RTO_DEF
 	kcp.rx_minrto = IKCP_RTO_MIN
+	kcp.rx_maxrto = IKCP_RTO_MAX
 	kcp.interval = IKCP_INTERVAL
 	kcp.ts_flush = IKCP_INTERVAL
 	kcp.ssthresh = IKCP_THRESH_INIT
 	kcp.dead_link = IKCP_DEADLINK
 	kcp.output = output
+	kcp.cc = &renoControl{kcp: kcp}
 	return kcp
 }
 
@@ -217,7 +268,7 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 	}
 
 	var fast_recover bool
-	if len(kcp.rcv_queue) >= int(kcp.rcv_wnd) {
+	if kcp.rcv_held() >= int(kcp.rcv_wnd) {
 		fast_recover = true
 	}
 
@@ -239,7 +290,7 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 	count = 0
 	for k := range kcp.rcv_buf {
 		seg := &kcp.rcv_buf[k]
-		if seg.sn == kcp.rcv_nxt && len(kcp.rcv_queue) < int(kcp.rcv_wnd) {
+		if seg.sn == kcp.rcv_nxt && kcp.rcv_held() < int(kcp.rcv_wnd) {
 			kcp.rcv_queue = append(kcp.rcv_queue, *seg)
 			kcp.rcv_nxt++
 			count++
@@ -250,7 +301,7 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 	kcp.rcv_buf = kcp.rcv_buf[count:]
 
 	// fast recover
-	if len(kcp.rcv_queue) < int(kcp.rcv_wnd) && fast_recover {
+	if kcp.rcv_held() < int(kcp.rcv_wnd) && fast_recover {
 		// ready to send back IKCP_CMD_WINS in ikcp_flush
 		// tell remote my window size
 		kcp.probe |= IKCP_ASK_TELL
@@ -260,40 +311,49 @@ func (kcp *KCP) Recv(buffer []byte) (n int) {
 
 // Send is user/upper level send, returns below zero for error
 func (kcp *KCP) Send(buffer []byte) int {
+	return kcp.sendBuffers(&buffersReader{bufs: [][]byte{buffer}}, len(buffer), 0)
+}
+
+// sendBuffers is Send over the next size bytes of r, the segments are
+// filled from the buffers of r without concatenating them first. They are
+// queued at priority prio, ahead of the segments of lower priorities.
+func (kcp *KCP) sendBuffers(r *buffersReader, size int, prio int32) int {
 	var count int
-	if len(buffer) == 0 {
+	if size == 0 {
 		return -1
 	}
+	pos := kcp.queuePos(prio)
 
 	// append to previous segment in streaming mode (if possible)
 	if kcp.stream != 0 {
-		n := len(kcp.snd_queue)
-		if n > 0 {
+		n := pos
+		if n > 0 && kcp.snd_queue[n-1].prio == prio {
 			old := &kcp.snd_queue[n-1]
 			if len(old.data) < int(kcp.mss) {
 				capacity := int(kcp.mss) - len(old.data)
 				extend := capacity
-				if len(buffer) < capacity {
-					extend = len(buffer)
+				if size < capacity {
+					extend = size
 				}
 				seg := NewSegment(len(old.data) + extend)
 				seg.frg = 0
+				seg.prio = prio
 				copy(seg.data, old.data)
-				copy(seg.data[len(old.data):], buffer)
-				buffer = buffer[extend:]
+				r.read(seg.data[len(old.data):])
+				size -= extend
 				kcp.snd_queue[n-1] = *seg
 			}
 		}
 
-		if len(buffer) == 0 {
+		if size == 0 {
 			return 0
 		}
 	}
 
-	if len(buffer) < int(kcp.mss) {
+	if size < int(kcp.mss) {
 		count = 1
 	} else {
-		count = (len(buffer) + int(kcp.mss) - 1) / int(kcp.mss)
+		count = (size + int(kcp.mss) - 1) / int(kcp.mss)
 	}
 
 	if count > 255 {
@@ -304,26 +364,77 @@ func (kcp *KCP) Send(buffer []byte) int {
 		count = 1
 	}
 
+	var tail []Segment
+	if pos < len(kcp.snd_queue) {
+		tail = append(tail, kcp.snd_queue[pos:]...)
+		kcp.snd_queue = kcp.snd_queue[:pos]
+	}
 	for i := 0; i < count; i++ {
-		var size int
-		if len(buffer) > int(kcp.mss) {
-			size = int(kcp.mss)
+		var segsize int
+		if size > int(kcp.mss) {
+			segsize = int(kcp.mss)
 		} else {
-			size = len(buffer)
+			segsize = size
 		}
-		seg := NewSegment(size)
-		copy(seg.data, buffer[:size])
+		seg := NewSegment(segsize)
+		r.read(seg.data)
 		if kcp.stream == 0 { // message mode
 			seg.frg = uint32(count - i - 1)
 		} else { // stream mode
 			seg.frg = 0
 		}
+		seg.prio = prio
 		kcp.snd_queue = append(kcp.snd_queue, *seg)
-		buffer = buffer[size:]
+		size -= segsize
 	}
+	kcp.snd_queue = append(kcp.snd_queue, tail...)
 	return 0
 }
 
+// queuePos returns where the segments of priority prio are queued, after
+// the segments of the same or higher priorities. The rest of a message
+// partly moved to snd_buf stays ahead, its segments must keep their sn
+// contiguous.
+func (kcp *KCP) queuePos(prio int32) int {
+	k := kcp.contLen()
+	for k < len(kcp.snd_queue) && kcp.snd_queue[k].prio >= prio {
+		k++
+	}
+	return k
+}
+
+// contLen returns the number of segments at the head of snd_queue left of
+// a message partly moved to snd_buf
+func (kcp *KCP) contLen() int {
+	if !kcp.snd_cont {
+		return 0
+	}
+	for k := range kcp.snd_queue {
+		if kcp.snd_queue[k].frg == 0 {
+			return k + 1
+		}
+	}
+	return len(kcp.snd_queue)
+}
+
+// buffersReader reads the concatenation of buffers, leaving them untouched
+type buffersReader struct {
+	bufs [][]byte
+	off  int // read in bufs[0]
+}
+
+// read fills dst, the buffers hold at least len(dst) more bytes
+func (r *buffersReader) read(dst []byte) {
+	for len(dst) > 0 {
+		n := copy(dst, r.bufs[0][r.off:])
+		dst = dst[n:]
+		if r.off += n; r.off == len(r.bufs[0]) {
+			r.bufs = r.bufs[1:]
+			r.off = 0
+		}
+	}
+}
+
 // https://tools.ietf.org/html/rfc6298
 func (kcp *KCP) update_ack(rtt int32) {
 	var rto uint32 = 0
@@ -342,7 +453,7 @@ func (kcp *KCP) update_ack(rtt int32) {
 		}
 	}
 	rto = kcp.rx_srtt + _imax_(1, 4*kcp.rx_rttval)
-	kcp.rx_rto = _ibound_(kcp.rx_minrto, rto, IKCP_RTO_MAX)
+	kcp.rx_rto = _ibound_(kcp.rx_minrto, rto, kcp.rx_maxrto)
 }
 
 func (kcp *KCP) shrink_buf() {
@@ -446,7 +557,7 @@ func (kcp *KCP) parse_data(newseg *Segment) {
 	count := 0
 	for k := range kcp.rcv_buf {
 		seg := &kcp.rcv_buf[k]
-		if seg.sn == kcp.rcv_nxt && len(kcp.rcv_queue) < int(kcp.rcv_wnd) {
+		if seg.sn == kcp.rcv_nxt && kcp.rcv_held() < int(kcp.rcv_wnd) {
 			kcp.rcv_queue = append(kcp.rcv_queue, kcp.rcv_buf[k])
 			kcp.rcv_nxt++
 			count++
@@ -466,6 +577,8 @@ func (kcp *KCP) Input(data []byte) int {
 
 	var maxack uint32
 	var flag int
+	var rtt int32
+	acking := kcp.snd_una // the acks of the segments from it tell F-RTO which transmission arrived
 	for {
 		var ts, sn, length, una, conv uint32
 		var wnd uint16
@@ -492,9 +605,14 @@ func (kcp *KCP) Input(data []byte) int {
 		}
 
 		if cmd != IKCP_CMD_PUSH && cmd != IKCP_CMD_ACK &&
-			cmd != IKCP_CMD_WASK && cmd != IKCP_CMD_WINS {
+			cmd != IKCP_CMD_WASK && cmd != IKCP_CMD_WINS && cmd != IKCP_CMD_SACK {
 			return -3
 		}
+		if cmd != IKCP_CMD_PUSH && frg&sackCapability != 0 {
+			kcp.sack_peer = true
+		}
+		frto := kcp.frto_state != 0 && (cmd == IKCP_CMD_ACK || cmd == IKCP_CMD_SACK) &&
+			_itimediff(sn, acking) >= 0 && _itimediff(sn, kcp.snd_nxt) < 0
 
 		kcp.rmt_wnd = uint32(wnd)
 		kcp.parse_una(una)
@@ -502,16 +620,52 @@ func (kcp *KCP) Input(data []byte) int {
 
 		if cmd == IKCP_CMD_ACK {
 			if _itimediff(kcp.current, ts) >= 0 {
-				kcp.update_ack(_itimediff(kcp.current, ts))
+				rtt = _itimediff(kcp.current, ts)
+				kcp.update_ack(rtt)
+				if rtt == 0 { // within the millisecond of the clock
+					rtt = 1
+				}
 			}
 			kcp.parse_ack(sn)
 			kcp.shrink_buf()
+			if frto {
+				kcp.frto_ack(ts)
+			}
+			if kcp.rack {
+				kcp.rack_ack(ts, sn)
+			}
 			if flag == 0 {
 				flag = 1
 				maxack = sn
 			} else if _itimediff(sn, maxack) > 0 {
 				maxack = sn
 			}
+		} else if cmd == IKCP_CMD_SACK {
+			if length%8 != 0 {
+				return -3
+			}
+			if _itimediff(kcp.current, ts) >= 0 {
+				rtt = _itimediff(kcp.current, ts)
+				kcp.update_ack(rtt)
+				if rtt == 0 { // within the millisecond of the clock
+					rtt = 1
+				}
+			}
+			acked := kcp.parse_sack(data[:length], sn)
+			kcp.shrink_buf()
+			kcp.sack_acked = true
+			if frto {
+				kcp.frto_ack(ts)
+			}
+			if kcp.rack {
+				kcp.rack_ack(ts, sn)
+			}
+			if flag == 0 {
+				flag = 1
+				maxack = acked
+			} else if _itimediff(acked, maxack) > 0 {
+				maxack = acked
+			}
 		} else if cmd == IKCP_CMD_PUSH {
 			if _itimediff(sn, kcp.rcv_nxt+kcp.rcv_wnd) < 0 {
 				kcp.ack_push(sn, ts)
@@ -544,68 +698,115 @@ func (kcp *KCP) Input(data []byte) int {
 	if flag != 0 {
 		kcp.parse_fastack(maxack)
 	}
+	if kcp.frto_state == 2 && len(kcp.snd_buf) == 0 {
+		kcp.frto_end(true) // everything acked without a retransmission
+	}
 
-	if _itimediff(kcp.snd_una, una) > 0 {
-		if kcp.cwnd < kcp.rmt_wnd {
-			mss := kcp.mss
-			if kcp.cwnd < kcp.ssthresh {
-				kcp.cwnd++
-				kcp.incr += mss
-			} else {
-				if kcp.incr < mss {
-					kcp.incr = mss
-				}
-				kcp.incr += (mss*mss)/kcp.incr + (mss / 16)
-				if (kcp.cwnd+1)*mss <= kcp.incr {
-					kcp.cwnd++
-				}
-			}
-			if kcp.cwnd > kcp.rmt_wnd {
-				kcp.cwnd = kcp.rmt_wnd
-				kcp.incr = kcp.rmt_wnd * mss
-			}
-		}
+	if acked := _itimediff(kcp.snd_una, una); acked > 0 {
+		kcp.cc.OnAck(int(acked), time.Duration(rtt)*time.Millisecond, int(kcp.snd_nxt-kcp.snd_una))
 	}
 
 	return 0
 }
 
+// sendWindow returns the segments which may be in flight
+func (kcp *KCP) sendWindow() uint32 {
+	cwnd := _imin_(kcp.snd_wnd, kcp.rmt_wnd)
+	if window := uint32(kcp.cc.Window()); kcp.nocwnd == 0 {
+		cwnd = _imin_(window, cwnd)
+	}
+	return cwnd
+}
+
+// pacingRate returns the bytes per second flush sends the segments at, the
+// pacing rate of the congestion control, or the one of SetPacing, 0 without
+// pacing
+func (kcp *KCP) pacingRate() int64 {
+	if rate := int64(kcp.cc.PacingRate()); rate > 0 {
+		return rate
+	}
+	return kcp.pace_rate
+}
+
+// paceCredit replenishes the bytes the pacing rate lets flush send, a burst
+// of a pacingQuantum at most, false without pacing
+func (kcp *KCP) paceCredit() (int64, bool) {
+	rate := kcp.pacingRate()
+	if rate <= 0 {
+		kcp.ts_pace_due = 0
+		return 0, false
+	}
+	elapsed := int64(_itimediff(kcp.current, kcp.ts_pace))
+	if elapsed < 0 || kcp.ts_pace == 0 {
+		elapsed = int64(kcp.interval)
+	}
+	kcp.ts_pace = kcp.current
+	burst := rate*int64(pacingQuantum/time.Millisecond)/1000 + int64(kcp.mtu)
+	kcp.pace_credit += rate * elapsed / 1000
+	if kcp.pace_credit > burst {
+		kcp.pace_credit = burst
+	}
+	return kcp.pace_credit, true
+}
+
+// paceDue records when the pacing rate replenishes the credit flush ran out
+// of, so that Check schedules the flush of the segments held back
+func (kcp *KCP) paceDue(credit int64) {
+	wait := uint32((1-credit)*1000/kcp.pacingRate()) + 1
+	kcp.ts_pace_due = kcp.current + wait
+	if kcp.ts_pace_due == 0 {
+		kcp.ts_pace_due = 1
+	}
+}
+
 func (kcp *KCP) wnd_unused() int32 {
-	if len(kcp.rcv_queue) < int(kcp.rcv_wnd) {
-		return int32(int(kcp.rcv_wnd) - len(kcp.rcv_queue))
+	if held := kcp.rcv_held(); held < int(kcp.rcv_wnd) {
+		return int32(int(kcp.rcv_wnd) - held)
 	}
 	return 0
 }
 
+// rcv_held returns the segments of the receive queue which count against
+// the receive window, the fragments of an incomplete message at its tail
+// don't, so that a message of more fragments than the window is still
+// reassembled
+func (kcp *KCP) rcv_held() int {
+	i := len(kcp.rcv_queue)
+	if i == 0 || kcp.rcv_queue[i-1].frg == 0 {
+		return i
+	}
+	for i--; i > 0 && kcp.rcv_queue[i-1].frg == kcp.rcv_queue[i].frg+1; i-- {
+	}
+	return i
+}
+
 // flush pending data
 func (kcp *KCP) flush() {
 	current := kcp.current
 	buffer := kcp.buffer
 	change := 0
-	lost := false
+	lost := 0
 
 	if kcp.updated == 0 {
 		return
 	}
+	kcp.rexmit = false
 	var seg Segment
 	seg.conv = kcp.conv
 	seg.cmd = IKCP_CMD_ACK
 	seg.wnd = uint32(kcp.wnd_unused())
 	seg.una = kcp.rcv_nxt
+	if kcp.sack {
+		seg.frg = sackCapability
+	}
 
 	// flush acknowledges
-	count := len(kcp.acklist) / 2
-	ptr := buffer
-	for i := 0; i < count; i++ {
-		size := len(buffer) - len(ptr)
-		if size+IKCP_OVERHEAD > int(kcp.mtu) {
-			kcp.output(buffer, size)
-			ptr = buffer
-		}
-		seg.sn, seg.ts = kcp.ack_get(i)
-		ptr = seg.encode(ptr)
+	ptr := kcp.flush_acks(seg, buffer)
+	if kcp.sack && !kcp.sack_acked && len(kcp.snd_queue) > 0 && _itimediff(current, kcp.ts_sack) >= 0 {
+		// tell a remote receiving only data of the capability
+		kcp.probe |= IKCP_ASK_TELL
+		kcp.ts_sack = current + kcp.rx_rto
 	}
-	kcp.acklist = nil
 
 	// probe window size (if remote window size equals zero)
 	if kcp.rmt_wnd == 0 {
@@ -655,16 +856,22 @@ func (kcp *KCP) flush() {
 	kcp.probe = 0
 
 	// calculate window size
-	cwnd := _imin_(kcp.snd_wnd, kcp.rmt_wnd)
-	if kcp.nocwnd == 0 {
-		cwnd = _imin_(kcp.cwnd, cwnd)
-	}
+	cwnd := kcp.sendWindow()
+	credit, paced := kcp.paceCredit()
 
-	count = 0
+	count := 0
+	kcp.ts_pace_due = 0
 	for k := range kcp.snd_queue {
 		if _itimediff(kcp.snd_nxt, kcp.snd_una+cwnd) >= 0 {
 			break
 		}
+		if paced {
+			if credit <= 0 {
+				kcp.paceDue(credit)
+				break
+			}
+			credit -= int64(IKCP_OVERHEAD + len(kcp.snd_queue[k].data))
+		}
 		newseg := kcp.snd_queue[k]
 		newseg.conv = kcp.conv
 		newseg.cmd = IKCP_CMD_PUSH
@@ -678,9 +885,13 @@ func (kcp *KCP) flush() {
 		newseg.xmit = 0
 		kcp.snd_buf = append(kcp.snd_buf, newseg)
 		kcp.snd_nxt++
+		kcp.snd_cont = newseg.frg != 0
 		count++
 	}
 	kcp.snd_queue = kcp.snd_queue[count:]
+	if paced {
+		kcp.pace_credit = credit
+	}
 
 	// calculate resent
 	resent := uint32(kcp.fastresend)
@@ -691,6 +902,7 @@ func (kcp *KCP) flush() {
 	if kcp.nodelay != 0 {
 		rtomin = 0
 	}
+	tlp := kcp.rack && kcp.rack_probe()
 
 	// flush data segments
 	for k := range kcp.snd_buf {
@@ -701,21 +913,39 @@ func (kcp *KCP) flush() {
 			segment.xmit++
 			segment.rto = kcp.rx_rto
 			segment.resendts = current + segment.rto + rtomin
-		} else if _itimediff(current, segment.resendts) >= 0 {
+		} else if _itimediff(current, segment.resendts) >= 0 && !kcp.frto_holds(segment) {
 			needsend = true
 			segment.xmit++
 			kcp.xmit++
-			if kcp.nodelay == 0 {
+			if kcp.rto_backoff > 0 {
+				segment.rto = uint32(float64(segment.rto) * kcp.rto_backoff)
+			} else if kcp.nodelay == 0 {
 				segment.rto += kcp.rx_rto
 			} else {
 				segment.rto += kcp.rx_rto / 2
 			}
-			segment.rto = _imin_(segment.rto, 8*kcp.rx_rto)
+			segment.rto = _imin_(segment.rto, _imin_(8*kcp.rx_rto, kcp.rx_maxrto))
 			segment.resendts = current + segment.rto
-			lost = true
+			if kcp.frto_timeout(segment) {
+				lost++
+			}
 			atomic.AddUint64(&DefaultSnmp.RetransSegs, 1)
 			atomic.AddUint64(&DefaultSnmp.LostSegs, 1)
-		} else if segment.fastack >= resent {
+		} else if kcp.rack && kcp.rack_lost(segment) {
+			needsend = true
+			segment.xmit++
+			segment.fastack = 0
+			segment.resendts = current + segment.rto
+			change++
+			atomic.AddUint64(&DefaultSnmp.RetransSegs, 1)
+			atomic.AddUint64(&DefaultSnmp.FastRetransSegs, 1)
+		} else if tlp && k == len(kcp.snd_buf)-1 {
+			// tail loss probe, the ack it brings back lets RACK see the losses
+			needsend = true
+			segment.xmit++
+			kcp.rack_tlp = true
+			atomic.AddUint64(&DefaultSnmp.RetransSegs, 1)
+		} else if !kcp.rack && segment.fastack >= resent {
 			needsend = true
 			segment.xmit++
 			segment.fastack = 0
@@ -723,7 +953,7 @@ func (kcp *KCP) flush() {
 			change++
 			atomic.AddUint64(&DefaultSnmp.RetransSegs, 1)
 			atomic.AddUint64(&DefaultSnmp.FastRetransSegs, 1)
-		} else if segment.fastack > 0 && len(kcp.snd_queue) == 0 {
+		} else if !kcp.rack && segment.fastack > 0 && len(kcp.snd_queue) == 0 {
 			// early retransmit
 			needsend = true
 			segment.xmit++
@@ -745,13 +975,24 @@ func (kcp *KCP) flush() {
 			if size+need >= int(kcp.mtu) {
 				kcp.output(buffer, size)
 				ptr = buffer
+				kcp.rexmit = false
 			}
 
 			ptr = segment.encode(ptr)
 			copy(ptr, segment.data)
 			ptr = ptr[len(segment.data):]
+			if segment.xmit > 1 {
+				kcp.rexmit = true
+				if paced {
+					// sent at once, the new segments wait for them
+					kcp.pace_credit -= int64(need)
+				}
+			}
 
 			if segment.xmit >= kcp.dead_link {
+				if kcp.state == 0 {
+					kcp.dead_sn, kcp.dead_xmit = segment.sn, segment.xmit
+				}
 				kcp.state = 0xFFFFFFFF
 			}
 		}
@@ -762,32 +1003,56 @@ func (kcp *KCP) flush() {
 	if size > 0 {
 		kcp.output(buffer, size)
 	}
+	kcp.rexmit = false
 
-	// update ssthresh
-	// rate halving, https://tools.ietf.org/html/rfc6937
-	if change != 0 {
-		inflight := kcp.snd_nxt - kcp.snd_una
-		kcp.ssthresh = inflight / 2
-		if kcp.ssthresh < IKCP_THRESH_MIN {
-			kcp.ssthresh = IKCP_THRESH_MIN
-		}
-		kcp.cwnd = kcp.ssthresh + resent
-		kcp.incr = kcp.cwnd * kcp.mss
+	// congestion control, a timeout prevails over fast retransmits
+	inflight := int(kcp.snd_nxt - kcp.snd_una)
+	if lost != 0 {
+		kcp.cc.OnLoss(lost, true, inflight)
+	} else if change != 0 {
+		kcp.cc.OnLoss(change, false, inflight)
 	}
+}
 
-	// congestion control, https://tools.ietf.org/html/rfc5681
-	if lost {
-		kcp.ssthresh = cwnd / 2
-		if kcp.ssthresh < IKCP_THRESH_MIN {
-			kcp.ssthresh = IKCP_THRESH_MIN
+// flush_acks encodes the pending acknowledges after ptr, in the buffer
+func (kcp *KCP) flush_acks(seg Segment, ptr []byte) []byte {
+	buffer := kcp.buffer
+	count := len(kcp.acklist) / 2
+	if kcp.sack && kcp.sack_peer && count > 0 {
+		ptr = kcp.flush_sack(seg, ptr)
+		count = 0
+	}
+	for i := 0; i < count; i++ {
+		size := len(buffer) - len(ptr)
+		if size+IKCP_OVERHEAD > int(kcp.mtu) {
+			kcp.output(buffer, size)
+			ptr = buffer
 		}
-		kcp.cwnd = 1
-		kcp.incr = kcp.mss
+		seg.sn, seg.ts = kcp.ack_get(i)
+		ptr = seg.encode(ptr)
 	}
+	kcp.acklist = nil
+	return ptr
+}
 
-	if kcp.cwnd < 1 {
-		kcp.cwnd = 1
-		kcp.incr = kcp.mss
+// flushAcks sends only the pending acknowledges, for a session paused,
+// which doesn't send anything else
+func (kcp *KCP) flushAcks() {
+	if kcp.updated == 0 || len(kcp.acklist) == 0 {
+		return
+	}
+	var seg Segment
+	seg.conv = kcp.conv
+	seg.cmd = IKCP_CMD_ACK
+	seg.wnd = uint32(kcp.wnd_unused())
+	seg.una = kcp.rcv_nxt
+	if kcp.sack {
+		seg.frg = sackCapability
+	}
+	buffer := kcp.buffer
+	ptr := kcp.flush_acks(seg, buffer)
+	if size := len(buffer) - len(ptr); size > 0 {
+		kcp.output(buffer, size)
 	}
 }
 
@@ -817,6 +1082,9 @@ func (kcp *KCP) Update(current uint32) {
 			kcp.ts_flush = kcp.current + kcp.interval
 		}
 		kcp.flush()
+	} else if kcp.ts_pace_due != 0 && _itimediff(kcp.current, kcp.ts_pace_due) >= 0 {
+		// the segments the pacing held back are due before the interval
+		kcp.flush()
 	}
 }
 
@@ -846,9 +1114,21 @@ func (kcp *KCP) Check(current uint32) uint32 {
 	}
 
 	tm_flush = _itimediff(ts_flush, current)
+	if kcp.ts_pace_due != 0 {
+		due := _itimediff(kcp.ts_pace_due, current)
+		if due <= 0 {
+			return current
+		}
+		if due < tm_flush {
+			tm_flush = due
+		}
+	}
 
 	for k := range kcp.snd_buf {
 		seg := &kcp.snd_buf[k]
+		if kcp.frto_holds(seg) {
+			continue
+		}
 		diff := _itimediff(seg.resendts, current)
 		if diff <= 0 {
 			return current
@@ -869,21 +1149,96 @@ func (kcp *KCP) Check(current uint32) uint32 {
 	return current + minimal
 }
 
+// idle tells if flush has nothing to do: no segment to send nor in flight,
+// no ack nor window probe pending, so that nothing needs an update until
+// the next input or send
+func (kcp *KCP) idle() bool {
+	return len(kcp.snd_queue) == 0 && len(kcp.snd_buf) == 0 && len(kcp.acklist) == 0 &&
+		kcp.probe == 0 && kcp.rmt_wnd != 0
+}
+
 // SetMtu changes MTU size, default is 1400
 func (kcp *KCP) SetMtu(mtu int) int {
 	if mtu < 50 || mtu < IKCP_OVERHEAD {
 		return -1
 	}
-	buffer := make([]byte, (mtu+IKCP_OVERHEAD)*3)
-	if buffer == nil {
-		return -2
+	// the buffer never shrinks, the segments in flight keep their size
+	if size := (mtu + IKCP_OVERHEAD) * 3; size > len(kcp.buffer) {
+		kcp.buffer = make([]byte, size)
 	}
 	kcp.mtu = uint32(mtu)
 	kcp.mss = kcp.mtu - IKCP_OVERHEAD
-	kcp.buffer = buffer
+	kcp.resegment()
 	return 0
 }
 
+// resegment splits the queued segments larger than the mss again, the
+// messages which would need more than 255 segments, or partly moved to
+// snd_buf, keep theirs
+func (kcp *KCP) resegment() {
+	cont := kcp.contLen()
+	queue := append([]Segment(nil), kcp.snd_queue[:cont]...)
+	for rest := kcp.snd_queue[cont:]; len(rest) > 0; {
+		// a message ends at frg 0, every segment does in stream mode
+		n := 1
+		if kcp.stream == 0 && int(rest[0].frg) < len(rest) {
+			n = int(rest[0].frg) + 1
+		}
+		unit := rest[:n]
+		rest = rest[n:]
+
+		size, oversized := 0, false
+		bufs := make([][]byte, len(unit))
+		for k := range unit {
+			size += len(unit[k].data)
+			oversized = oversized || len(unit[k].data) > int(kcp.mss)
+			bufs[k] = unit[k].data
+		}
+		count := (size + int(kcp.mss) - 1) / int(kcp.mss)
+		if !oversized || kcp.stream == 0 && count > 255 {
+			queue = append(queue, unit...)
+			continue
+		}
+		r := buffersReader{bufs: bufs}
+		for i := 0; i < count; i++ {
+			segsize := int(kcp.mss)
+			if size < segsize {
+				segsize = size
+			}
+			seg := NewSegment(segsize)
+			r.read(seg.data)
+			if kcp.stream == 0 {
+				seg.frg = uint32(count - i - 1)
+			}
+			seg.prio = unit[0].prio
+			queue = append(queue, *seg)
+			size -= segsize
+		}
+	}
+	kcp.snd_queue = queue
+}
+
+// SetRTO bounds the retransmission timeout to [minrto, maxrto] in
+// millisec, and sets the factor the rto of a segment is multiplied by each
+// time it's retransmitted. minrto 0 keeps the floor of nodelay, lowered to
+// maxrto if above, maxrto 0 keeps IKCP_RTO_MAX, backoff 0 keeps the linear
+// growth of nodelay.
+func (kcp *KCP) SetRTO(minrto, maxrto uint32, backoff float64) {
+	kcp.minrto_set = minrto
+	if minrto == 0 {
+		minrto = IKCP_RTO_MIN
+		if kcp.nodelay != 0 {
+			minrto = IKCP_RTO_NDL
+		}
+	}
+	if maxrto == 0 {
+		maxrto = IKCP_RTO_MAX
+	}
+	kcp.rx_minrto, kcp.rx_maxrto = _imin_(minrto, maxrto), maxrto
+	kcp.rto_backoff = backoff
+	kcp.rx_rto = _ibound_(kcp.rx_minrto, kcp.rx_rto, kcp.rx_maxrto)
+}
+
 // NoDelay options
 // fastest: ikcp_nodelay(kcp, 1, 20, 2, 1)
 // nodelay: 0:disable(default), 1:enable
@@ -893,11 +1248,14 @@ func (kcp *KCP) SetMtu(mtu int) int {
 func (kcp *KCP) NoDelay(nodelay, interval, resend, nc int) int {
 	if nodelay >= 0 {
 		kcp.nodelay = uint32(nodelay)
-		if nodelay != 0 {
+		if kcp.minrto_set != 0 {
+			kcp.rx_minrto = kcp.minrto_set
+		} else if nodelay != 0 {
 			kcp.rx_minrto = IKCP_RTO_NDL
 		} else {
 			kcp.rx_minrto = IKCP_RTO_MIN
 		}
+		kcp.rx_minrto = _imin_(kcp.rx_minrto, kcp.rx_maxrto)
 	}
 	if interval >= 0 {
 		if interval > 5000 {
@@ -906,6 +1264,9 @@ func (kcp *KCP) NoDelay(nodelay, interval, resend, nc int) int {
 			interval = 10
 		}
 		kcp.interval = uint32(interval)
+		if ic, ok := kcp.cc.(intervalControl); ok {
+			ic.setInterval(time.Duration(interval) * time.Millisecond)
+		}
 	}
 	if resend >= 0 {
 		kcp.fastresend = int32(resend)
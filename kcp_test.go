@@ -283,3 +283,38 @@ func TestNetwork(t *testing.T) {
 	test(1) // 普通模式，关闭流控等
 	test(2) // 快速模式，所有开关都打开，且关闭流控
 }
+
+func TestRetransmitFlag(t *testing.T) {
+	var flags []bool
+	var kcp *KCP
+	kcp = NewKCP(1, func(buf []byte, size int) {
+		flags = append(flags, kcp.rexmit)
+	})
+	kcp.Update(0)
+	kcp.Send([]byte("hello"))
+	kcp.flush()
+	kcp.current += 10 * IKCP_RTO_DEF // rto expired
+	kcp.flush()
+	if len(flags) != 2 || flags[0] || !flags[1] {
+		t.Fatal("unexpected retransmit flags", flags)
+	}
+}
+
+func TestHasPush(t *testing.T) {
+	ack := Segment{cmd: IKCP_CMD_ACK}
+	push := Segment{cmd: IKCP_CMD_PUSH, data: []byte("hello")}
+	buf := make([]byte, 3*IKCP_OVERHEAD+len(push.data))
+	ptr := ack.encode(buf)
+	ptr = ack.encode(ptr)
+	if hasPush(buf[:len(buf)-len(ptr)]) {
+		t.Fatal("acks reported as data")
+	}
+	ptr = push.encode(ptr)
+	copy(ptr, push.data)
+	if !hasPush(buf) {
+		t.Fatal("data segment not found")
+	}
+	if hasPush(buf[:len(buf)-1]) {
+		t.Fatal("truncated segment reported as data")
+	}
+}
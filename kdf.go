@@ -0,0 +1,94 @@
+package kcp
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/pbkdf2"
+	"golang.org/x/crypto/scrypt"
+)
+
+// key derivation functions of KeyParams
+const (
+	KDFPBKDF2     = iota // PBKDF2-HMAC-SHA256
+	KDFPBKDF2SHA1        // PBKDF2-HMAC-SHA1, as kcptun derives its keys
+	KDFScrypt
+	KDFArgon2id
+)
+
+const defaultKeyLen = 32 // bytes of the keys derived, enough for every crypt
+
+// KeyParams selects the function deriving a key from a passphrase and its
+// cost. Only the fields of the function selected are used.
+type KeyParams struct {
+	KDF    int // KDFPBKDF2, KDFPBKDF2SHA1, KDFScrypt or KDFArgon2id
+	KeyLen int // bytes of the key, 32 if 0
+
+	Iterations int // PBKDF2
+
+	N, R, P int // scrypt cost, a power of two, block size and parallelization
+
+	Time    uint32 // Argon2id passes
+	Memory  uint32 // Argon2id memory, in KiB
+	Threads uint8  // Argon2id lanes
+}
+
+// Presets of KeyParams. The cost is paid by each side every time a key is
+// derived, the presets target a fraction of a second on a server CPU.
+var (
+	// KeyParamsKcptun derives the keys of kcptun from its --key, with the
+	// salt "kcp-go"
+	KeyParamsKcptun = KeyParams{KDF: KDFPBKDF2SHA1, Iterations: 4096}
+
+	// KeyParamsPBKDF2 is the OWASP recommendation for PBKDF2-HMAC-SHA256
+	KeyParamsPBKDF2 = KeyParams{KDF: KDFPBKDF2, Iterations: 600000}
+
+	// KeyParamsScrypt is scrypt over 128 MiB
+	KeyParamsScrypt = KeyParams{KDF: KDFScrypt, N: 1 << 17, R: 8, P: 1}
+
+	// KeyParamsArgon2id is the second recommendation of RFC 9106, 3 passes
+	// over 64 MiB
+	KeyParamsArgon2id = KeyParams{KDF: KDFArgon2id, Time: 3, Memory: 64 * 1024, Threads: 4}
+)
+
+// NewKeyFromPassphrase derives the key of a crypt from a passphrase, so that
+// passwords aren't fed to the crypt constructors as they are. Both sides must
+// derive with the same salt and params. Memory-hard functions, scrypt and
+// Argon2id, best resist the guessing of weak passphrases.
+func NewKeyFromPassphrase(pass, salt []byte, params KeyParams) ([]byte, error) {
+	keyLen := params.KeyLen
+	if keyLen == 0 {
+		keyLen = defaultKeyLen
+	}
+	if keyLen < 0 {
+		return nil, errKDFParams
+	}
+
+	switch params.KDF {
+	case KDFPBKDF2, KDFPBKDF2SHA1:
+		if params.Iterations < 1 {
+			return nil, errKDFParams
+		}
+		h := sha256.New
+		if params.KDF == KDFPBKDF2SHA1 {
+			h = sha1.New
+		}
+		return pbkdf2.Key(pass, salt, params.Iterations, keyLen, h), nil
+	case KDFScrypt:
+		if params.R < 1 || params.P < 1 {
+			return nil, errKDFParams
+		}
+		key, err := scrypt.Key(pass, salt, params.N, params.R, params.P, keyLen)
+		if err != nil {
+			return nil, errKDFParams
+		}
+		return key, nil
+	case KDFArgon2id:
+		if params.Time < 1 || params.Threads < 1 || params.Memory < 8*uint32(params.Threads) {
+			return nil, errKDFParams
+		}
+		return argon2.IDKey(pass, salt, params.Time, params.Memory, params.Threads, uint32(keyLen)), nil
+	}
+	return nil, errKDFParams
+}
@@ -0,0 +1,117 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// FECThenEncrypt frames the packets with fec headers, then encrypts
+	// them along with their headers (default)
+	FECThenEncrypt = 0
+	// EncryptThenFEC seals each packet on its own, then frames the
+	// ciphertext with fec headers in the clear
+	EncryptThenFEC = 1
+
+	layersFixed = 1 << 31 // set in UDPSession.layers once the order is in use
+)
+
+// SetLayerOrder sets the order the fec and crypt layers are applied to the
+// packets sent. FECThenEncrypt hides the structure of the flow, fec headers
+// included. EncryptThenFEC leaves the fec headers readable to middleboxes,
+// the shards are recovered from ciphertext and every packet is authenticated
+// on its own once recovered. EncryptThenFEC sends a data shard per packet,
+// the span size is ignored. The listener adopts the order of the first
+// packet of a session and answers likewise, so the order must be set before
+// the session sends anything. Without a crypt both orders are the same.
+func (s *UDPSession) SetLayerOrder(order int) error {
+	if s.fec == nil {
+		return errNoFEC
+	}
+	if order != FECThenEncrypt && order != EncryptThenFEC {
+		return errLayerOrder
+	}
+	for {
+		layers := atomic.LoadUint32(&s.layers)
+		if layers&layersFixed != 0 {
+			return errLayersFixed
+		}
+		if atomic.CompareAndSwapUint32(&s.layers, layers, uint32(order)) {
+			return nil
+		}
+	}
+}
+
+// fixLayerOrder keeps the order of the layers from now on and returns it
+func (s *UDPSession) fixLayerOrder() int {
+	for {
+		layers := atomic.LoadUint32(&s.layers)
+		if atomic.CompareAndSwapUint32(&s.layers, layers, layers|layersFixed) {
+			return int(layers &^ layersFixed)
+		}
+	}
+}
+
+// encryptThenFEC tells if the packets of the session are sealed before their
+// fec framing
+func (s *UDPSession) encryptThenFEC() bool {
+	return s.fec != nil && s.block != nil && atomic.LoadUint32(&s.layers)&^layersFixed == EncryptThenFEC
+}
+
+// sealUnderFEC seals the kcp packet of ext on its own and moves the fec
+// header of ext in front of it, off is the crypt header room left ahead of
+// the fec header. The packet keeps its length.
+func (s *UDPSession) sealUnderFEC(ext []byte, off int) {
+	var header [fecHeaderSizePlus2]byte
+	copy(header[:], ext[off:])
+	s.encryptPacket(ext[fecHeaderSizePlus2:])
+	copy(ext, header[:])
+}
+
+// sealedInput feeds a kcp packet to kcp, the packet is opened first if it
+// was sealed before its fec framing. The caller holds mu.
+func (s *UDPSession) sealedInput(pkt []byte, sealed bool) {
+	if sealed {
+		raw := pkt
+		var ok bool
+		if !epochNear(s.block, s, pkt) {
+			return
+		}
+		if pkt, ok = decryptPacket(s.block, pkt); !ok || !s.rxOpened(raw) {
+			return
+		}
+	}
+	// the unauthenticated parity shards of EncryptThenFEC don't count
+	atomic.StoreInt64(&s.lastInput, time.Now().UnixNano())
+	s.unreachCount = 0
+	s.kcp.current = currentMs()
+	s.convInput(pkt)
+}
+
+// sealedPayload returns the sealed kcp packet carried by a data or nofec
+// shard sent in the clear, false if data isn't such a shard
+func sealedPayload(data []byte) ([]byte, bool) {
+	data, ok := unpad(data)
+	if !ok || !isFECPacket(data) || data[4] != typeData && data[4] != typeNoFEC ||
+		len(data) <= fecHeaderSizePlus2 || isSpan(data[fecHeaderSize:]) {
+		return nil, false
+	}
+	return data[fecHeaderSizePlus2:], true
+}
+
+// peekSealed opens a copy of a sealed kcp packet of a remote unknown and
+// returns its conv, false if the packet fails to open
+func (l *Listener) peekSealed(block BlockCrypt, pkt []byte) (conv uint32, ok bool) {
+	if !epochNear(block, nil, pkt) {
+		return 0, false
+	}
+	buf := l.rxbuf.Get().([]byte)[:len(pkt)]
+	copy(buf, pkt)
+	if plain, valid := openPacket(block, buf, true); valid && len(plain) >= IKCP_OVERHEAD {
+		conv, ok = binary.LittleEndian.Uint32(plain), true
+	}
+	xorBytes(buf, buf, buf)
+	l.rxbuf.Put(buf[:cap(buf)])
+	return
+}
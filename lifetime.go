@@ -0,0 +1,70 @@
+package kcp
+
+import "time"
+
+// lifetimeGrace is how long an expired session has to deliver the data
+// written before it's closed
+const lifetimeGrace = 5 * time.Second
+
+// maxLifetime is the lifetime of the sessions of a listener
+type maxLifetime struct {
+	lifetime time.Duration
+	expired  func(s *UDPSession)
+}
+
+// SetMaxLifetime makes the session close itself once it's lifetime old,
+// counted from its creation, whatever its activity, so that long-lived
+// tunnels are dialed again, with fresh keys, to a server the balancer
+// picks again. expired, if not nil, is called with the session once its
+// lifetime is over, then the session is closed gracefully: writes fail,
+// and the data written is delivered within 5s, see CloseGracefully. A
+// session already older expires at once. 0 disables the lifetime
+// (default).
+func (s *UDPSession) SetMaxLifetime(lifetime time.Duration, expired func(s *UDPSession)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lifetime != nil {
+		s.lifetime.Stop()
+		s.lifetime = nil
+	}
+	if lifetime <= 0 || s.closed() {
+		return
+	}
+	s.lifetime = time.AfterFunc(lifetime-time.Since(s.created), func() {
+		if s.closed() {
+			return
+		}
+		if expired != nil {
+			expired(s)
+		}
+		s.CloseGracefully(lifetimeGrace)
+	})
+}
+
+// stopLifetime stops the lifetime of a closed session, whose timer would
+// keep it reachable until then
+func (s *UDPSession) stopLifetime() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lifetime != nil {
+		s.lifetime.Stop()
+		s.lifetime = nil
+	}
+}
+
+// SetMaxLifetime sets the lifetime of the sessions the listener creates
+// from now on, as UDPSession.SetMaxLifetime does. 0 disables it (default).
+func (l *Listener) SetMaxLifetime(lifetime time.Duration, expired func(s *UDPSession)) {
+	var m *maxLifetime
+	if lifetime > 0 {
+		m = &maxLifetime{lifetime: lifetime, expired: expired}
+	}
+	l.lifetime.Store(m)
+}
+
+// startLifetime starts the lifetime of a new session of the listener
+func (l *Listener) startLifetime(s *UDPSession) {
+	if m, _ := l.lifetime.Load().(*maxLifetime); m != nil {
+		s.SetMaxLifetime(m.lifetime, m.expired)
+	}
+}
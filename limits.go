@@ -0,0 +1,168 @@
+package kcp
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	rateBucketsLimit = 65536                // remote IPs tracked by the rate limit
+	rateBucketsPrune = rateBucketsLimit / 4 // buckets forgotten at once when the limit is reached
+)
+
+type (
+	// connFilter tells if the packets of a remote without session, claiming conv, may be processed
+	connFilter func(remote net.Addr, conv uint32) bool
+
+	// connRate is the token bucket rate limit of the new sessions of an IP
+	connRate struct {
+		rate  float64 // tokens per second
+		burst float64 // tokens a bucket holds
+	}
+
+	// tokenBucket holds the new session tokens of a remote IP
+	tokenBucket struct {
+		tokens float64
+		last   time.Time // of the last refill
+	}
+)
+
+// SetMaxSessions caps the number of concurrent sessions of the listener,
+// accepted or waiting for Accept. The first packets of the new sessions
+// beyond are dropped and counted in Snmp.SessionOverflows, their remotes
+// retransmit until a session closes. 0 removes the limit (default).
+func (l *Listener) SetMaxSessions(max int) error {
+	if max < 0 {
+		return errLimitParams
+	}
+	atomic.StoreInt32(&l.maxSessions, int32(max))
+	return nil
+}
+
+// SetConnRate limits the new sessions of each remote IP to rate per second,
+// in bursts of up to burst sessions, so that a host flooding the listener
+// with new conversations can't exhaust it. The first packets of the new
+// sessions beyond are dropped and counted in Snmp.RateLimitDrops. A rate of
+// 0 removes the limit (default).
+func (l *Listener) SetConnRate(rate float64, burst int) error {
+	if rate < 0 || rate > 0 && burst < 1 {
+		return errLimitParams
+	}
+	var r *connRate
+	if rate > 0 {
+		r = &connRate{rate: rate, burst: float64(burst)}
+	}
+	l.connRate.Store(r)
+	return nil
+}
+
+// limit tells if a new session may be created for the remote, under the
+// session limit and the rate limit of its IP. The token of the IP is
+// charged by spend, once the session is created.
+func (l *Listener) limit(from net.Addr) bool {
+	if max := atomic.LoadInt32(&l.maxSessions); max > 0 && len(l.sessions) >= int(max) {
+		atomic.AddUint64(&DefaultSnmp.SessionOverflows, 1)
+		return false
+	}
+	r, _ := l.connRate.Load().(*connRate)
+	if r == nil {
+		return true
+	}
+
+	now := time.Now()
+	ip := addrHost(from)
+	b := l.rateBuckets[ip]
+	if b == nil {
+		if len(l.rateBuckets) >= rateBucketsLimit {
+			l.pruneBuckets(r, now)
+		}
+		b = &tokenBucket{tokens: r.burst, last: now}
+		l.rateBuckets[ip] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * r.rate
+	if b.tokens > r.burst {
+		b.tokens = r.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		atomic.AddUint64(&DefaultSnmp.RateLimitDrops, 1)
+		return false
+	}
+	return true
+}
+
+// spend charges the token of a session created for the remote to the
+// bucket of its IP, which limit refilled
+func (l *Listener) spend(from net.Addr) {
+	if b := l.rateBuckets[addrHost(from)]; b != nil {
+		b.tokens--
+	}
+}
+
+// pruneBuckets forgets the IPs whose bucket refilled, which are the same as
+// new, then arbitrary ones until rateBucketsPrune buckets were forgotten, so
+// that the scan happens once per rateBucketsPrune new IPs at most
+func (l *Listener) pruneBuckets(r *connRate, now time.Time) {
+	for ip, b := range l.rateBuckets {
+		if b.tokens+now.Sub(b.last).Seconds()*r.rate >= r.burst {
+			delete(l.rateBuckets, ip)
+		}
+	}
+	for ip := range l.rateBuckets {
+		if len(l.rateBuckets) <= rateBucketsLimit-rateBucketsPrune {
+			break
+		}
+		delete(l.rateBuckets, ip)
+	}
+}
+
+// SetConnFilter makes the listener ask filter whether to process the
+// packets of each remote without session, with the address of the remote
+// and the conv its packet claims, for allow and deny lists or custom
+// admission control without a proxy in front. filter is called first on
+// each such packet, before any crypto, cookie challenge, noise handshake or
+// state of the conversation, and before the limits of the listener apply,
+// so that the refused remotes cost nothing. conv is read in the clear, it's
+// 0 with a listener decrypting its packets, where filter decides on the
+// address only. filter also vets the remotes a session would migrate to.
+// The packets it refuses are dropped. filter is called by the goroutine of
+// the listener, it must not block. nil removes the filter.
+func (l *Listener) SetConnFilter(filter func(remote net.Addr, conv uint32) bool) {
+	l.filter.Store(connFilter(filter))
+}
+
+// filterConn tells if the filter of the listener lets the packets of a
+// remote without session be processed
+func (l *Listener) filterConn(from net.Addr, conv uint32) bool {
+	filter, _ := l.filter.Load().(connFilter)
+	return filter == nil || filter(from, conv)
+}
+
+// clearConv returns the conv a packet of a remote without session claims,
+// for the filter, 0 if the listener decrypts its packets
+func (l *Listener) clearConv(data []byte) uint32 {
+	keys, _ := l.keys.Load().([]BlockCrypt)
+	resolver, _ := l.resolver.Load().(keyResolver)
+	if l.block != nil || l.noise != nil || len(keys) > 0 || resolver != nil {
+		return 0
+	}
+	if data, ok := unpad(data); ok && !l.isCookieEcho(data) {
+		if conv, ok := packetConv(data); ok {
+			return conv
+		}
+	}
+	return 0
+}
+
+// addrHost returns the host of a remote address, the IP of a UDP address,
+// the whole address for transports without ports
+func addrHost(addr net.Addr) string {
+	if a, ok := addr.(*net.UDPAddr); ok {
+		return a.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	return addr.String()
+}
@@ -0,0 +1,109 @@
+package kcp
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// maxFragments is the most segments a message is split into, the frg field
+// of the segments counts down to 0 from maxFragments-1
+const maxFragments = 255
+
+// streamSelector tells if a new session of conv with remote is in stream mode
+type streamSelector func(remote net.Addr, conv uint32) bool
+
+// SetStreamMode makes the listener ask stream whether each new session is
+// in stream or message mode, with the address of the remote and its conv,
+// so that one listener serves both the dialers writing a byte stream and
+// the ones writing messages, told apart by their address or conv, for
+// instance a port or a conv range of each kind. The mode of the sessions
+// must match the one of their dialers. stream is called by the goroutine of
+// the listener, before the first packet of the session is input, it must
+// not block. nil puts the new sessions in message mode, the default.
+func (l *Listener) SetStreamMode(stream func(remote net.Addr, conv uint32) bool) {
+	l.streamMode.Store(streamSelector(stream))
+}
+
+// sessionStream tells if a new session of conv with the remote is in stream
+// mode
+func (l *Listener) sessionStream(from net.Addr, conv uint32) bool {
+	stream, _ := l.streamMode.Load().(streamSelector)
+	return stream != nil && stream(from, conv)
+}
+
+// StreamMode tells if the session is in stream mode, see SetStreamMode.
+func (s *UDPSession) StreamMode() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kcp.stream != 0
+}
+
+// WriteMessage writes msg as a single message, which the remote reads whole
+// with ReadMessage, sparing the application its own length prefixes. The
+// message is split into up to 255 segments of the mss, numbered by their frg
+// field, the remote reassembles it even beyond its receive window. The
+// session must be in message mode, the default, and empty messages are
+// refused as an empty segment ends the stream.
+func (s *UDPSession) WriteMessage(msg []byte) error {
+	_, err := s.write([][]byte{msg}, false, true, PriorityNormal)
+	return err
+}
+
+// ReadMessage reads the next message of the remote whole, as written by
+// WriteMessage or by a Write in message mode. The rest of a message partly
+// read by Read is returned first. It returns io.EOF once the remote closed
+// its write side.
+func (s *UDPSession) ReadMessage() ([]byte, error) {
+	for {
+		s.mu.Lock()
+		if s.closed() {
+			s.mu.Unlock()
+			return nil, s.closedErr()
+		}
+		if len(s.sockbuff) > 0 {
+			msg := s.sockbuff
+			s.sockbuff = nil
+			s.mu.Unlock()
+			return msg, nil
+		}
+		if s.rdEOF || s.rdClosed {
+			s.mu.Unlock()
+			return nil, io.EOF
+		}
+		if !s.rd.IsZero() && time.Now().After(s.rd) {
+			s.mu.Unlock()
+			return nil, errTimeout
+		}
+
+		switch n := s.kcp.PeekSize(); {
+		case n == 0: // the remote closed its write side
+			s.recv(nil)
+			s.rdEOF = true
+			s.mu.Unlock()
+			return nil, io.EOF
+		case n > 0:
+			msg := make([]byte, n)
+			s.recv(msg)
+			s.mu.Unlock()
+			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(n))
+			atomic.AddUint64(&s.bytesReceived, uint64(n))
+			return msg, nil
+		}
+
+		s.waitRead(s.chReadEvent)
+	}
+}
+
+// checkMessage tells if a message of size bytes can be sent, the caller
+// holds mu
+func (s *UDPSession) checkMessage(size int) error {
+	if s.kcp.stream != 0 {
+		return errStreamMode
+	}
+	if size == 0 || size > maxFragments*int(s.kcp.mss) {
+		return errMessageSize
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+)
+
+// migration follows the remotes of a listener to their new addresses
+type migration struct {
+	migrated func(s *UDPSession, previous net.Addr)
+}
+
+// SetMigration lets the sessions of the listener follow their remotes across
+// address changes, such as a mobile client moving from WiFi to LTE or a NAT
+// rebinding its port. A packet from an unknown address carrying the conv of
+// a session moves the session to that address if the packet opens under the
+// crypt of the session and is fresh: it carries data, a window probe, a ping
+// or a datagram stamped by the clock of the remote later than anything the
+// session received, so that packets replayed from elsewhere don't move it,
+// whatever the crypt. The packets from the new address which aren't fresh,
+// such as the bare acks, are dropped until a fresh one moves the session.
+// Sessions without crypt and sessions set up by a
+// noise handshake stay on their address. migrated, if not nil, is called
+// with each session moved and its previous address, by the goroutine of the
+// listener, it must not block, as the RemoteAddrChanged event of the
+// session. Disabled by default.
+func (l *Listener) SetMigration(enabled bool, migrated func(s *UDPSession, previous net.Addr)) {
+	var m *migration
+	if enabled {
+		m = &migration{migrated: migrated}
+	}
+	l.migration.Store(m)
+}
+
+// migrationCopy returns a copy of a packet from an unknown address before it
+// is opened in place, nil if migration is disabled
+func (l *Listener) migrationCopy(packet []byte) []byte {
+	if m, _ := l.migration.Load().(*migration); m == nil || len(l.convs) == 0 {
+		return nil
+	}
+	buf := l.rxbuf.Get().([]byte)[:len(packet)]
+	copy(buf, packet)
+	return buf
+}
+
+// migrate moves the session of conv to the address a packet came from, if
+// the packet opens under the crypt of the session and is fresh, and feeds it
+// the packet. It returns true if the packet belongs to the session, moved or
+// not.
+func (l *Listener) migrate(conv uint32, from net.Addr, packet []byte) bool {
+	m, _ := l.migration.Load().(*migration)
+	s := l.convs[conv]
+	if m == nil || packet == nil || s == nil || s.block == nil {
+		return false
+	}
+
+	var data []byte
+	if s.encryptThenFEC() {
+		pkt, framed := sealedPayload(packet)
+		if !framed {
+			return false
+		}
+		if c, ok := l.peekSealed(s.block, pkt); !ok || c != conv {
+			return false
+		}
+		data, _ = unpad(packet)
+	} else {
+		// the listener checked the nonce against the replay window already
+		plain, ok := openPacket(s.block, packet, true)
+		if ok {
+			plain, ok = unpad(plain)
+		}
+		if !ok {
+			return false
+		}
+		if c, ok := packetConv(plain); !ok || c != conv || !s.rxOpened(packet) {
+			return false
+		}
+		data = plain
+	}
+	// the closed and exported sessions stay, their events are over
+	ts, fresh := senderTs(data)
+	s.mu.Lock()
+	valid := fresh && s.fresh(ts) && !s.exported && !s.closed()
+	s.mu.Unlock()
+	if !valid {
+		return true
+	}
+
+	previous := s.RemoteAddr()
+	if l.sessions[previous.String()] == s {
+		delete(l.sessions, previous.String())
+	}
+	addr := from.String()
+	s.currentRemote.Store(from)
+	l.sessions[addr] = s
+	delete(l.cookieVerified, addr)
+	atomic.AddUint64(&DefaultSnmp.Migrations, 1)
+	s.kcpInput(data)
+	if m.migrated != nil {
+		m.migrated(s, previous)
+	}
+	s.emit(func(h *SessionEvents) {
+		if h.RemoteAddrChanged != nil {
+			h.RemoteAddrChanged(s, previous)
+		}
+	})
+	return true
+}
+
+// fresh tells if ts of the clock of the remote is later than anything the
+// session received, the caller holds mu
+func (s *UDPSession) fresh(ts uint32) bool {
+	return !s.rxTsSeen || _itimediff(ts, s.rxTs) > 0
+}
+
+// senderTs returns the latest timestamp of the clock of the sender in a kcp
+// packet, under its fec header if any, false if it carries none, as the
+// acks echo the timestamps of the receiver
+func senderTs(data []byte) (ts uint32, ok bool) {
+	if isFECPacket(data) {
+		if data[4] != typeData && data[4] != typeNoFEC || len(data) < fecHeaderSizePlus2 || isSpan(data[fecHeaderSize:]) {
+			return 0, false
+		}
+		size := int(binary.LittleEndian.Uint16(data[fecHeaderSize:]))
+		if size < 2 || fecHeaderSize+size > len(data) {
+			return 0, false
+		}
+		data = data[fecHeaderSizePlus2 : fecHeaderSize+size]
+	}
+	if isDatagram(data) {
+		// no timestamp in the 1 byte tag of a datagram
+		return 0, false
+	}
+	for len(data) >= IKCP_OVERHEAD {
+		switch data[4] {
+		case IKCP_CMD_PUSH, IKCP_CMD_WASK, IKCP_CMD_WINS, cmdPing, cmdPong, cmdRekey:
+			if t := binary.LittleEndian.Uint32(data[8:]); !ok || _itimediff(t, ts) > 0 {
+				ts, ok = t, true
+			}
+		}
+		length := int(binary.LittleEndian.Uint32(data[20:]))
+		if length > len(data)-IKCP_OVERHEAD {
+			break
+		}
+		data = data[IKCP_OVERHEAD+length:]
+	}
+	return ts, ok
+}
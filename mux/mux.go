@@ -0,0 +1,439 @@
+// Package mux multiplexes independent streams over a single kcp session.
+//
+// Each stream is a net.Conn with flow control of its own, a stream whose
+// application stops reading doesn't stall the others. The data of the
+// streams is framed and written to the session by priority: the frames are
+// held back while the kcp send queue is longer than Config.SendQueue, so
+// that a stream of higher priority overtakes the bulk transfers of lower
+// ones instead of queueing behind them.
+//
+// A frame starts with an 8 bytes header, version(1) cmd(1) length(2)
+// stream id(4), in little endian, followed by length bytes of payload.
+// The dialer of the kcp session opens the streams of odd ids, the listener
+// those of even ids.
+package mux
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+)
+
+const (
+	version = 1
+
+	cmdSYN = 0 // opens a stream
+	cmdFIN = 1 // ends the data of a stream
+	cmdPSH = 2 // data of a stream
+	cmdUPD = 3 // grants the remote more bytes to send on a stream
+
+	headerSize      = 8         // version(1) cmd(1) length(2) stream id(4)
+	initialWindow   = 64 * 1024 // bytes a stream sends before its first window update
+	controlPriority = math.MaxInt
+	sendPoll        = 5 * time.Millisecond // kcp send queue polling while it's full
+)
+
+var (
+	errTimeout     = error(timeoutError{})
+	errBrokenPipe  = errors.New("broken pipe")
+	errProtocol    = errors.New("mux protocol violation")
+	errGoAway      = errors.New("stream ids exhausted")
+	errConfig      = errors.New("invalid mux config")
+	errStreamLimit = errors.New("accept backlog full")
+)
+
+type (
+	// Config defines the limits of a Session
+	Config struct {
+		MaxFrameSize  int // largest payload of a data frame, at most 65535
+		StreamWindow  int // bytes received on a stream and not read yet, at least 64KiB
+		AcceptBacklog int // streams opened by the remote and not accepted yet
+		SendQueue     int // kcp segments queued beyond which frames wait by priority
+	}
+
+	// Session multiplexes streams over a kcp session, it implements
+	// net.Listener accepting the streams opened by the remote
+	Session struct {
+		conn   *kcp.UDPSession
+		config Config
+
+		mu      sync.Mutex
+		streams map[uint32]*Stream
+		nextID  uint32 // id of the next stream opened
+		goAway  bool   // stream ids exhausted
+		err     error  // why the session died
+		die     chan struct{}
+		dieOnce sync.Once
+		accepts chan *Stream
+		queueMu sync.Mutex
+		queue   writeQueue    // frames waiting for kcp
+		seq     uint64        // order of the frames queued
+		chQueue chan struct{} // notified when a frame is queued
+	}
+
+	// writeRequest is a frame waiting for kcp
+	writeRequest struct {
+		priority int
+		seq      uint64
+		index    int // in the queue, -1 once popped
+		frame    []byte
+		result   chan error
+	}
+
+	// writeQueue orders the frames by priority, then by age
+	writeQueue []*writeRequest
+
+	// timeoutError is returned once a deadline passes, it implements net.Error
+	timeoutError struct{}
+)
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Is makes errors.Is(err, os.ErrDeadlineExceeded) hold
+func (timeoutError) Is(target error) bool { return target == os.ErrDeadlineExceeded }
+
+// DefaultConfig returns the default limits of a Session
+func DefaultConfig() *Config {
+	return &Config{
+		MaxFrameSize:  4096,
+		StreamWindow:  256 * 1024,
+		AcceptBacklog: 1024,
+		SendQueue:     32,
+	}
+}
+
+// verify checks the limits
+func (c *Config) verify() error {
+	if c.MaxFrameSize <= 0 || c.MaxFrameSize > math.MaxUint16 ||
+		c.StreamWindow < initialWindow || c.StreamWindow > math.MaxInt32 ||
+		c.AcceptBacklog <= 0 || c.SendQueue <= 0 {
+		return errConfig
+	}
+	return nil
+}
+
+// Client runs a Session over a session dialed by kcp, config nil takes the
+// defaults
+func Client(conn *kcp.UDPSession, config *Config) (*Session, error) {
+	return newSession(conn, config, 1)
+}
+
+// Server runs a Session over a session accepted by a kcp listener, config
+// nil takes the defaults
+func Server(conn *kcp.UDPSession, config *Config) (*Session, error) {
+	return newSession(conn, config, 2)
+}
+
+func newSession(conn *kcp.UDPSession, config *Config, firstID uint32) (*Session, error) {
+	if config == nil {
+		config = DefaultConfig()
+	}
+	if err := config.verify(); err != nil {
+		return nil, err
+	}
+	s := &Session{
+		conn:    conn,
+		config:  *config,
+		streams: make(map[uint32]*Stream),
+		nextID:  firstID,
+		die:     make(chan struct{}),
+		accepts: make(chan *Stream, config.AcceptBacklog),
+		chQueue: make(chan struct{}, 1),
+	}
+	go s.recvLoop()
+	go s.sendLoop()
+	return s, nil
+}
+
+// OpenStream opens a stream of priority 0 to the remote
+func (s *Session) OpenStream() (*Stream, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	if s.goAway {
+		s.mu.Unlock()
+		return nil, errGoAway
+	}
+	id := s.nextID
+	s.nextID += 2
+	if s.nextID < id {
+		s.goAway = true
+	}
+	st := newStream(id, s)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	if err := s.wait(s.queueFrame(controlPriority, cmdSYN, id, nil)); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for the next stream opened by the remote
+func (s *Session) AcceptStream() (*Stream, error) {
+	select {
+	case st := <-s.accepts:
+		return st, nil
+	case <-s.die:
+		return nil, s.closeErr()
+	}
+}
+
+// Accept implements the Accept method in the net.Listener interface.
+func (s *Session) Accept() (net.Conn, error) { return s.AcceptStream() }
+
+// Addr returns the local address of the kcp session.
+func (s *Session) Addr() net.Addr { return s.conn.LocalAddr() }
+
+// Close closes the session and its streams, along with the kcp session.
+func (s *Session) Close() error {
+	if !s.closeWithError(errBrokenPipe) {
+		return errBrokenPipe
+	}
+	return nil
+}
+
+// IsClosed tells if the session was closed, by Close or a failure of the kcp
+// session
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// NumStreams returns the number of streams open
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// closeWithError closes the session once, it returns false if it was
+// closed already
+func (s *Session) closeWithError(err error) (closed bool) {
+	s.dieOnce.Do(func() {
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		close(s.die)
+		s.conn.Close()
+		closed = true
+	})
+	return
+}
+
+// closeErr returns why the session died
+func (s *Session) closeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// stream returns an open stream by id
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+// removeStream forgets a stream once both sides ended it
+func (s *Session) removeStream(id uint32) {
+	s.mu.Lock()
+	delete(s.streams, id)
+	s.mu.Unlock()
+}
+
+// queueFrame queues a frame for kcp
+func (s *Session) queueFrame(priority int, cmd byte, id uint32, payload []byte) *writeRequest {
+	frame := make([]byte, headerSize+len(payload))
+	frame[0] = version
+	frame[1] = cmd
+	binary.LittleEndian.PutUint16(frame[2:], uint16(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:], id)
+	copy(frame[headerSize:], payload)
+	req := &writeRequest{priority: priority, frame: frame, result: make(chan error, 1)}
+
+	s.queueMu.Lock()
+	s.seq++
+	req.seq = s.seq
+	heap.Push(&s.queue, req)
+	s.queueMu.Unlock()
+	select {
+	case s.chQueue <- struct{}{}:
+	default:
+	}
+	return req
+}
+
+// wait waits for a frame to be written to kcp
+func (s *Session) wait(req *writeRequest) error {
+	select {
+	case err := <-req.result:
+		return err
+	case <-s.die:
+		return s.closeErr()
+	}
+}
+
+// unqueue removes a frame not popped yet
+func (s *Session) unqueue(req *writeRequest) bool {
+	s.queueMu.Lock()
+	defer s.queueMu.Unlock()
+	if req.index < 0 {
+		return false
+	}
+	heap.Remove(&s.queue, req.index)
+	return true
+}
+
+// sendLoop writes the frames queued to kcp by priority, the data frames
+// wait while the kcp send queue is full
+func (s *Session) sendLoop() {
+	poll := time.NewTicker(sendPoll)
+	defer poll.Stop()
+	for {
+		var req *writeRequest
+		s.queueMu.Lock()
+		waiting := len(s.queue)
+		if waiting > 0 && (s.queue[0].priority == controlPriority || s.conn.WaitSnd() < s.config.SendQueue) {
+			req = heap.Pop(&s.queue).(*writeRequest)
+		}
+		s.queueMu.Unlock()
+
+		if req == nil {
+			var busy <-chan time.Time
+			if waiting > 0 {
+				busy = poll.C
+			}
+			select {
+			case <-s.chQueue:
+			case <-busy:
+			case <-s.die:
+				return
+			}
+			continue
+		}
+
+		_, err := s.conn.Write(req.frame)
+		req.result <- err
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+// recvLoop reads the frames of the remote
+func (s *Session) recvLoop() {
+	var header [headerSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, header[:]); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		if header[0] != version {
+			s.closeWithError(errProtocol)
+			return
+		}
+		payload := make([]byte, binary.LittleEndian.Uint16(header[2:]))
+		if _, err := io.ReadFull(s.conn, payload); err != nil {
+			s.closeWithError(err)
+			return
+		}
+		id := binary.LittleEndian.Uint32(header[4:])
+
+		var err error
+		switch header[1] {
+		case cmdSYN:
+			err = s.accept(id)
+		case cmdFIN:
+			if st := s.stream(id); st != nil {
+				st.finReceived()
+			}
+		case cmdPSH:
+			if st := s.stream(id); st != nil {
+				err = st.push(payload)
+			}
+		case cmdUPD:
+			if len(payload) != 4 {
+				err = errProtocol
+			} else if st := s.stream(id); st != nil {
+				st.grant(binary.LittleEndian.Uint32(payload))
+			}
+		default:
+			err = errProtocol
+		}
+		if err != nil {
+			s.closeWithError(err)
+			return
+		}
+	}
+}
+
+// accept creates a stream opened by the remote, the stream is ended at once
+// if the backlog is full
+func (s *Session) accept(id uint32) error {
+	s.mu.Lock()
+	if id%2 == s.nextID%2 || s.streams[id] != nil {
+		s.mu.Unlock()
+		return errProtocol
+	}
+	st := newStream(id, s)
+	s.streams[id] = st
+	s.mu.Unlock()
+
+	select {
+	case s.accepts <- st:
+	default:
+		st.mu.Lock()
+		st.err = errStreamLimit
+		st.mu.Unlock()
+		st.Close()
+	}
+	return nil
+}
+
+func (q writeQueue) Len() int { return len(q) }
+
+func (q writeQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q writeQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *writeQueue) Push(x interface{}) {
+	req := x.(*writeRequest)
+	req.index = len(*q)
+	*q = append(*q, req)
+}
+
+func (q *writeQueue) Pop() interface{} {
+	old := *q
+	req := old[len(old)-1]
+	old[len(old)-1] = nil
+	req.index = -1
+	*q = old[:len(old)-1]
+	return req
+}
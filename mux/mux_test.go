@@ -0,0 +1,285 @@
+package mux
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	kcp "github.com/xtaci/kcp-go"
+)
+
+// pair returns the client session over a kcp session dialed to a listener,
+// and the server sessions over the kcp sessions accepted, which are created
+// once the client sends
+func pair(t *testing.T, config *Config) (*Session, chan *Session) {
+	l, err := kcp.ListenWithOptions("127.0.0.1:0", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	servers := make(chan *Session, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		conn.SetNoDelay(1, 10, 2, 1)
+		conn.SetWindowSize(512, 512)
+		s, err := Server(conn, config)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { s.Close() })
+		servers <- s
+	}()
+
+	conn, err := kcp.DialWithOptions(l.Addr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetNoDelay(1, 10, 2, 1)
+	conn.SetWindowSize(512, 512)
+	client, err := Client(conn, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, servers
+}
+
+func TestStreams(t *testing.T) {
+	client, servers := pair(t, nil)
+	const streams, size = 8, 300 * 1024 // beyond the initial window
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		st, err := client.OpenStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer st.Close()
+			data := make([]byte, size)
+			rand.Read(data)
+			go st.Write(data)
+			echo := make([]byte, size)
+			st.SetReadDeadline(time.Now().Add(10 * time.Second))
+			if _, err := io.ReadFull(st, echo); err != nil || !bytes.Equal(data, echo) {
+				t.Error("echo mismatch", st.ID(), err)
+			}
+		}()
+	}
+
+	server := <-servers
+	for i := 0; i < streams; i++ {
+		st, err := server.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			io.Copy(st, st)
+			st.Close()
+		}()
+	}
+	wg.Wait()
+
+	// the streams closed on both sides are forgotten
+	deadline := time.Now().Add(2 * time.Second)
+	for client.NumStreams() != 0 || server.NumStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("streams left", client.NumStreams(), server.NumStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	client, servers := pair(t, nil)
+	stalled, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	active, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := <-servers
+	server.AcceptStream() // never read
+	remote, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the remote doesn't read, the writes stop at the initial window
+	stalled.SetWriteDeadline(time.Now().Add(500 * time.Millisecond))
+	n, err := stalled.Write(make([]byte, 1024*1024))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() || n != initialWindow {
+		t.Fatal("write not held by the window", n, err)
+	}
+
+	// the other streams carry on
+	go active.Write([]byte("hello"))
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(remote, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("stream stalled by another", err)
+	}
+}
+
+func TestWriteQueue(t *testing.T) {
+	var q writeQueue
+	var reqs []*writeRequest
+	for seq, priority := range []int{0, 5, 0, controlPriority, 5, -1, 0} {
+		req := &writeRequest{priority: priority, seq: uint64(seq)}
+		heap.Push(&q, req)
+		reqs = append(reqs, req)
+	}
+	heap.Remove(&q, reqs[6].index)
+	var order []uint64
+	for q.Len() > 0 {
+		order = append(order, heap.Pop(&q).(*writeRequest).seq)
+	}
+	if fmt.Sprint(order) != "[3 1 4 0 2 5]" {
+		t.Fatal("frames popped out of order", order)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	config := DefaultConfig()
+	config.StreamWindow = 4 * 1024 * 1024
+	config.SendQueue = 8
+	client, servers := pair(t, config)
+	bulk, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	urgent, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	urgent.SetPriority(10)
+	server := <-servers
+
+	// the urgent data written while the bulk transfer is under way arrives
+	// before the end of the bulk transfer
+	const bulkSize = 2 * 1024 * 1024
+	go bulk.Write(make([]byte, bulkSize))
+	time.Sleep(20 * time.Millisecond)
+	go urgent.Write(make([]byte, 64*1024))
+
+	done := make(chan string, 2)
+	for i := 0; i < 2; i++ {
+		st, err := server.AcceptStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			size, name := bulkSize, "bulk"
+			if st.ID() == urgent.ID() {
+				size, name = 64*1024, "urgent"
+			}
+			st.SetReadDeadline(time.Now().Add(20 * time.Second))
+			if _, err := io.ReadFull(st, make([]byte, size)); err != nil {
+				t.Error(name, err)
+			}
+			done <- name
+		}()
+	}
+	if first := <-done; first != "urgent" {
+		t.Fatal("urgent stream overtaken by the bulk transfer")
+	}
+	<-done
+}
+
+func TestDeadlines(t *testing.T) {
+	client, servers := pair(t, nil)
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-servers
+
+	// a blocked read is woken by a deadline in the past
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		st.SetReadDeadline(time.Now().Add(-time.Second))
+	}()
+	start := time.Now()
+	_, err = st.Read(make([]byte, 10))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatal("want a timeout error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatal("read not woken by the deadline", elapsed)
+	}
+
+	// the deadline of a stream leaves the others alone
+	other, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := other.Read(make([]byte, 10)); err != errTimeout {
+		t.Fatal("want a timeout error", err)
+	}
+	if _, err := st.Read(make([]byte, 10)); err != errTimeout {
+		t.Fatal("deadline lost", err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	client, servers := pair(t, nil)
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.Write([]byte("bye"))
+	st.Close()
+	if _, err := st.Write([]byte("late")); err != errBrokenPipe {
+		t.Fatal("write after Close", err)
+	}
+
+	server := <-servers
+	remote, err := server.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote.SetReadDeadline(time.Now().Add(5 * time.Second))
+	data, err := io.ReadAll(remote)
+	if err != nil || string(data) != "bye" {
+		t.Fatal("data before the fin lost", string(data), err)
+	}
+
+	client.Close()
+	if !client.IsClosed() {
+		t.Fatal("session not closed")
+	}
+	if _, err := client.OpenStream(); err == nil {
+		t.Fatal("stream opened on a closed session")
+	}
+	if _, err := client.AcceptStream(); err == nil {
+		t.Fatal("stream accepted on a closed session")
+	}
+}
+
+func TestConfig(t *testing.T) {
+	config := DefaultConfig()
+	config.StreamWindow = initialWindow - 1
+	if _, err := Client(nil, config); err != errConfig {
+		t.Fatal("window below the initial window", err)
+	}
+	config = DefaultConfig()
+	config.MaxFrameSize = 65536
+	if _, err := Server(nil, config); err != errConfig {
+		t.Fatal("frames larger than the length field", err)
+	}
+}
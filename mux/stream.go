@@ -0,0 +1,342 @@
+package mux
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stream is a flow-controlled stream of a Session, it implements net.Conn
+type Stream struct {
+	id       uint32
+	sess     *Session
+	priority int64 // atomic
+	writeMu  sync.Mutex
+
+	mu        sync.Mutex
+	buffers   [][]byte // data received and not read yet
+	received  uint64   // bytes received
+	read      uint64   // bytes read by the application
+	granted   uint64   // bytes the remote was allowed to send
+	credit    int      // bytes this side may still send
+	closed    bool     // Close called
+	finRecv   bool     // the remote ended its data
+	err       error    // why the stream was ended locally, if not by Close
+	rd, wd    time.Time
+	rdChanged chan struct{} // closed and renewed when rd changes or the stream ends
+	wdChanged chan struct{} // closed and renewed when wd changes or the stream ends
+	chRead    chan struct{} // notified when data or the fin of the remote arrives
+	chWrite   chan struct{} // notified when the remote grants more bytes
+}
+
+func newStream(id uint32, sess *Session) *Stream {
+	return &Stream{
+		id:        id,
+		sess:      sess,
+		granted:   initialWindow,
+		credit:    initialWindow,
+		rdChanged: make(chan struct{}),
+		wdChanged: make(chan struct{}),
+		chRead:    make(chan struct{}, 1),
+		chWrite:   make(chan struct{}, 1),
+	}
+}
+
+// ID returns the id of the stream
+func (st *Stream) ID() uint32 { return st.id }
+
+// SetPriority sets the priority of the data written from now on, the frames
+// of higher priorities are written to kcp first. Streams open with priority
+// 0.
+func (st *Stream) SetPriority(priority int) {
+	if priority >= controlPriority {
+		priority = controlPriority - 1
+	}
+	atomic.StoreInt64(&st.priority, int64(priority))
+}
+
+// Read implements the Conn Read method.
+func (st *Stream) Read(b []byte) (n int, err error) {
+	for {
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return 0, errBrokenPipe
+		}
+		if len(st.buffers) > 0 {
+			for len(st.buffers) > 0 && n < len(b) {
+				k := copy(b[n:], st.buffers[0])
+				n += k
+				if st.buffers[0] = st.buffers[0][k:]; len(st.buffers[0]) == 0 {
+					st.buffers[0] = nil
+					st.buffers = st.buffers[1:]
+				}
+			}
+			st.read += uint64(n)
+			increment := st.windowUpdate()
+			st.mu.Unlock()
+			if increment > 0 {
+				var payload [4]byte
+				binary.LittleEndian.PutUint32(payload[:], increment)
+				st.sess.queueFrame(controlPriority, cmdUPD, st.id, payload[:])
+			}
+			return n, nil
+		}
+		if st.finRecv {
+			st.mu.Unlock()
+			return 0, io.EOF
+		}
+		if st.sess.IsClosed() {
+			st.mu.Unlock()
+			return 0, st.sess.closeErr()
+		}
+		if !st.rd.IsZero() && !time.Now().Before(st.rd) {
+			st.mu.Unlock()
+			return 0, errTimeout
+		}
+
+		timeout, stop := deadlineTimer(st.rd)
+		rdChanged := st.rdChanged
+		st.mu.Unlock()
+
+		select {
+		case <-st.chRead:
+		case <-timeout:
+		case <-rdChanged:
+		case <-st.sess.die:
+		}
+		stop()
+	}
+}
+
+// windowUpdate returns the bytes to grant the remote once half of the window
+// was read, 0 if it isn't time to, the caller holds mu
+func (st *Stream) windowUpdate() uint32 {
+	target := st.read + uint64(st.sess.config.StreamWindow)
+	if target-st.granted < uint64(st.sess.config.StreamWindow/2) {
+		return 0
+	}
+	increment := target - st.granted
+	st.granted = target
+	return uint32(increment)
+}
+
+// Write implements the Conn Write method, it returns once the data was
+// written to kcp.
+func (st *Stream) Write(b []byte) (n int, err error) {
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+	for len(b) > 0 {
+		size, err := st.reserve(len(b))
+		if err != nil {
+			return n, err
+		}
+		req := st.sess.queueFrame(int(atomic.LoadInt64(&st.priority)), cmdPSH, st.id, b[:size])
+		if err := st.waitWritten(req); err != nil {
+			if err == errTimeout {
+				st.mu.Lock()
+				st.credit += size
+				st.mu.Unlock()
+			}
+			return n, err
+		}
+		n += size
+		b = b[size:]
+	}
+	return n, nil
+}
+
+// reserve waits for the remote to grant bytes and takes up to size of them
+// for a frame
+func (st *Stream) reserve(size int) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return 0, errBrokenPipe
+		}
+		if st.err != nil {
+			st.mu.Unlock()
+			return 0, st.err
+		}
+		if st.sess.IsClosed() {
+			st.mu.Unlock()
+			return 0, st.sess.closeErr()
+		}
+		if !st.wd.IsZero() && !time.Now().Before(st.wd) {
+			st.mu.Unlock()
+			return 0, errTimeout
+		}
+		if st.credit > 0 {
+			if size > st.credit {
+				size = st.credit
+			}
+			if size > st.sess.config.MaxFrameSize {
+				size = st.sess.config.MaxFrameSize
+			}
+			st.credit -= size
+			st.mu.Unlock()
+			return size, nil
+		}
+
+		timeout, stop := deadlineTimer(st.wd)
+		wdChanged := st.wdChanged
+		st.mu.Unlock()
+
+		select {
+		case <-st.chWrite:
+		case <-timeout:
+		case <-wdChanged:
+		case <-st.sess.die:
+		}
+		stop()
+	}
+}
+
+// waitWritten waits for a data frame to be written to kcp, the frame is
+// dropped if the write deadline passes before it leaves the queue
+func (st *Stream) waitWritten(req *writeRequest) error {
+	for {
+		st.mu.Lock()
+		if !st.wd.IsZero() && !time.Now().Before(st.wd) {
+			st.mu.Unlock()
+			if st.sess.unqueue(req) {
+				return errTimeout
+			}
+			return st.sess.wait(req)
+		}
+		timeout, stop := deadlineTimer(st.wd)
+		wdChanged := st.wdChanged
+		st.mu.Unlock()
+
+		select {
+		case err := <-req.result:
+			stop()
+			return err
+		case <-timeout:
+		case <-wdChanged:
+		case <-st.sess.die:
+			stop()
+			return st.sess.closeErr()
+		}
+		stop()
+	}
+}
+
+// push queues the data of a frame received, the remote may not send more
+// than granted
+func (st *Stream) push(data []byte) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	st.received += uint64(len(data))
+	if st.received > st.granted {
+		return errProtocol
+	}
+	if st.closed || len(data) == 0 {
+		return nil
+	}
+	st.buffers = append(st.buffers, data)
+	notify(st.chRead)
+	return nil
+}
+
+// grant gives this side more bytes to send
+func (st *Stream) grant(increment uint32) {
+	st.mu.Lock()
+	st.credit += int(increment)
+	st.mu.Unlock()
+	notify(st.chWrite)
+}
+
+// finReceived ends the data of the remote, the stream is forgotten once
+// closed on both sides
+func (st *Stream) finReceived() {
+	st.mu.Lock()
+	st.finRecv = true
+	closed := st.closed
+	st.mu.Unlock()
+	notify(st.chRead)
+	if closed {
+		st.sess.removeStream(st.id)
+	}
+}
+
+// Close ends the stream, the remote reads io.EOF once it read the data
+// written before.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return errBrokenPipe
+	}
+	st.closed = true
+	st.buffers = nil
+	finRecv := st.finRecv
+	close(st.rdChanged)
+	st.rdChanged = make(chan struct{})
+	close(st.wdChanged)
+	st.wdChanged = make(chan struct{})
+	st.mu.Unlock()
+
+	st.sess.queueFrame(controlPriority, cmdFIN, st.id, nil)
+	if finRecv {
+		st.sess.removeStream(st.id)
+	}
+	return nil
+}
+
+// LocalAddr returns the local address of the kcp session.
+func (st *Stream) LocalAddr() net.Addr { return st.sess.conn.LocalAddr() }
+
+// RemoteAddr returns the remote address of the kcp session.
+func (st *Stream) RemoteAddr() net.Addr { return st.sess.conn.RemoteAddr() }
+
+// SetDeadline sets the read and write deadlines of the stream, as in the
+// net.Conn interface. Every goroutine blocked in Read or Write picks up the
+// new deadline. A zero time value disables the deadline.
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline implements the Conn SetReadDeadline method.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.rd = t
+	close(st.rdChanged)
+	st.rdChanged = make(chan struct{})
+	st.mu.Unlock()
+	return nil
+}
+
+// SetWriteDeadline implements the Conn SetWriteDeadline method.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.wd = t
+	close(st.wdChanged)
+	st.wdChanged = make(chan struct{})
+	st.mu.Unlock()
+	return nil
+}
+
+// deadlineTimer returns a channel firing at the deadline t, nil if t is zero,
+// and a function releasing the timer
+func deadlineTimer(t time.Time) (<-chan time.Time, func()) {
+	if t.IsZero() {
+		return nil, func() {}
+	}
+	timer := time.NewTimer(time.Until(t))
+	return timer.C, func() { timer.Stop() }
+}
+
+// notify wakes the goroutine waiting on a channel of capacity 1
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
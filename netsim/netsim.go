@@ -0,0 +1,147 @@
+// Package netsim wraps a net.PacketConn to simulate an impaired network,
+// outgoing packets are lost, duplicated or reordered from a seeded random
+// source, so a test sees the same network on every run.
+//
+// Loss follows the Gilbert-Elliott model, a two-state channel where the
+// good state loses packets with probability LossGood and the bad state
+// with probability LossBad. Before each packet the channel moves from the
+// good to the bad state with probability P and back with probability R,
+// bursts of the bad state last 1/R packets on average.
+package netsim
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+)
+
+type (
+	// Config describes the impairments of a Conn, the zero value is a
+	// perfect network
+	Config struct {
+		P        float64 // good to bad state transition probability
+		R        float64 // bad to good state transition probability
+		LossGood float64 // loss probability in the good state
+		LossBad  float64 // loss probability in the bad state
+
+		Duplicate    float64 // probability a packet is sent twice
+		Reorder      float64 // probability a packet is held back
+		ReorderDepth int     // packets a held packet is overtaken by, 1 if 0
+
+		Seed int64 // seed of the random source
+	}
+
+	// Stats counts what happened to the packets written to a Conn
+	Stats struct {
+		Packets    uint64 // packets written
+		Lost       uint64
+		Duplicated uint64
+		Reordered  uint64
+		Bursts     uint64 // transitions to the bad state
+	}
+
+	// Conn is a net.PacketConn impairing the packets written to it,
+	// reads are passed through
+	Conn struct {
+		net.PacketConn
+		cfg   Config
+		mu    sync.Mutex
+		rng   *rand.Rand
+		bad   bool
+		held  []heldPacket
+		stats Stats
+	}
+
+	heldPacket struct {
+		data  []byte
+		addr  net.Addr
+		after int // packets to let past before it is sent
+	}
+)
+
+// New wraps conn with the impairments of cfg
+func New(conn net.PacketConn, cfg Config) *Conn {
+	if cfg.ReorderDepth <= 0 {
+		cfg.ReorderDepth = 1
+	}
+	c := new(Conn)
+	c.PacketConn = conn
+	c.cfg = cfg
+	c.rng = rand.New(rand.NewSource(cfg.Seed))
+	return c
+}
+
+// WriteTo sends b to addr through the simulated network, a lost packet
+// is reported as written like a real network would
+func (c *Conn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.stats.Packets++
+	var err error
+	if c.lost() {
+		c.stats.Lost++
+	} else {
+		copies := 1
+		if c.cfg.Duplicate > 0 && c.rng.Float64() < c.cfg.Duplicate {
+			c.stats.Duplicated++
+			copies++
+		}
+		if c.cfg.Reorder > 0 && c.rng.Float64() < c.cfg.Reorder {
+			c.stats.Reordered++
+			for i := 0; i < copies; i++ {
+				data := make([]byte, len(b))
+				copy(data, b)
+				c.held = append(c.held, heldPacket{data, addr, c.cfg.ReorderDepth + 1})
+			}
+		} else {
+			for i := 0; i < copies; i++ {
+				if _, e := c.PacketConn.WriteTo(b, addr); e != nil {
+					err = e
+				}
+			}
+		}
+	}
+
+	// release the held packets the current one went past
+	n := 0
+	for _, h := range c.held {
+		h.after--
+		if h.after > 0 {
+			c.held[n] = h
+			n++
+		} else if _, e := c.PacketConn.WriteTo(h.data, h.addr); e != nil && err == nil {
+			err = e
+		}
+	}
+	c.held = c.held[:n]
+
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// lost advances the channel state and tells if the next packet is lost
+func (c *Conn) lost() bool {
+	if c.bad {
+		if c.rng.Float64() < c.cfg.R {
+			c.bad = false
+		}
+	} else if c.rng.Float64() < c.cfg.P {
+		c.bad = true
+		c.stats.Bursts++
+	}
+	loss := c.cfg.LossGood
+	if c.bad {
+		loss = c.cfg.LossBad
+	}
+	return loss > 0 && c.rng.Float64() < loss
+}
+
+// Stats returns a copy of the counters of c
+func (c *Conn) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
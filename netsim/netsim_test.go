@@ -0,0 +1,122 @@
+package netsim
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"testing"
+)
+
+// recorder is a PacketConn collecting the packets written to it
+type recorder struct {
+	net.PacketConn
+	packets []uint32
+}
+
+func (r *recorder) WriteTo(b []byte, addr net.Addr) (int, error) {
+	r.packets = append(r.packets, binary.LittleEndian.Uint32(b))
+	return len(b), nil
+}
+
+func send(c *Conn, n int) {
+	b := make([]byte, 4)
+	for i := 0; i < n; i++ {
+		binary.LittleEndian.PutUint32(b, uint32(i))
+		c.WriteTo(b, nil)
+	}
+}
+
+func TestPerfect(t *testing.T) {
+	r := new(recorder)
+	send(New(r, Config{}), 1000)
+	for i, id := range r.packets {
+		if id != uint32(i) {
+			t.Fatal("packet", i, "is", id)
+		}
+	}
+	if len(r.packets) != 1000 {
+		t.Fatal(len(r.packets))
+	}
+}
+
+func TestGilbertElliott(t *testing.T) {
+	const N = 100000
+	cfg := Config{P: 0.01, R: 0.25, LossGood: 0.001, LossBad: 0.5, Seed: 1}
+	r := new(recorder)
+	c := New(r, cfg)
+	send(c, N)
+	stats := c.Stats()
+	if stats.Packets != N || uint64(len(r.packets))+stats.Lost != N {
+		t.Fatalf("%+v", stats)
+	}
+
+	// stationary probability of the bad state is P/(P+R)
+	pb := cfg.P / (cfg.P + cfg.R)
+	expected := (1-pb)*cfg.LossGood + pb*cfg.LossBad
+	if rate := float64(stats.Lost) / N; math.Abs(rate-expected) > expected/5 {
+		t.Fatal("loss rate", rate, "expected", expected)
+	}
+
+	// losses come in bursts, a packet following a lost one is lost far
+	// more often than with independent losses of the same rate
+	delivered := make([]bool, N)
+	for _, id := range r.packets {
+		delivered[id] = true
+	}
+	consecutive := 0
+	for i := 1; i < N; i++ {
+		if !delivered[i] && !delivered[i-1] {
+			consecutive++
+		}
+	}
+	if rate := float64(consecutive) / float64(stats.Lost); rate < 5*expected {
+		t.Fatal("no burst loss", rate)
+	}
+
+	// the same seed gives the same network
+	r2 := new(recorder)
+	send(New(r2, cfg), N)
+	if len(r2.packets) != len(r.packets) {
+		t.Fatal("not deterministic")
+	}
+	for i := range r.packets {
+		if r.packets[i] != r2.packets[i] {
+			t.Fatal("not deterministic at", i)
+		}
+	}
+}
+
+func TestDuplicate(t *testing.T) {
+	r := new(recorder)
+	c := New(r, Config{Duplicate: 1})
+	send(c, 10)
+	if len(r.packets) != 20 || c.Stats().Duplicated != 10 {
+		t.Fatal(len(r.packets), c.Stats())
+	}
+}
+
+func TestReorder(t *testing.T) {
+	r := new(recorder)
+	c := New(r, Config{Reorder: 0.3, ReorderDepth: 2, Seed: 1})
+	send(c, 1000)
+	stats := c.Stats()
+	if stats.Reordered == 0 {
+		t.Fatal("nothing reordered")
+	}
+
+	// every packet is delivered once, but the held ones still in flight
+	seen := make(map[uint32]bool)
+	late := 0
+	for i, id := range r.packets {
+		if seen[id] {
+			t.Fatal("duplicate", id)
+		}
+		seen[id] = true
+		if int(id) < i {
+			late++
+		}
+	}
+	if late == 0 || len(r.packets)+len(c.held) != 1000 {
+		t.Fatal(late, len(r.packets), len(c.held))
+	}
+}
@@ -0,0 +1,587 @@
+package kcp
+
+import (
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/mlkem"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+const (
+	noiseProtocol     = "Noise_IK_25519_ChaChaPoly_SHA256"
+	noiseProtocolNN   = "Noise_NN_25519_ChaChaPoly_SHA256" // anonymous key exchange
+	noiseProtocolHFS  = "Noise_NNhfs_25519+MLKEM768_ChaChaPoly_SHA256"
+	noiseKeySize      = 32
+	noiseMsg1Size     = 2*noiseKeySize + 2*chacha20poly1305.Overhead                        // e, s, empty payload
+	noiseMsg1SizeNN   = noiseKeySize                                                        // e, empty payload in the clear
+	noiseMsg1SizeHFS  = noiseKeySize + mlkem.EncapsulationKeySize768                        // e, e1, empty payload in the clear
+	noiseMsg2Size     = noiseKeySize + chacha20poly1305.Overhead                            // e, empty payload
+	noiseMsg2SizeHFS  = noiseMsg2Size + mlkem.CiphertextSize768 + chacha20poly1305.Overhead // e, ekem1, empty payload
+	noiseTimeout      = time.Second                                                         // before the first message is sent again
+	noiseRetries      = 5
+	noisePendingLimit = 1024 // handshakes answered, waiting for the first packet of their session
+	noisePendingTTL   = noiseTimeout * noiseRetries
+	noiseQueue        = 64 // first messages waiting for the handshake workers
+)
+
+type (
+	// NoiseConfig enables a Noise_IK handshake ahead of each session. The
+	// handshake authenticates the listener by its static key, and derives
+	// the keys of the session from ephemeral keys, so that the sessions
+	// recorded stay secret even once the static keys leak. The packets of
+	// the session are then sealed with ChaCha20-Poly1305.
+	NoiseConfig struct {
+		// PrivateKey is the local static key, a dialer without one uses
+		// a random key
+		PrivateKey []byte
+
+		// RemoteKey is the static public key of the listener, required to dial
+		RemoteKey []byte
+
+		// Authorize accepts the static public key of a dialing remote,
+		// nil accepts any remote. It is called by the handshake workers of
+		// the listener, concurrently.
+		Authorize func(key []byte) bool
+
+		anonymous bool // Noise_NN with ephemeral keys only, see DialWithKeyExchange
+		hybrid    bool // Noise_NNhfs, ML-KEM-768 along with X25519
+	}
+
+	// noiseState is the symmetric state of a Noise handshake
+	noiseState struct {
+		ck, h [32]byte
+		k     cipher.AEAD // nil until the first key is mixed in
+		n     uint64
+	}
+
+	// noiseHandshake is the handshake state of either side of Noise_IK,
+	// or Noise_NN if anonymous
+	noiseHandshake struct {
+		noiseState
+		anonymous bool
+		hybrid    bool                       // Noise_NNhfs, anonymous too
+		s, spub   [noiseKeySize]byte         // local static key
+		e, epub   [noiseKeySize]byte         // local ephemeral key
+		rs, re    [noiseKeySize]byte         // remote static and ephemeral keys
+		e1        *mlkem.DecapsulationKey768 // local ephemeral kem key, initiator
+		re1       []byte                     // remote ephemeral kem key, responder
+	}
+
+	// noisePending is a handshake answered by a listener, its session is
+	// created by the first packet authenticated under its keys. It is
+	// forgotten once expired, or replaced by the next handshake of the
+	// remote.
+	noisePending struct {
+		msg1, msg2 []byte
+		block      BlockCrypt
+		addr       string
+		from       net.Addr
+		expires    time.Time
+	}
+)
+
+// GenerateNoiseKey returns a new static key pair for NoiseConfig
+func GenerateNoiseKey() (private, public []byte, err error) {
+	private = make([]byte, noiseKeySize)
+	if _, err := io.ReadFull(crand.Reader, private); err != nil {
+		return nil, nil, err
+	}
+	public, err = curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return nil, nil, err
+	}
+	return private, public, nil
+}
+
+func (ns *noiseState) init(protocol string) {
+	copy(ns.h[:], protocol)
+	ns.ck = ns.h
+	ns.mixHash(nil) // empty prologue
+}
+
+func (ns *noiseState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(ns.h[:])
+	h.Write(data)
+	h.Sum(ns.h[:0])
+}
+
+func (ns *noiseState) mixKey(ikm []byte) {
+	var k [32]byte
+	ns.ck, k = noiseHKDF(ns.ck[:], ikm)
+	ns.k, _ = chacha20poly1305.New(k[:])
+	ns.n = 0
+}
+
+func (ns *noiseState) nonce() []byte {
+	var nonce [chacha20poly1305.NonceSize]byte
+	binary.LittleEndian.PutUint64(nonce[4:], ns.n)
+	ns.n++
+	return nonce[:]
+}
+
+// encryptAndHash appends the encrypted plaintext to out
+func (ns *noiseState) encryptAndHash(out, plaintext []byte) []byte {
+	ciphertext := plaintext
+	if ns.k != nil {
+		ciphertext = ns.k.Seal(nil, ns.nonce(), plaintext, ns.h[:])
+	}
+	ns.mixHash(ciphertext)
+	return append(out, ciphertext...)
+}
+
+func (ns *noiseState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	plaintext := ciphertext
+	if ns.k != nil {
+		var err error
+		if plaintext, err = ns.k.Open(nil, ns.nonce(), ciphertext, ns.h[:]); err != nil {
+			return nil, errNoiseHandshake
+		}
+	}
+	ns.mixHash(ciphertext)
+	return plaintext, nil
+}
+
+// split derives the keys of the packets sent by the initiator and the responder
+func (ns *noiseState) split() (k1, k2 [32]byte) {
+	return noiseHKDF(ns.ck[:], nil)
+}
+
+// noiseHKDF is the two outputs HKDF of the Noise specification
+func noiseHKDF(ck, ikm []byte) (out1, out2 [32]byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{1})
+	mac.Sum(out1[:0])
+	mac.Reset()
+	mac.Write(out1[:])
+	mac.Write([]byte{2})
+	mac.Sum(out2[:0])
+	return
+}
+
+func newNoiseHandshake(private []byte, anonymous, hybrid bool) (*noiseHandshake, error) {
+	hs := &noiseHandshake{anonymous: anonymous || hybrid, hybrid: hybrid}
+	if private == nil {
+		if _, err := io.ReadFull(crand.Reader, hs.s[:]); err != nil {
+			return nil, err
+		}
+	} else if len(private) != noiseKeySize {
+		return nil, errNoiseKey
+	} else {
+		copy(hs.s[:], private)
+	}
+	pub, err := curve25519.X25519(hs.s[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(hs.spub[:], pub)
+	if _, err := io.ReadFull(crand.Reader, hs.e[:]); err != nil {
+		return nil, err
+	}
+	pub, err = curve25519.X25519(hs.e[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(hs.epub[:], pub)
+	if hybrid {
+		hs.init(noiseProtocolHFS)
+	} else if anonymous {
+		hs.init(noiseProtocolNN)
+	} else {
+		hs.init(noiseProtocol)
+	}
+	return hs, nil
+}
+
+// mixDH mixes the shared secret of a local private and a remote public key in
+func (hs *noiseHandshake) mixDH(private, public *[noiseKeySize]byte) error {
+	shared, err := curve25519.X25519(private[:], public[:])
+	if err != nil {
+		return errNoiseHandshake
+	}
+	hs.mixKey(shared)
+	return nil
+}
+
+// newNoiseInitiator starts the handshake of a dialer with the listener's static key
+func newNoiseInitiator(config *NoiseConfig) (*noiseHandshake, error) {
+	if config.anonymous || config.hybrid {
+		hs, err := newNoiseHandshake(nil, config.anonymous, config.hybrid)
+		if err != nil || !hs.hybrid {
+			return hs, err
+		}
+		if hs.e1, err = mlkem.GenerateKey768(); err != nil {
+			return nil, err
+		}
+		return hs, nil
+	}
+	if len(config.RemoteKey) != noiseKeySize {
+		return nil, errNoiseKey
+	}
+	hs, err := newNoiseHandshake(config.PrivateKey, false, false)
+	if err != nil {
+		return nil, err
+	}
+	copy(hs.rs[:], config.RemoteKey)
+	hs.mixHash(hs.rs[:]) // <- s
+	return hs, nil
+}
+
+// newNoiseResponder starts the handshake of a listener
+func newNoiseResponder(config *NoiseConfig) (*noiseHandshake, error) {
+	if config.anonymous || config.hybrid {
+		return newNoiseHandshake(nil, config.anonymous, config.hybrid)
+	}
+	if len(config.PrivateKey) != noiseKeySize {
+		return nil, errNoiseKey
+	}
+	hs, err := newNoiseHandshake(config.PrivateKey, false, false)
+	if err != nil {
+		return nil, err
+	}
+	hs.mixHash(hs.spub[:]) // <- s
+	return hs, nil
+}
+
+// msg1Size returns the size of the first handshake message
+func (hs *noiseHandshake) msg1Size() int {
+	switch {
+	case hs.hybrid:
+		return noiseMsg1SizeHFS
+	case hs.anonymous:
+		return noiseMsg1SizeNN
+	}
+	return noiseMsg1Size
+}
+
+// msg2Size returns the size of the second handshake message
+func (hs *noiseHandshake) msg2Size() int {
+	if hs.hybrid {
+		return noiseMsg2SizeHFS
+	}
+	return noiseMsg2Size
+}
+
+// writeMsg1 returns -> e, es, s, ss, or -> e if anonymous, or -> e, e1 if
+// hybrid
+func (hs *noiseHandshake) writeMsg1() ([]byte, error) {
+	msg := make([]byte, 0, hs.msg1Size())
+	msg = append(msg, hs.epub[:]...)
+	hs.mixHash(hs.epub[:])
+	if hs.hybrid {
+		msg = hs.encryptAndHash(msg, hs.e1.EncapsulationKey().Bytes())
+	}
+	if hs.anonymous {
+		return hs.encryptAndHash(msg, nil), nil
+	}
+	if err := hs.mixDH(&hs.e, &hs.rs); err != nil {
+		return nil, err
+	}
+	msg = hs.encryptAndHash(msg, hs.spub[:])
+	if err := hs.mixDH(&hs.s, &hs.rs); err != nil {
+		return nil, err
+	}
+	return hs.encryptAndHash(msg, nil), nil
+}
+
+// readMsg1 reads -> e, es, s, ss, or -> e if anonymous, or -> e, e1 if
+// hybrid
+func (hs *noiseHandshake) readMsg1(msg []byte) error {
+	if len(msg) != hs.msg1Size() {
+		return errNoiseHandshake
+	}
+	copy(hs.re[:], msg)
+	hs.mixHash(hs.re[:])
+	if hs.hybrid {
+		re1, err := hs.decryptAndHash(msg[noiseKeySize:noiseMsg1SizeHFS])
+		if err != nil {
+			return err
+		}
+		hs.re1 = append([]byte(nil), re1...)
+		msg = msg[mlkem.EncapsulationKeySize768:]
+	}
+	if hs.anonymous {
+		_, err := hs.decryptAndHash(msg[noiseKeySize:])
+		return err
+	}
+	if err := hs.mixDH(&hs.s, &hs.re); err != nil {
+		return err
+	}
+	rs, err := hs.decryptAndHash(msg[noiseKeySize : 2*noiseKeySize+chacha20poly1305.Overhead])
+	if err != nil {
+		return err
+	}
+	copy(hs.rs[:], rs)
+	if err := hs.mixDH(&hs.s, &hs.rs); err != nil {
+		return err
+	}
+	_, err = hs.decryptAndHash(msg[2*noiseKeySize+chacha20poly1305.Overhead:])
+	return err
+}
+
+// writeMsg2 returns <- e, ee, se, or <- e, ee if anonymous, or
+// <- e, ee, ekem1 if hybrid
+func (hs *noiseHandshake) writeMsg2() ([]byte, error) {
+	msg := make([]byte, 0, hs.msg2Size())
+	msg = append(msg, hs.epub[:]...)
+	hs.mixHash(hs.epub[:])
+	if err := hs.mixDH(&hs.e, &hs.re); err != nil {
+		return nil, err
+	}
+	if hs.hybrid {
+		re1, err := mlkem.NewEncapsulationKey768(hs.re1)
+		if err != nil {
+			return nil, errNoiseHandshake
+		}
+		shared, ciphertext := re1.Encapsulate()
+		msg = hs.encryptAndHash(msg, ciphertext)
+		hs.mixKey(shared)
+	}
+	if !hs.anonymous {
+		if err := hs.mixDH(&hs.e, &hs.rs); err != nil {
+			return nil, err
+		}
+	}
+	return hs.encryptAndHash(msg, nil), nil
+}
+
+// readMsg2 reads <- e, ee, se, or <- e, ee if anonymous, or <- e, ee, ekem1
+// if hybrid
+func (hs *noiseHandshake) readMsg2(msg []byte) error {
+	if len(msg) != hs.msg2Size() {
+		return errNoiseHandshake
+	}
+	copy(hs.re[:], msg)
+	hs.mixHash(hs.re[:])
+	if err := hs.mixDH(&hs.e, &hs.re); err != nil {
+		return err
+	}
+	if hs.hybrid {
+		end := noiseKeySize + mlkem.CiphertextSize768 + chacha20poly1305.Overhead
+		ciphertext, err := hs.decryptAndHash(msg[noiseKeySize:end])
+		if err != nil {
+			return err
+		}
+		shared, err := hs.e1.Decapsulate(ciphertext)
+		if err != nil {
+			return errNoiseHandshake
+		}
+		hs.mixKey(shared)
+		msg = msg[end-noiseKeySize:]
+	}
+	if !hs.anonymous {
+		if err := hs.mixDH(&hs.s, &hs.re); err != nil {
+			return err
+		}
+	}
+	_, err := hs.decryptAndHash(msg[noiseKeySize:])
+	return err
+}
+
+// crypt returns the crypt of the session once the handshake completed
+func (hs *noiseHandshake) crypt(initiator bool) BlockCrypt {
+	k1, k2 := hs.split()
+	if !initiator {
+		k1, k2 = k2, k1
+	}
+	c := new(aeadCrypt)
+	c.init(chacha20poly1305.New, k1[:], k2[:])
+	return c
+}
+
+// dialNoise runs the handshake of a dialer on conn, the first message is
+// sent again until the listener answers or ctx is done
+func dialNoise(ctx context.Context, conn net.PacketConn, raddr net.Addr, config *NoiseConfig) (BlockCrypt, error) {
+	hs, err := newNoiseInitiator(config)
+	if err != nil {
+		return nil, err
+	}
+	msg1, err := hs.writeMsg1()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	// a done ctx ends the read in progress
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	// only the challenges answering msg1 are echoed
+	tags := new(cookieTags)
+	tags.sent(msg1)
+
+	buf := make([]byte, mtuLimit)
+	for i := 0; i < noiseRetries; i++ {
+		if _, err := conn.WriteTo(msg1, raddr); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(noiseTimeout))
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					break
+				}
+				return nil, err
+			}
+			if from.String() != raddr.String() {
+				continue
+			}
+			if tags.challenged(buf[:n]) {
+				// the listener challenges before answering the handshake
+				echoCookie(conn, nil, buf[:n], raddr)
+				conn.WriteTo(msg1, raddr)
+				continue
+			}
+			if n != hs.msg2Size() {
+				continue
+			}
+			// a forged answer spoils the state, which is replayed from a copy
+			attempt := *hs
+			if err := attempt.readMsg2(buf[:n]); err != nil {
+				atomic.AddUint64(&DefaultSnmp.InAuthErrors, 1)
+				continue
+			}
+			return attempt.crypt(true), nil
+		}
+	}
+	return nil, errNoiseTimeout
+}
+
+// msg1Size returns the size of the first handshake message under config
+func (config *NoiseConfig) msg1Size() int {
+	hs := noiseHandshake{anonymous: config.anonymous || config.hybrid, hybrid: config.hybrid}
+	return hs.msg1Size()
+}
+
+// noiseInput runs the handshake of a listener for a remote without session.
+// It returns the crypt of an answered handshake to try the packet with,
+// false if the packet was a handshake message. The first messages are
+// answered by the handshake workers, a new one from a remote with a
+// handshake answered replaces it once answered.
+func (l *Listener) noiseInput(addr string, from net.Addr, data []byte) (BlockCrypt, bool) {
+	msg1 := len(data) == l.noise.msg1Size()
+	if p := l.noisePending[addr]; p != nil {
+		if bytes.Equal(data, p.msg1) { // the answer was lost
+			l.extension().writeTo(l.conn, p.msg2, from)
+			return nil, false
+		}
+		if msg1 {
+			// the remote restarted its handshake, or a packet of the
+			// session has the size of a first message
+			l.queueNoise(addr, from, data)
+		}
+		return p.block, true
+	}
+	if msg1 {
+		l.queueNoise(addr, from, data)
+	}
+	return nil, false
+}
+
+// queueNoise hands a first message to the handshake workers, it is dropped
+// if they're busy, and the remote sends it again
+func (l *Listener) queueNoise(addr string, from net.Addr, data []byte) {
+	p := &noisePending{msg1: make([]byte, len(data)), addr: addr, from: from}
+	copy(p.msg1, data)
+	select {
+	case l.noiseJobs <- p:
+	default:
+		atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+	}
+}
+
+// noiseWorker answers the first messages queued, off the goroutine of
+// monitor, and hands the handshakes answered to monitor
+func (l *Listener) noiseWorker() {
+	for {
+		select {
+		case p := <-l.noiseJobs:
+			if l.answerNoise(p) {
+				select {
+				case l.chNoise <- p:
+				case <-l.die:
+					return
+				}
+			}
+		case <-l.die:
+			return
+		}
+	}
+}
+
+// answerNoise reads the first message of a handshake and fills in the
+// answer and the crypt of the session, false if the handshake failed
+func (l *Listener) answerNoise(p *noisePending) bool {
+	hs, err := newNoiseResponder(l.noise)
+	if err != nil {
+		reportError(err)
+		return false
+	}
+	if err := hs.readMsg1(p.msg1); err != nil {
+		atomic.AddUint64(&DefaultSnmp.InAuthErrors, 1)
+		return false
+	}
+	if !hs.anonymous && l.noise.Authorize != nil && !l.noise.Authorize(hs.rs[:]) {
+		return false
+	}
+	if p.msg2, err = hs.writeMsg2(); err != nil {
+		reportError(err)
+		return false
+	}
+	p.block = hs.crypt(false)
+	return true
+}
+
+// addNoise keeps a handshake answered by a worker and sends the answer, the
+// caller is monitor. A handshake answered twice keeps its first answer, and
+// the handshake expiring first makes room for a new one.
+func (l *Listener) addNoise(p *noisePending, now time.Time) {
+	if _, ok := l.sessions[p.addr]; ok {
+		return
+	}
+	if old := l.noisePending[p.addr]; old != nil && bytes.Equal(old.msg1, p.msg1) {
+		return
+	}
+	l.purgeNoise(now)
+	if len(l.noisePending) >= noisePendingLimit {
+		var oldest *noisePending
+		for _, q := range l.noisePending {
+			if oldest == nil || q.expires.Before(oldest.expires) {
+				oldest = q
+			}
+		}
+		delete(l.noisePending, oldest.addr)
+	}
+	p.expires = now.Add(noisePendingTTL)
+	l.noisePending[p.addr] = p
+	l.extension().writeTo(l.conn, p.msg2, p.from)
+}
+
+// purgeNoise forgets the handshakes expired, the caller is monitor
+func (l *Listener) purgeNoise(now time.Time) {
+	for addr, p := range l.noisePending {
+		if now.After(p.expires) {
+			delete(l.noisePending, addr)
+		}
+	}
+}
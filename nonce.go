@@ -0,0 +1,235 @@
+package kcp
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	aeadSaltSize = 12   // random salt of the explicit nonces, then a counter
+	replayWords  = 256  // bitmap words of a replay window
+	replaySalts  = 4096 // remote salts tracked by a crypt
+)
+
+// aeadSubkeyLabel prefixes the salt in the derivation of a subkey
+const aeadSubkeyLabel = "kcp-go aead subkey"
+
+type (
+	// NonceCrypt is an AEADCrypt whose nonces are a random salt followed by
+	// a counter, carried in each packet. Each crypt picks its own 96 bits
+	// salt and seals under a subkey derived from the key and the salt, so
+	// that the nonces never repeat under a subkey, even across processes
+	// sharing a key. The packets replaying a nonce already received are
+	// dropped. The state may be persisted, so that a process restarting
+	// with the same salt never reuses a nonce either.
+	NonceCrypt interface {
+		AEADCrypt
+
+		// NonceState returns the salt of the nonces sealed and the counter
+		// of the last one.
+		NonceState() (salt []byte, counter uint64)
+
+		// SetNonceState restores the state returned by NonceState before the
+		// crypt is used. Nonces sealed after the state was saved must be
+		// skipped, by saving the counter ahead of use or restoring it with a
+		// margin.
+		SetNonceState(salt []byte, counter uint64)
+	}
+
+	// replayChecker is implemented by the crypts dropping replayed nonces
+	replayChecker interface {
+		fresh(packet []byte) bool
+	}
+
+	// nonceMover is a NonceCrypt whose state moves with the sessions by
+	// Export and Import
+	nonceMover interface {
+		NonceCrypt
+		restoreNonce(salt []byte, counter uint64)
+		replay(salt []byte) *replayState
+		restoreReplay(st *replayState)
+	}
+
+	// replayState is the replay window of a remote salt, gob encoded
+	replayState struct {
+		Salt []byte
+		Top  uint64
+		Bits []uint64
+	}
+
+	// nonceState generates the explicit nonces of a crypt and tracks the
+	// nonces received from each remote salt
+	nonceState struct {
+		salt    [aeadSaltSize]byte // set before use
+		counter uint64             // atomic
+
+		mu      sync.Mutex
+		windows map[[aeadSaltSize]byte]*replayWindow // by remote salt
+		tick    uint64                               // use of the windows, for eviction
+	}
+
+	// replayWindow tracks the counters received behind the newest one
+	replayWindow struct {
+		top  uint64 // newest counter received
+		bits [replayWords]uint64
+		used uint64      // tick of the last use
+		open cipher.AEAD // under the subkey of the salt, once a packet opened
+	}
+)
+
+// aeadSubkey derives the subkey of a salt from an AEAD key of 32 bytes or
+// less, as long as key
+func aeadSubkey(key, salt []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(aeadSubkeyLabel))
+	mac.Write(salt)
+	return mac.Sum(nil)[:len(key)]
+}
+
+// init picks the random salt of the nonces
+func (n *nonceState) init() {
+	io.ReadFull(crand.Reader, n.salt[:])
+	n.windows = make(map[[aeadSaltSize]byte]*replayWindow)
+}
+
+// next fills in the next nonce
+func (n *nonceState) next(nonce []byte) {
+	copy(nonce, n.salt[:])
+	binary.LittleEndian.PutUint64(nonce[aeadSaltSize:], atomic.AddUint64(&n.counter, 1))
+}
+
+// window returns the window of a remote salt, created if missing, with
+// mu held
+func (n *nonceState) window(salt []byte) *replayWindow {
+	var key [aeadSaltSize]byte
+	copy(key[:], salt)
+	n.tick++
+	w := n.windows[key]
+	if w == nil {
+		// forget the remote unheard of the longest
+		if len(n.windows) >= replaySalts {
+			var oldest [aeadSaltSize]byte
+			used := n.tick
+			for s, w := range n.windows {
+				if w.used < used {
+					oldest, used = s, w.used
+				}
+			}
+			delete(n.windows, oldest)
+		}
+		w = new(replayWindow)
+		n.windows[key] = w
+	}
+	w.used = n.tick
+	return w
+}
+
+// opener returns the cipher opening the packets of a remote salt, nil
+// until a packet opened under it
+func (n *nonceState) opener(salt []byte) cipher.AEAD {
+	var key [aeadSaltSize]byte
+	copy(key[:], salt)
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if w := n.windows[key]; w != nil {
+		return w.open
+	}
+	return nil
+}
+
+// remember keeps the cipher a packet of a remote salt opened under
+func (n *nonceState) remember(salt []byte, open cipher.AEAD) {
+	n.mu.Lock()
+	n.window(salt).open = open
+	n.mu.Unlock()
+}
+
+// fresh tells if an authenticated nonce wasn't received before, and
+// remembers it
+func (n *nonceState) fresh(nonce []byte) bool {
+	counter := binary.LittleEndian.Uint64(nonce[aeadSaltSize:])
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.window(nonce[:aeadSaltSize]).check(counter)
+}
+
+// check tells if counter wasn't received before and marks it, counters too
+// far behind the newest one are rejected
+func (w *replayWindow) check(counter uint64) bool {
+	if counter > w.top {
+		// clear the words passed by the window
+		for k := w.top/64 + 1; k <= counter/64 && k-w.top/64 <= replayWords; k++ {
+			w.bits[k%replayWords] = 0
+		}
+		w.top = counter
+	} else if w.top-counter >= (replayWords-1)*64 {
+		return false
+	}
+	word, bit := &w.bits[counter/64%replayWords], uint64(1)<<(counter%64)
+	if *word&bit != 0 {
+		return false
+	}
+	*word |= bit
+	return true
+}
+
+// NonceState implements NonceCrypt
+func (c *aeadCrypt) NonceState() (salt []byte, counter uint64) {
+	return append([]byte(nil), c.nonce.salt[:]...), atomic.LoadUint64(&c.nonce.counter)
+}
+
+// SetNonceState implements NonceCrypt, the subkey sealing is derived from
+// the salt restored
+func (c *aeadCrypt) SetNonceState(salt []byte, counter uint64) {
+	copy(c.nonce.salt[:], salt)
+	atomic.StoreUint64(&c.nonce.counter, counter)
+	c.seal, _ = c.newAEAD(aeadSubkey(c.sealKey, c.nonce.salt[:]))
+}
+
+// restoreNonce restores the nonces of a session sealed by another process,
+// the counter of the salt never goes back, as the sessions of a listener
+// share its crypt
+func (c *aeadCrypt) restoreNonce(salt []byte, counter uint64) {
+	if current, sealed := c.NonceState(); bytes.Equal(current, salt) && sealed > counter {
+		counter = sealed
+	}
+	c.SetNonceState(salt, counter)
+}
+
+// replay returns the replay window of a remote salt, nil if unknown
+func (c *aeadCrypt) replay(salt []byte) *replayState {
+	var key [aeadSaltSize]byte
+	copy(key[:], salt)
+	c.nonce.mu.Lock()
+	defer c.nonce.mu.Unlock()
+	w := c.nonce.windows[key]
+	if w == nil {
+		return nil
+	}
+	return &replayState{Salt: key[:], Top: w.top, Bits: append([]uint64(nil), w.bits[:]...)}
+}
+
+// restoreReplay restores the replay window of a remote salt, unless the
+// salt was received already
+func (c *aeadCrypt) restoreReplay(st *replayState) {
+	if len(st.Salt) != aeadSaltSize || len(st.Bits) != replayWords {
+		return
+	}
+	var key [aeadSaltSize]byte
+	copy(key[:], st.Salt)
+	c.nonce.mu.Lock()
+	defer c.nonce.mu.Unlock()
+	if c.nonce.windows[key] != nil {
+		return
+	}
+	w := c.nonce.window(st.Salt)
+	w.top = st.Top
+	copy(w.bits[:], st.Bits)
+}
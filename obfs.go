@@ -0,0 +1,107 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+const (
+	// the padding frame wraps a packet after its crypt header, its type sits
+	// where fec headers have their flag and kcp packets their cmd, so that
+	// receivers tell it apart without being configured
+	typePadding       = 0xf7 // packet padded to a size bucket
+	typeDummy         = 0xf8 // dummy packet, dropped by the receiver
+	paddingHeaderSize = 5    // packet length(4) + type(1)
+)
+
+// obfsParams defines how the packets sent are shaped
+type obfsParams struct {
+	buckets []int         // packet sizes padded to, ascending
+	dummy   time.Duration // mean interval of the dummy packets, 0 disables
+}
+
+// SetObfuscation pads the packets sent up to the smallest of the bucket
+// sizes they fit in, crypt header included, and sends a dummy packet of a
+// random bucket size every dummy interval on average, making the flow harder
+// to fingerprint by packet length and timing. Packets larger than every
+// bucket are sent as is. The remote strips the padding and drops the dummy
+// packets whether or not it shapes its own packets. No buckets disables the
+// padding, dummy 0 disables the dummy packets (default).
+func (s *UDPSession) SetObfuscation(buckets []int, dummy time.Duration) error {
+	p := obfsParams{buckets: append([]int(nil), buckets...), dummy: dummy}
+	sort.Ints(p.buckets)
+	for _, size := range p.buckets {
+		if size < s.headerSize+paddingHeaderSize+IKCP_OVERHEAD || size > mtuLimit {
+			return errObfsParams
+		}
+	}
+	if dummy < 0 || dummy > 0 && len(p.buckets) == 0 {
+		return errObfsParams
+	}
+
+	// the packets sent from now on are padded, outputTask times the dummy
+	// packets, the latest setting wins
+	s.obfs.Store(&p)
+	select {
+	case <-s.chObfsParams:
+	default:
+	}
+	s.chObfsParams <- p
+	return nil
+}
+
+// obfuscation returns the packet shaping of the session, nil if never set
+func (s *UDPSession) obfuscation() *obfsParams {
+	p, _ := s.obfs.Load().(*obfsParams)
+	return p
+}
+
+// pad wraps the packet in ext after its crypt header of off bytes into a
+// padding frame, grown to the smallest bucket it fits in
+func (p *obfsParams) pad(ext []byte, off int) []byte {
+	n := len(ext) - off
+	k := sort.SearchInts(p.buckets, len(ext)+paddingHeaderSize)
+	if k == len(p.buckets) {
+		return ext
+	}
+	ext = ext[:p.buckets[k]]
+	copy(ext[off+paddingHeaderSize:], ext[off:off+n])
+	binary.LittleEndian.PutUint32(ext[off:], uint32(n))
+	ext[off+4] = typePadding
+	padding := ext[off+paddingHeaderSize+n:]
+	xorBytes(padding, padding, padding)
+	return ext
+}
+
+// dummyPacket fills ext with a dummy packet of a random bucket size after
+// its crypt header of off bytes
+func (p *obfsParams) dummyPacket(ext []byte, off int, r *rand.Rand) []byte {
+	ext = ext[:p.buckets[r.Intn(len(p.buckets))]]
+	r.Read(ext[off:])
+	binary.LittleEndian.PutUint32(ext[off:], 0)
+	ext[off+4] = typeDummy
+	return ext
+}
+
+// nextDummy returns the random interval before the next dummy packet
+func (p *obfsParams) nextDummy(r *rand.Rand) time.Duration {
+	return time.Duration(r.ExpFloat64() * float64(p.dummy))
+}
+
+// unpad strips the padding frame of a decrypted packet, it returns false
+// for dummy and malformed packets
+func unpad(data []byte) ([]byte, bool) {
+	if len(data) < paddingHeaderSize || data[4] != typePadding && data[4] != typeDummy {
+		return data, true
+	}
+	if data[4] == typeDummy {
+		return nil, false
+	}
+	n := binary.LittleEndian.Uint32(data)
+	if n > uint32(len(data)-paddingHeaderSize) {
+		return nil, false
+	}
+	return data[paddingHeaderSize : paddingHeaderSize+int(n)], true
+}
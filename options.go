@@ -0,0 +1,227 @@
+package kcp
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+type (
+	// Option configures a session of Dial, or the listener of Listen and
+	// its sessions
+	Option func(o *options)
+
+	// rtoBounds are the parameters of SetRTOBounds
+	rtoBounds struct {
+		min, max time.Duration
+		backoff  float64
+	}
+
+	// options are the configuration of Dial and Listen
+	options struct {
+		block        BlockCrypt   // packet encryption, nil for none
+		noise        *NoiseConfig // handshake ahead of the sessions of a listener, if enabled
+		rto          *rtoBounds   // of SetRTOBounds, if set
+		dataShards   int
+		parityShards int
+		sndwnd       int   // send window in segments, 0 keeps the default
+		rcvwnd       int   // receive window in segments, 0 keeps the default
+		nodelay      []int // parameters of SetNoDelay, if set
+		readBuffer   int   // SO_RCVBUF of the socket
+		writeBuffer  int   // SO_SNDBUF of the socket
+		dscp         int   // DSCP of the packets, -1 keeps the default
+		pacing       bool  // spread the segments, see SetPacing
+		loss         int   // loss detection mode, see SetLossDetection
+		sack         bool  // acknowledge by ranges, see SetSACK
+		deadLink     int   // retransmission limit of SetDeadLink, 0 keeps the default
+		deadFail     bool  // a dead link closes the session
+		frto         bool  // detect the spurious timeouts, see SetFRTO
+		windowBudget int   // memory of the windows tuned, see SetWindowAutoTune
+	}
+)
+
+// WithCrypt encrypts the packets with block, see DialWithOptions.
+func WithCrypt(block BlockCrypt) Option {
+	return func(o *options) { o.block = block }
+}
+
+// WithFEC enables Reed-Solomon erasure coding, see DialWithOptions,
+// parityShards 0 disables it.
+func WithFEC(dataShards, parityShards int) Option {
+	return func(o *options) { o.dataShards, o.parityShards = dataShards, parityShards }
+}
+
+// WithWindowSize sets the window sizes of the sessions, in segments, as
+// SetWindowSize does, 0 keeps a default.
+func WithWindowSize(sndwnd, rcvwnd int) Option {
+	return func(o *options) { o.sndwnd, o.rcvwnd = sndwnd, rcvwnd }
+}
+
+// WithNoDelay sets the kcp parameters of the sessions as SetNoDelay does.
+func WithNoDelay(nodelay, interval, resend, nc int) Option {
+	return func(o *options) { o.nodelay = []int{nodelay, interval, resend, nc} }
+}
+
+// WithBuffers sets the sizes of the receive and send buffers of the socket,
+// 16MiB by default, 0 keeps a default.
+func WithBuffers(readBuffer, writeBuffer int) Option {
+	return func(o *options) {
+		if readBuffer > 0 {
+			o.readBuffer = readBuffer
+		}
+		if writeBuffer > 0 {
+			o.writeBuffer = writeBuffer
+		}
+	}
+}
+
+// WithDSCP sets the 6bit DSCP field of the IP header of the packets, see
+// SetDSCP.
+func WithDSCP(dscp int) Option {
+	return func(o *options) { o.dscp = dscp }
+}
+
+// WithPacing spreads the segments of the sessions as SetPacing does.
+func WithPacing(enabled bool) Option {
+	return func(o *options) { o.pacing = enabled }
+}
+
+// WithRTOBounds bounds the retransmission timeout of the sessions as
+// SetRTOBounds does.
+func WithRTOBounds(min, max time.Duration, backoff float64) Option {
+	return func(o *options) { o.rto = &rtoBounds{min, max, backoff} }
+}
+
+// WithLossDetection selects the loss detection of the sessions as
+// SetLossDetection does.
+func WithLossDetection(mode int) Option {
+	return func(o *options) { o.loss = mode }
+}
+
+// WithSACK acknowledges by ranges in the sessions as SetSACK does.
+func WithSACK(enabled bool) Option {
+	return func(o *options) { o.sack = enabled }
+}
+
+// WithDeadLink sets the retransmission limit of the sessions as
+// SetDeadLink does, xmit 0 keeps the default.
+func WithDeadLink(xmit int, fail bool) Option {
+	return func(o *options) { o.deadLink, o.deadFail = xmit, fail }
+}
+
+// WithFRTO detects the spurious timeouts of the sessions as SetFRTO does.
+func WithFRTO(enabled bool) Option {
+	return func(o *options) { o.frto = enabled }
+}
+
+// WithWindowAutoTune sizes the windows of the sessions as
+// SetWindowAutoTune does, from the windows of WithWindowSize on.
+func WithWindowAutoTune(budget int) Option {
+	return func(o *options) { o.windowBudget = budget }
+}
+
+// newOptions returns the configuration of opts
+func newOptions(opts []Option) *options {
+	o := &options{readBuffer: soBuffer, writeBuffer: soBuffer, dscp: -1}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// setup sets up the socket of a session or listener
+func (o *options) setup(conn *net.UDPConn) {
+	conn.SetReadBuffer(o.readBuffer)
+	conn.SetWriteBuffer(o.writeBuffer)
+	if o.dscp >= 0 {
+		setDSCP(conn, o.dscp)
+	}
+}
+
+// tune sets the kcp parameters of a new session
+func (o *options) tune(s *UDPSession) {
+	if o.sndwnd > 0 || o.rcvwnd > 0 {
+		s.SetWindowSize(o.sndwnd, o.rcvwnd)
+	}
+	if o.nodelay != nil {
+		s.SetNoDelay(o.nodelay[0], o.nodelay[1], o.nodelay[2], o.nodelay[3])
+	}
+	if o.pacing {
+		s.SetPacing(true)
+	}
+	if o.rto != nil {
+		s.SetRTOBounds(o.rto.min, o.rto.max, o.rto.backoff)
+	}
+	if o.loss != LossDetectionDupAck {
+		s.SetLossDetection(o.loss)
+	}
+	if o.sack {
+		s.SetSACK(true)
+	}
+	if o.deadLink > 0 {
+		s.SetDeadLink(o.deadLink, o.deadFail)
+	}
+	if o.frto {
+		s.SetFRTO(true)
+	}
+	if o.windowBudget > 0 {
+		s.SetWindowAutoTune(o.windowBudget)
+	}
+}
+
+// check validates the options which the sessions apply
+func (o *options) check() error {
+	if _, err := newSessionFEC(o.dataShards, o.parityShards); err != nil {
+		return err
+	}
+	if o.rto != nil && !validRTOBounds(o.rto.min, o.rto.max, o.rto.backoff) {
+		return errRTOBounds
+	}
+	if o.loss != LossDetectionDupAck && o.loss != LossDetectionRACK {
+		return errLossDetection
+	}
+	if o.deadLink < 0 {
+		return errDeadLink
+	}
+	if o.windowBudget < 0 {
+		return errWindowBudget
+	}
+	return nil
+}
+
+// setDSCP sets the DSCP of the packets of conn, conns which aren't IP
+// sockets are left as is
+func setDSCP(conn net.PacketConn, dscp int) {
+	c, ok := conn.(net.Conn)
+	if !ok {
+		return
+	}
+	if err := ipv4.NewConn(c).SetTOS(dscp << 2); err != nil {
+		log.Println("dscp:", err)
+	}
+}
+
+// DialContext connects like Dial, the resolution of raddr is cancelled
+// once ctx is done.
+func DialContext(ctx context.Context, raddr string, opts ...Option) (*UDPSession, error) {
+	o := newOptions(opts)
+	udpaddr, err := resolveUDPAddr(ctx, raddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := o.check(); err != nil {
+		return nil, err
+	}
+	conn := dialConn()
+	o.setup(conn)
+	sess, err := NewConn(udpaddr, o.block, o.dataShards, o.parityShards, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	o.tune(sess)
+	return sess, nil
+}
@@ -0,0 +1,34 @@
+package kcp
+
+import "time"
+
+const (
+	pacingGain    = 1.25             // of the delivery rate, so that the pacing lets the window grow
+	pacingQuantum = time.Millisecond // burst sent without waiting, the clock of kcp is coarser
+)
+
+// SetPacing spreads the segments sent at the estimated delivery rate, the
+// pacing rate of the congestion control if it has one, the window over the
+// smoothed rtt otherwise, instead of sending each flush in a burst, which
+// builds queues and loses packets on links with shallow buffers. flush
+// holds the new segments back once the rate is spent, and kcp is updated
+// again when they are due. The acks and retransmissions aren't held back,
+// the new segments wait for the retransmissions. Disabled by default.
+func (s *UDPSession) SetPacing(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pacing = enabled
+	s.updatePacingRate()
+}
+
+// updatePacingRate estimates the rate the segments are paced at without a
+// pacing rate of the congestion control, 0 with pacing disabled or before
+// the rtt is measured, the caller holds mu
+func (s *UDPSession) updatePacingRate() {
+	var rate int64
+	if s.pacing && s.kcp.rx_srtt > 0 {
+		window := float64(s.kcp.sendWindow()) * float64(s.kcp.mtu)
+		rate = int64(pacingGain * window * 1000 / float64(s.kcp.rx_srtt))
+	}
+	s.kcp.pace_rate = rate
+}
@@ -0,0 +1,39 @@
+package kcp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Pause halts the sending of the session, retransmissions and window
+// probes included, keeping its state, so that the application holds the
+// remote back, or the session lives through a known blackout of the
+// network, such as the suspension of a laptop, whose retransmissions would
+// otherwise reach the dead link limit, see SessionEvents.DeadLink. The
+// data written is queued, and the packets received are still processed
+// and acknowledged, so that the remote doesn't retransmit them.
+// The idle timeout of the listener spares the paused sessions, the maximum
+// lifetime doesn't. The remote, not paused itself, may see a dead link.
+func (s *UDPSession) Pause() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	atomic.StoreInt32(&s.paused, 1)
+}
+
+// Resume resumes the sending of a paused session, the segments whose
+// retransmission is due are sent at once.
+func (s *UDPSession) Resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if atomic.SwapInt32(&s.paused, 0) == 0 {
+		return
+	}
+	// the silence of the remote during the pause doesn't count as idle
+	atomic.StoreInt64(&s.lastInput, time.Now().UnixNano())
+	s.wakeUpdate()
+}
+
+// Paused tells if the session is paused
+func (s *UDPSession) Paused() bool {
+	return atomic.LoadInt32(&s.paused) != 0
+}
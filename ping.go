@@ -0,0 +1,112 @@
+package kcp
+
+import (
+	"context"
+	"encoding/binary"
+	"time"
+)
+
+const (
+	// cmdPing and cmdPong are the channel tags of the probes of Ping and of
+	// their answers, multiplexed with the kcp segments like the datagrams,
+	// the id of the probe in the sn of the kcp header
+	cmdPing = 91
+	cmdPong = 92
+)
+
+// Ping measures the round trip time to the remote at the application
+// level, from the sending of a probe to the arrival of its answer, sent by
+// the goroutines of the remote session, independently of the smoothed rtt
+// of kcp. The probe, outside of the stream and best-effort, is dropped
+// rather than queued when the output of the session is full, and is sent
+// again every rto until answered. It fails with the error of ctx once ctx is done, or with the
+// error of the session once closed.
+func (s *UDPSession) Ping(ctx context.Context) (time.Duration, error) {
+	answered := make(chan uint32, 1)
+	sent := make(map[uint32]time.Time)
+	defer func() {
+		s.mu.Lock()
+		for id := range sent {
+			delete(s.pings, id)
+		}
+		s.mu.Unlock()
+	}()
+
+	retry := time.NewTimer(0)
+	defer retry.Stop()
+	for {
+		select {
+		case <-retry.C:
+			s.mu.Lock()
+			if s.closed() {
+				err := s.closedErr()
+				s.mu.Unlock()
+				return 0, err
+			}
+			s.pingSeq++
+			id := s.pingSeq
+			s.pings[id] = answered
+			sent[id] = time.Now()
+			s.sendControl(cmdPing, id)
+			rto := time.Duration(s.kcp.rx_rto) * time.Millisecond
+			s.mu.Unlock()
+			retry.Reset(rto)
+		case id := <-answered:
+			return time.Since(sent[id]), nil
+		case <-s.die:
+			s.mu.Lock()
+			err := s.closedErr()
+			s.mu.Unlock()
+			return 0, err
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+}
+
+// isPing tells if a kcp packet is a probe of Ping or its answer
+func isPing(pkt []byte) bool {
+	return len(pkt) >= IKCP_OVERHEAD && (pkt[4] == cmdPing || pkt[4] == cmdPong)
+}
+
+// pingInput answers a probe of the remote, or hands the answer of a probe
+// to its Ping, the caller holds mu
+func (s *UDPSession) pingInput(pkt []byte) {
+	conv := binary.LittleEndian.Uint32(pkt)
+	if conv != s.kcp.conv && !(conv == 0 && s.convAssigned) {
+		return
+	}
+	id := binary.LittleEndian.Uint32(pkt[12:])
+	if pkt[4] == cmdPing {
+		if !s.Paused() {
+			s.sendControl(cmdPong, id)
+		}
+		return
+	}
+	if answered := s.pings[id]; answered != nil {
+		select {
+		case answered <- id:
+		default: // an earlier probe was answered
+		}
+	}
+}
+
+// sendControl sends a frame of the channel cmd outside of kcp, with id in
+// the sn of its header, best-effort: the frame is dropped if the output is
+// full, rather than blocking the caller, which holds mu
+func (s *UDPSession) sendControl(cmd byte, id uint32) {
+	ext := s.xmitBuf.Get().([]byte)[:s.headerSize+IKCP_OVERHEAD]
+	pkt := ext[s.headerSize:]
+	for k := range pkt {
+		pkt[k] = 0
+	}
+	binary.LittleEndian.PutUint32(pkt, s.kcp.conv)
+	pkt[4] = cmd
+	binary.LittleEndian.PutUint32(pkt[8:], currentMs())
+	binary.LittleEndian.PutUint32(pkt[12:], id)
+	select {
+	case s.chUDPOutput <- ext:
+	default:
+		s.xmitBuf.Put(ext[:cap(ext)])
+	}
+}
@@ -0,0 +1,22 @@
+package kcp
+
+// Priorities of WritePriority
+const (
+	PriorityLow    = -1
+	PriorityNormal = 0 // priority of Write
+	PriorityHigh   = 1
+)
+
+// WritePriority writes b like Write, queued ahead of the data written at
+// lower priorities which is still waiting for the congestion window, so
+// that control messages overtake a bulk transfer on the same session. The
+// data already sent, and the rest of a message partly sent, keep their
+// place. The remote reads the data in the order it leaves the queue, the
+// priorities should thus carry separate messages, in message mode, or
+// separate streams of a protocol such as mux on top.
+func (s *UDPSession) WritePriority(b []byte, priority int) (n int, err error) {
+	if priority < PriorityLow || priority > PriorityHigh {
+		return 0, errPriority
+	}
+	return s.write([][]byte{b}, false, false, priority)
+}
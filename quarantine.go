@@ -0,0 +1,70 @@
+package kcp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// convAddr is a conversation with a remote address
+type convAddr struct {
+	addr string
+	conv uint32
+}
+
+// SetQuarantine keeps the conv and the remote address of each session
+// closed in quarantine for period, as TCP keeps a closed connection in
+// TIME_WAIT, their packets being dropped meanwhile, so that the packets of
+// a closed session arriving late neither create a ghost session nor reach
+// a new session reusing the conv. The requests of a conv of a dialer which
+// was assigned its conv are dropped likewise. 0 disables the quarantine
+// (default), the pairs in quarantine are then released.
+func (l *Listener) SetQuarantine(period time.Duration) error {
+	if period < 0 {
+		return errQuarantine
+	}
+	atomic.StoreInt64(&l.quarantine, int64(period))
+	return nil
+}
+
+// quarantineClosed puts the conv of the closed s in quarantine, the caller
+// is monitor
+func (l *Listener) quarantineClosed(s *UDPSession, now time.Time) {
+	period := time.Duration(atomic.LoadInt64(&l.quarantine))
+	if period == 0 {
+		return
+	}
+	if l.quarantined == nil {
+		l.quarantined = make(map[convAddr]time.Time)
+	}
+	addr := s.RemoteAddr().String()
+	l.quarantined[convAddr{addr, s.GetConv()}] = now.Add(period)
+	if s.convAssigned {
+		l.quarantined[convAddr{addr, 0}] = now.Add(period)
+	}
+}
+
+// inQuarantine tells if the packets of conv from addr are dropped, the
+// caller is monitor
+func (l *Listener) inQuarantine(addr string, conv uint32) bool {
+	until, ok := l.quarantined[convAddr{addr, conv}]
+	if !ok {
+		return false
+	}
+	if atomic.LoadInt64(&l.quarantine) == 0 || time.Now().After(until) {
+		delete(l.quarantined, convAddr{addr, conv})
+		return false
+	}
+	atomic.AddUint64(&DefaultSnmp.QuarantineDrops, 1)
+	return true
+}
+
+// purgeQuarantine releases the pairs whose quarantine is over, the caller
+// is monitor
+func (l *Listener) purgeQuarantine(now time.Time) {
+	released := atomic.LoadInt64(&l.quarantine) == 0
+	for pair, until := range l.quarantined {
+		if released || now.After(until) {
+			delete(l.quarantined, pair)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package kcp
+
+const rackMinPTO = 10 // least delay of a tail loss probe, in millisec
+
+// Loss detection modes of SetLossDetection
+const (
+	LossDetectionDupAck = iota // resend after the duplicate acks of the resend parameter of SetNoDelay
+	LossDetectionRACK          // RACK with tail loss probes, robust to reordering
+)
+
+// SetLossDetection selects how the session tells a segment in flight is
+// lost before its rto expires. LossDetectionDupAck, the default, resends a
+// segment once as many later segments as the resend parameter of
+// SetNoDelay were acked, which reordering fools and which never fires for
+// the last segments of a burst. LossDetectionRACK, as in RFC 8985, resends
+// a segment once a segment sent after it was acked and an rtt and a
+// reordering window of a quarter of the lowest rtt have passed since it
+// was sent, and probes the tail of a burst with its last segment after two
+// rtts of silence, so that the ack the probe brings back reveals the
+// losses before the rto.
+func (s *UDPSession) SetLossDetection(mode int) error {
+	switch mode {
+	case LossDetectionDupAck, LossDetectionRACK:
+	default:
+		return errLossDetection
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.SetRACK(mode == LossDetectionRACK)
+	return nil
+}
+
+// LossDetection returns the loss detection mode of SetLossDetection.
+func (s *UDPSession) LossDetection() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.kcp.rack {
+		return LossDetectionRACK
+	}
+	return LossDetectionDupAck
+}
+
+// SetRACK detects the lost segments by RACK with tail loss probes instead
+// of duplicate acks, see UDPSession.SetLossDetection.
+func (kcp *KCP) SetRACK(enabled bool) {
+	kcp.rack = enabled
+	kcp.rack_tlp = false
+}
+
+// rack_ack records the delivery of segment sn, sent at ts
+func (kcp *KCP) rack_ack(ts, sn uint32) {
+	kcp.rack_tlp = false
+	rtt := _itimediff(kcp.current, ts)
+	if rtt < 0 {
+		return
+	}
+	if rtt == 0 { // within the millisecond of the clock
+		rtt = 1
+	}
+	if kcp.rack_minrtt == 0 || kcp.rack_before(kcp.rack_ts, kcp.rack_sn, ts, sn) {
+		kcp.rack_ts, kcp.rack_sn, kcp.rack_rtt = ts, sn, uint32(rtt)
+	}
+	if kcp.rack_minrtt == 0 || uint32(rtt) < kcp.rack_minrtt {
+		kcp.rack_minrtt = uint32(rtt)
+	}
+}
+
+// rack_lost tells if seg, already sent, is lost: a segment sent after it
+// was delivered, and the reordering window passed
+func (kcp *KCP) rack_lost(seg *Segment) bool {
+	if kcp.rack_minrtt == 0 || !kcp.rack_before(seg.ts, seg.sn, kcp.rack_ts, kcp.rack_sn) {
+		return false
+	}
+	reo := _imax_(kcp.rack_minrtt/4, 1)
+	return _itimediff(kcp.current, seg.ts) >= int32(kcp.rack_rtt+reo)
+}
+
+// rack_before tells if the segment sn1 sent at ts1 was sent before the
+// segment sn2 sent at ts2, the sn breaking the ties of the millisecond clock
+func (kcp *KCP) rack_before(ts1, sn1, ts2, sn2 uint32) bool {
+	if d := _itimediff(ts1, ts2); d != 0 {
+		return d < 0
+	}
+	return _itimediff(sn1, sn2) < 0
+}
+
+// rack_probe tells if the last segment of snd_buf is to be sent again as a
+// tail loss probe: nothing follows it, and nothing was acked for two rtts
+// since it was sent
+func (kcp *KCP) rack_probe() bool {
+	if kcp.rack_tlp || len(kcp.snd_queue) > 0 || len(kcp.snd_buf) == 0 || kcp.rx_srtt == 0 {
+		return false
+	}
+	last := &kcp.snd_buf[len(kcp.snd_buf)-1]
+	if last.xmit == 0 {
+		return false
+	}
+	pto := _imax_(2*kcp.rx_srtt, rackMinPTO)
+	return _itimediff(kcp.current, last.ts+pto) >= 0 && _itimediff(last.resendts, kcp.current) > 0
+}
@@ -0,0 +1,780 @@
+package kcp
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// The stream of a ReconnectingConn is framed over its kcp sessions. A frame
+// starts with a 9 bytes header, cmd(1) arg(8) in little endian. Every session
+// opens with a hello of each side, carrying the id of the connection and the
+// offset of the stream received so far, each side then sends again the bytes
+// past the offset of the other.
+const (
+	rcHello = 0 // arg is the offset received, the id(16) of the connection follows
+	rcData  = 1 // arg bytes of the stream follow
+	rcAck   = 2 // arg is the offset read by the application, sent as a keepalive too
+	rcFin   = 3 // the remote closed the connection
+
+	rcHeaderSize = 9
+	rcIDSize     = 16
+	rcFrameSize  = 64 * 1024 // largest payload of a data frame
+	rcBacklog    = 128       // connections not accepted yet
+	rcMinBackoff = 100 * time.Millisecond
+	rcMaxBackoff = 2 * time.Second
+)
+
+type (
+	// ReconnectConfig defines the timeouts and the buffers of a
+	// ReconnectingConn
+	ReconnectConfig struct {
+		Timeout time.Duration // a broken connection fails unless resumed in time
+		Idle    time.Duration // silence of the remote after which a session is dead
+		Window  int           // bytes written and not read by the remote yet
+	}
+
+	// ReconnectingConn is a net.Conn whose stream survives the loss of its
+	// kcp session: the dialer dials a new session once the session dies, and
+	// both sides resume the stream at the offset the other received. The
+	// bytes written are kept until the application of the remote reads them,
+	// Write blocks while Window of them are pending.
+	//
+	// The acks are sent within the stream, so the sessions are always read
+	// to the end: the Window of the remote bounds the bytes received and not
+	// read.
+	ReconnectingConn struct {
+		config ReconnectConfig
+		id     [rcIDSize]byte
+		dial   func() (*UDPSession, error) // nil on the side of the listener
+		l      *ReconnectListener
+
+		wrMu    sync.Mutex // serializes Write
+		sessMu  sync.Mutex // orders the data frames on the session
+		mu      sync.Mutex
+		sess    *UDPSession   // nil while broken
+		gen     uint64        // of sess, the failures of the sessions before are stale
+		sent    []byte        // written and not read by the remote
+		sentOff uint64        // offset of sent[0]
+		recvOff uint64        // bytes of the stream received
+		readOff uint64        // bytes of the stream read
+		rbuf    []byte        // received and not read
+		err     error         // why the connection ended, io.EOF once the remote closed it
+		closed  bool          // Close was called
+		rd, wd  time.Time     // deadlines
+		chRead  chan struct{} // notified when data arrives, or when rd changes
+		chAcked chan struct{} // closed and renewed when sent shrinks, or when wd changes
+		chAck   chan struct{} // notified when an ack is due
+		die     chan struct{}
+		dieOnce sync.Once
+	}
+
+	// ReconnectListener accepts the ReconnectingConns dialed to a Listener,
+	// and hands the sessions of the ones resumed over to them
+	ReconnectListener struct {
+		l       *Listener
+		config  ReconnectConfig
+		mu      sync.Mutex
+		conns   map[[rcIDSize]byte]*ReconnectingConn
+		accepts chan *ReconnectingConn
+		err     error
+		die     chan struct{}
+		dieOnce sync.Once
+	}
+)
+
+// DefaultReconnectConfig returns the default timeouts and buffers of a
+// ReconnectingConn
+func DefaultReconnectConfig() *ReconnectConfig {
+	return &ReconnectConfig{
+		Timeout: 30 * time.Second,
+		Idle:    10 * time.Second,
+		Window:  4 * 1024 * 1024,
+	}
+}
+
+// verify checks the timeouts and the buffers
+func (c *ReconnectConfig) verify() error {
+	if c.Timeout <= 0 || c.Idle <= 0 || c.Window < rcFrameSize {
+		return errResumeConfig
+	}
+	return nil
+}
+
+// DialReconnecting opens a ReconnectingConn with the sessions of dial, which
+// is called again each time the session dies, after a dead link or Idle of
+// silence, until a session resumes the stream or Timeout passes. The
+// sessions are switched to the stream mode and their event handler is
+// replaced. A nil config uses DefaultReconnectConfig.
+func DialReconnecting(dial func() (*UDPSession, error), config *ReconnectConfig) (*ReconnectingConn, error) {
+	if config == nil {
+		config = DefaultReconnectConfig()
+	}
+	if err := config.verify(); err != nil {
+		return nil, err
+	}
+	c := newReconnectingConn(*config)
+	c.dial = dial
+	if _, err := io.ReadFull(crand.Reader, c.id[:]); err != nil {
+		return nil, err
+	}
+	s, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.resume(s); err != nil {
+		return nil, err
+	}
+	go c.keepalive()
+	return c, nil
+}
+
+// ListenReconnecting accepts the ReconnectingConns dialed to l, which it
+// owns from then on. A nil config uses DefaultReconnectConfig, the Idle of
+// both sides should match.
+func ListenReconnecting(l *Listener, config *ReconnectConfig) (*ReconnectListener, error) {
+	if config == nil {
+		config = DefaultReconnectConfig()
+	}
+	if err := config.verify(); err != nil {
+		return nil, err
+	}
+	rl := &ReconnectListener{
+		l:       l,
+		config:  *config,
+		conns:   make(map[[rcIDSize]byte]*ReconnectingConn),
+		accepts: make(chan *ReconnectingConn, rcBacklog),
+		die:     make(chan struct{}),
+	}
+	go rl.acceptLoop()
+	return rl, nil
+}
+
+// newReconnectingConn returns a connection without session
+func newReconnectingConn(config ReconnectConfig) *ReconnectingConn {
+	return &ReconnectingConn{
+		config:  config,
+		chRead:  make(chan struct{}, 1),
+		chAcked: make(chan struct{}),
+		chAck:   make(chan struct{}, 1),
+		die:     make(chan struct{}),
+	}
+}
+
+// Read implements the Conn Read method, the data received before the
+// connection ended is read before its error.
+func (c *ReconnectingConn) Read(b []byte) (n int, err error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return 0, errBrokenPipe
+		}
+		if len(c.rbuf) > 0 {
+			n = copy(b, c.rbuf)
+			c.rbuf = c.rbuf[n:]
+			c.readOff += uint64(n)
+			c.mu.Unlock()
+			notify(c.chAck)
+			return n, nil
+		}
+		if c.err != nil {
+			err = c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		if !c.rd.IsZero() && time.Now().After(c.rd) {
+			c.mu.Unlock()
+			return 0, errTimeout
+		}
+
+		timer, timeout := deadlineTimer(c.rd)
+		c.mu.Unlock()
+
+		select {
+		case <-c.chRead:
+		case <-timeout:
+		case <-c.die:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Write implements the Conn Write method, it returns once the data is
+// queued, the data is kept until the remote acknowledges it.
+func (c *ReconnectingConn) Write(b []byte) (n int, err error) {
+	c.wrMu.Lock()
+	defer c.wrMu.Unlock()
+	for n < len(b) {
+		c.mu.Lock()
+		if c.err != nil {
+			err = c.err
+			c.mu.Unlock()
+			if err == io.EOF {
+				err = errBrokenPipe
+			}
+			return n, err
+		}
+		if !c.wd.IsZero() && time.Now().After(c.wd) {
+			c.mu.Unlock()
+			return n, errTimeout
+		}
+
+		space := c.config.Window - len(c.sent)
+		if space <= 0 {
+			timer, timeout := deadlineTimer(c.wd)
+			acked := c.chAcked
+			c.mu.Unlock()
+			select {
+			case <-acked:
+			case <-timeout:
+			case <-c.die:
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		}
+
+		chunk := b[n:]
+		if len(chunk) > space {
+			chunk = chunk[:space]
+		}
+		if len(chunk) > rcFrameSize {
+			chunk = chunk[:rcFrameSize]
+		}
+		c.sent = append(c.sent, chunk...)
+		sess, gen := c.sess, c.gen
+		c.mu.Unlock()
+		n += len(chunk)
+
+		// a broken session leaves the chunk to the replay of the next one
+		if sess != nil {
+			c.sessMu.Lock()
+			if c.current(gen) {
+				if err := writeFrame(sess, rcData, uint64(len(chunk)), chunk); err != nil {
+					go c.fail(gen)
+				}
+			}
+			c.sessMu.Unlock()
+		}
+	}
+	return n, nil
+}
+
+// Close closes the connection once the remote read the data written, or
+// Timeout passed, and lets the remote read an eof after it.
+func (c *ReconnectingConn) Close() error {
+	deadline := time.NewTimer(c.config.Timeout)
+	defer deadline.Stop()
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return errBrokenPipe
+		}
+		if len(c.sent) == 0 || c.err != nil {
+			break
+		}
+		acked := c.chAcked
+		c.mu.Unlock()
+		select {
+		case <-acked:
+			continue
+		case <-deadline.C:
+		case <-c.die:
+		}
+		c.mu.Lock()
+		break
+	}
+	c.closed = true
+	sess := c.sess
+	c.mu.Unlock()
+
+	if sess != nil {
+		if writeFrame(sess, rcFin, 0, nil) == nil {
+			sess.CloseGracefully(c.config.Idle)
+		}
+	}
+	c.end(errBrokenPipe)
+	return nil
+}
+
+// LocalAddr returns the local network address of the current session, nil
+// while the connection is broken.
+func (c *ReconnectingConn) LocalAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sess == nil {
+		return nil
+	}
+	return c.sess.LocalAddr()
+}
+
+// RemoteAddr returns the remote network address of the current session, nil
+// while the connection is broken.
+func (c *ReconnectingConn) RemoteAddr() net.Addr {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.sess == nil {
+		return nil
+	}
+	return c.sess.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines, as in the net.Conn interface.
+func (c *ReconnectingConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	c.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline implements the Conn SetReadDeadline method.
+func (c *ReconnectingConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rd = t
+	c.mu.Unlock()
+	notify(c.chRead)
+	return nil
+}
+
+// SetWriteDeadline implements the Conn SetWriteDeadline method.
+func (c *ReconnectingConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.wd = t
+	c.wakeWriters()
+	c.mu.Unlock()
+	return nil
+}
+
+// current tells if gen is the generation of the current session
+func (c *ReconnectingConn) current(gen uint64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.sess != nil && c.gen == gen
+}
+
+// wakeWriters wakes the goroutines waiting for sent to shrink, the caller
+// holds mu
+func (c *ReconnectingConn) wakeWriters() {
+	close(c.chAcked)
+	c.chAcked = make(chan struct{})
+}
+
+// acked drops the bytes before the offset off, read by the remote, from
+// sent, the caller holds mu
+func (c *ReconnectingConn) acked(off uint64) error {
+	if off < c.sentOff {
+		return nil
+	}
+	if off > c.sentOff+uint64(len(c.sent)) {
+		return errResumeOffset
+	}
+	if off > c.sentOff {
+		c.sent = c.sent[off-c.sentOff:]
+		c.sentOff = off
+		c.wakeWriters()
+	}
+	return nil
+}
+
+// resume makes the dialer's s the session of the connection, after the
+// exchange of the hellos
+func (c *ReconnectingConn) resume(s *UDPSession) error {
+	s.SetStreamMode(true)
+	s.SetDeadline(time.Now().Add(c.config.Idle))
+	c.mu.Lock()
+	off := c.recvOff
+	c.mu.Unlock()
+	if err := writeFrame(s, rcHello, off, c.id[:]); err != nil {
+		s.Close()
+		return err
+	}
+	peerOff, id, err := readHello(s)
+	if err == nil && id != c.id {
+		err = errResumeProtocol
+	}
+	if err != nil {
+		s.Close()
+		return err
+	}
+	s.SetDeadline(time.Time{})
+	return c.attach(s, peerOff)
+}
+
+// attach makes s the session of the connection, and sends again the bytes
+// past peerOff, the offset the remote received
+func (c *ReconnectingConn) attach(s *UDPSession, peerOff uint64) error {
+	c.sessMu.Lock()
+	defer c.sessMu.Unlock()
+
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		s.Close()
+		return err
+	}
+	if peerOff < c.sentOff || peerOff > c.sentOff+uint64(len(c.sent)) {
+		c.mu.Unlock()
+		s.Close()
+		c.end(errResumeOffset)
+		return errResumeOffset
+	}
+	old := c.sess
+	c.sess = s
+	c.gen++
+	gen := c.gen
+	replay := c.sent[peerOff-c.sentOff:] // sent only grows past its length, the replayed bytes stay
+	c.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+
+	s.SetEventHandler(SessionEvents{DeadLink: func(*UDPSession) { go c.fail(gen) }})
+	go c.readLoop(s, gen)
+	for len(replay) > 0 {
+		chunk := replay
+		if len(chunk) > rcFrameSize {
+			chunk = chunk[:rcFrameSize]
+		}
+		if err := writeFrame(s, rcData, uint64(len(chunk)), chunk); err != nil {
+			go c.fail(gen)
+			break
+		}
+		replay = replay[len(chunk):]
+	}
+	return nil
+}
+
+// suspend drops the session of the connection for the listener to attach a
+// new one, and returns the offset received
+func (c *ReconnectingConn) suspend() uint64 {
+	c.mu.Lock()
+	old := c.sess
+	c.sess = nil
+	c.gen++
+	off := c.recvOff
+	c.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return off
+}
+
+// fail drops the session of generation gen, the dialer dials a new one, the
+// listener side waits for the remote to come back. The session of a closed
+// connection is left to deliver the fin, Close ends the connection.
+func (c *ReconnectingConn) fail(gen uint64) {
+	c.mu.Lock()
+	if c.sess == nil || c.gen != gen || c.closed {
+		c.mu.Unlock()
+		return
+	}
+	old := c.sess
+	c.sess = nil
+	c.gen++
+	gen = c.gen
+	c.mu.Unlock()
+	old.Close()
+
+	if c.dial != nil {
+		go c.redial()
+	} else {
+		go c.expire(gen)
+	}
+}
+
+// redial dials sessions until one resumes the stream, or Timeout passes
+func (c *ReconnectingConn) redial() {
+	deadline := time.Now().Add(c.config.Timeout)
+	backoff := rcMinBackoff
+	for {
+		s, err := c.dial()
+		if err == nil {
+			if err = c.resume(s); err == nil {
+				return
+			}
+		}
+		if err == errResumeOffset || time.Now().Add(backoff).After(deadline) {
+			c.end(errResumeTimeout)
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-c.die:
+			return
+		}
+		if backoff *= 2; backoff > rcMaxBackoff {
+			backoff = rcMaxBackoff
+		}
+	}
+}
+
+// expire ends the connection unless a session is attached within Timeout of
+// the failure of generation gen
+func (c *ReconnectingConn) expire(gen uint64) {
+	timer := time.NewTimer(c.config.Timeout)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.die:
+		return
+	}
+	c.mu.Lock()
+	expired := c.sess == nil && c.gen == gen
+	c.mu.Unlock()
+	if expired {
+		c.end(errResumeTimeout)
+	}
+}
+
+// end ends the connection with err, the reads get the data received first
+func (c *ReconnectingConn) end(err error) {
+	c.dieOnce.Do(func() {
+		c.mu.Lock()
+		c.err = err
+		old := c.sess
+		c.sess = nil
+		c.gen++
+		c.mu.Unlock()
+		close(c.die)
+		if old != nil {
+			old.Close()
+		}
+		if c.l != nil {
+			c.l.forget(c)
+		}
+	})
+}
+
+// readLoop reads the frames of s, the session of generation gen
+func (c *ReconnectingConn) readLoop(s *UDPSession, gen uint64) {
+	hdr := make([]byte, rcHeaderSize)
+	for {
+		s.SetReadDeadline(time.Now().Add(c.config.Idle))
+		if _, err := io.ReadFull(s, hdr); err != nil {
+			c.fail(gen)
+			return
+		}
+		arg := binary.LittleEndian.Uint64(hdr[1:])
+		switch hdr[0] {
+		case rcData:
+			if arg == 0 || arg > rcFrameSize {
+				c.end(errResumeProtocol)
+				return
+			}
+			data := make([]byte, arg)
+			if _, err := io.ReadFull(s, data); err != nil {
+				c.fail(gen)
+				return
+			}
+			c.mu.Lock()
+			if c.gen != gen { // the stream resumes on the next session
+				c.mu.Unlock()
+				return
+			}
+			c.rbuf = append(c.rbuf, data...)
+			c.recvOff += arg
+			c.mu.Unlock()
+			notify(c.chRead)
+		case rcAck:
+			c.mu.Lock()
+			err := c.acked(arg)
+			c.mu.Unlock()
+			if err != nil {
+				c.end(err)
+				return
+			}
+		case rcFin:
+			c.end(io.EOF)
+			return
+		default:
+			c.end(errResumeProtocol)
+			return
+		}
+	}
+}
+
+// keepalive sends the acks of the data read, and one every Idle/4 so that
+// the remote sees the session alive
+func (c *ReconnectingConn) keepalive() {
+	ticker := time.NewTicker(c.config.Idle / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.chAck:
+		case <-ticker.C:
+		case <-c.die:
+			return
+		}
+		c.mu.Lock()
+		sess, gen, off := c.sess, c.gen, c.readOff
+		c.mu.Unlock()
+		if sess != nil {
+			if err := writeFrame(sess, rcAck, off, nil); err != nil {
+				go c.fail(gen)
+			}
+		}
+	}
+}
+
+// Accept waits for and returns the next ReconnectingConn dialed to the
+// listener.
+func (rl *ReconnectListener) Accept() (net.Conn, error) {
+	return rl.AcceptReconnecting()
+}
+
+// AcceptReconnecting is Accept returning the ReconnectingConn.
+func (rl *ReconnectListener) AcceptReconnecting() (*ReconnectingConn, error) {
+	select {
+	case c := <-rl.accepts:
+		return c, nil
+	case <-rl.die:
+		return nil, rl.err
+	}
+}
+
+// Close closes the listener and its Listener, the connections accepted
+// live on but can't resume anymore.
+func (rl *ReconnectListener) Close() error {
+	err := rl.l.Close()
+	rl.stop(errBrokenPipe)
+	return err
+}
+
+// Addr returns the network address of the Listener.
+func (rl *ReconnectListener) Addr() net.Addr {
+	return rl.l.Addr()
+}
+
+// stop stops the listener with err
+func (rl *ReconnectListener) stop(err error) {
+	rl.dieOnce.Do(func() {
+		rl.err = err
+		close(rl.die)
+	})
+}
+
+// acceptLoop reads the hellos of the sessions of the Listener
+func (rl *ReconnectListener) acceptLoop() {
+	for {
+		s, err := rl.l.Accept()
+		if err != nil {
+			rl.stop(err)
+			return
+		}
+		go rl.handshake(s)
+	}
+}
+
+// handshake opens or resumes the connection of the hello of s
+func (rl *ReconnectListener) handshake(s *UDPSession) {
+	s.SetStreamMode(true)
+	s.SetDeadline(time.Now().Add(rl.config.Idle))
+	peerOff, id, err := readHello(s)
+	if err != nil {
+		s.Close()
+		return
+	}
+
+	rl.mu.Lock()
+	c, resumed := rl.conns[id]
+	if !resumed {
+		if peerOff != 0 { // the connection is gone
+			rl.mu.Unlock()
+			s.Close()
+			return
+		}
+		select {
+		case <-rl.die:
+			rl.mu.Unlock()
+			s.Close()
+			return
+		default:
+		}
+		c = newReconnectingConn(rl.config)
+		c.id, c.l = id, rl
+		rl.conns[id] = c
+	}
+	rl.mu.Unlock()
+
+	off := c.suspend()
+	if err := writeFrame(s, rcHello, off, id[:]); err != nil {
+		s.Close()
+		if resumed {
+			c.mu.Lock()
+			gen := c.gen
+			c.mu.Unlock()
+			go c.expire(gen)
+		} else {
+			c.end(err)
+		}
+		return
+	}
+	s.SetDeadline(time.Time{})
+	if err := c.attach(s, peerOff); err != nil || resumed {
+		return
+	}
+
+	go c.keepalive()
+	select {
+	case rl.accepts <- c:
+	default: // backlog full
+		c.end(errBrokenPipe)
+	}
+}
+
+// forget drops the connection from the ones to resume
+func (rl *ReconnectListener) forget(c *ReconnectingConn) {
+	rl.mu.Lock()
+	if rl.conns[c.id] == c {
+		delete(rl.conns, c.id)
+	}
+	rl.mu.Unlock()
+}
+
+// deadlineTimer returns a timer firing at the deadline t, nil without deadline
+func deadlineTimer(t time.Time) (*time.Timer, <-chan time.Time) {
+	if t.IsZero() {
+		return nil, nil
+	}
+	timer := time.NewTimer(time.Until(t))
+	return timer, timer.C
+}
+
+// notify wakes the goroutine waiting on ch, if any
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// readHello reads the hello of the remote from s
+func readHello(s *UDPSession) (off uint64, id [rcIDSize]byte, err error) {
+	buf := make([]byte, rcHeaderSize+rcIDSize)
+	if _, err = io.ReadFull(s, buf); err != nil {
+		return 0, id, err
+	}
+	if buf[0] != rcHello {
+		return 0, id, errResumeProtocol
+	}
+	copy(id[:], buf[rcHeaderSize:])
+	return binary.LittleEndian.Uint64(buf[1:]), id, nil
+}
+
+// writeFrame writes a frame to s in one call, so that the frames of the
+// goroutines writing to s don't interleave
+func writeFrame(s *UDPSession, cmd byte, arg uint64, payload []byte) error {
+	var hdr [rcHeaderSize]byte
+	hdr[0] = cmd
+	binary.LittleEndian.PutUint64(hdr[1:], arg)
+	_, err := s.WriteBuffers(net.Buffers{hdr[:], payload})
+	return err
+}
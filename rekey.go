@@ -0,0 +1,322 @@
+package kcp
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	epochSize    = 4               // key epoch in front of the packets of an EpochCrypt
+	epochKeySize = 32              // size of the keys derived for each epoch
+	epochCache   = 8               // derived crypts kept by an EpochCrypt
+	epochGrace   = 5 * time.Second // packets of the previous epoch accepted after a switch
+)
+
+// cmdRekey is the channel tag of the frames announcing a key epoch,
+// multiplexed with the kcp segments like the probes of Ping, the epoch in
+// the sn of the kcp header
+const cmdRekey = 93
+
+type (
+	// EpochCrypt implements BlockCrypt with a key rotating through epochs.
+	// The key of each epoch is derived from the master key with HKDF and
+	// handed to the crypt registered by name. Every packet starts with its
+	// epoch in the clear. A rotation is announced by a control frame sent
+	// under the current key: the remote switches to the next epoch once the
+	// frame is authenticated, and answers under the new key, which switches
+	// the session announcing. The previous epoch stays accepted for a short
+	// while. A session accepts the packets of its epoch and the next one
+	// alone, the keys of other epochs aren't even derived, and a new session
+	// starts in epoch 0.
+	EpochCrypt struct {
+		name     string
+		master   []byte
+		overhead int // crypt header size within an epoch
+
+		mu     sync.Mutex
+		crypts map[uint32]BlockCrypt // derived, by epoch
+	}
+
+	// epochState tracks the key epochs of a session using an EpochCrypt
+	epochState struct {
+		tx         uint32    // epoch of the packets sent, atomic
+		rx         uint32    // newest epoch received, atomic
+		prevEnd    time.Time // packets of epoch rx-1 are accepted until then
+		rekeyBytes uint64    // bytes sent before rotating the key, 0 disables, atomic
+		rekeyDue   uint32    // rekeyBytes were sent, atomic
+		txLast     uint32    // epoch txBytes were counted for, owned by outputTask
+		txBytes    uint64
+		announce   uint32    // epoch announced, while announcing
+		announcing bool      // until the remote switched to announce
+		resendAt   time.Time // of the announce
+	}
+)
+
+// NewEpochCrypt initiates EpochCrypt over the crypt registered as name, with
+// the master key the epoch keys are derived from
+func NewEpochCrypt(name string, key []byte) (BlockCrypt, error) {
+	c := &EpochCrypt{name: name, crypts: make(map[uint32]BlockCrypt)}
+	c.master = make([]byte, len(key))
+	copy(c.master, key)
+	bc, err := c.crypt(0)
+	if err != nil {
+		return nil, err
+	}
+	c.overhead = epochSize + cryptOverhead(bc)
+	return c, nil
+}
+
+// crypt returns the crypt of an epoch, kept for the packets to come
+func (c *EpochCrypt) crypt(epoch uint32) (BlockCrypt, error) {
+	bc, cached, err := c.derive(epoch)
+	if err == nil && !cached {
+		c.keep(epoch, bc)
+	}
+	return bc, err
+}
+
+// derive returns the crypt of an epoch, cached tells if it was kept already
+func (c *EpochCrypt) derive(epoch uint32) (bc BlockCrypt, cached bool, err error) {
+	c.mu.Lock()
+	bc = c.crypts[epoch]
+	c.mu.Unlock()
+	if bc != nil {
+		return bc, true, nil
+	}
+
+	var info [len("kcp-go epoch") + 4]byte
+	copy(info[:], "kcp-go epoch")
+	binary.BigEndian.PutUint32(info[len("kcp-go epoch"):], epoch)
+	key := make([]byte, epochKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, c.master, nil, info[:]), key); err != nil {
+		return nil, false, err
+	}
+	bc, err = NewCryptByName(c.name, key)
+	return bc, false, err
+}
+
+// cached tells if the crypt of an epoch is kept
+func (c *EpochCrypt) cached(epoch uint32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.crypts[epoch] != nil
+}
+
+// keep caches the crypt of an epoch, once a packet was sealed or opened
+// under it
+func (c *EpochCrypt) keep(epoch uint32, bc BlockCrypt) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.crypts[epoch] != nil {
+		return
+	}
+
+	// forget the oldest epoch
+	if len(c.crypts) >= epochCache {
+		oldest := epoch
+		for e := range c.crypts {
+			if int32(e-oldest) < 0 {
+				oldest = e
+			}
+		}
+		delete(c.crypts, oldest)
+	}
+	c.crypts[epoch] = bc
+}
+
+// Encrypt implements Encrypt interface, the first 4 bytes of src hold the
+// epoch whose key encrypts the rest
+func (c *EpochCrypt) Encrypt(dst, src []byte) {
+	epoch := binary.LittleEndian.Uint32(src)
+	bc, err := c.crypt(epoch)
+	if err != nil {
+		xorBytes(dst, dst, dst)
+		return
+	}
+	binary.LittleEndian.PutUint32(dst, epoch)
+	bc.Encrypt(dst[epochSize:], src[epochSize:])
+}
+
+// Decrypt implements Decrypt interface, the first 4 bytes of src hold the
+// epoch whose key decrypts the rest
+func (c *EpochCrypt) Decrypt(dst, src []byte) {
+	epoch := binary.LittleEndian.Uint32(src)
+	bc, _, err := c.derive(epoch)
+	if err != nil {
+		xorBytes(dst, dst, dst)
+		return
+	}
+	binary.LittleEndian.PutUint32(dst, epoch)
+	bc.Decrypt(dst[epochSize:], src[epochSize:])
+}
+
+// Rekey announces the next key epoch to the remote, the session switches
+// to it once the remote answers under its key. It fails if the session
+// doesn't use an EpochCrypt, or the previous rotation is pending.
+func (s *UDPSession) Rekey() error {
+	if _, ok := s.block.(*EpochCrypt); !ok {
+		return errNoEpochCrypt
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rekey()
+}
+
+// rekey announces the next key epoch, the caller holds mu
+func (s *UDPSession) rekey() error {
+	st := &s.epoch
+	rx := atomic.LoadUint32(&st.rx)
+	if st.announcing || atomic.LoadUint32(&st.tx) != rx {
+		return errRekeyPending
+	}
+	st.announce, st.announcing = rx+1, true
+	st.resendAt = time.Time{}
+	s.updateRekey(time.Now())
+	return nil
+}
+
+// SetRekeyBytes rotates the key every time n bytes were sent under it,
+// 0 disables the rotation (default). The session must use an EpochCrypt.
+func (s *UDPSession) SetRekeyBytes(n uint64) error {
+	if _, ok := s.block.(*EpochCrypt); !ok {
+		return errNoEpochCrypt
+	}
+	atomic.StoreUint64(&s.epoch.rekeyBytes, n)
+	return nil
+}
+
+// updateRekey announces the next epoch once rekeyBytes were sent, and sends
+// the announce again every rto until the remote switched. It returns the
+// delay to the next announce, -1 if none is pending. The caller holds mu.
+func (s *UDPSession) updateRekey(now time.Time) time.Duration {
+	st := &s.epoch
+	if atomic.CompareAndSwapUint32(&st.rekeyDue, 1, 0) {
+		s.rekey() // due again with the next packet while pending
+	}
+	if !st.announcing {
+		return -1
+	}
+	if atomic.LoadUint32(&st.rx) == st.announce {
+		st.announcing = false
+		return -1
+	}
+	if !now.Before(st.resendAt) {
+		s.sendControl(cmdRekey, st.announce)
+		st.resendAt = now.Add(time.Duration(s.kcp.rx_rto) * time.Millisecond)
+	}
+	return st.resendAt.Sub(now)
+}
+
+// isRekey tells if a kcp packet announces a key epoch
+func isRekey(pkt []byte) bool {
+	return len(pkt) >= IKCP_OVERHEAD && pkt[4] == cmdRekey
+}
+
+// rekeyInput switches to the epoch announced by the remote, and answers
+// under its key, the caller holds mu
+func (s *UDPSession) rekeyInput(pkt []byte) {
+	conv := binary.LittleEndian.Uint32(pkt)
+	if conv != s.kcp.conv && !(conv == 0 && s.convAssigned) {
+		return
+	}
+	if _, ok := s.block.(*EpochCrypt); !ok {
+		return
+	}
+	st := &s.epoch
+	epoch := binary.LittleEndian.Uint32(pkt[12:])
+	rx := atomic.LoadUint32(&st.rx)
+	if epoch == rx+1 {
+		s.switchEpoch(rx, epoch)
+		rx = epoch
+	}
+	if epoch != rx {
+		return
+	}
+	if st.announcing && st.announce == epoch {
+		// both ends announced the epoch, or this is the answer
+		st.announcing = false
+		return
+	}
+	s.sendControl(cmdRekey, epoch)
+}
+
+// switchEpoch moves the session from epoch rx to the next one
+func (s *UDPSession) switchEpoch(rx, epoch uint32) {
+	st := &s.epoch
+	st.prevEnd = time.Now().Add(epochGrace)
+	atomic.StoreUint32(&st.rx, epoch)
+	// answer in the new epoch, unless the rotation was ours
+	atomic.CompareAndSwapUint32(&st.tx, rx, epoch)
+}
+
+// sealEpoch encrypts a packet under the key of the current epoch, and has
+// the next epoch announced once enough bytes were sent under it
+func (s *UDPSession) sealEpoch(c *EpochCrypt, buf []byte) {
+	st := &s.epoch
+	epoch := atomic.LoadUint32(&st.tx)
+	if epoch != st.txLast {
+		st.txLast = epoch
+		st.txBytes = 0
+	}
+	st.txBytes += uint64(len(buf))
+	if limit := atomic.LoadUint64(&st.rekeyBytes); limit > 0 && st.txBytes >= limit &&
+		atomic.CompareAndSwapUint32(&st.rekeyDue, 0, 1) {
+		s.wakeUpdate()
+	}
+
+	bc, err := c.crypt(epoch)
+	if err != nil {
+		reportError(err)
+		return
+	}
+	binary.LittleEndian.PutUint32(buf, epoch)
+	sealPacket(bc, buf[epochSize:])
+}
+
+// epochNear tells if the epoch of a packet may be opened by the session s,
+// before its key is derived: the epoch of the session, the next one, or
+// the previous one for a short while. A new session, s nil, starts in epoch
+// 0, the packets of a remote unknown in other epochs are opened under the
+// keys kept alone, for the sessions migrating.
+func epochNear(block BlockCrypt, s *UDPSession, packet []byte) bool {
+	c, ok := block.(*EpochCrypt)
+	if !ok {
+		return true
+	}
+	if len(packet) < epochSize {
+		return false
+	}
+	epoch := binary.LittleEndian.Uint32(packet)
+	if s == nil {
+		return epoch == 0 || c.cached(epoch)
+	}
+	switch rx := atomic.LoadUint32(&s.epoch.rx); epoch {
+	case rx, rx + 1:
+		return true
+	case rx - 1:
+		return time.Now().Before(s.epoch.prevEnd)
+	}
+	return false
+}
+
+// rxEpoch tells if the session accepts an authenticated packet of the given
+// epoch, switching to the epoch announced by the remote. It is called by the
+// goroutine receiving the packets of the session.
+func (s *UDPSession) rxEpoch(packet []byte) bool {
+	if !epochNear(s.block, s, packet) {
+		return false
+	}
+	if _, ok := s.block.(*EpochCrypt); ok {
+		epoch := binary.LittleEndian.Uint32(packet)
+		if rx := atomic.LoadUint32(&s.epoch.rx); epoch == rx+1 {
+			s.switchEpoch(rx, epoch)
+		}
+	}
+	return true
+}
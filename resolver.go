@@ -0,0 +1,126 @@
+package kcp
+
+import (
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+)
+
+const (
+	convHeaderSize  = 4 // conv in front of the packets of a ConvCrypt
+	maxListenerKeys = 4 // crypts tried on the first packet of a conversation
+)
+
+type (
+	// keyResolver returns the crypt of a new conversation by its conv and
+	// the address of the remote
+	keyResolver func(conv uint32, remote net.Addr) (BlockCrypt, error)
+
+	// ConvCrypt implements BlockCrypt for dialing a listener which resolves
+	// the crypt of each conversation by its conv, see Listener.SetKeyResolver.
+	// Sessions dialed with it take its conv, sent in the clear in front of
+	// every packet, and encrypt the rest with its crypt.
+	ConvCrypt struct {
+		conv  uint32
+		block BlockCrypt
+	}
+)
+
+// NewConvCrypt initiates ConvCrypt with the conv of the sessions dialed and
+// the crypt agreed upon with the listener for this conv
+func NewConvCrypt(conv uint32, block BlockCrypt) BlockCrypt {
+	return &ConvCrypt{conv: conv, block: block}
+}
+
+// session returns the crypt of a session dialed with c
+func (c *ConvCrypt) session() *sessionCrypt {
+	sc := &sessionCrypt{header: make([]byte, convHeaderSize), block: c.block}
+	binary.LittleEndian.PutUint32(sc.header, c.conv)
+	return sc
+}
+
+// Encrypt implements Encrypt interface
+func (c *ConvCrypt) Encrypt(dst, src []byte) { c.session().Encrypt(dst, src) }
+
+// Decrypt implements Decrypt interface
+func (c *ConvCrypt) Decrypt(dst, src []byte) { c.session().Decrypt(dst, src) }
+
+// SetKeyResolver makes the listener resolve the crypt of each new
+// conversation with resolver, called on the first packet received from a
+// remote, instead of using the crypt of the listener. A single listener thus
+// serves many customers with a key each. The remotes dial with a ConvCrypt,
+// the conv in the clear is handed to resolver. The packets of a conversation
+// resolver returns an error for are dropped. nil restores the crypt of the
+// listener. Listeners with a noise handshake ignore the resolver.
+func (l *Listener) SetKeyResolver(resolver func(conv uint32, remote net.Addr) (BlockCrypt, error)) {
+	l.resolver.Store(keyResolver(resolver))
+}
+
+// SetKeys makes the listener try each of keys in order on the first packet
+// of a new conversation instead of its own crypt, so that a pre-shared key
+// can be rotated without a flag day: the listeners accept the old and new
+// keys while the remotes move to the new key, then drop the old one. A
+// session keeps the key which opened its first packet. At most 4 keys are
+// tried, the first ones should be the most used. nil restores the crypt of
+// the listener. Listeners with a key resolver or a noise handshake ignore the
+// keys.
+func (l *Listener) SetKeys(keys []BlockCrypt) error {
+	if len(keys) > maxListenerKeys {
+		return errKeys
+	}
+	minSize := minPacketSize(l.block)
+	for _, bc := range keys {
+		if bc == nil {
+			return errKeys
+		}
+		if n := minPacketSize(bc); n < minSize {
+			minSize = n
+		}
+	}
+	l.keys.Store(append([]BlockCrypt(nil), keys...))
+	atomic.StoreInt32(&l.minSize, int32(minSize))
+	return nil
+}
+
+// tryKeys returns the first key of the listener which opens the packet of a
+// new conversation sealed in data, block if the listener has no keys
+func (l *Listener) tryKeys(block BlockCrypt, data []byte) (BlockCrypt, bool) {
+	keys, _ := l.keys.Load().([]BlockCrypt)
+	if len(keys) == 0 {
+		return block, true
+	}
+	for _, bc := range keys {
+		// packets pass the size check of the key with the least overhead
+		if len(data) < minPacketSize(bc) {
+			continue
+		}
+		if _, ok := l.peekSealed(bc, data); ok {
+			return bc, true
+		}
+	}
+	return nil, false
+}
+
+// resolveCrypt returns the crypt of a new conversation whose packet is
+// sealed in data, by its key resolver or its keys, block if the listener has
+// neither
+func (l *Listener) resolveCrypt(block BlockCrypt, data []byte, remote net.Addr) (BlockCrypt, bool) {
+	if l.noise != nil {
+		return block, true
+	}
+	resolver, _ := l.resolver.Load().(keyResolver)
+	if resolver == nil {
+		return l.tryKeys(block, data)
+	}
+	if len(data) < convHeaderSize {
+		return nil, false
+	}
+	conv := binary.LittleEndian.Uint32(data)
+	bc, err := resolver(conv, remote)
+	if err != nil || bc == nil {
+		atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+		return nil, false
+	}
+	c := &ConvCrypt{conv: conv, block: bc}
+	return c.session(), true
+}
@@ -0,0 +1,97 @@
+package kcp
+
+// sackCapability is the bit of the frg of the ACK, WASK, WINS and SACK
+// segments, where frg is otherwise 0, advertising that the sender
+// understands IKCP_CMD_SACK
+const sackCapability = 0x80
+
+// SetSACK acknowledges the segments received by ranges once the remote
+// advertised it understands them, as a session with SACK enabled does in
+// the ACK and window segments it sends. A single SACK segment per flush
+// then carries una, the ranges of sn received beyond it, and the ts of the
+// latest segment sent among the ones acknowledged, instead of a segment
+// per sn, which shrinks the acks of a fast stream by an order of magnitude
+// and tells the sender of every hole at once. Remotes unaware of SACK keep
+// the plain acks.
+func (s *UDPSession) SetSACK(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.kcp.SetSACK(enabled)
+}
+
+// SetSACK enables the acknowledgment by ranges, see UDPSession.SetSACK.
+func (kcp *KCP) SetSACK(enabled bool) {
+	kcp.sack = enabled
+	kcp.sack_acked = false
+	kcp.ts_sack = kcp.current
+}
+
+// flush_sack encodes into ptr the SACK segment of the acklist, seg holding
+// the fields common to the acks, and returns the rest of ptr
+func (kcp *KCP) flush_sack(seg Segment, ptr []byte) []byte {
+	// the latest sent of the segments acknowledged is echoed, for the rtt
+	seg.cmd = IKCP_CMD_SACK
+	seg.sn, seg.ts = kcp.ack_get(0)
+	for i := 1; i < len(kcp.acklist)/2; i++ {
+		if sn, ts := kcp.ack_get(i); kcp.rack_before(seg.ts, seg.sn, ts, sn) {
+			seg.sn, seg.ts = sn, ts
+		}
+	}
+
+	// the lowest ranges of rcv_buf, as many as a packet holds
+	n := 0
+	for k := range kcp.rcv_buf {
+		if k == 0 || kcp.rcv_buf[k].sn != kcp.rcv_buf[k-1].sn+1 {
+			n++
+		}
+	}
+	if max := (int(kcp.mtu) - IKCP_OVERHEAD) / 8; n > max {
+		n = max
+	}
+
+	size := len(kcp.buffer) - len(ptr)
+	if size+IKCP_OVERHEAD+8*n > int(kcp.mtu) {
+		kcp.output(kcp.buffer, size)
+		ptr = kcp.buffer
+	}
+	header := ptr
+	ptr = seg.encode(ptr)
+	ikcp_encode32u(header[20:], uint32(8*n))
+	for k := 0; n > 0; n-- {
+		first := kcp.rcv_buf[k].sn
+		last := first
+		for k++; k < len(kcp.rcv_buf) && kcp.rcv_buf[k].sn == last+1; k++ {
+			last++
+		}
+		ptr = ikcp_encode32u(ptr, first)
+		ptr = ikcp_encode32u(ptr, last)
+	}
+	return ptr
+}
+
+// parse_sack removes from snd_buf the segments within the ranges of a SACK
+// echoing segment sn, and returns the highest sn acknowledged
+func (kcp *KCP) parse_sack(ranges []byte, sn uint32) uint32 {
+	maxack := sn
+	var first, last uint32
+	decoded := false
+	k := 0
+	for _, seg := range kcp.snd_buf {
+		// the ranges ascend, the ones below seg are done with
+		for (!decoded || _itimediff(seg.sn, last) > 0) && len(ranges) >= 8 {
+			ranges = ikcp_decode32u(ranges, &first)
+			ranges = ikcp_decode32u(ranges, &last)
+			decoded = true
+			if _itimediff(last, maxack) > 0 {
+				maxack = last
+			}
+		}
+		if decoded && _itimediff(seg.sn, first) >= 0 && _itimediff(seg.sn, last) <= 0 {
+			continue
+		}
+		kcp.snd_buf[k] = seg
+		k++
+	}
+	kcp.snd_buf = kcp.snd_buf[:k]
+	return maxack
+}
@@ -0,0 +1,142 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const selfTestSize = 48 // bytes of the packets of the vectors
+
+// selfTestSalt is the salt of the nonces of the AEAD vectors, the counter
+// starts at 1
+var selfTestSalt = []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+
+// selfTestVectors are the packets encrypted by the builtin crypts, keyed by
+// bytes 0 to 31, from a packet of bytes 0 to 47. The header of the packets of
+// AEAD crypts is filled in by Seal.
+var selfTestVectors = map[string]string{
+	"aes":         "15cb3d10047d330ab6b768ccaa72202024d2e19cd29760adc5e6bf5ff6a374314941b7782ced7cd13da49a6e3d4c1e1b",
+	"aes-128":     "bb11f8ddf9540585a9cc41ceb499a7655104c76dc3e5d8094488cf230cec07cf054e63cf52381982c2835e43c1d2dd80",
+	"aes-192":     "713824a00e3fd2973dd18329358c868153ba06f3ad1accd9b25d6b0f5f552632429610e7d5239d05fb9097036687d375",
+	"aes-256":     "15cb3d10047d330ab6b768ccaa72202024d2e19cd29760adc5e6bf5ff6a374314941b7782ced7cd13da49a6e3d4c1e1b",
+	"aes-gcm":     "0102030405060708090a0b0c0100000000000000f1cc6bb73bed0a67eb7b6ee0a9d119407e03d02f22e87ce6821d9a57",
+	"chacha20":    "0102030405060708090a0b0c010000000000000040855cbc2eb94fd1f69876821bb646a1076452a73754c34c99ee32b5",
+	"hmac-sha256": "6b59a89a78015ddbb59e9589a2fd2293101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f",
+	"none":        "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f",
+	"salsa20":     "000102030405060726a40554145a27c1c663a1ba3cf142e037c25eb36781c6cd39c5ce378adce09b5f962f547a74f95a",
+	"sm4":         "ff27e1bd6332be351ba083754dfbb5ac0082191619c653d92e33a8a7d74c5f4e7bcc1899b98d93f9f1cca0afa24d2acb",
+	"sm4-gcm":     "0102030405060708090a0b0c0100000000000000162a6488971ba54230884b451eef8e1e26c2e02bc90b44b33f801e05",
+	"tea":         "01348d3d967f5900f45f05c2bb6fe6ec2edabbb5911d1448c6dc7a4c5db84bba4ccce7af526afa580394c521ff91f5b4",
+	"xor":         "b216b2f17a8f89fdbf995a506cc1b8d67ae113d26acec97845d6736af9932712f94a6ef10cc470a52d841ff1b097df2f",
+	"xsalsa20":    "000102030405060708090a0b0c0d0e0fafe4ed0f3df60e4dd2d61bfdd124b5cb60e2c5d325f00089e00001b127951ca3",
+}
+
+// SelfTest checks every registered crypt, for deployments which must assert
+// their crypto before use. The builtin crypts encrypt a packet into its
+// known-answer vector and decrypt it back, the AEADs must also reject the
+// packet once tampered with. The MACs computed by this package, the tags of
+// HMACCrypt and the cookies of listeners, must be compared through
+// subtle.ConstantTimeCompare. The tags of the other AEADs are compared by
+// their cipher.AEAD implementation. The crypts registered by the application
+// have no vectors, they are only checked to decrypt what they encrypt. The
+// first failure is returned.
+func SelfTest() error {
+	cryptsMu.RLock()
+	names := make([]string, 0, len(crypts))
+	for name := range crypts {
+		names = append(names, name)
+	}
+	cryptsMu.RUnlock()
+	sort.Strings(names)
+
+	key := make([]byte, 32)
+	for i := range key {
+		key[i] = byte(i)
+	}
+	for _, name := range names {
+		bc, err := NewCryptByName(name, key)
+		if err != nil {
+			return selfTestError(name, err.Error())
+		}
+		// the salt of "auto" tells its cipher, it has no vector
+		vector, known := selfTestVectors[name]
+		if err := selfTestCrypt(name, bc, vector, known); err != nil {
+			return err
+		}
+	}
+
+	// cookies
+	var cookie [cookieSize]byte
+	ck := newCookieKey(key)
+	now := time.Now()
+	ck.challenge(cookie[:], cookie[:], "127.0.0.1:1", now)
+	compares := atomic.LoadUint64(&macCompares)
+	if !ck.verify(cookie[:], "127.0.0.1:1", now) || ck.verify(cookie[:], "127.0.0.1:2", now) {
+		return selfTestError("cookie", "cookie mismatch")
+	}
+	if atomic.LoadUint64(&macCompares) == compares {
+		return selfTestError("cookie", "mac not compared in constant time")
+	}
+	return nil
+}
+
+// selfTestCrypt checks a crypt against its vector if known
+func selfTestCrypt(name string, bc BlockCrypt, vector string, known bool) error {
+	plain := make([]byte, selfTestSize, mtuLimit)
+	for i := range plain {
+		plain[i] = byte(i)
+	}
+	packet := make([]byte, selfTestSize, mtuLimit)
+	copy(packet, plain)
+
+	aead, isAEAD := bc.(AEADCrypt)
+	if isAEAD {
+		if nc, ok := aead.(NonceCrypt); ok {
+			nc.SetNonceState(selfTestSalt, 0)
+		}
+		aead.Seal(packet)
+	} else {
+		bc.Encrypt(packet, packet)
+	}
+	if known && hex.EncodeToString(packet) != vector {
+		return selfTestError(name, "known-answer mismatch")
+	}
+	if !known && bytes.Equal(packet, plain) && name != "none" {
+		return selfTestError(name, "packet left in the clear")
+	}
+
+	if !isAEAD {
+		bc.Decrypt(packet, packet)
+		if !bytes.Equal(packet, plain) {
+			return selfTestError(name, "decryption mismatch")
+		}
+		return nil
+	}
+
+	// tampering with the header or the payload is detected
+	for _, k := range []int{0, aead.Overhead() - 1, selfTestSize - 1} {
+		tampered := make([]byte, selfTestSize, mtuLimit)
+		copy(tampered, packet)
+		tampered[k] ^= 1
+		if aead.Open(tampered) {
+			return selfTestError(name, "tampered packet accepted")
+		}
+	}
+	compares := atomic.LoadUint64(&macCompares)
+	if !aead.Open(packet) || !bytes.Equal(packet[aead.Overhead():], plain[aead.Overhead():]) {
+		return selfTestError(name, "decryption mismatch")
+	}
+	if _, ok := bc.(*HMACCrypt); ok && atomic.LoadUint64(&macCompares) == compares {
+		return selfTestError(name, "mac not compared in constant time")
+	}
+	return nil
+}
+
+// selfTestError reports a crypt failing SelfTest
+func selfTestError(name, reason string) error {
+	return errors.New("crypt " + name + " failed self-test: " + reason)
+}
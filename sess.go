@@ -1,26 +1,71 @@
 package kcp
 
 import (
+	"bytes"
+	"context"
 	crand "crypto/rand"
 	"encoding/binary"
 	"errors"
 	"io"
 	"log"
+	"math"
 	"math/rand"
 	"net"
+	"os"
+	"runtime"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/klauspost/crc32"
-
-	"golang.org/x/net/ipv4"
 )
 
 var (
-	errTimeout    = errors.New("i/o timeout")
-	errBrokenPipe = errors.New("broken pipe")
-	rng           = rand.New(rand.NewSource(time.Now().UnixNano()))
+	errTimeout        = error(timeoutError{})
+	errBrokenPipe     = errors.New("broken pipe")
+	errNoFEC          = errors.New("fec not enabled")
+	errFECParams      = errors.New("invalid fec parameters")
+	errShardSize      = errors.New("shard sizes do not match")
+	errTooFewShards   = errors.New("too few shards to reconstruct")
+	errFECVersion     = errors.New("unsupported fec header version")
+	errFECPacket      = errors.New("malformed fec packet")
+	errCryptName      = errors.New("unknown crypt")
+	errCryptKey       = errors.New("crypt key too short")
+	errNoEpochCrypt   = errors.New("crypt has no key epochs")
+	errRekeyPending   = errors.New("key rotation pending")
+	errObfsParams     = errors.New("invalid obfuscation parameters")
+	errNoiseKey       = errors.New("invalid noise key")
+	errNoiseHandshake = errors.New("noise handshake failed")
+	errNoiseTimeout   = errors.New("noise handshake timeout")
+	errLayerOrder     = errors.New("invalid layer order")
+	errLayersFixed    = errors.New("layer order fixed once packets are sent")
+	errKDFParams      = errors.New("invalid key derivation parameters")
+	errKeys           = errors.New("invalid listener keys")
+	errHeaderSample   = errors.New("crypt header too short to sample")
+	errBacklogParams  = errors.New("invalid accept backlog parameters")
+	errConnRefused    = errors.New("connection refused by the remote")
+	errStreamMode     = errors.New("messages need the message mode")
+	errMessageSize    = errors.New("invalid message size")
+	errConvRequest    = errors.New("conv can't be requested")
+	errMTU            = errors.New("invalid mtu")
+	errDatagramSize   = errors.New("invalid datagram size")
+	errPriority       = errors.New("invalid write priority")
+	errLimitParams    = errors.New("invalid listener limits")
+	errRTOBounds      = errors.New("invalid rto bounds")
+	errLossDetection  = errors.New("unknown loss detection")
+	errDeadLink       = errors.New("invalid dead link threshold")
+	errWindowBudget   = errors.New("invalid window memory budget")
+	errQuarantine     = errors.New("invalid quarantine period")
+	errNoSession      = errors.New("no session of this conv")
+	errLocalAddr      = errors.New("no local address of the family of the remote")
+	errNoAddress      = errors.New("no address to dial")
+	errExport         = errors.New("session state can't be exported")
+	errResumeConfig   = errors.New("invalid reconnect config")
+	errResumeOffset   = errors.New("remote offset out of the stream")
+	errResumeProtocol = errors.New("reconnect protocol violation")
+	errResumeTimeout  = errors.New("connection not resumed in time")
+	rng               = rand.New(rand.NewSource(time.Now().UnixNano()))
+	errorHandler      atomic.Value // func(error)
 )
 
 const (
@@ -31,58 +76,156 @@ const (
 	crcSize         = 4     // 4bytes packet checksum
 	cryptHeaderSize = nonceSize + crcSize
 	connTimeout     = 60 * time.Second
+	closeLinger     = 5 * time.Second // a closed session waits that long for its eof to be acknowledged
 	mtuLimit        = 2048
 	txQueueLimit    = 8192
+	parityQueue     = 8 // fec groups waiting for their parity shards
 	rxFecLimit      = 2048
 	soBuffer        = 16777216
 )
 
 type (
+	// timeoutError is returned once a deadline passes, it implements net.Error
+	// so that callers such as crypto/tls see a timeout
+	timeoutError struct{}
+
+	// fecParams defines the geometry, codec and flush timeout of fec groups
+	fecParams struct {
+		dataShards, parityShards int
+		codec                    int
+		flushTimeout             time.Duration
+		leopardThreshold         int // groups larger than this use leopard, 0 disables
+		spanSize                 int // stream bytes per data shard, 0 for a shard per packet
+	}
+
+	// parityJob is a closed fec group handed over to parityTask
+	parityJob struct {
+		enc     fecCodec // codec of the group
+		data    [][]byte // copies of the data shards from their size field on
+		headers [][]byte // fec headers of the parity shards, marked in seqid order
+		offset  int      // crypt header room ahead of the fec headers
+	}
+
 	// UDPSession defines a KCP session implemented by UDP
 	UDPSession struct {
-		kcp           *KCP         // the core ARQ
-		fec           *FEC         // forward error correction
-		conn          *net.UDPConn // the underlying UDP socket
+		kcp           *KCP           // the core ARQ
+		fec           *FEC           // forward error correction
+		conn          net.PacketConn // the underlying socket
 		block         BlockCrypt
-		needUpdate    bool
 		l             *Listener // point to server listener if it's a server socket
-		local, remote net.Addr
-		rd            time.Time // read deadline
-		wd            time.Time // write deadline
-		sockbuff      []byte    // kcp receiving is based on packet, I turn it into stream
-		die           chan struct{}
-		isClosed      bool
+		local         net.Addr
+		rd            time.Time     // read deadline
+		wd            time.Time     // write deadline
+		created       time.Time     // for the age of the session
+		lifetime      *time.Timer   // closes the session once its lifetime is over, if set
+		cookieTags    *cookieTags   // packets sent until the listener was heard from, nil for the sessions of a listener
+		sockbuff      []byte        // kcp receiving is based on packet, I turn it into stream
+		datagrams     [][]byte      // unreliable datagrams waiting for ReadUnreliable
+		die           chan struct{} // closed by Close, wakes every blocked call
+		dieOnce       sync.Once
+		done          chan struct{} // closed once the session stops, after it lingered
+		doneOnce      sync.Once
+		rdClosed      bool // CloseRead called, the data received is dropped
+		wrClosed      bool // CloseWrite called, the eof is queued after the data
+		rdEOF         bool // the eof of the remote was read
+		established   bool // a packet of the remote was received
+		refused       bool // closed by a reset of the listener
+		kicked        bool // closed by Listener.CloseSession, lingers until the eof of the remote
+		convPending   bool // the conv requested isn't assigned yet
+		convAssigned  bool // the conv was assigned by the listener
+		pastWatermark bool // the queue reached the watermark
+		handshaken    bool // the keys came from a noise handshake
+		exported      bool // Export took the state, the packets are dropped
 		mu            sync.Mutex
 		chReadEvent   chan struct{}
 		chWriteEvent  chan struct{}
-		chTicker      chan time.Time
+		chDatagram    chan struct{}
+		rdChanged     chan struct{} // closed and renewed when rd changes
+		wdChanged     chan struct{} // closed and renewed when wd changes
+		lastInput     int64         // atomic, unix nanoseconds of the last packet received and authenticated
+		paused        int32         // atomic, 1 while Pause halts the sending
+		mtu           int32         // atomic, copy of the kcp mtu for outputTask, which can't take mu
+		bytesSent     uint64        // atomic, payload bytes written
+		bytesReceived uint64        // atomic, payload bytes read
+		currentRemote atomic.Value  // net.Addr of the remote, changed when it migrates
+		events        atomic.Value  // *SessionEvents of the session
+		ext           atomic.Value  // *headerExtension of the packets of a dialer, if set
+		obfs          atomic.Value  // *obfsParams padding the packets sent, see SetObfuscation
+		rxSalt        atomic.Value  // []byte, salt of the nonces of the remote, for Export
+		chUpdate      chan struct{} // wakes updateTask, see wakeUpdate
 		chUDPOutput   chan []byte
+		chFECParams   chan fecParams  // pending fec geometry change
+		chObfsParams  chan obfsParams // pending packet shaping change
+		chParityJobs  chan parityJob  // groups to compute the parity of
+		chParity      chan [][]byte   // parity shards ready to be sent
+		chRepair      chan int        // fountain repair symbols SendFECRepair asks parityTask for
+		fecTx         fecParams       // latest requested fec geometry
+		fecPkt        fecPacket       // decoded by kcpInput, reused across packets
+		fecSpan       spanReader      // reassembles the packets spanning data shards
 		headerSize    int
 		ackNoDelay    bool
+		noFEC         bool       // packets flushed now bypass fec grouping
+		fecDataOnly   bool       // packets without data segments bypass fec grouping
+		rexmitDup     int        // extra copies of packets carrying retransmissions
+		pacing        bool       // SetPacing spreads the segments
+		watermark     int        // segments waiting the queue drains below to call onDrained
+		onDrained     func()     // called once the queue drained below watermark
+		rtoBase       uint32     // smoothed rto while the link is healthy
+		rtoSpiked     bool       // the rto reached twice rtoBase
+		linkDead      bool       // a segment reached the retransmission limit
+		deadUna       uint32     // snd_una when the link went dead
+		unreachErr    error      // the icmp error which closed a connected session
+		unreachCount  int        // icmp errors since the last packet received
+		rxTs          uint32     // latest timestamp of the clock of the remote received, see senderTs
+		rxTsSeen      bool       // rxTs was received
+		deadLinkErr   error      // the dead link which closed the session, see SetDeadLink
+		deadLinkFail  bool       // a dead link closes the session
+		epoch         epochState // key epochs, if block is an EpochCrypt
+		layers        uint32     // order of the fec and crypt layers, atomic
 		xmitBuf       sync.Pool
+
+		pingSeq uint32                   // id of the latest probe of Ping
+		pings   map[uint32]chan<- uint32 // Pings waiting for the answer of a probe, by id
+
+		autoTune autoTune // sizing of the windows, see SetWindowAutoTune
 	}
 )
 
-// newUDPSession create a new udp session for client or server
-func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn *net.UDPConn, remote *net.UDPAddr, block BlockCrypt) *UDPSession {
+// newUDPSession create a new udp session for client or server, fec is nil if disabled
+func newUDPSession(conv uint32, fec *FEC, l *Listener, conn net.PacketConn, remote net.Addr, block BlockCrypt) *UDPSession {
 	sess := new(UDPSession)
-	sess.chTicker = make(chan time.Time, 1)
+	sess.chUpdate = make(chan struct{}, 1)
 	sess.chUDPOutput = make(chan []byte, txQueueLimit)
+	sess.chFECParams = make(chan fecParams, 1)
+	sess.chObfsParams = make(chan obfsParams, 1)
+	sess.chParityJobs = make(chan parityJob, parityQueue)
+	sess.chParity = make(chan [][]byte, parityQueue)
+	sess.chRepair = make(chan int)
 	sess.die = make(chan struct{})
+	sess.done = make(chan struct{})
 	sess.local = conn.LocalAddr()
 	sess.chReadEvent = make(chan struct{}, 1)
 	sess.chWriteEvent = make(chan struct{}, 1)
-	sess.remote = remote
+	sess.chDatagram = make(chan struct{}, 1)
+	sess.pings = make(map[uint32]chan<- uint32)
+	sess.rdChanged = make(chan struct{})
+	sess.wdChanged = make(chan struct{})
+	sess.lastInput = time.Now().UnixNano()
+	sess.created = time.Now()
+	sess.currentRemote.Store(remote)
 	sess.conn = conn
 	sess.l = l
 	sess.block = block
-	sess.fec = newFEC(rxFecLimit, dataShards, parityShards)
+	sess.fec = fec
+	if fec != nil {
+		sess.fecTx = fecParams{fec.dataShards, fec.parityShards, FECCodecReedSolomon, 0, 0, 0}
+	}
 	sess.xmitBuf.New = func() interface{} {
 		return make([]byte, mtuLimit)
 	}
 	// calculate header size
 	if sess.block != nil {
-		sess.headerSize += cryptHeaderSize
+		sess.headerSize += cryptOverhead(sess.block)
 	}
 	if sess.fec != nil {
 		sess.headerSize += fecHeaderSizePlus2
@@ -90,19 +233,37 @@ func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn
 
 	sess.kcp = NewKCP(conv, func(buf []byte, size int) {
 		if size >= IKCP_OVERHEAD {
-			ext := sess.xmitBuf.Get().([]byte)[:sess.headerSize+size]
-			copy(ext[sess.headerSize:], buf)
-			select {
-			case sess.chUDPOutput <- ext:
-			case <-sess.die:
+			// a second loss of a retransmitted segment stalls the stream,
+			// the copies are fec-protected as separate data shards
+			copies := 1
+			if sess.kcp.rexmit {
+				copies += sess.rexmitDup
+			}
+			for i := 0; i < copies; i++ {
+				ext := sess.xmitBuf.Get().([]byte)[:sess.headerSize+size]
+				copy(ext[sess.headerSize:], buf)
+				if sess.fec != nil && (sess.noFEC || sess.fecDataOnly && !hasPush(buf[:size])) { // tell outputTask to skip grouping
+					ext[sess.headerSize-fecHeaderSizePlus2+4] = typeNoFEC
+				}
+				select {
+				case sess.chUDPOutput <- ext:
+				case <-sess.done:
+				}
 			}
 		}
 	})
 	sess.kcp.WndSize(defaultWndSize, defaultWndSize)
 	sess.kcp.SetMtu(IKCP_MTU_DEF - sess.headerSize)
+	sess.mtu = int32(sess.kcp.mtu)
 
+	if l == nil {
+		sess.cookieTags = new(cookieTags)
+	}
 	go sess.updateTask()
 	go sess.outputTask()
+	if fec != nil {
+		go sess.parityTask()
+	}
 	if l == nil { // it's a client connection
 		go sess.readLoop()
 	}
@@ -125,6 +286,11 @@ func newUDPSession(conv uint32, dataShards, parityShards int, l *Listener, conn
 func (s *UDPSession) Read(b []byte) (n int, err error) {
 	for {
 		s.mu.Lock()
+		if s.closed() {
+			s.mu.Unlock()
+			return 0, s.closedErr()
+		}
+
 		if len(s.sockbuff) > 0 { // copy from buffer
 			n = copy(b, s.sockbuff)
 			s.sockbuff = s.sockbuff[n:]
@@ -132,9 +298,9 @@ func (s *UDPSession) Read(b []byte) (n int, err error) {
 			return n, nil
 		}
 
-		if s.isClosed {
+		if s.rdEOF || s.rdClosed {
 			s.mu.Unlock()
-			return 0, errBrokenPipe
+			return 0, io.EOF
 		}
 
 		if !s.rd.IsZero() {
@@ -144,44 +310,109 @@ func (s *UDPSession) Read(b []byte) (n int, err error) {
 			}
 		}
 
+		if s.kcp.PeekSize() == 0 { // the remote closed its write side
+			s.recv(nil)
+			s.rdEOF = true
+			s.mu.Unlock()
+			return 0, io.EOF
+		}
+
 		if n := s.kcp.PeekSize(); n > 0 { // data arrived
 			if len(b) >= n {
-				s.kcp.Recv(b)
+				s.recv(b)
 			} else {
 				buf := make([]byte, n)
-				s.kcp.Recv(buf)
+				s.recv(buf)
 				n = copy(b, buf)
 				s.sockbuff = buf[n:] // store remaining bytes into sockbuff for next read
 			}
 			s.mu.Unlock()
 			atomic.AddUint64(&DefaultSnmp.BytesReceived, uint64(n))
+			atomic.AddUint64(&s.bytesReceived, uint64(n))
 			return n, nil
 		}
 
-		var timeout <-chan time.Time
-		if !s.rd.IsZero() {
-			delay := s.rd.Sub(time.Now())
-			timeout = time.After(delay)
-		}
-		s.mu.Unlock()
+		s.waitRead(s.chReadEvent)
+	}
+}
 
-		// wait for read event or timeout
-		select {
-		case <-s.chReadEvent:
-		case <-timeout:
-		case <-s.die:
-		}
+// recv moves the next message of kcp to buf, and has updateTask send the
+// window update once reading reopened a full receive window, as the sender
+// would otherwise wait for its window probe; the caller holds mu
+func (s *UDPSession) recv(buf []byte) int {
+	n := s.kcp.Recv(buf)
+	if s.kcp.probe&IKCP_ASK_TELL != 0 {
+		s.wakeUpdate()
+	}
+	return n
+}
+
+// waitRead releases mu, which the caller holds, and waits for an event,
+// the read deadline or a new deadline
+func (s *UDPSession) waitRead(event chan struct{}) {
+	var timeout <-chan time.Time
+	var timer *time.Timer
+	if !s.rd.IsZero() {
+		timer = time.NewTimer(time.Until(s.rd))
+		timeout = timer.C
+	}
+	rdChanged := s.rdChanged
+	s.mu.Unlock()
+
+	select {
+	case <-event:
+	case <-timeout:
+	case <-rdChanged:
+	case <-s.die:
+	}
+	if timer != nil {
+		timer.Stop()
 	}
 }
 
 // Write implements the Conn Write method.
 func (s *UDPSession) Write(b []byte) (n int, err error) {
+	return s.write([][]byte{b}, false, false, PriorityNormal)
+}
+
+// WriteNoFEC writes a latency-critical message, the packets flushed by this
+// call are sent immediately without waiting for a fec group to fill and carry
+// no parity, so they are not protected against loss beyond kcp retransmission.
+func (s *UDPSession) WriteNoFEC(b []byte) (n int, err error) {
+	return s.write([][]byte{b}, true, false, PriorityNormal)
+}
+
+// WriteBuffers writes the concatenation of bufs like Write, the segments are
+// filled from the buffers directly instead of from a copy of them joined into
+// one slice, which saves scatter/gather senders such as proxies a large copy.
+// The buffers are left untouched.
+func (s *UDPSession) WriteBuffers(bufs net.Buffers) (n int, err error) {
+	return s.write(bufs, false, false, PriorityNormal)
+}
+
+// write sends the concatenation of bufs as a stream of messages of up to 255
+// segments, or as a single message, at priority prio
+func (s *UDPSession) write(bufs [][]byte, noFEC, message bool, prio int) (n int, err error) {
+	size := 0
+	for _, b := range bufs {
+		size += len(b)
+	}
 	for {
 		s.mu.Lock()
-		if s.isClosed {
+		if s.closed() {
+			s.mu.Unlock()
+			return 0, s.closedErr()
+		}
+		if s.wrClosed {
 			s.mu.Unlock()
 			return 0, errBrokenPipe
 		}
+		if message {
+			if err := s.checkMessage(size); err != nil {
+				s.mu.Unlock()
+				return 0, err
+			}
+		}
 
 		if !s.wd.IsZero() {
 			if time.Now().After(s.wd) { // timeout
@@ -191,69 +422,317 @@ func (s *UDPSession) Write(b []byte) (n int, err error) {
 		}
 
 		if s.kcp.WaitSnd() < 2*int(s.kcp.snd_wnd) {
-			n = len(b)
-			max := s.kcp.mss << 8
-			for {
-				if len(b) <= int(max) { // in most cases
-					s.kcp.Send(b)
-					break
-				} else {
-					s.kcp.Send(b[:max])
-					b = b[max:]
+			n = size
+			max := int(s.kcp.mss) * maxFragments
+			r := buffersReader{bufs: bufs}
+			for size > 0 {
+				chunk := size
+				if !message && chunk > max {
+					chunk = max
 				}
+				s.kcp.sendBuffers(&r, chunk, int32(prio))
+				size -= chunk
 			}
-			s.kcp.current = currentMs()
-			s.kcp.flush()
+			if !s.Paused() {
+				s.kcp.current = currentMs()
+				s.noFEC = noFEC
+				s.kcp.flush()
+				s.noFEC = false
+			}
+			s.wakeUpdate()
+			drained := s.checkWatermark()
 			s.mu.Unlock()
+			if drained != nil {
+				drained()
+			}
 			atomic.AddUint64(&DefaultSnmp.BytesSent, uint64(n))
+			atomic.AddUint64(&s.bytesSent, uint64(n))
 			return n, nil
 		}
 
 		var timeout <-chan time.Time
+		var timer *time.Timer
 		if !s.wd.IsZero() {
-			delay := s.wd.Sub(time.Now())
-			timeout = time.After(delay)
+			timer = time.NewTimer(time.Until(s.wd))
+			timeout = timer.C
 		}
+		wdChanged := s.wdChanged
 		s.mu.Unlock()
 
-		// wait for write event or timeout
+		// wait for write event, timeout or a new deadline
 		select {
 		case <-s.chWriteEvent:
 		case <-timeout:
+		case <-wdChanged:
 		case <-s.die:
 		}
+		if timer != nil {
+			timer.Stop()
+		}
 	}
 }
 
-// Close closes the connection.
+// Close closes the connection. The calls blocked in Read, Write and the
+// other methods of the session return at once with an error, and so do the
+// calls after it, even if data was received and not read. The session
+// lingers in the background for up to 5s, until the remote acknowledged the
+// data written and an eof sent after it, as with CloseWrite, so that the
+// reads of the remote end with io.EOF instead of timing out. The data
+// received meanwhile is dropped. A dialer closes its socket, or the
+// net.PacketConn it was given, once the session stopped lingering.
 func (s *UDPSession) Close() error {
+	return s.close(true)
+}
+
+// close closes the session, which lingers until the remote acknowledged the
+// eof if linger is set, or stops at once
+func (s *UDPSession) close(linger bool) error {
+	// die is closed without mu, which a Write may hold while the output
+	// is full, the blocked calls return at once
+	once := false
+	s.dieOnce.Do(func() {
+		close(s.die)
+		once = true
+	})
+	if !once {
+		return errBrokenPipe
+	}
+	if linger {
+		go s.linger()
+	} else {
+		s.stop()
+	}
+	s.stopLifetime()
+
+	atomic.AddUint64(&DefaultSnmp.CurrEstab, ^uint64(0))
+	s.emit(func(h *SessionEvents) {
+		if h.Closed != nil {
+			h.Closed(s)
+		}
+	})
+	return nil
+}
+
+// linger sends the eof of a closed session, and stops the session once the
+// remote acknowledged it or closeLinger passed. A kicked session waits for
+// the eof of the remote too, and for its ack to be sent, dropping the data
+// received meanwhile. The sessions which neither heard of their remote nor
+// sent it anything, or were refused, stop at once.
+func (s *UDPSession) linger() {
+	s.mu.Lock()
+	lingering := (s.established || s.kcp.WaitSnd() > 0) && !s.refused && s.unreachErr == nil && s.deadLinkErr == nil
+	if lingering {
+		s.rdClosed = true
+		s.sockbuff = nil
+		s.dropReceived()
+		s.queueEOF()
+	}
+	s.mu.Unlock()
+
+	if lingering {
+		deadline := time.NewTimer(closeLinger)
+		defer deadline.Stop()
+		poll := time.NewTicker(10 * time.Millisecond)
+		defer poll.Stop()
+	wait:
+		for {
+			s.mu.Lock()
+			waiting := s.kcp.WaitSnd()
+			if s.kicked && (!s.rdEOF || len(s.kcp.acklist) > 0 || len(s.chUDPOutput) > 0) {
+				waiting++
+			}
+			s.mu.Unlock()
+			if waiting == 0 {
+				break
+			}
+			select {
+			case <-poll.C:
+			case <-deadline.C:
+				break wait
+			case <-s.done:
+				return
+			}
+		}
+	}
+	s.stop()
+}
+
+// stop stops the goroutines of a closed session, and closes the socket of
+// a dialer
+func (s *UDPSession) stop() {
+	s.doneOnce.Do(func() {
+		close(s.done)
+		if s.l == nil { // client socket close
+			s.conn.Close()
+		}
+	})
+}
+
+// closed tells if the session was closed
+func (s *UDPSession) closed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// closedErr returns the error of the reads and writes of a closed session,
+// the caller holds mu
+func (s *UDPSession) closedErr() error {
+	if s.refused {
+		return errConnRefused
+	}
+	if s.unreachErr != nil {
+		return s.unreachErr
+	}
+	if s.deadLinkErr != nil {
+		return s.deadLinkErr
+	}
+	return errBrokenPipe
+}
+
+// CloseGracefully closes the session once the data written was acknowledged
+// by the remote, or the timeout passed, whichever comes first. Writes fail
+// from the call on, and the remote reads an eof after the data as with
+// CloseWrite. It returns the bytes the remote didn't acknowledge in time,
+// which are abandoned.
+func (s *UDPSession) CloseGracefully(timeout time.Duration) (abandoned int, err error) {
+	if err := s.CloseWrite(); err != nil {
+		return 0, err
+	}
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(10 * time.Millisecond)
+	defer poll.Stop()
+drain:
+	for {
+		s.mu.Lock()
+		waiting := s.kcp.WaitSnd()
+		s.mu.Unlock()
+		if waiting == 0 {
+			break
+		}
+		select {
+		case <-poll.C:
+		case <-deadline.C:
+			break drain
+		case <-s.die:
+			return 0, errBrokenPipe
+		}
+	}
+
+	s.mu.Lock()
+	for k := range s.kcp.snd_buf {
+		abandoned += len(s.kcp.snd_buf[k].data)
+	}
+	for k := range s.kcp.snd_queue {
+		abandoned += len(s.kcp.snd_queue[k].data)
+	}
+	s.mu.Unlock()
+	return abandoned, s.close(false)
+}
+
+// CloseWrite shuts down the writing side of the session like the CloseWrite
+// method of net.TCPConn: the data written so far is sent, followed by an eof
+// which ends the reads of the remote once it has read the data, while the
+// session keeps reading. Writes fail from now on. The eof is an empty kcp
+// segment, the remote must run a version of this package with half-close
+// support.
+func (s *UDPSession) CloseWrite() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.isClosed {
+	if s.closed() {
 		return errBrokenPipe
 	}
-	close(s.die)
-	s.isClosed = true
-	if s.l == nil { // client socket close
-		s.conn.Close()
+	if s.wrClosed {
+		return nil
 	}
+	s.queueEOF()
 
-	atomic.AddUint64(&DefaultSnmp.CurrEstab, ^uint64(0))
+	// blocked writes fail
+	close(s.wdChanged)
+	s.wdChanged = make(chan struct{})
+	return nil
+}
+
+// queueEOF sends the eof after the data written, once, the caller holds mu
+func (s *UDPSession) queueEOF() {
+	if s.wrClosed {
+		return
+	}
+	s.wrClosed = true
+	s.kcp.snd_queue = append(s.kcp.snd_queue, *NewSegment(0))
+	if !s.Paused() {
+		s.kcp.current = currentMs()
+		s.kcp.flush()
+	}
+	s.wakeUpdate()
+}
+
+// CloseRead shuts down the reading side of the session like the CloseRead
+// method of net.TCPConn: reads return io.EOF from now on, the data received
+// is dropped but still acknowledged, so that the remote isn't stalled, and
+// the session keeps writing.
+func (s *UDPSession) CloseRead() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed() {
+		return errBrokenPipe
+	}
+	s.rdClosed = true
+	s.sockbuff = nil
+	s.dropReceived()
+
+	// blocked reads return
+	close(s.rdChanged)
+	s.rdChanged = make(chan struct{})
 	return nil
 }
 
+// dropReceived drops the messages received once the reading side is closed,
+// the caller holds mu
+func (s *UDPSession) dropReceived() {
+	var buf []byte
+	for n := s.kcp.PeekSize(); n >= 0; n = s.kcp.PeekSize() {
+		if n > len(buf) {
+			buf = make([]byte, n)
+		}
+		if n == 0 {
+			s.rdEOF = true
+		}
+		s.recv(buf)
+	}
+}
+
 // LocalAddr returns the local network address. The Addr returned is shared by all invocations of LocalAddr, so do not modify it.
 func (s *UDPSession) LocalAddr() net.Addr { return s.local }
 
 // RemoteAddr returns the remote network address. The Addr returned is shared by all invocations of RemoteAddr, so do not modify it.
-func (s *UDPSession) RemoteAddr() net.Addr { return s.remote }
-
-// SetDeadline sets the deadline associated with the listener. A zero time value disables the deadline.
+// It changes once the remote migrates, see Listener.SetMigration.
+func (s *UDPSession) RemoteAddr() net.Addr { return s.currentRemote.Load().(net.Addr) }
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// Is makes errors.Is(err, os.ErrDeadlineExceeded) hold, as for the net.Conns
+// of the standard library
+func (timeoutError) Is(target error) bool { return target == os.ErrDeadlineExceeded }
+
+// SetDeadline sets the read and write deadlines, as in the net.Conn
+// interface: once a deadline passes, pending and future calls fail with an
+// error whose Timeout method returns true and which matches
+// os.ErrDeadlineExceeded, until the deadline is extended. Every goroutine
+// blocked in Read or Write picks up the new deadline. A zero time value
+// disables the deadline.
 func (s *UDPSession) SetDeadline(t time.Time) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.rd = t
-	s.wd = t
+	s.setReadDeadline(t)
+	s.setWriteDeadline(t)
 	return nil
 }
 
@@ -261,7 +740,7 @@ func (s *UDPSession) SetDeadline(t time.Time) error {
 func (s *UDPSession) SetReadDeadline(t time.Time) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.rd = t
+	s.setReadDeadline(t)
 	return nil
 }
 
@@ -269,10 +748,24 @@ func (s *UDPSession) SetReadDeadline(t time.Time) error {
 func (s *UDPSession) SetWriteDeadline(t time.Time) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	s.wd = t
+	s.setWriteDeadline(t)
 	return nil
 }
 
+// setReadDeadline sets rd and wakes all the blocked readers, the caller holds mu
+func (s *UDPSession) setReadDeadline(t time.Time) {
+	s.rd = t
+	close(s.rdChanged)
+	s.rdChanged = make(chan struct{})
+}
+
+// setWriteDeadline sets wd and wakes all the blocked writers, the caller holds mu
+func (s *UDPSession) setWriteDeadline(t time.Time) {
+	s.wd = t
+	close(s.wdChanged)
+	s.wdChanged = make(chan struct{})
+}
+
 // SetWindowSize set maximum window size
 func (s *UDPSession) SetWindowSize(sndwnd, rcvwnd int) {
 	s.mu.Lock()
@@ -280,14 +773,40 @@ func (s *UDPSession) SetWindowSize(sndwnd, rcvwnd int) {
 	s.kcp.WndSize(sndwnd, rcvwnd)
 }
 
-// SetMtu sets the maximum transmission unit
-func (s *UDPSession) SetMtu(mtu int) {
+// SetMtu sets the maximum transmission unit, the largest packet sent,
+// headers included. It may be called on a live session, when a change of the
+// path MTU is detected: the segments queued from then on are cut by the new
+// mss, as are the queued ones not sent yet, while the segments in flight keep
+// their size. The fec shard size is reduced to fit the new MTU.
+func (s *UDPSession) SetMtu(mtu int) error {
+	if mtu > mtuLimit || mtu-s.headerSize < 50 {
+		return errMTU
+	}
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.kcp.SetMtu(mtu - s.headerSize)
+	atomic.StoreInt32(&s.mtu, int32(s.kcp.mtu))
+	if limit := s.spanLimit(); s.fecTx.spanSize > limit {
+		s.fecTx.spanSize = limit
+		if limit < spanMinSize {
+			s.fecTx.spanSize = 0
+		}
+		s.updateFECParams()
+	}
+	return nil
+}
+
+// spanLimit returns the largest fec shard size fitting the mtu, the caller
+// holds mu
+func (s *UDPSession) spanLimit() int {
+	return int(s.kcp.mtu) - spanHeaderSize
 }
 
-// SetStreamMode toggles the stream mode on/off
+// SetStreamMode toggles the stream mode on/off, in which the writes are
+// merged into a byte stream instead of kept as messages. Both sides of the
+// session must be in the same mode, see Listener.SetStreamMode for the
+// sessions of a listener.
 func (s *UDPSession) SetStreamMode(enable bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -305,232 +824,916 @@ func (s *UDPSession) SetACKNoDelay(nodelay bool) {
 	s.ackNoDelay = nodelay
 }
 
+// SetRetransmitDuplicates sends n extra copies of the packets carrying
+// retransmitted segments, as losing them again stalls the stream, 0 disables.
+func (s *UDPSession) SetRetransmitDuplicates(n int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if n < 0 {
+		n = 0
+	}
+	s.rexmitDup = n
+}
+
 // SetNoDelay calls nodelay() of kcp
 func (s *UDPSession) SetNoDelay(nodelay, interval, resend, nc int) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.kcp.NoDelay(nodelay, interval, resend, nc)
+	s.wakeUpdate()
 }
 
-// SetDSCP sets the 6bit DSCP field of IP header
-func (s *UDPSession) SetDSCP(dscp int) {
+// SetRTOBounds bounds the retransmission timeout estimated from the rtt to
+// [min, max], and sets the factor the rto of a segment is multiplied by
+// each time it's retransmitted, up to 8 times the rto and max. Real-time
+// deployments want a floor lower than the default one, satellite links a
+// higher ceiling. min 0 keeps the floor of SetNoDelay, 30ms with nodelay,
+// 100ms without, lowered to max if above, max 0 keeps 60s, and backoff 0
+// keeps the linear growth of SetNoDelay, by half the rto with nodelay, by
+// the rto without. The bounds have a millisecond resolution.
+func (s *UDPSession) SetRTOBounds(min, max time.Duration, backoff float64) error {
+	if !validRTOBounds(min, max, backoff) {
+		return errRTOBounds
+	}
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if err := ipv4.NewConn(s.conn).SetTOS(dscp << 2); err != nil {
-		log.Println("dscp:", err)
-	}
+	s.kcp.SetRTO(uint32(min/time.Millisecond), uint32(max/time.Millisecond), backoff)
+	return nil
 }
 
-func (s *UDPSession) outputTask() {
-	// offset pre-compute
-	fecOffset := 0
-	if s.block != nil {
-		fecOffset = cryptHeaderSize
-	}
-	szOffset := fecOffset + fecHeaderSize
-
-	// fec data group
-	var fecGroup [][]byte
-	var fecCnt int
-	var fecMaxSize int
-	if s.fec != nil {
-		fecGroup = make([][]byte, s.fec.shardSize)
-		for k := range fecGroup {
-			fecGroup[k] = make([]byte, mtuLimit)
-		}
+// validRTOBounds tells if SetRTOBounds accepts the bounds
+func validRTOBounds(min, max time.Duration, backoff float64) bool {
+	ceiling := max
+	if ceiling == 0 {
+		ceiling = IKCP_RTO_MAX * time.Millisecond
 	}
-
-	// ping
-	ticker := time.NewTicker(5 * time.Second)
-	defer ticker.Stop()
-	for {
-		select {
-		case ext := <-s.chUDPOutput:
-			var ecc [][]byte
-			if s.fec != nil {
-				s.fec.markData(ext[fecOffset:])
-				// explicit size
-				binary.LittleEndian.PutUint16(ext[szOffset:], uint16(len(ext[szOffset:])))
-
-				// copy data to fec group
-				xorBytes(fecGroup[fecCnt], fecGroup[fecCnt], fecGroup[fecCnt])
-				copy(fecGroup[fecCnt], ext)
-				fecCnt++
-				if len(ext) > fecMaxSize {
-					fecMaxSize = len(ext)
-				}
-
-				//  calculate Reed-Solomon Erasure Code
-				if fecCnt == s.fec.dataShards {
-					ecc = s.fec.calcECC(fecGroup, szOffset, fecMaxSize)
-					for k := range ecc {
-						s.fec.markFEC(ecc[k][fecOffset:])
-						ecc[k] = ecc[k][:fecMaxSize]
-					}
-					fecCnt = 0
-					fecMaxSize = 0
-				}
-			}
-
-			if s.block != nil {
-				io.ReadFull(crand.Reader, ext[:nonceSize])
-				checksum := crc32.ChecksumIEEE(ext[cryptHeaderSize:])
-				binary.LittleEndian.PutUint32(ext[nonceSize:], checksum)
-				s.block.Encrypt(ext, ext)
-
-				if ecc != nil {
-					for k := range ecc {
-						io.ReadFull(crand.Reader, ecc[k][:nonceSize])
-						checksum := crc32.ChecksumIEEE(ecc[k][cryptHeaderSize:])
-						binary.LittleEndian.PutUint32(ecc[k][nonceSize:], checksum)
-						s.block.Encrypt(ecc[k], ecc[k])
-					}
-				}
-			}
-
-			//if rand.Intn(100) < 80 {
-			n, err := s.conn.WriteTo(ext, s.remote)
-			if err != nil {
-				log.Println(err, n)
-			}
-			atomic.AddUint64(&DefaultSnmp.OutSegs, 1)
-			atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(n))
-			//}
-
-			if ecc != nil {
-				for k := range ecc {
-					n, err := s.conn.WriteTo(ecc[k], s.remote)
-					if err != nil {
-						log.Println(err, n)
-					}
-					atomic.AddUint64(&DefaultSnmp.OutSegs, 1)
-					atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(n))
-				}
-			}
-			xorBytes(ext, ext, ext)
-			s.xmitBuf.Put(ext)
-		case <-ticker.C: // only for NAT keep purpose
-			sz := rng.Intn(IKCP_MTU_DEF - s.headerSize - IKCP_OVERHEAD)
-			sz += s.headerSize + IKCP_OVERHEAD
-			ping := make([]byte, sz)
-			io.ReadFull(crand.Reader, ping)
-			n, err := s.conn.WriteTo(ping, s.remote)
-			if err != nil {
-				log.Println(err, n)
-			}
-		case <-s.die:
-			return
-		}
+	switch {
+	case min < 0 || max < 0 || min > ceiling:
+		return false
+	case min > 0 && min < time.Millisecond || max > 0 && max < time.Millisecond:
+		return false
+	case min > math.MaxUint32*time.Millisecond/8 || max > math.MaxUint32*time.Millisecond/8:
+		return false
 	}
+	return backoff == 0 || backoff >= 1
 }
 
-// kcp update, input loop
-func (s *UDPSession) updateTask() {
-	var tc <-chan time.Time
-	if s.l == nil { // client
-		ticker := time.NewTicker(10 * time.Millisecond)
-		tc = ticker.C
-		defer ticker.Stop()
-	} else {
-		tc = s.chTicker
+// SetFECParameters changes the Reed-Solomon geometry of outgoing packets,
+// the switch happens at the next group boundary and the remote detects it from the fec headers,
+// the groups in flight with the previous geometry are still recovered.
+// parityShards 0 sends plain kcp packets without fec header, which the remote detects too.
+func (s *UDPSession) SetFECParameters(dataShards, parityShards int) error {
+	if s.fec == nil {
+		return errNoFEC
 	}
-
-	var nextupdate uint32
-	for {
-		select {
-		case <-tc:
-			s.mu.Lock()
-			current := currentMs()
-			if current >= nextupdate || s.needUpdate {
-				s.kcp.Update(current)
-				nextupdate = s.kcp.Check(current)
-			}
-			if s.kcp.WaitSnd() < 2*int(s.kcp.snd_wnd) {
-				s.notifyWriteEvent()
-			}
-			s.needUpdate = false
-			s.mu.Unlock()
-		case <-s.die:
-			if s.l != nil { // has listener
-				s.l.chDeadlinks <- s.remote
-			}
-			return
-		}
+	if parityShards != 0 && (!validFECParameters(dataShards, parityShards) || dataShards+parityShards > rxFecLimit) {
+		return errFECParams
 	}
-}
 
-// GetConv gets conversation id of a session
-func (s *UDPSession) GetConv() uint32 {
-	return s.kcp.conv
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fecTx.dataShards = dataShards
+	s.fecTx.parityShards = parityShards
+	s.updateFECParams()
+	return nil
 }
 
-func (s *UDPSession) notifyReadEvent() {
-	select {
-	case s.chReadEvent <- struct{}{}:
+// SetFECCodec selects the parity codec of outgoing packets, FECCodecXOR
+// always sends exactly 1 parity shard per group regardless of parityShards.
+// With FECCodecFountain parityShards repair symbols are sent per group, and
+// as many more as a one-way link needs on demand with SendFECRepair.
+func (s *UDPSession) SetFECCodec(codec int) error {
+	if s.fec == nil {
+		return errNoFEC
+	}
+	switch codec {
+	case FECCodecReedSolomon, FECCodecXOR, FECCodecLeopard, FECCodecFountain:
 	default:
+		return errFECParams
 	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fecTx.codec = codec
+	s.updateFECParams()
+	return nil
 }
 
-func (s *UDPSession) notifyWriteEvent() {
+// SendFECRepair sends n more repair symbols of the latest group sent with
+// FECCodecFountain, after those sent already, for a one-way link whose
+// remote can't have the losses retransmitted in time, or before a burst of
+// them. The symbols are generated on demand from the data shards of the
+// group, which are kept until the next group closes.
+func (s *UDPSession) SendFECRepair(n int) error {
+	if s.fec == nil {
+		return errNoFEC
+	}
+	s.mu.Lock()
+	codec := s.fecTx.codec
+	s.mu.Unlock()
+	if codec != FECCodecFountain || n <= 0 {
+		return errFECParams
+	}
+
 	select {
-	case s.chWriteEvent <- struct{}{}:
-	default:
+	case s.chRepair <- n:
+		return nil
+	case <-s.die:
+		return io.ErrClosedPipe
 	}
 }
 
-func (s *UDPSession) kcpInput(data []byte) {
-	atomic.AddUint64(&DefaultSnmp.InSegs, 1)
-	s.mu.Lock()
-	if s.fec != nil {
-		f := s.fec.decode(data)
-		if f.flag == typeData || f.flag == typeFEC {
-			if f.flag == typeFEC {
+// SetFECFlushTimeout sets the maximum time a fec group can stay partially filled,
+// when it expires the group is closed and its parity shards are sent, so that
+// low-rate traffic is protected too. 0 disables the timer (default).
+func (s *UDPSession) SetFECFlushTimeout(timeout time.Duration) error {
+	if s.fec == nil {
+		return errNoFEC
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fecTx.flushTimeout = timeout
+	s.updateFECParams()
+	return nil
+}
+
+// SetFECDataOnly sends the packets without data segments, such as pure acks
+// and window probes, outside of fec groups when enabled, so that the parity
+// is spent protecting payload.
+func (s *UDPSession) SetFECDataOnly(enabled bool) error {
+	if s.fec == nil {
+		return errNoFEC
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fecDataOnly = enabled
+	return nil
+}
+
+// SetFECRxLimit caps the memory held by fec shards waiting for their group
+// to complete, 0 means the queue is only limited by its packet count.
+// Whole groups least likely to complete are evicted when the cap is hit.
+func (s *UDPSession) SetFECRxLimit(bytes int) error {
+	if s.fec == nil {
+		return errNoFEC
+	}
+	if bytes < 0 {
+		return errFECParams
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fec.setRxByteLimit(bytes)
+	return nil
+}
+
+// SetFECShardSize packs the outgoing packets back to back into data shards
+// of size bytes, packets larger than a shard span several ones, so that the
+// protection and the parity overhead don't depend on the packet sizes.
+// Partial shards are sent when no more packets are queued. 0 sends a data
+// shard per packet (default).
+func (s *UDPSession) SetFECShardSize(size int) error {
+	if s.fec == nil {
+		return errNoFEC
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if size != 0 && (size < spanMinSize || size > s.spanLimit()) {
+		return errFECParams
+	}
+	s.fecTx.spanSize = size
+	s.updateFECParams()
+	return nil
+}
+
+// SetFECRxExpire sets how long an incomplete fec group is kept without
+// receiving a shard, its remaining shards are given up on afterwards.
+// Shorter ages free memory sooner on lossy links, the default is 30s.
+func (s *UDPSession) SetFECRxExpire(age time.Duration) error {
+	if s.fec == nil {
+		return errNoFEC
+	}
+	if age < time.Millisecond || age > 0x7fffffff*time.Millisecond {
+		return errFECParams
+	}
+
+	s.fec.setRxExpire(uint32(age / time.Millisecond))
+	return nil
+}
+
+// SetFECLeopardThreshold switches Reed-Solomon groups of more than shards
+// data and parity shards in total to the leopard-gf16 codec, which scales
+// much better with large groups. 0 disables the switch (default). It needs
+// github.com/klauspost/reedsolomon v1.11.0 or later. Leopard codes shards
+// of a multiple of 64 bytes, its parity shards are up to 63 bytes longer
+// than the data shards, which the default mtu leaves room for on ethernet.
+func (s *UDPSession) SetFECLeopardThreshold(shards int) error {
+	if s.fec == nil {
+		return errNoFEC
+	}
+	if shards < 0 {
+		return errFECParams
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fecTx.leopardThreshold = shards
+	s.updateFECParams()
+	return nil
+}
+
+// updateFECParams hands the latest fec setting over to outputTask
+func (s *UDPSession) updateFECParams() {
+	p := s.fecTx
+	if p.codec == FECCodecXOR && p.parityShards > 0 {
+		p.parityShards = 1
+	}
+	if p.codec == FECCodecReedSolomon && p.leopardThreshold > 0 && p.dataShards+p.parityShards > p.leopardThreshold {
+		p.codec = FECCodecLeopard
+	}
+
+	// the latest setting wins
+	select {
+	case <-s.chFECParams:
+	default:
+	}
+	s.chFECParams <- p
+}
+
+// FECStats returns a snapshot of the fec decoding statistics
+func (s *UDPSession) FECStats() FECStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fec == nil {
+		return FECStats{}
+	}
+	return s.fec.snapshot()
+}
+
+// SetDSCP sets the 6bit DSCP field of IP header, sessions over a conn which
+// isn't an IP socket are left as is
+func (s *UDPSession) SetDSCP(dscp int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	setDSCP(s.conn, dscp)
+}
+
+func (s *UDPSession) outputTask() {
+	// offset pre-compute
+	fecOffset := 0
+	if s.block != nil {
+		fecOffset = cryptOverhead(s.block)
+	}
+	szOffset := fecOffset + fecHeaderSize
+	cryptOffset := fecOffset
+
+	// the order of the layers is fixed by the first packet, encrypting
+	// before fec leaves no crypt header room ahead of the fec headers
+	var layersKnown bool
+	var outer bool
+
+	// data shards of the current group, kept for parityTask
+	var fecData [][]byte
+	var fecCnt int
+	var fecPassthrough bool // parityShards is 0, packets are sent without fec header
+	var fecFlushTimeout time.Duration
+	var fecSpan spanWriter // cuts packets into fixed size shards if enabled
+	var obfs obfsParams    // dummy packets
+
+	// dummy packet timer, armed while dummy packets are enabled
+	obfsRand := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var obfsDummy <-chan time.Time
+	obfsDummyTimer := time.NewTimer(time.Hour)
+	obfsDummyTimer.Stop()
+	defer obfsDummyTimer.Stop()
+
+	// fec flush timer, armed by the first shard of a group
+	var fecFlush <-chan time.Time
+	fecFlushTimer := time.NewTimer(time.Hour)
+	fecFlushTimer.Stop()
+	defer fecFlushTimer.Stop()
+
+	// send pads, encrypts and writes a packet
+	send := func(ext []byte) {
+		if p := s.obfuscation(); p != nil && len(p.buckets) > 0 {
+			ext = p.pad(ext, fecOffset)
+		}
+		if s.block != nil && !outer {
+			s.encryptPacket(ext)
+		}
+		s.writePacket(ext)
+		xorBytes(ext, ext, ext)
+		s.xmitBuf.Put(ext[:cap(ext)])
+	}
+
+	// closeGroup takes the seqids of the parity shards right after the data
+	// shards and hands the group over to parityTask, filled is the number of
+	// data shards of a group closed early, 0 for a full group. parityTask
+	// sends the parity back, which is drained while the queue is full.
+	closeGroup := func(filled int) {
+		job := parityJob{enc: s.fec.encoder(), data: fecData, offset: fecOffset}
+		job.headers = make([][]byte, s.fec.parityShards)
+		for k := range job.headers {
+			job.headers[k] = make([]byte, fecHeaderSize)
+			if filled > 0 {
+				s.fec.markPartialFEC(job.headers[k], filled)
+			} else {
+				s.fec.markFEC(job.headers[k])
+			}
+		}
+		fecData = nil
+		fecCnt = 0
+
+		for {
+			select {
+			case s.chParityJobs <- job:
+				return
+			case ecc := <-s.chParity:
+				for k := range ecc {
+					send(ecc[k])
+				}
+			case <-s.done:
+				return
+			}
+		}
+	}
+
+	// data marks a data shard of the current group, the group is closed
+	// with its last data shard
+	data := func(ext []byte) {
+		s.fec.markData(ext[fecOffset:])
+		shard := s.xmitBuf.Get().([]byte)[:len(ext)-szOffset]
+		copy(shard, ext[szOffset:])
+		fecData = append(fecData, shard)
+		fecCnt++
+
+		if fecCnt == s.fec.dataShards {
+			closeGroup(0)
+			if fecFlush != nil {
+				if !fecFlushTimer.Stop() {
+					select {
+					case <-fecFlushTimer.C:
+					default:
+					}
+				}
+				fecFlush = nil
+			}
+		} else if fecCnt == 1 && fecFlushTimeout > 0 {
+			fecFlushTimer.Reset(fecFlushTimeout)
+			fecFlush = fecFlushTimer.C
+		}
+	}
+
+	// ping
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case ext := <-s.chUDPOutput:
+			if !layersKnown {
+				layersKnown = true
+				if s.fixLayerOrder() == EncryptThenFEC && s.fec != nil && s.block != nil {
+					outer = true
+					fecOffset, szOffset = 0, fecHeaderSize
+				}
+			}
+			if outer {
+				s.sealUnderFEC(ext, cryptOffset)
+			}
+
+			// parameters change at group boundary
+			if s.fec != nil && fecCnt == 0 && len(fecSpan.buf) == 0 {
+				select {
+				case p := <-s.chFECParams:
+					fecFlushTimeout = p.flushTimeout
+					fecSpan.size = p.spanSize
+					fecPassthrough = p.parityShards == 0
+					if !fecPassthrough && (p.dataShards != s.fec.dataShards || p.parityShards != s.fec.parityShards || p.codec != s.fec.codec) {
+						if err := s.fec.setParameters(p.dataShards, p.parityShards, p.codec); err != nil {
+							reportError(err)
+						}
+					}
+				default:
+				}
+			}
+
+			if s.fec != nil && fecPassthrough && !outer {
+				// strip the fec header, the remote tells raw kcp packets by their cmd byte
+				copy(ext[fecOffset:], ext[szOffset+2:])
+				send(ext[:len(ext)-fecHeaderSizePlus2])
+			} else if s.fec != nil && (ext[fecOffset+4] == typeNoFEC || fecPassthrough) {
+				// flushed by WriteNoFEC, or passthrough with the fec header kept
+				// in front of sealed packets
+				s.fec.markNoFEC(ext[fecOffset:])
+				binary.LittleEndian.PutUint16(ext[szOffset:], uint16(len(ext[szOffset:])))
+				send(ext)
+			} else if s.fec != nil && fecSpan.size > 0 && !outer {
+				fecSpan.write(ext[szOffset+2:])
+				xorBytes(ext, ext, ext)
+				s.xmitBuf.Put(ext)
+
+				// a partial shard is cut once no more packets are queued
+				for {
+					shard := s.xmitBuf.Get().([]byte)[:mtuLimit]
+					n := fecSpan.cut(shard[szOffset+2:], len(s.chUDPOutput) == 0)
+					if n == 0 {
+						s.xmitBuf.Put(shard)
+						break
+					}
+					shard = shard[:szOffset+2+n]
+					binary.LittleEndian.PutUint16(shard[szOffset:], uint16(2+n)|fecSizeSpan)
+					data(shard)
+					send(shard)
+				}
+			} else if s.fec != nil {
+				// explicit size
+				binary.LittleEndian.PutUint16(ext[szOffset:], uint16(len(ext[szOffset:])))
+				data(ext)
+				send(ext)
+			} else {
+				send(ext)
+			}
+		case ecc := <-s.chParity:
+			for k := range ecc {
+				send(ecc[k])
+			}
+		case <-fecFlush: // close the partial group, the data shards not sent are zero
+			fecFlush = nil
+			if fecCnt > 0 {
+				filled := fecCnt
+				s.fec.skip(s.fec.dataShards - filled)
+				closeGroup(filled)
+			}
+		case <-ticker.C: // only for NAT keep purpose
+			mtu := int(atomic.LoadInt32(&s.mtu))
+			sz := rng.Intn(mtu - IKCP_OVERHEAD)
+			sz += s.headerSize + IKCP_OVERHEAD
+			ping := s.xmitBuf.Get().([]byte)[:sz]
+			io.ReadFull(crand.Reader, ping)
+			n, err := s.extension().writeTo(s.conn, ping, s.RemoteAddr())
+			if err != nil {
+				log.Println(err, n)
+			}
+			s.xmitBuf.Put(ping[:cap(ping)])
+		case p := <-s.chObfsParams:
+			obfs = p
+			if !obfsDummyTimer.Stop() {
+				select {
+				case <-obfsDummyTimer.C:
+				default:
+				}
+			}
+			obfsDummy = nil
+			if obfs.dummy > 0 {
+				obfsDummyTimer.Reset(obfs.nextDummy(obfsRand))
+				obfsDummy = obfsDummyTimer.C
+			}
+		case <-obfsDummy:
+			ext := obfs.dummyPacket(s.xmitBuf.Get().([]byte)[:mtuLimit], fecOffset, obfsRand)
+			if s.block != nil && !outer {
+				s.encryptPacket(ext)
+			}
+			s.writePacket(ext)
+			xorBytes(ext, ext, ext)
+			s.xmitBuf.Put(ext[:cap(ext)])
+			obfsDummyTimer.Reset(obfs.nextDummy(obfsRand))
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// parityTask computes the parity shards of the groups closed by outputTask,
+// so that the erasure code never holds back the data shards. The parity is
+// sent behind the data, its seqids were taken in order by outputTask.
+func (s *UDPSession) parityTask() {
+	var latest fountainGroup
+	for {
+		select {
+		case job := <-s.chParityJobs:
+			fecOffset := job.offset
+			szOffset := fecOffset + fecHeaderSize
+			fc, fountain := job.enc.(*fountainCodec)
+			if fountain {
+				szOffset += fountainIndexSize
+			}
+			ecc := make([][]byte, len(job.headers))
+			parity := make([][]byte, len(job.headers))
+			for k := range ecc {
+				ecc[k] = s.xmitBuf.Get().([]byte)[:mtuLimit]
+				parity[k] = ecc[k][szOffset:]
+			}
+			maxlen := 0
+			var err error
+			if lc, ok := job.enc.(leopardCodec); ok {
+				maxlen, err = lc.encodeGroup(job.data, parity)
+			} else {
+				for idx, shard := range job.data {
+					if err == nil {
+						err = encodeParity(job.enc, shard, idx, parity, 0)
+					}
+					if len(shard) > maxlen {
+						maxlen = len(shard)
+					}
+				}
+			}
+			latest.release(s)
+			if fountain && err == nil {
+				latest = fountainGroup{fc, job.data, job.headers[0], fecOffset, maxlen, len(ecc)}
+			} else {
+				for _, shard := range job.data {
+					s.xmitBuf.Put(shard[:cap(shard)])
+				}
+			}
+			if err != nil {
+				reportError(err)
+				for k := range ecc {
+					s.xmitBuf.Put(ecc[k])
+				}
+				continue
+			}
+			for k := range ecc {
+				copy(ecc[k][fecOffset:], job.headers[k])
+				if fountain {
+					binary.LittleEndian.PutUint16(ecc[k][fecOffset+fecHeaderSize:], uint16(k))
+				}
+				ecc[k] = ecc[k][:szOffset+maxlen]
+			}
+
+			select {
+			case s.chParity <- ecc:
+			case <-s.done:
+				return
+			}
+		case n := <-s.chRepair:
+			if ecc := latest.repair(s, n); len(ecc) > 0 {
+				select {
+				case s.chParity <- ecc:
+				case <-s.done:
+					return
+				}
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// fountainGroup is the latest group parityTask coded with the fountain
+// code, whose repair symbols SendFECRepair asks for
+type fountainGroup struct {
+	codec  *fountainCodec // nil if none
+	data   [][]byte       // copies of the data shards from their size field on
+	header []byte         // fec header of the first parity shard, which the repair symbols share
+	offset int            // crypt header room ahead of the fec header
+	maxlen int            // length of the repair symbols
+	next   int            // index of the next repair symbol
+}
+
+// repair returns the packets of the next n repair symbols of the group,
+// as many as their index allows
+func (g *fountainGroup) repair(s *UDPSession, n int) [][]byte {
+	if g.codec == nil {
+		return nil
+	}
+	var ecc [][]byte
+	symOffset := g.offset + fecHeaderSize + fountainIndexSize
+	for ; n > 0 && g.next <= 0xffff; n-- {
+		buf := s.xmitBuf.Get().([]byte)[:symOffset+g.maxlen]
+		copy(buf[g.offset:], g.header)
+		binary.LittleEndian.PutUint16(buf[g.offset+fecHeaderSize:], uint16(g.next))
+		g.codec.Repair(g.data, g.next, buf[symOffset:])
+		ecc = append(ecc, buf)
+		g.next++
+	}
+	return ecc
+}
+
+// release returns the data shards of the group to xmitBuf
+func (g *fountainGroup) release(s *UDPSession) {
+	for _, shard := range g.data {
+		s.xmitBuf.Put(shard[:cap(shard)])
+	}
+	*g = fountainGroup{}
+}
+
+// encryptPacket encrypts a packet in place
+func (s *UDPSession) encryptPacket(buf []byte) {
+	if c, ok := s.block.(*EpochCrypt); ok {
+		s.sealEpoch(c, buf)
+		return
+	}
+	sealPacket(s.block, buf)
+}
+
+// sealPacket fills in the nonce and checksum of a packet, then encrypts it
+// in place. An AEADCrypt seals the packet under its own header instead.
+func sealPacket(block BlockCrypt, buf []byte) {
+	if sc, ok := block.(*sessionCrypt); ok {
+		copy(buf, sc.header)
+		sealPacket(sc.block, buf[len(sc.header):])
+		return
+	}
+	if hc, ok := block.(*HeaderCrypt); ok {
+		sealPacket(hc.block, buf)
+		hc.mask(buf)
+		return
+	}
+	if aead, ok := block.(AEADCrypt); ok {
+		aead.Seal(buf)
+		return
+	}
+	io.ReadFull(crand.Reader, buf[:nonceSize])
+	checksum := crc32.ChecksumIEEE(buf[cryptHeaderSize:])
+	binary.LittleEndian.PutUint32(buf[nonceSize:], checksum)
+	block.Encrypt(buf, buf)
+}
+
+// decryptPacket decrypts a packet in place and returns its payload, false if
+// the checksum mismatches, the packet fails authentication or replays a nonce
+func decryptPacket(block BlockCrypt, data []byte) ([]byte, bool) {
+	return openPacket(block, data, false)
+}
+
+// openPacket is decryptPacket, the nonce of a packet opened to peek at may be
+// received again
+func openPacket(block BlockCrypt, data []byte, peek bool) ([]byte, bool) {
+	if c, ok := block.(*EpochCrypt); ok {
+		// the key of an epoch is kept once a packet opened under it
+		epoch := binary.LittleEndian.Uint32(data)
+		bc, cached, err := c.derive(epoch)
+		if err != nil {
+			atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+			return nil, false
+		}
+		plain, ok := openPacket(bc, data[epochSize:], peek)
+		if ok && !cached {
+			c.keep(epoch, bc)
+		}
+		return plain, ok
+	}
+	if c, ok := block.(*SessionCrypt); ok {
+		sc, err := c.derive(data)
+		if err != nil {
+			atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+			return nil, false
+		}
+		block = sc
+	}
+	if sc, ok := block.(*sessionCrypt); ok {
+		if !bytes.Equal(data[:len(sc.header)], sc.header) {
+			atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+			return nil, false
+		}
+		return openPacket(sc.block, data[len(sc.header):], peek)
+	}
+	if hc, ok := block.(*HeaderCrypt); ok {
+		hc.mask(data)
+		return openPacket(hc.block, data, peek)
+	}
+	if aead, ok := block.(AEADCrypt); ok {
+		if !aead.Open(data) {
+			atomic.AddUint64(&DefaultSnmp.InAuthErrors, 1)
+			return nil, false
+		}
+		if rc, ok := aead.(replayChecker); ok && !peek && !rc.fresh(data) {
+			atomic.AddUint64(&DefaultSnmp.InReplays, 1)
+			return nil, false
+		}
+		return data[aead.Overhead():], true
+	}
+	block.Decrypt(data, data)
+	data = data[nonceSize:]
+	checksum := crc32.ChecksumIEEE(data[crcSize:])
+	if checksum != binary.LittleEndian.Uint32(data) {
+		atomic.AddUint64(&DefaultSnmp.InCsumErrors, 1)
+		return nil, false
+	}
+	return data[crcSize:], true
+}
+
+// writePacket sends a packet to the remote
+func (s *UDPSession) writePacket(buf []byte) {
+	s.cookieTags.sent(buf)
+	n, err := s.extension().writeTo(s.conn, buf, s.RemoteAddr())
+	if s.l == nil && isUnreachable(err) {
+		go s.unreachable(err)
+	} else if err != nil {
+		log.Println(err, n)
+	}
+	atomic.AddUint64(&DefaultSnmp.OutSegs, 1)
+	atomic.AddUint64(&DefaultSnmp.OutBytes, uint64(n))
+}
+
+// updateTask updates kcp once the earliest of its deadlines is due, the
+// retransmission of a segment in flight or the next flush of the acks and
+// of the segments queued, and sleeps while kcp has nothing to do until
+// wakeUpdate, so that idle sessions cost no cpu
+func (s *UDPSession) updateTask() {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+		case <-s.chUpdate:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+		case <-s.done:
+			if s.l != nil { // has listener
+				s.l.chDeadlinks <- s
+			}
+			return
+		}
+
+		s.mu.Lock()
+		current := currentMs()
+		next := time.Duration(-1) // asleep until woken
+		if !s.Paused() {
+			s.kcp.Update(current)
+			if !s.kcp.idle() {
+				next = time.Duration(_itimediff(s.kcp.Check(current), current)) * time.Millisecond
+			}
+		} else {
+			// the remote isn't kept retransmitting what was received
+			s.kcp.current = current
+			s.kcp.flushAcks()
+		}
+		if s.kcp.WaitSnd() < 2*int(s.kcp.snd_wnd) {
+			s.notifyWriteEvent()
+		}
+		drained := s.checkWatermark()
+		health := s.checkHealth()
+		if s.pacing {
+			s.updatePacingRate()
+		}
+		if announce := s.updateRekey(time.Now()); announce >= 0 && (next < 0 || announce < next) {
+			next = announce
+		}
+		s.tuneWindows(time.Now())
+		s.mu.Unlock()
+		if drained != nil {
+			drained()
+		}
+		if health != nil {
+			health()
+		}
+		if next >= 0 {
+			timer.Reset(next)
+		}
+	}
+}
+
+// wakeUpdate has updateTask update kcp and schedule its next update, once
+// kcp has something new to do
+func (s *UDPSession) wakeUpdate() {
+	select {
+	case s.chUpdate <- struct{}{}:
+	default:
+	}
+}
+
+// GetConv gets conversation id of a session
+func (s *UDPSession) GetConv() uint32 {
+	return atomic.LoadUint32(&s.kcp.conv)
+}
+
+// WaitSnd returns the number of segments waiting to be sent or acknowledged,
+// so that the application can hold back its writes by priority instead of
+// queueing them behind each other
+func (s *UDPSession) WaitSnd() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.kcp.WaitSnd()
+}
+
+func (s *UDPSession) notifyReadEvent() {
+	select {
+	case s.chReadEvent <- struct{}{}:
+	default:
+	}
+}
+
+func (s *UDPSession) notifyWriteEvent() {
+	select {
+	case s.chWriteEvent <- struct{}{}:
+	default:
+	}
+}
+
+// spanInput feeds a packet reassembled from data shards to kcp
+func (s *UDPSession) spanInput(pkt []byte) {
+	atomic.StoreInt64(&s.lastInput, time.Now().UnixNano())
+	s.unreachCount = 0
+	s.kcp.current = currentMs()
+	s.convInput(pkt)
+}
+
+func (s *UDPSession) kcpInput(data []byte) {
+	atomic.AddUint64(&DefaultSnmp.InSegs, 1)
+	sealed := s.encryptThenFEC()
+	s.mu.Lock()
+	if s.exported {
+		s.mu.Unlock()
+		return
+	}
+	established := !s.established
+	s.established = true
+	s.cookieTags.finish()
+	if s.fec != nil && isFECPacket(data) {
+		f := &s.fecPkt
+		if err := s.fec.decodeInto(data, f); err != nil {
+			atomic.AddUint64(&DefaultSnmp.InErrs, 1)
+			reportError(err)
+		} else if f.flag == typeNoFEC {
+			if err := s.fec.inputNoFEC(*f); err != nil {
+				atomic.AddUint64(&DefaultSnmp.FECErrs, 1)
+				reportError(err)
+			} else {
+				s.sealedInput(data[fecHeaderSizePlus2:], sealed)
+			}
+		} else {
+			if f.flag != typeData {
 				atomic.AddUint64(&DefaultSnmp.FECSegs, 1)
 			}
 
-			if recovers := s.fec.input(f); recovers != nil {
+			recovers, err := s.fec.input(*f)
+			if err != nil {
+				atomic.AddUint64(&DefaultSnmp.FECErrs, 1)
+				reportError(err)
+			}
+			if recovers != nil {
 				for k := range recovers {
-					sz := binary.LittleEndian.Uint16(recovers[k])
-					if int(sz) <= len(recovers[k]) && sz >= 2 {
-						s.kcp.current = currentMs()
-						s.kcp.Input(recovers[k][2:sz])
-						atomic.AddUint64(&DefaultSnmp.FECRecovered, 1)
+					if isSpan(recovers[k]) {
+						s.fecSpan.input(recovers[k], s.spanInput)
 					} else {
-						atomic.AddUint64(&DefaultSnmp.FECErrs, 1)
+						s.sealedInput(recovers[k][2:], sealed)
 					}
+					atomic.AddUint64(&DefaultSnmp.FECRecovered, 1)
+					s.fec.putShard(recovers[k])
+				}
+			}
+			// the payload layout of an unknown header version can't be trusted
+			if f.flag == typeData && err != errFECVersion {
+				if isSpan(data[fecHeaderSize:]) {
+					s.fecSpan.input(data[fecHeaderSize:], s.spanInput)
+				} else {
+					s.sealedInput(data[fecHeaderSizePlus2:], sealed)
 				}
 			}
 		}
-		if f.flag == typeData {
-			s.kcp.current = currentMs()
-			s.kcp.Input(data[fecHeaderSizePlus2:])
-		}
-
+		f.data = nil // the shard is owned by fec now
 	} else {
-		s.kcp.current = currentMs()
-		s.kcp.Input(data)
+		s.sealedInput(data, sealed)
+	}
+	if s.rdClosed {
+		s.dropReceived()
 	}
 
 	if s.ackNoDelay {
 		s.kcp.current = currentMs()
-		s.kcp.flush()
-	} else {
-		s.needUpdate = true
+		if s.Paused() {
+			s.kcp.flushAcks()
+		} else {
+			s.kcp.flush()
+		}
 	}
+	s.wakeUpdate()
 	s.mu.Unlock()
 	s.notifyReadEvent()
+	if established {
+		s.emit(func(h *SessionEvents) {
+			if h.Established != nil {
+				h.Established(s)
+			}
+		})
+	}
 }
 
 func (s *UDPSession) receiver(ch chan []byte) {
 	for {
 		data := s.xmitBuf.Get().([]byte)[:mtuLimit]
-		if n, _, err := s.conn.ReadFromUDP(data); err == nil && n >= s.headerSize+IKCP_OVERHEAD {
+		n, _, err := s.conn.ReadFrom(data)
+		if err != nil {
+			if isUnreachable(err) && !s.unreachable(err) {
+				s.xmitBuf.Put(data)
+				continue
+			}
+			return
+		}
+		if n, ok := s.extension().strip(data, n); !ok {
+			s.xmitBuf.Put(data)
+		} else if n >= minPacketSize(s.block) {
 			select {
 			case ch <- data[:n]:
-			case <-s.die:
+			case <-s.done:
 			}
-		} else if err != nil {
-			return
 		} else {
 			atomic.AddUint64(&DefaultSnmp.InErrs, 1)
 		}
@@ -545,28 +1748,34 @@ func (s *UDPSession) readLoop() {
 	for {
 		select {
 		case data := <-chPacket:
+			if s.cookieTags.challenged(data) {
+				echoCookie(s.conn, s.extension(), data, s.RemoteAddr())
+				s.xmitBuf.Put(data)
+				continue
+			}
+			if isReset(data, s.GetConv()) {
+				s.resetInput(data)
+				s.xmitBuf.Put(data)
+				continue
+			}
 			raw := data
-			dataValid := false
-			if s.block != nil {
-				s.block.Decrypt(data, data)
-				data = data[nonceSize:]
-				checksum := crc32.ChecksumIEEE(data[crcSize:])
-				if checksum == binary.LittleEndian.Uint32(data) {
-					data = data[crcSize:]
-					dataValid = true
-				} else {
-					atomic.AddUint64(&DefaultSnmp.InCsumErrors, 1)
+			dataValid := true
+			outer := s.encryptThenFEC() // packets opened by kcpInput under their fec framing
+			if s.block != nil && !outer {
+				if dataValid = epochNear(s.block, s, data); dataValid {
+					data, dataValid = decryptPacket(s.block, data)
 				}
-			} else if s.block == nil {
-				dataValid = true
 			}
 
 			if dataValid {
+				data, dataValid = unpad(data)
+			}
+			if dataValid && (outer || s.rxOpened(raw)) {
 				s.kcpInput(data)
 			}
 			xorBytes(raw, raw, raw)
 			s.xmitBuf.Put(raw)
-		case <-s.die:
+		case <-s.done:
 			return
 		}
 	}
@@ -577,22 +1786,91 @@ type (
 	Listener struct {
 		block                    BlockCrypt
 		dataShards, parityShards int
-		fec                      *FEC // for fec init test
-		conn                     *net.UDPConn
+		fec                      *FEC        // for fec init test
+		codecs                   *codecCache // fec codecs shared by the sessions
+		conn                     net.PacketConn
 		sessions                 map[string]*UDPSession
-		chAccepts                chan *UDPSession
-		chDeadlinks              chan net.Addr
+		convs                    map[uint32]*UDPSession // sessions by conv, the first one on a collision
+		chDeadlinks              chan *UDPSession
+		chAdmin                  chan func()              // run by monitor, which owns the session maps
+		noise                    *NoiseConfig             // handshake ahead of the sessions, if enabled
+		options                  *options                 // configuration of the new sessions
+		noisePending             map[string]*noisePending // answered handshakes, by remote address
+		noiseJobs                chan *noisePending       // first messages for the handshake workers
+		chNoise                  chan *noisePending       // handshakes answered by the workers
+		resolver                 atomic.Value             // keyResolver of the crypt of new conversations
+		cookies                  atomic.Value             // *cookieKey challenging new remotes, if enabled
+		cookieVerified           map[string]struct{}      // remotes which echoed a cookie, by address
+		keys                     atomic.Value             // []BlockCrypt tried in order on new conversations
+		minSize                  int32                    // atomic, size of the smallest packet accepted
+		idle                     atomic.Value             // *idleReaper of the sessions, if enabled
+		migration                atomic.Value             // *migration of the sessions, if enabled
+		events                   atomic.Value             // *SessionEvents of all the sessions
+		maxSessions              int32                    // atomic, concurrent sessions, 0 for no limit
+		connRate                 atomic.Value             // *connRate of the new sessions per IP, if enabled
+		rateBuckets              map[string]*tokenBucket  // new session tokens, by remote IP
+		filter                   atomic.Value             // connFilter of the new sessions, if set
+		ext                      atomic.Value             // *headerExtension of the packets, if set
+		streamMode               atomic.Value             // streamSelector of the mode of the new sessions, if set
+		lifetime                 atomic.Value             // *maxLifetime of the new sessions, if enabled
+		quarantine               int64                    // atomic, period the convs of the closed sessions are kept, 0 if disabled
+		quarantined              map[convAddr]time.Time   // convs in quarantine, until when
+		backlog                  acceptBacklog            // sessions waiting for Accept
 		headerSize               int
 		die                      chan struct{}
 		rxbuf                    sync.Pool
 	}
 
 	packet struct {
-		from *net.UDPAddr
+		from net.Addr
 		data []byte
 	}
 )
 
+// handshake creates the fec codec of a new session from its first packet.
+// The fec header announces the geometry of the remote, which the session
+// adopts for its outgoing packets, so that both sides need not be configured
+// alike; a fec session is created even if the listener has fec disabled.
+// Plain kcp packets get the geometry of the listener and are answered with
+// plain packets, fec is nil if disabled on both sides.
+func (l *Listener) handshake(data []byte) (fec *FEC, plain bool, err error) {
+	if !isFECPacket(data) {
+		if l.fec == nil {
+			return nil, false, nil
+		}
+		// parameters were validated in ListenWithOptions
+		fec, err = newSharedFEC(rxFecLimit, l.dataShards, l.parityShards, l.codecs)
+		return fec, true, err
+	}
+	if len(data) < fecHeaderSize {
+		return nil, false, errFECPacket
+	}
+	dataShards, parityShards := int(data[7]), int(data[8])
+	if !validFECParameters(dataShards, parityShards) || dataShards+parityShards > rxFecLimit {
+		return nil, false, errFECParams
+	}
+	fec, err = newSharedFEC(rxFecLimit, dataShards, parityShards, l.codecs)
+	return fec, false, err
+}
+
+// packetConv returns the conv of a kcp packet opened by the crypt, under
+// its fec header if any
+func packetConv(data []byte) (conv uint32, ok bool) {
+	if !isFECPacket(data) {
+		if len(data) < 4 {
+			return 0, false
+		}
+		return binary.LittleEndian.Uint32(data), true
+	}
+	if data[4] == typeData && isSpan(data[fecHeaderSize:]) {
+		return spanConv(data[fecHeaderSize:])
+	}
+	if (data[4] == typeData || data[4] == typeNoFEC) && len(data) >= fecHeaderSizePlus2+4 {
+		return binary.LittleEndian.Uint32(data[fecHeaderSizePlus2:]), true
+	}
+	return 0, false
+}
+
 // monitor incoming data for all connections of server
 func (l *Listener) monitor() {
 	chPacket := make(chan packet, txQueueLimit)
@@ -605,66 +1883,137 @@ func (l *Listener) monitor() {
 			raw := p.data
 			data := p.data
 			from := p.from
-			dataValid := false
-			if l.block != nil {
-				l.block.Decrypt(data, data)
-				data = data[nonceSize:]
-				checksum := crc32.ChecksumIEEE(data[crcSize:])
-				if checksum == binary.LittleEndian.Uint32(data) {
-					data = data[crcSize:]
-					dataValid = true
-				} else {
-					atomic.AddUint64(&DefaultSnmp.InCsumErrors, 1)
+			addr := from.String()
+			s, ok := l.sessions[addr]
+
+			// sessions set up by a noise handshake have their own crypt
+			block, dataValid := l.block, true
+			sealed := raw // packet under the crypt layer
+			var outer bool
+			var outerConv uint32
+			var pristine []byte // copy of a packet from a new address, for migration
+			var tag uint64      // of a packet from a new address, before it's opened, for a reset
+			if ok {
+				block = s.block
+				outer = s.encryptThenFEC()
+				dataValid = !l.isCookieEcho(data)
+			} else if !l.filterConn(from, l.clearConv(data)) {
+				// refused remotes cost no crypto, cookie or handshake
+				dataValid = false
+			} else {
+				pristine = l.migrationCopy(raw)
+				tag = cookieTag(raw)
+				// no state is kept for a remote until it echoes a cookie
+				dataValid = l.cookieInput(addr, from, data)
+				if l.noise != nil && dataValid {
+					block, dataValid = l.noiseInput(addr, from, data)
+				}
+				// a remote encrypting before fec sends its fec headers in
+				// the clear, the first packet opened tells the order
+				if pkt, framed := sealedPayload(data); framed && dataValid {
+					if bc, resolved := l.resolveCrypt(block, pkt, from); resolved && bc != nil {
+						if outerConv, outer = l.peekSealed(bc, pkt); outer {
+							block, sealed = bc, pkt
+						}
+					}
 				}
-			} else if l.block == nil {
-				dataValid = true
+				if dataValid && !outer {
+					block, dataValid = l.resolveCrypt(block, data, from)
+				}
+				if c, salted := block.(*SessionCrypt); salted && dataValid {
+					// the key of a new session is derived from the header of its first packet
+					if sc, err := c.derive(sealed); err == nil {
+						block = sc
+					} else {
+						dataValid = false
+					}
+				}
+			}
+			if dataValid && block != nil && !outer {
+				if dataValid = epochNear(block, s, data); dataValid {
+					data, dataValid = decryptPacket(block, data)
+				}
+			}
+			if dataValid {
+				data, dataValid = unpad(data)
 			}
 
 			if dataValid {
-				addr := from.String()
-				s, ok := l.sessions[addr]
 				if !ok { // new session
-					var conv uint32
-					convValid := false
-					if l.fec != nil {
-						isfec := binary.LittleEndian.Uint16(data[4:])
-						if isfec == typeData {
-							conv = binary.LittleEndian.Uint32(data[fecHeaderSizePlus2:])
-							convValid = true
-						}
-					} else {
-						conv = binary.LittleEndian.Uint32(data)
-						convValid = true
+					conv, convValid := outerConv, outer
+					if !outer {
+						conv, convValid = packetConv(data)
 					}
 
-					if convValid {
-						if s := newUDPSession(conv, l.dataShards, l.parityShards, l, l.conn, from, l.block); s != nil {
+					if convValid && !l.inQuarantine(addr, conv) &&
+						!l.migrate(conv, from, pristine) && l.limit(from) && l.admit(conv, from, len(raw), tag) {
+						assigned := conv == 0 // the dialer requested its conv
+						if assigned {
+							conv = l.assignConv()
+						}
+						fec, plain, err := l.handshake(data)
+						if err != nil {
+							atomic.AddUint64(&DefaultSnmp.FECErrs, 1)
+							reportError(err)
+						} else if s := newUDPSession(conv, fec, l, l.conn, from, block); s != nil {
+							if plain {
+								// answer a remote with fec disabled likewise
+								s.SetFECParameters(fec.dataShards, 0)
+							}
+							order := FECThenEncrypt
+							if outer {
+								order = EncryptThenFEC
+							}
+							atomic.StoreUint32(&s.layers, uint32(order)|layersFixed)
+							l.options.tune(s)
+							if l.sessionStream(from, conv) {
+								s.SetStreamMode(true)
+							}
+							s.convAssigned = assigned
 							s.kcpInput(data)
 							l.sessions[addr] = s
-							l.chAccepts <- s
+							if l.convs[conv] == nil {
+								l.convs[conv] = s
+							}
+							l.startLifetime(s)
+							l.spend(from)
+							delete(l.noisePending, addr)
+							delete(l.cookieVerified, addr)
+							l.backlog.push(s)
 						} else {
 							log.Println("cannot create session")
 						}
 					}
-				} else {
+				} else if outer || s.rxOpened(raw) {
 					s.kcpInput(data)
 				}
 			}
 
+			if pristine != nil {
+				xorBytes(pristine, pristine, pristine)
+				l.rxbuf.Put(pristine[:cap(pristine)])
+			}
 			xorBytes(raw, raw, raw)
 			l.rxbuf.Put(raw)
-		case deadlink := <-l.chDeadlinks:
-			delete(l.sessions, deadlink.String())
+		case s := <-l.chDeadlinks:
+			if addr := s.RemoteAddr().String(); l.sessions[addr] == s {
+				delete(l.sessions, addr)
+			}
+			if l.convs[s.GetConv()] == s {
+				delete(l.convs, s.GetConv())
+			}
+			l.quarantineClosed(s, time.Now())
+		case p := <-l.chNoise:
+			l.addNoise(p, time.Now())
+		case f := <-l.chAdmin:
+			f()
 		case <-l.die:
 			return
 		case <-ticker.C:
 			now := time.Now()
-			for _, s := range l.sessions {
-				select {
-				case s.chTicker <- now:
-				default:
-				}
-			}
+			l.reapIdle(now)
+			l.purgeQuarantine(now)
+			l.purgeNoise(now)
 		}
 	}
 }
@@ -672,10 +2021,14 @@ func (l *Listener) monitor() {
 func (l *Listener) receiver(ch chan packet) {
 	for {
 		data := l.rxbuf.Get().([]byte)[:mtuLimit]
-		if n, from, err := l.conn.ReadFromUDP(data); err == nil && n >= l.headerSize+IKCP_OVERHEAD {
-			ch <- packet{from, data[:n]}
-		} else if err != nil {
+		n, from, err := l.conn.ReadFrom(data)
+		if err != nil {
 			return
+		}
+		if n, ok := l.extension().strip(data, n); !ok {
+			l.rxbuf.Put(data)
+		} else if n >= int(atomic.LoadInt32(&l.minSize)) {
+			ch <- packet{from, data[:n]}
 		} else {
 			atomic.AddUint64(&DefaultSnmp.InErrs, 1)
 		}
@@ -684,11 +2037,23 @@ func (l *Listener) receiver(ch chan packet) {
 
 // Accept implements the Accept method in the Listener interface; it waits for the next call and returns a generic Conn.
 func (l *Listener) Accept() (*UDPSession, error) {
-	select {
-	case c := <-l.chAccepts:
-		return c, nil
-	case <-l.die:
-		return nil, errors.New("listener stopped")
+	return l.AcceptContext(context.Background())
+}
+
+// AcceptContext waits for the next session like Accept, it returns the error
+// of ctx once ctx is done.
+func (l *Listener) AcceptContext(ctx context.Context) (*UDPSession, error) {
+	for {
+		if s := l.backlog.pop(); s != nil {
+			return s, nil
+		}
+		select {
+		case <-l.backlog.ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-l.die:
+			return nil, errors.New("listener stopped")
+		}
 	}
 }
 
@@ -708,71 +2073,387 @@ func (l *Listener) Addr() net.Addr {
 }
 
 // Listen listens for incoming KCP packets addressed to the local address laddr on the network "udp",
-func Listen(laddr string) (*Listener, error) {
-	return ListenWithOptions(laddr, nil, 0, 0)
+// configured by opts, the window sizes and kcp parameters of which apply to each new session.
+func Listen(laddr string, opts ...Option) (*Listener, error) {
+	return listen(laddr, newOptions(opts))
 }
 
 // ListenWithOptions listens for incoming KCP packets addressed to the local address laddr on the network "udp" with packet encryption,
-// dataShards, parityShards defines Reed-Solomon Erasure Coding parameters
+// dataShards, parityShards defines Reed-Solomon Erasure Coding parameters, parityShards 0 disables fec
+// without header overhead, sessions accept plain kcp packets from remotes with fec disabled as well.
+// Each session adopts the fec geometry announced by the first packet of its remote.
 func ListenWithOptions(laddr string, block BlockCrypt, dataShards, parityShards int) (*Listener, error) {
+	return Listen(laddr, WithCrypt(block), WithFEC(dataShards, parityShards))
+}
+
+// ListenWithNoise listens like ListenWithOptions, and sets up each session
+// with a Noise_IK handshake authenticating the listener by config.PrivateKey.
+func ListenWithNoise(laddr string, config *NoiseConfig, dataShards, parityShards int) (*Listener, error) {
+	if config == nil || len(config.PrivateKey) != noiseKeySize {
+		return nil, errNoiseKey
+	}
+	return listenNoise(laddr, config, dataShards, parityShards)
+}
+
+// ListenWithKeyExchange listens like ListenWithOptions, and sets up each
+// session with an X25519 exchange of ephemeral keys, the Noise_NN handshake,
+// so that no long-lived key needs to be distributed. Neither side is
+// authenticated, which leaves the sessions open to an active man in the middle.
+func ListenWithKeyExchange(laddr string, dataShards, parityShards int) (*Listener, error) {
+	return listenNoise(laddr, &NoiseConfig{anonymous: true}, dataShards, parityShards)
+}
+
+// ListenWithHybridKeyExchange listens like ListenWithKeyExchange, the
+// ephemeral X25519 keys are combined with ML-KEM-768 keys, the Noise_NNhfs
+// handshake, so that the sessions recorded stay secret should X25519 fall to
+// a quantum computer.
+func ListenWithHybridKeyExchange(laddr string, dataShards, parityShards int) (*Listener, error) {
+	return listenNoise(laddr, &NoiseConfig{hybrid: true}, dataShards, parityShards)
+}
+
+// ServeConn serves the sessions of remotes on conn like ListenWithOptions,
+// conn being any packet transport, such as an ICMP tunnel, a serial radio
+// or an in-process pipe. The packets of conn must keep their boundaries,
+// and the addresses it reports identify the remotes. The listener owns
+// conn, which it closes with itself.
+func ServeConn(block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) (*Listener, error) {
+	return serve(conn, newOptions([]Option{WithCrypt(block), WithFEC(dataShards, parityShards)}))
+}
+
+// listenNoise listens with the handshake of config ahead of the sessions
+func listenNoise(laddr string, config *NoiseConfig, dataShards, parityShards int) (*Listener, error) {
+	o := newOptions([]Option{WithFEC(dataShards, parityShards)})
+	o.noise = config
+	return listen(laddr, o)
+}
+
+func listen(laddr string, o *options) (*Listener, error) {
 	udpaddr, err := net.ResolveUDPAddr("udp", laddr)
 	if err != nil {
 		return nil, err
 	}
+	if err := o.check(); err != nil {
+		return nil, err
+	}
 	conn, err := net.ListenUDP("udp", udpaddr)
 	if err != nil {
 		return nil, err
 	}
-	conn.SetReadBuffer(soBuffer)
-	conn.SetWriteBuffer(soBuffer)
+	o.setup(conn)
+	return serve(conn, o)
+}
+
+func serve(conn net.PacketConn, o *options) (*Listener, error) {
+	fec, err := newSessionFEC(o.dataShards, o.parityShards)
+	if err != nil {
+		return nil, err
+	}
 
 	l := new(Listener)
 	l.conn = conn
 	l.sessions = make(map[string]*UDPSession)
-	l.chAccepts = make(chan *UDPSession, 1024)
-	l.chDeadlinks = make(chan net.Addr, 1024)
+	l.backlog.depth = defaultBacklog
+	l.backlog.ready = make(chan struct{}, 1)
+	l.chDeadlinks = make(chan *UDPSession, 1024)
+	l.chAdmin = make(chan func())
+	l.convs = make(map[uint32]*UDPSession)
 	l.die = make(chan struct{})
-	l.dataShards = dataShards
-	l.parityShards = parityShards
-	l.block = block
-	l.fec = newFEC(rxFecLimit, dataShards, parityShards)
+	l.dataShards = o.dataShards
+	l.parityShards = o.parityShards
+	l.block = o.block
+	l.noise = o.noise
+	l.options = o
+	l.noisePending = make(map[string]*noisePending)
+	l.cookieVerified = make(map[string]struct{})
+	l.rateBuckets = make(map[string]*tokenBucket)
+	l.minSize = int32(minPacketSize(l.block))
+	l.fec = fec
+	l.codecs = newCodecCache()
 	l.rxbuf.New = func() interface{} {
 		return make([]byte, mtuLimit)
 	}
 
 	// calculate header size
 	if l.block != nil {
-		l.headerSize += cryptHeaderSize
+		l.headerSize += cryptOverhead(l.block)
+	} else if l.noise != nil {
+		l.headerSize += aeadHeaderSize
 	}
 	if l.fec != nil {
 		l.headerSize += fecHeaderSizePlus2
 	}
 
+	if l.noise != nil {
+		l.noiseJobs = make(chan *noisePending, noiseQueue)
+		l.chNoise = make(chan *noisePending)
+		for i := 0; i < runtime.NumCPU(); i++ {
+			go l.noiseWorker()
+		}
+	}
 	go l.monitor()
 	return l, nil
 }
 
-// Dial connects to the remote address "raddr" on the network "udp"
-func Dial(raddr string) (*UDPSession, error) {
-	return DialWithOptions(raddr, nil, 0, 0)
+// Dial connects to the remote address "raddr" on the network "udp", configured by opts
+func Dial(raddr string, opts ...Option) (*UDPSession, error) {
+	return DialContext(context.Background(), raddr, opts...)
 }
 
 // DialWithOptions connects to the remote address "raddr" on the network "udp" with packet encryption
 func DialWithOptions(raddr string, block BlockCrypt, dataShards, parityShards int) (*UDPSession, error) {
-	udpaddr, err := net.ResolveUDPAddr("udp", raddr)
+	return DialWithOptionsContext(context.Background(), raddr, block, dataShards, parityShards)
+}
+
+// DialWithOptionsContext connects like DialWithOptions, the resolution of
+// raddr is cancelled once ctx is done.
+func DialWithOptionsContext(ctx context.Context, raddr string, block BlockCrypt, dataShards, parityShards int) (*UDPSession, error) {
+	return DialContext(ctx, raddr, WithCrypt(block), WithFEC(dataShards, parityShards))
+}
+
+// DialWithLocalAddr connects like DialWithOptions from the local address
+// laddr instead of the wildcard address, as multi-homed hosts and policy
+// routing need. The host of laddr is an IP or the name of an interface,
+// whose first address of the family of raddr is taken, its port may be
+// empty or 0 for any port.
+func DialWithLocalAddr(laddr, raddr string, block BlockCrypt, dataShards, parityShards int) (*UDPSession, error) {
+	udpaddr, err := resolveUDPAddr(context.Background(), raddr)
+	if err != nil {
+		return nil, err
+	}
+	local, err := localUDPAddr(laddr, udpaddr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := newSessionFEC(dataShards, parityShards); err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", local)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetReadBuffer(soBuffer)
+	conn.SetWriteBuffer(soBuffer)
+	sess, err := NewConn(udpaddr, block, dataShards, parityShards, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return sess, nil
+}
+
+// NewConn establishes a session with the remote at raddr over conn like
+// DialWithOptions, conn being any packet transport as with ServeConn, all
+// of whose packets are read by the session. The session owns conn, which it
+// closes once it stopped, after lingering on Close.
+func NewConn(raddr net.Addr, block BlockCrypt, dataShards, parityShards int, conn net.PacketConn) (*UDPSession, error) {
+	fec, err := newSessionFEC(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	conv := randomConv()
+	switch c := block.(type) {
+	case *SessionCrypt:
+		if block, err = c.session(conv); err != nil {
+			return nil, err
+		}
+	case *ConvCrypt:
+		conv, block = c.conv, c.session()
+	}
+	return newUDPSession(conv, fec, nil, conn, raddr, block), nil
+}
+
+// DialWithNoise connects like DialWithOptions, after a Noise_IK handshake
+// authenticating the listener by config.RemoteKey. The keys of the session
+// are derived by the handshake.
+func DialWithNoise(raddr string, config *NoiseConfig, dataShards, parityShards int) (*UDPSession, error) {
+	return DialWithNoiseContext(context.Background(), raddr, config, dataShards, parityShards)
+}
+
+// DialWithNoiseContext connects like DialWithNoise, the resolution of raddr
+// and the handshake are cancelled once ctx is done, failing with the error of
+// ctx.
+func DialWithNoiseContext(ctx context.Context, raddr string, config *NoiseConfig, dataShards, parityShards int) (*UDPSession, error) {
+	if config == nil {
+		return nil, errNoiseKey
+	}
+	udpaddr, err := resolveUDPAddr(ctx, raddr)
+	if err != nil {
+		return nil, err
+	}
+	fec, err := newSessionFEC(dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	udpconn := dialConn()
+	block, err := dialNoise(ctx, udpconn, udpaddr, config)
+	if err != nil {
+		udpconn.Close()
+		return nil, err
+	}
+	sess := newUDPSession(randomConv(), fec, nil, udpconn, udpaddr, block)
+	sess.handshaken = true
+	return sess, nil
+}
+
+// DialWithKeyExchange connects like DialWithOptions, after an X25519
+// exchange of ephemeral keys with a listener from ListenWithKeyExchange.
+func DialWithKeyExchange(raddr string, dataShards, parityShards int) (*UDPSession, error) {
+	return DialWithKeyExchangeContext(context.Background(), raddr, dataShards, parityShards)
+}
+
+// DialWithKeyExchangeContext connects like DialWithKeyExchange, cancelled
+// once ctx is done like DialWithNoiseContext.
+func DialWithKeyExchangeContext(ctx context.Context, raddr string, dataShards, parityShards int) (*UDPSession, error) {
+	return DialWithNoiseContext(ctx, raddr, &NoiseConfig{anonymous: true}, dataShards, parityShards)
+}
+
+// DialWithHybridKeyExchange connects like DialWithKeyExchange, with a
+// listener from ListenWithHybridKeyExchange.
+func DialWithHybridKeyExchange(raddr string, dataShards, parityShards int) (*UDPSession, error) {
+	return DialWithHybridKeyExchangeContext(context.Background(), raddr, dataShards, parityShards)
+}
+
+// DialWithHybridKeyExchangeContext connects like DialWithHybridKeyExchange,
+// cancelled once ctx is done like DialWithNoiseContext.
+func DialWithHybridKeyExchangeContext(ctx context.Context, raddr string, dataShards, parityShards int) (*UDPSession, error) {
+	return DialWithNoiseContext(ctx, raddr, &NoiseConfig{hybrid: true}, dataShards, parityShards)
+}
+
+// resolveUDPAddr resolves raddr like net.ResolveUDPAddr, preferring IPv4,
+// it fails with the error of ctx once ctx is done
+func resolveUDPAddr(ctx context.Context, raddr string) (*net.UDPAddr, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	host, service, err := net.SplitHostPort(raddr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.DefaultResolver.LookupPort(ctx, "udp", service)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		return &net.UDPAddr{Port: port}, nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	addr := addrs[0]
+	for _, a := range addrs {
+		if a.IP.To4() != nil {
+			addr = a
+			break
+		}
+	}
+	return &net.UDPAddr{IP: addr.IP, Port: port, Zone: addr.Zone}, nil
+}
+
+// localUDPAddr resolves the local address of a dial to raddr, its host is
+// an IP or the name of an interface
+func localUDPAddr(laddr string, raddr *net.UDPAddr) (*net.UDPAddr, error) {
+	host, service, err := net.SplitHostPort(laddr)
+	if err != nil {
+		host, service = laddr, "0"
+	}
+	if service == "" {
+		service = "0"
+	}
+	port, err := net.LookupPort("udp", service)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" {
+		return &net.UDPAddr{Port: port}, nil
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return &net.UDPAddr{IP: ip, Port: port}, nil
+	}
+	ifi, err := net.InterfaceByName(host)
 	if err != nil {
 		return nil, err
 	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	v4 := raddr.IP == nil || raddr.IP.To4() != nil
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && (ipnet.IP.To4() != nil) == v4 {
+			local := &net.UDPAddr{IP: ipnet.IP, Port: port}
+			if ipnet.IP.IsLinkLocalUnicast() && !v4 {
+				local.Zone = ifi.Name
+			}
+			return local, nil
+		}
+	}
+	return nil, errLocalAddr
+}
+
+// dialConn returns a socket bound to a random local port
+func dialConn() *net.UDPConn {
 	for {
 		port := basePort + rng.Int()%(maxPort-basePort)
 		if udpconn, err := net.ListenUDP("udp", &net.UDPAddr{Port: port}); err == nil {
 			udpconn.SetReadBuffer(soBuffer)
 			udpconn.SetWriteBuffer(soBuffer)
-			return newUDPSession(rng.Uint32(), dataShards, parityShards, nil, udpconn, udpaddr, block), nil
+			return udpconn
 		}
 	}
 }
 
+// newSessionFEC creates the fec codec of a session, fec is disabled if
+// either dataShards or parityShards is zero
+func newSessionFEC(dataShards, parityShards int) (*FEC, error) {
+	if dataShards == 0 || parityShards == 0 {
+		return nil, nil
+	}
+	return newFEC(rxFecLimit, dataShards, parityShards)
+}
+
+// minPacketSize returns the size of the smallest valid packet, the fec header
+// is optional as a remote with parityShards 0 sends plain kcp packets
+func minPacketSize(block BlockCrypt) int {
+	if block != nil {
+		return cryptOverhead(block) + IKCP_OVERHEAD
+	}
+	return IKCP_OVERHEAD
+}
+
+// cryptOverhead returns the size of the crypt header in front of packets
+func cryptOverhead(block BlockCrypt) int {
+	switch c := block.(type) {
+	case *EpochCrypt:
+		return c.overhead
+	case *SessionCrypt:
+		return c.overhead
+	case *sessionCrypt:
+		return len(c.header) + cryptOverhead(c.block)
+	case *ConvCrypt:
+		return convHeaderSize + cryptOverhead(c.block)
+	case *HeaderCrypt:
+		return c.overhead
+	}
+	if aead, ok := block.(AEADCrypt); ok {
+		return aead.Overhead()
+	}
+	return cryptHeaderSize
+}
+
+// SetErrorHandler installs a callback for errors which can't be returned
+// to the caller, such as fec codec failures inside the session goroutines.
+// The handler may be called concurrently; errors are dropped if it is nil.
+func SetErrorHandler(handler func(error)) {
+	errorHandler.Store(handler)
+}
+
+func reportError(err error) {
+	if handler, ok := errorHandler.Load().(func(error)); ok && handler != nil {
+		handler(err)
+	}
+}
+
 func currentMs() uint32 {
 	return uint32(time.Now().UnixNano() / int64(time.Millisecond))
 }
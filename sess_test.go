@@ -1,13 +1,30 @@
 package kcp
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	crand "crypto/rand"
 	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/big"
+	"net"
+	"os"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/xtaci/kcp-go/netsim"
 	"golang.org/x/crypto/pbkdf2"
 )
 
@@ -69,6 +86,10 @@ func handle_client(conn *UDPSession) {
 	count := 0
 	for {
 		n, err := conn.Read(buf)
+		if err == io.EOF { // the client closed
+			conn.Close()
+			return
+		}
 		if err != nil {
 			panic(err)
 		}
@@ -268,3 +289,5033 @@ func client4(wg *sync.WaitGroup) {
 	cli.Close()
 	wg.Done()
 }
+
+func TestSetFECParameters(t *testing.T) {
+	cli, err := DialTest()
+	if err != nil {
+		panic(err)
+	}
+	defer cli.Close()
+	if cli.SetFECParameters(0, 3) == nil {
+		t.Fatal("invalid parameters accepted")
+	}
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 10)
+	for i := 0; i < 100; i++ {
+		if i == 50 {
+			if err := cli.SetFECParameters(5, 2); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if i == 75 {
+			if err := cli.SetFECCodec(FECCodecXOR); err != nil {
+				t.Fatal(err)
+			}
+		}
+		msg := fmt.Sprintf("hello%v", i)
+		cli.Write([]byte(msg))
+		if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+			t.Fatal("echo mismatch", err)
+		}
+	}
+}
+
+func TestFECFlushTimeout(t *testing.T) {
+	cli, err := DialTest()
+	if err != nil {
+		panic(err)
+	}
+	defer cli.Close()
+	if err := cli.SetFECFlushTimeout(20 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 10)
+	for i := 0; i < 10; i++ {
+		msg := fmt.Sprintf("hello%v", i)
+		cli.Write([]byte(msg))
+		if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+			t.Fatal("echo mismatch", err)
+		}
+		<-time.After(50 * time.Millisecond)
+	}
+}
+
+func TestWriteNoFEC(t *testing.T) {
+	cli, err := DialTest()
+	if err != nil {
+		panic(err)
+	}
+	defer cli.Close()
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 10)
+	for i := 0; i < 20; i++ {
+		msg := fmt.Sprintf("hello%v", i)
+		if i%2 == 0 {
+			cli.WriteNoFEC([]byte(msg))
+		} else {
+			cli.Write([]byte(msg))
+		}
+		if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+			t.Fatal("echo mismatch", err)
+		}
+	}
+}
+
+func TestRetransmitDuplicates(t *testing.T) {
+	cli, err := DialTest()
+	if err != nil {
+		panic(err)
+	}
+	defer cli.Close()
+	cli.SetRetransmitDuplicates(1)
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 10)
+	for i := 0; i < 20; i++ {
+		msg := fmt.Sprintf("hello%v", i)
+		cli.Write([]byte(msg))
+		if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+			t.Fatal("echo mismatch", err)
+		}
+	}
+}
+
+func TestFECLeopardThreshold(t *testing.T) {
+	cli, err := DialTest()
+	if err != nil {
+		panic(err)
+	}
+	defer cli.Close()
+	if cli.SetFECLeopardThreshold(-1) == nil {
+		t.Fatal("invalid threshold accepted")
+	}
+	if err := cli.SetFECLeopardThreshold(12); err != nil {
+		t.Fatal(err)
+	}
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 10)
+	for i := 0; i < 50; i++ {
+		msg := fmt.Sprintf("hello%v", i)
+		cli.Write([]byte(msg))
+		if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+			t.Fatal("echo mismatch", err)
+		}
+	}
+}
+
+func TestFECLeopardLoss(t *testing.T) {
+	const addr = "127.0.0.1:9924"
+	const size = 512 << 10
+	l, err := ListenWithOptions(addr, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	raddr, _ := net.ResolveUDPAddr("udp", addr)
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lossy := netsim.New(udp, netsim.Config{LossGood: 0.05, Seed: 1})
+	cli, err := NewConn(raddr, nil, 10, 3, lossy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.SetFECLeopardThreshold(12); err != nil {
+		t.Fatal(err)
+	}
+	cli.SetWindowSize(512, 512)
+	cli.SetNoDelay(1, 10, 2, 1)
+
+	msg := make([]byte, size)
+	for k := range msg {
+		msg[k] = byte(k * 7)
+	}
+	go cli.Write(msg)
+	s, err := acceptFrom(l, udp.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.SetWindowSize(512, 512)
+	s.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(s, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatal("data mismatch")
+	}
+	if lossy.Stats().Lost == 0 {
+		t.Fatal("nothing lost")
+	}
+	if stats := s.FECStats(); stats.GroupsRecovered == 0 {
+		t.Fatal("no leopard group recovered", stats)
+	}
+}
+
+func TestFECDataOnly(t *testing.T) {
+	cli, err := DialTest()
+	if err != nil {
+		panic(err)
+	}
+	defer cli.Close()
+	if err := cli.SetFECDataOnly(true); err != nil {
+		t.Fatal(err)
+	}
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 10)
+	for i := 0; i < 20; i++ {
+		msg := fmt.Sprintf("hello%v", i)
+		cli.Write([]byte(msg))
+		if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+			t.Fatal("echo mismatch", err)
+		}
+	}
+}
+
+func TestFECPassthrough(t *testing.T) {
+	cli, err := DialTest()
+	if err != nil {
+		panic(err)
+	}
+	defer cli.Close()
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 10)
+	for i := 0; i < 60; i++ {
+		switch i {
+		case 20: // plain kcp packets, the server detects the missing header
+			if err := cli.SetFECParameters(10, 0); err != nil {
+				t.Fatal(err)
+			}
+		case 40:
+			if err := cli.SetFECParameters(10, 3); err != nil {
+				t.Fatal(err)
+			}
+		}
+		msg := fmt.Sprintf("hello%v", i)
+		cli.Write([]byte(msg))
+		if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+			t.Fatal("echo mismatch", err)
+		}
+	}
+}
+
+func TestSetFECRxExpire(t *testing.T) {
+	cli, err := DialTest()
+	if err != nil {
+		panic(err)
+	}
+	defer cli.Close()
+	if cli.SetFECRxExpire(0) == nil {
+		t.Fatal("invalid age accepted")
+	}
+	if err := cli.SetFECRxExpire(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 10)
+	for i := 0; i < 20; i++ {
+		msg := fmt.Sprintf("hello%v", i)
+		cli.Write([]byte(msg))
+		if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+			t.Fatal("echo mismatch", err)
+		}
+	}
+}
+
+func TestFECShardSize(t *testing.T) {
+	cli, err := DialTest()
+	if err != nil {
+		panic(err)
+	}
+	defer cli.Close()
+	if cli.SetFECShardSize(10) == nil {
+		t.Fatal("invalid shard size accepted")
+	}
+	if err := cli.SetFECShardSize(300); err != nil {
+		t.Fatal(err)
+	}
+	cli.SetStreamMode(true)
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 4096)
+	for i := 0; i < 20; i++ {
+		// packets both smaller and larger than a shard
+		msg := make([]byte, 10+i*200)
+		for k := range msg {
+			msg[k] = byte(i + k)
+		}
+		cli.Write(msg)
+		if _, err := io.ReadFull(cli, buf[:len(msg)]); err != nil || !bytes.Equal(buf[:len(msg)], msg) {
+			t.Fatal("echo mismatch", err)
+		}
+	}
+}
+
+func TestParityTask(t *testing.T) {
+	s := new(UDPSession)
+	s.done = make(chan struct{})
+	defer close(s.done)
+	s.chParityJobs = make(chan parityJob, parityQueue)
+	s.chParity = make(chan [][]byte, parityQueue)
+	s.xmitBuf.New = func() interface{} {
+		return make([]byte, mtuLimit)
+	}
+	go s.parityTask()
+
+	// a group closed early, its parity is computed behind the data shards
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(128, 10, 3)
+	data := makefecgroup(0, 7)
+	job := parityJob{enc: tx.encoder()}
+	for k := range data {
+		tx.markData(data[k])
+		job.data = append(job.data, append([]byte(nil), data[k][fecHeaderSize:]...))
+	}
+	tx.skip(3)
+	for k := 0; k < 3; k++ {
+		hdr := make([]byte, fecHeaderSize)
+		tx.markPartialFEC(hdr, 7)
+		job.headers = append(job.headers, hdr)
+	}
+	s.chParityJobs <- job
+	ecc := <-s.chParity
+	if len(ecc) != 3 || binary.LittleEndian.Uint32(ecc[0]) != 10 {
+		t.Fatal("parity shards not in seqid order")
+	}
+
+	var recovered [][]byte
+	for k, shard := range append(data, ecc...) {
+		if k != 2 && k != 4 {
+			shards, err := rx.input(mustDecode(t, rx, shard))
+			if err != nil {
+				t.Fatal(err)
+			}
+			recovered = append(recovered, shards...)
+		}
+	}
+	if len(recovered) != 2 || shardID(recovered[0])+shardID(recovered[1]) != 6 {
+		t.Fatal("group not recovered", rx.stats)
+	}
+}
+
+func TestSendFECRepair(t *testing.T) {
+	tx, _ := newFEC(128, 10, 3)
+	rx, _ := newFEC(128, 10, 3)
+	if err := tx.setParameters(10, 2, FECCodecFountain); err != nil {
+		t.Fatal(err)
+	}
+	s := new(UDPSession)
+	s.done = make(chan struct{})
+	defer close(s.done)
+	s.die = make(chan struct{})
+	s.fec = tx
+	s.fecTx.codec = FECCodecFountain
+	s.chParityJobs = make(chan parityJob, parityQueue)
+	s.chParity = make(chan [][]byte, parityQueue)
+	s.chRepair = make(chan int)
+	s.xmitBuf.New = func() interface{} {
+		return make([]byte, mtuLimit)
+	}
+	go s.parityTask()
+
+	data := makefecgroup(0, 10)
+	job := parityJob{enc: tx.encoder()}
+	for k := range data {
+		tx.markData(data[k])
+		job.data = append(job.data, append([]byte(nil), data[k][fecHeaderSize:]...))
+	}
+	for k := 0; k < 2; k++ {
+		hdr := make([]byte, fecHeaderSize)
+		tx.markFEC(hdr)
+		job.headers = append(job.headers, hdr)
+	}
+	s.chParityJobs <- job
+	ecc := <-s.chParity
+
+	// 5 data shards lost, 2 repair symbols sent with the group, 4 on demand
+	if err := s.SendFECRepair(4); err != nil {
+		t.Fatal(err)
+	}
+	ecc = append(ecc, <-s.chParity...)
+	if len(ecc) != 6 || binary.LittleEndian.Uint32(ecc[5]) != 10 || binary.LittleEndian.Uint16(ecc[5][fecHeaderSize:]) != 5 {
+		t.Fatal("repair symbols not indexed after the group")
+	}
+	var recovered [][]byte
+	for _, pkt := range append(data[5:], ecc...) {
+		shards, err := rx.input(mustDecode(t, rx, pkt))
+		if err != nil {
+			t.Fatal(err)
+		}
+		recovered = append(recovered, shards...)
+	}
+	if len(recovered) != 5 {
+		t.Fatal("group not recovered", len(recovered), rx.stats)
+	}
+
+	s.fecTx.codec = FECCodecReedSolomon
+	if s.SendFECRepair(1) == nil {
+		t.Fatal("repair without the fountain code")
+	}
+}
+
+func TestFECHandshake(t *testing.T) {
+	echo := func(addr string, dataShards, parityShards int) *Listener {
+		l, err := ListenWithOptions(addr, nil, dataShards, parityShards)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			for {
+				s, err := l.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					buf := make([]byte, 1024)
+					for {
+						n, err := s.Read(buf)
+						if err != nil {
+							return
+						}
+						s.Write(buf[:n])
+					}
+				}()
+			}
+		}()
+		return l
+	}
+	for _, c := range []struct {
+		addr           string
+		listen, dialed [2]int // data and parity shards
+	}{
+		{"127.0.0.1:9998", [2]int{0, 0}, [2]int{5, 2}},  // fec disabled on the listener
+		{"127.0.0.1:9997", [2]int{10, 3}, [2]int{0, 0}}, // fec disabled on the client
+		{"127.0.0.1:9996", [2]int{10, 3}, [2]int{6, 4}}, // different geometries
+	} {
+		l := echo(c.addr, c.listen[0], c.listen[1])
+		cli, err := DialWithOptions(c.addr, nil, c.dialed[0], c.dialed[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 10)
+		for i := 0; i < 10; i++ {
+			msg := fmt.Sprintf("hello%v", i)
+			cli.Write([]byte(msg))
+			if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+				t.Fatal(c.addr, "echo mismatch", err)
+			}
+		}
+		cli.Close()
+		l.Close()
+	}
+}
+
+func TestAESGCMAuth(t *testing.T) {
+	const addr = "127.0.0.1:9995"
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESGCMCrypt(pass)
+	l, err := ListenWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					n, err := s.Read(buf)
+					if err != nil {
+						return
+					}
+					s.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+
+	cli, err := DialWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 10)
+	for i := 0; i < 10; i++ {
+		msg := fmt.Sprintf("hello%v", i)
+		cli.Write([]byte(msg))
+		if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+			t.Fatal("echo mismatch", err)
+		}
+	}
+
+	// forged packets are dropped before reaching kcp
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	before := atomic.LoadUint64(&DefaultSnmp.InAuthErrors)
+	forged := make([]byte, aeadHeaderSize+fecHeaderSizePlus2+IKCP_OVERHEAD)
+	for i := 0; i < 10; i++ {
+		conn.Write(forged)
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadUint64(&DefaultSnmp.InAuthErrors)-before < 10 {
+		if time.Now().After(deadline) {
+			t.Fatal("forged packets not counted", atomic.LoadUint64(&DefaultSnmp.InAuthErrors)-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRekey(t *testing.T) {
+	const addr = "127.0.0.1:9994"
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, err := NewEpochCrypt("aes-gcm", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ListenWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					n, err := s.Read(buf)
+					if err != nil {
+						return
+					}
+					s.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+
+	cli, err := DialWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetDeadline(time.Now().Add(5 * time.Second))
+	echo := func(n int) {
+		buf := make([]byte, 1024)
+		for i := 0; i < n; i++ {
+			msg := fmt.Sprintf("hello%v", i)
+			cli.Write([]byte(msg))
+			if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+				t.Fatal("echo mismatch", err)
+			}
+		}
+	}
+	echo(5)
+
+	// the announce alone switches both ends, the remote answers in the new
+	// epoch
+	if err := cli.Rekey(); err != nil {
+		t.Fatal(err)
+	}
+	if cli.Rekey() != errRekeyPending {
+		t.Fatal("rotation started before the remote followed")
+	}
+	for start := time.Now(); atomic.LoadUint32(&cli.epoch.tx) != 1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("remote still in epoch", atomic.LoadUint32(&cli.epoch.rx))
+		}
+	}
+	echo(5)
+	if rx := atomic.LoadUint32(&cli.epoch.rx); rx != 1 {
+		t.Fatal("remote still in epoch", rx)
+	}
+
+	// rotation by volume
+	cli.SetRekeyBytes(1000)
+	echo(50)
+	if rx := atomic.LoadUint32(&cli.epoch.rx); rx < 3 {
+		t.Fatal("key not rotated, epoch", rx)
+	}
+
+	plain, err := DialWithOptions(addr, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if plain.Rekey() != errNoEpochCrypt || plain.SetRekeyBytes(1) != errNoEpochCrypt {
+		t.Fatal("rotation without epochs")
+	}
+}
+
+func TestRxEpoch(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewEpochCrypt("chacha20", pass)
+	s := &UDPSession{block: block}
+	packet := make([]byte, epochSize)
+	rx := func(epoch uint32) bool {
+		binary.LittleEndian.PutUint32(packet, epoch)
+		return s.rxEpoch(packet)
+	}
+	if !rx(0) || rx(2) || !rx(1) || atomic.LoadUint32(&s.epoch.tx) != 1 {
+		t.Fatal("next epoch not followed")
+	}
+	if !rx(0) {
+		t.Fatal("previous epoch rejected within the grace period")
+	}
+	s.epoch.prevEnd = time.Now()
+	if rx(0) {
+		t.Fatal("previous epoch accepted after the grace period")
+	}
+
+	// the keys of epochs far off aren't derived, nor kept until a packet
+	// opens under them
+	c := block.(*EpochCrypt)
+	forged := make([]byte, epochSize+aeadHeaderSize+32, mtuLimit)
+	binary.LittleEndian.PutUint32(forged, 5)
+	if epochNear(block, s, forged) || epochNear(block, nil, forged) {
+		t.Fatal("far epoch accepted")
+	}
+	binary.LittleEndian.PutUint32(forged, 2)
+	if !epochNear(block, s, forged) {
+		t.Fatal("next epoch refused")
+	}
+	if _, ok := decryptPacket(block, forged); ok || c.cached(2) {
+		t.Fatal("key of a forged packet kept")
+	}
+
+	// the epochs have distinct keys
+	a, _ := block.(*EpochCrypt).crypt(1)
+	b, _ := block.(*EpochCrypt).crypt(2)
+	data := make([]byte, aeadHeaderSize+32, mtuLimit)
+	a.(AEADCrypt).Seal(data)
+	if b.(AEADCrypt).Open(data) {
+		t.Fatal("packet opened under another epoch")
+	}
+}
+
+func TestNoiseHandshake(t *testing.T) {
+	serverPriv, serverPub, _ := GenerateNoiseKey()
+	clientPriv, clientPub, _ := GenerateNoiseKey()
+	handshake := func(remoteKey []byte) (BlockCrypt, BlockCrypt, error) {
+		i, err := newNoiseInitiator(&NoiseConfig{PrivateKey: clientPriv, RemoteKey: remoteKey})
+		if err != nil {
+			return nil, nil, err
+		}
+		r, _ := newNoiseResponder(&NoiseConfig{PrivateKey: serverPriv})
+		msg1, _ := i.writeMsg1()
+		if err := r.readMsg1(msg1); err != nil {
+			return nil, nil, err
+		}
+		if !bytes.Equal(r.rs[:], clientPub) {
+			t.Fatal("client key not learnt")
+		}
+		msg2, _ := r.writeMsg2()
+		if err := i.readMsg2(msg2); err != nil {
+			return nil, nil, err
+		}
+		return i.crypt(true), r.crypt(false), nil
+	}
+
+	client, server, err := handshake(serverPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range [][2]BlockCrypt{{client, server}, {server, client}} {
+		packet := make([]byte, aeadHeaderSize+100, mtuLimit)
+		copy(packet[aeadHeaderSize:], "hello")
+		c[0].(AEADCrypt).Seal(packet)
+		if !c[1].(AEADCrypt).Open(packet) || string(packet[aeadHeaderSize:aeadHeaderSize+5]) != "hello" {
+			t.Fatal("session keys mismatch")
+		}
+		// each direction has its own key
+		c[0].(AEADCrypt).Seal(packet)
+		if c[0].(AEADCrypt).Open(packet) {
+			t.Fatal("packet opened by its sender")
+		}
+	}
+
+	// an impostor without the private key of the listener
+	_, impostorPub, _ := GenerateNoiseKey()
+	if _, _, err := handshake(impostorPub); err != errNoiseHandshake {
+		t.Fatal("handshake with the wrong listener", err)
+	}
+}
+
+func TestKeyExchange(t *testing.T) {
+	const addr = "127.0.0.1:9989"
+	l, err := ListenWithKeyExchange(addr, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					n, err := s.Read(buf)
+					if err != nil {
+						return
+					}
+					s.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+
+	// every session has keys of its own
+	var blocks []BlockCrypt
+	for k := 0; k < 2; k++ {
+		cli, err := DialWithKeyExchange(addr, 10, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		cli.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 10)
+		for i := 0; i < 10; i++ {
+			msg := fmt.Sprintf("hello%v", i)
+			cli.Write([]byte(msg))
+			if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+				t.Fatal("echo mismatch", err)
+			}
+		}
+		blocks = append(blocks, cli.block)
+	}
+	packet := make([]byte, aeadHeaderSize+32, mtuLimit)
+	blocks[0].(AEADCrypt).Seal(packet)
+	if blocks[1].(AEADCrypt).Open(packet) {
+		t.Fatal("sessions share their keys")
+	}
+}
+
+func TestNoise(t *testing.T) {
+	const addr = "127.0.0.1:9993"
+	serverPriv, serverPub, _ := GenerateNoiseKey()
+	clientPriv, clientPub, _ := GenerateNoiseKey()
+	authorized := make(chan []byte, 1)
+	l, err := ListenWithNoise(addr, &NoiseConfig{PrivateKey: serverPriv, Authorize: func(key []byte) bool {
+		authorized <- append([]byte(nil), key...)
+		return true
+	}}, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *UDPSession, 1)
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			select {
+			case accepted <- s:
+			default:
+			}
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					n, err := s.Read(buf)
+					if err != nil {
+						return
+					}
+					s.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+
+	cli, err := DialWithNoise(addr, &NoiseConfig{PrivateKey: clientPriv, RemoteKey: serverPub}, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if key := <-authorized; !bytes.Equal(key, clientPub) {
+		t.Fatal("wrong client key authorized")
+	}
+	cli.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 10)
+	for i := 0; i < 10; i++ {
+		msg := fmt.Sprintf("hello%v", i)
+		cli.Write([]byte(msg))
+		if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+			t.Fatal("echo mismatch", err)
+		}
+	}
+	// the sessions of a handshake tell from those of a pre-shared key
+	if name := cli.Cipher(); name != "noise-chacha20" {
+		t.Fatal("cipher", name)
+	}
+	if name := (<-accepted).Cipher(); name != "noise-chacha20" {
+		t.Fatal("cipher of the listener", name)
+	}
+	if _, err := ListenWithNoise(addr, &NoiseConfig{}, 10, 3); err != errNoiseKey {
+		t.Fatal("listener without key", err)
+	}
+}
+
+func TestNoisePending(t *testing.T) {
+	l, err := ListenWithKeyExchange("127.0.0.1:9926", 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	from, _ := net.ResolveUDPAddr("udp", "127.0.0.1:9")
+	msg1 := func() []byte {
+		hs, _ := newNoiseInitiator(&NoiseConfig{anonymous: true})
+		msg, _ := hs.writeMsg1()
+		return msg
+	}
+	pending := func(want []byte) {
+		t.Helper()
+		for start := time.Now(); ; time.Sleep(time.Millisecond) {
+			var got []byte
+			l.admin(func() {
+				if p := l.noisePending[from.String()]; p != nil {
+					got = p.msg1
+				}
+			})
+			if bytes.Equal(got, want) {
+				return
+			}
+			if time.Since(start) > 5*time.Second {
+				t.Fatal("handshake not answered")
+			}
+		}
+	}
+
+	// the handshakes are answered by the workers, a new first message of
+	// the remote replaces its handshake
+	a, b := msg1(), msg1()
+	l.admin(func() { l.noiseInput(from.String(), from, a) })
+	pending(a)
+	l.admin(func() { l.noiseInput(from.String(), from, b) })
+	pending(b)
+	l.admin(func() { l.noiseInput(from.String(), from, a) })
+	pending(a)
+
+	// the handshakes expire, and the oldest makes room once the table is full
+	now := time.Now()
+	var full, evicted, expired bool
+	l.admin(func() {
+		l.noisePending = make(map[string]*noisePending)
+		for i := 0; i < noisePendingLimit; i++ {
+			addr := fmt.Sprint("10.0.0.1:", i)
+			l.noisePending[addr] = &noisePending{addr: addr, expires: now.Add(time.Duration(i+1) * time.Second)}
+		}
+		l.addNoise(&noisePending{addr: "10.0.0.2:1", from: from, msg2: []byte{0}}, now)
+		full, evicted = len(l.noisePending) == noisePendingLimit, l.noisePending["10.0.0.1:0"] == nil
+		l.purgeNoise(now.Add(noisePendingTTL + time.Hour))
+		expired = len(l.noisePending) == 0
+	})
+	if !full || !evicted {
+		t.Fatal("pending handshakes unbounded")
+	}
+	if !expired {
+		t.Fatal("expired handshakes kept")
+	}
+}
+
+func TestSessionCrypt(t *testing.T) {
+	const addr = "127.0.0.1:9992"
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, err := NewSessionCrypt("aes-gcm", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ListenWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					n, err := s.Read(buf)
+					if err != nil {
+						return
+					}
+					s.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+
+	var sessions []*UDPSession
+	for k := 0; k < 2; k++ {
+		cli, err := DialWithOptions(addr, block, 10, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		cli.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 10)
+		for i := 0; i < 10; i++ {
+			msg := fmt.Sprintf("hello%v", i)
+			cli.Write([]byte(msg))
+			if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+				t.Fatal("echo mismatch", err)
+			}
+		}
+		sessions = append(sessions, cli)
+	}
+
+	// the sessions don't share their keys
+	a, b := sessions[0].block.(*sessionCrypt), sessions[1].block.(*sessionCrypt)
+	if binary.LittleEndian.Uint32(a.header[:]) != sessions[0].GetConv() {
+		t.Fatal("conv not in the header")
+	}
+	packet := make([]byte, aeadHeaderSize+32, mtuLimit)
+	a.block.(AEADCrypt).Seal(packet)
+	if b.block.(AEADCrypt).Open(packet) {
+		t.Fatal("packet opened under the key of another session")
+	}
+}
+
+func TestObfuscation(t *testing.T) {
+	buckets := []int{1400, 128, 512}
+	raw, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	cli, err := DialWithOptions(raw.LocalAddr().String(), nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.SetObfuscation([]int{10}, 0) != errObfsParams || cli.SetObfuscation(nil, time.Second) != errObfsParams {
+		t.Fatal("invalid obfuscation accepted")
+	}
+	if err := cli.SetObfuscation(buckets, 20*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	cli.Write([]byte("hello"))
+
+	// every packet has a bucket size, the padding and dummy packets are stripped
+	padded, dummies := 0, 0
+	raw.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, mtuLimit)
+	for {
+		n, _, err := raw.ReadFrom(buf)
+		if err != nil {
+			break
+		}
+		if n != 128 && n != 512 && n != 1400 {
+			t.Fatal("packet size", n)
+		}
+		data, ok := unpad(buf[:n])
+		if !ok {
+			dummies++
+			continue
+		}
+		if len(data) < IKCP_OVERHEAD || binary.LittleEndian.Uint32(data) != cli.GetConv() {
+			t.Fatal("padding not stripped")
+		}
+		padded++
+	}
+	if padded == 0 || dummies == 0 {
+		t.Fatal("padded", padded, "dummies", dummies)
+	}
+}
+
+func TestObfuscationEcho(t *testing.T) {
+	const addr = "127.0.0.1:9990"
+	buckets := []int{256, 1024, 1500}
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESGCMCrypt(pass)
+	l, err := ListenWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.SetObfuscation(buckets, 10*time.Millisecond)
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					n, err := s.Read(buf)
+					if err != nil {
+						return
+					}
+					s.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+
+	cli, err := DialWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetObfuscation(buckets, 10*time.Millisecond)
+	cli.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 10)
+	for i := 0; i < 20; i++ {
+		msg := fmt.Sprintf("hello%v", i)
+		cli.Write([]byte(msg))
+		if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+			t.Fatal("echo mismatch", err)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLayerOrder(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESGCMCrypt(pass)
+	raw, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	cli, err := DialWithOptions(raw.LocalAddr().String(), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.SetLayerOrder(2) != errLayerOrder {
+		t.Fatal("invalid layer order accepted")
+	}
+	if err := cli.SetLayerOrder(EncryptThenFEC); err != nil {
+		t.Fatal(err)
+	}
+	cli.Write([]byte("hello"))
+
+	// the fec header is in the clear, the kcp packet under it is sealed
+	raw.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, mtuLimit)
+	n, _, err := raw.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf[4] != typeData || int(binary.LittleEndian.Uint16(buf[fecHeaderSize:])) != n-fecHeaderSize {
+		t.Fatal("fec header not in the clear")
+	}
+	data, ok := decryptPacket(block, buf[fecHeaderSizePlus2:n])
+	if !ok || binary.LittleEndian.Uint32(data) != cli.GetConv() {
+		t.Fatal("kcp packet not sealed")
+	}
+	if cli.SetLayerOrder(FECThenEncrypt) != errLayersFixed {
+		t.Fatal("layer order changed after sending")
+	}
+
+	// a forged shard under the fec header in the clear doesn't keep the
+	// session from idling
+	atomic.StoreInt64(&cli.lastInput, 0)
+	forged := append([]byte(nil), buf[:n]...)
+	forged[n-1] ^= 0xff
+	cli.kcpInput(forged)
+	if atomic.LoadInt64(&cli.lastInput) != 0 {
+		t.Fatal("unauthenticated shard counted as input")
+	}
+}
+
+func TestLayerOrderEcho(t *testing.T) {
+	const addr = "127.0.0.1:9988"
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewSessionCrypt("aes-gcm", pass)
+	l, err := ListenWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					n, err := s.Read(buf)
+					if err != nil {
+						return
+					}
+					s.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+
+	// the listener answers each session in the order it was dialed with
+	for _, order := range []int{EncryptThenFEC, FECThenEncrypt} {
+		cli, err := DialWithOptions(addr, block, 10, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.SetLayerOrder(order)
+		cli.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 10)
+		for i := 0; i < 20; i++ {
+			msg := fmt.Sprintf("hello%v", i)
+			if i%2 == 0 {
+				cli.WriteNoFEC([]byte(msg))
+			} else {
+				cli.Write([]byte(msg))
+			}
+			if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+				t.Fatal("order", order, "echo mismatch", err)
+			}
+		}
+		cli.Close()
+	}
+}
+
+func TestKeyResolver(t *testing.T) {
+	const addr = "127.0.0.1:9987"
+	keys := map[uint32][]byte{1: []byte("customer one key"), 2: []byte("customer two key")}
+	l, err := ListenWithOptions(addr, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetKeyResolver(func(conv uint32, remote net.Addr) (BlockCrypt, error) {
+		if keys[conv] == nil {
+			return nil, errCryptKey
+		}
+		return NewAESGCMCrypt(keys[conv])
+	})
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				buf := make([]byte, 1024)
+				for {
+					n, err := s.Read(buf)
+					if err != nil {
+						return
+					}
+					s.Write(buf[:n])
+				}
+			}()
+		}
+	}()
+
+	echo := func(conv uint32, key []byte, timeout time.Duration) error {
+		block, _ := NewAESGCMCrypt(key)
+		cli, err := DialWithOptions(addr, NewConvCrypt(conv, block), 10, 3)
+		if err != nil {
+			return err
+		}
+		defer cli.Close()
+		if cli.GetConv() != conv {
+			t.Fatal("conv", cli.GetConv())
+		}
+		cli.SetDeadline(time.Now().Add(timeout))
+		buf := make([]byte, 10)
+		for i := 0; i < 10; i++ {
+			msg := fmt.Sprintf("hello%v", i)
+			cli.Write([]byte(msg))
+			n, err := cli.Read(buf)
+			if err != nil {
+				return err
+			}
+			if string(buf[:n]) != msg {
+				t.Fatal("echo mismatch")
+			}
+		}
+		return nil
+	}
+
+	// each customer is served with its own key
+	for conv, key := range keys {
+		if err := echo(conv, key, 5*time.Second); err != nil {
+			t.Fatal("conv", conv, err)
+		}
+	}
+	// unknown customers and wrong keys get no answer
+	if echo(3, keys[1], 300*time.Millisecond) == nil || echo(2, keys[1], 300*time.Millisecond) == nil {
+		t.Fatal("conversation served without its key")
+	}
+}
+
+func TestHybridKeyExchange(t *testing.T) {
+	config := &NoiseConfig{hybrid: true}
+	i, _ := newNoiseInitiator(config)
+	r, _ := newNoiseResponder(config)
+	msg1, _ := i.writeMsg1()
+	if len(msg1) != noiseMsg1SizeHFS || r.readMsg1(msg1) != nil {
+		t.Fatal("msg1", len(msg1))
+	}
+	msg2, _ := r.writeMsg2()
+	if len(msg2) != noiseMsg2SizeHFS || len(msg2) > IKCP_MTU_DEF {
+		t.Fatal("msg2", len(msg2))
+	}
+	// the kem ciphertext is authenticated
+	forged := append([]byte(nil), msg2...)
+	forged[noiseKeySize+1] ^= 1
+	if attempt := *i; attempt.readMsg2(forged) != errNoiseHandshake {
+		t.Fatal("forged kem ciphertext accepted")
+	}
+	if err := i.readMsg2(msg2); err != nil {
+		t.Fatal(err)
+	}
+	packet := make([]byte, aeadHeaderSize+100, mtuLimit)
+	i.crypt(true).(AEADCrypt).Seal(packet)
+	if !r.crypt(false).(AEADCrypt).Open(packet) {
+		t.Fatal("session keys mismatch")
+	}
+
+	const addr = "127.0.0.1:9986"
+	l, err := ListenWithHybridKeyExchange(addr, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		buf := make([]byte, 1024)
+		for {
+			n, err := s.Read(buf)
+			if err != nil {
+				return
+			}
+			s.Write(buf[:n])
+		}
+	}()
+	cli, err := DialWithHybridKeyExchange(addr, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 10)
+	for k := 0; k < 10; k++ {
+		msg := fmt.Sprintf("hello%v", k)
+		cli.Write([]byte(msg))
+		if n, err := cli.Read(buf); err != nil || string(buf[:n]) != msg {
+			t.Fatal("echo mismatch", err)
+		}
+	}
+}
+
+func TestDeadlineWakesRead(t *testing.T) {
+	l, err := ListenWithOptions("127.0.0.1:9985", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cli, err := DialWithOptions("127.0.0.1:9985", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	// a deadline set while Read is blocked without one ends it
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cli.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	}()
+	start := time.Now()
+	_, err = cli.Read(make([]byte, 10))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal("want a timeout error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatal("read not woken by the deadline", elapsed)
+	}
+}
+
+func selfSignedTLS(t *testing.T) (*tls.Config, *x509.CertPool) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), crand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(crand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}},
+		MinVersion:   tls.VersionTLS13,
+	}
+	return config, pool
+}
+
+func TestTLS(t *testing.T) {
+	server, pool := selfSignedTLS(t)
+	l, err := ListenWithOptions("127.0.0.1:9984", nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tl := NewTLSListener(l, server)
+	defer tl.Close()
+	go func() {
+		conn, err := tl.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	cli, err := DialTLS("127.0.0.1:9984", &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS13}, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if v := cli.ConnectionState().Version; v != tls.VersionTLS13 {
+		t.Fatal("tls version", v)
+	}
+	cli.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 10)
+	for k := 0; k < 10; k++ {
+		msg := fmt.Sprintf("hello%v", k)
+		cli.Write([]byte(msg))
+		if n, err := io.ReadFull(cli, buf[:len(msg)]); err != nil || string(buf[:n]) != msg {
+			t.Fatal("echo mismatch", err)
+		}
+	}
+
+	// the handshake with a peer never answering times out
+	silent, err := ListenWithOptions("127.0.0.1:9983", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	defer func(timeout time.Duration) { tlsHandshakeTimeout = timeout }(tlsHandshakeTimeout)
+	tlsHandshakeTimeout = 300 * time.Millisecond
+	start := time.Now()
+	_, err = DialTLS("127.0.0.1:9983", &tls.Config{RootCAs: pool}, 0, 0)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal("want a handshake timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatal("handshake outlived its timeout", elapsed)
+	}
+}
+
+func TestCookies(t *testing.T) {
+	key := newCookieKey([]byte("secret"))
+	now := time.Now()
+	packet := make([]byte, 64)
+	cookie := make([]byte, len(packet))
+	key.challenge(cookie, packet, "127.0.0.1:1000", now)
+	if !key.verify(cookie, "127.0.0.1:1000", now) || !key.verify(cookie, "127.0.0.1:1000", now.Add(cookieLifetime)) {
+		t.Fatal("cookie rejected")
+	}
+	if key.verify(cookie, "127.0.0.1:1001", now) || key.verify(cookie, "127.0.0.1:1000", now.Add(3*cookieLifetime)) {
+		t.Fatal("cookie of another remote or expired accepted")
+	}
+	other := make([]byte, len(packet))
+	newCookieKey([]byte("other secret")).challenge(other, packet, "127.0.0.1:1000", now)
+	if bytes.Equal(cookie[:cookieMarkerSize], other[:cookieMarkerSize]) {
+		t.Fatal("cookies of different listeners share their marker")
+	}
+
+	// dialers only answer the challenges of their own packets, until they
+	// hear from the listener
+	tags := new(cookieTags)
+	if tags.challenged(cookie) {
+		t.Fatal("challenge answered before any packet was sent")
+	}
+	tags.sent(packet)
+	packet[0] = 1
+	key.challenge(other, packet, "127.0.0.1:1000", now)
+	if !tags.challenged(cookie) || tags.challenged(other) {
+		t.Fatal("challenge not bound to the packet answered")
+	}
+	tags.finish()
+	if tags.challenged(cookie) {
+		t.Fatal("challenge answered after the handshake")
+	}
+
+	const addr = "127.0.0.1:9982"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetCookies(true)
+	accepted := make(chan *UDPSession, 1)
+	go func() {
+		if s, err := l.Accept(); err == nil {
+			accepted <- s
+		}
+	}()
+
+	// a spoofed remote gets a challenge no larger than its packet, and no
+	// session without echoing it
+	raddr, _ := net.ResolveUDPAddr("udp", addr)
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pkt := make([]byte, 64)
+	binary.LittleEndian.PutUint32(pkt, 1234)
+	pkt[4] = IKCP_CMD_PUSH
+	conn.WriteToUDP(pkt, raddr)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, mtuLimit)
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil || n != len(pkt) || binary.LittleEndian.Uint64(buf[cookieMarkerSize:]) != cookieTag(pkt) {
+		t.Fatal("no challenge", n, err)
+	}
+	buf[cookieSize-1] ^= 1
+	conn.WriteToUDP(buf[:n], raddr)
+	conn.WriteToUDP(pkt, raddr)
+	select {
+	case <-accepted:
+		t.Fatal("session created with a forged cookie")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// dialers echo the cookie on their own
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Write([]byte("hello"))
+	var s *UDPSession
+	select {
+	case s = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no session once the cookie was echoed")
+	}
+	defer s.Close()
+	s.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := s.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatal("first message lost", err)
+	}
+
+	// the handshake of a key exchange is challenged as well
+	kl, err := ListenWithKeyExchange("127.0.0.1:9981", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kl.Close()
+	kl.SetCookies(true)
+	go func() {
+		if s, err := kl.Accept(); err == nil {
+			io.Copy(s, s)
+		}
+	}()
+	kcli, err := DialWithKeyExchange("127.0.0.1:9981", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer kcli.Close()
+	kcli.SetDeadline(time.Now().Add(5 * time.Second))
+	kcli.Write([]byte("hello"))
+	if n, err := kcli.Read(buf); err != nil || string(buf[:n]) != "hello" {
+		t.Fatal("echo mismatch", err)
+	}
+}
+
+func TestListenerKeys(t *testing.T) {
+	const addr = "127.0.0.1:9980"
+	oldKey, _ := NewAESBlockCrypt([]byte("old pre-shared key 0123456789abc"))
+	newKey, _ := NewAESGCMCrypt([]byte("new pre-shared key 0123456789abc"))
+	otherKey, _ := NewAESGCMCrypt([]byte("some other key 0123456789abcdef"))
+	l, err := ListenWithOptions(addr, oldKey, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.SetKeys(make([]BlockCrypt, maxListenerKeys+1)); err != errKeys {
+		t.Fatal("too many keys", err)
+	}
+	if err := l.SetKeys([]BlockCrypt{newKey, nil}); err != errKeys {
+		t.Fatal("nil key", err)
+	}
+	if err := l.SetKeys([]BlockCrypt{newKey, oldKey}); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(s, s)
+		}
+	}()
+
+	echo := func(block BlockCrypt, timeout time.Duration) error {
+		cli, err := DialWithOptions(addr, block, 0, 0)
+		if err != nil {
+			return err
+		}
+		defer cli.Close()
+		cli.SetDeadline(time.Now().Add(timeout))
+		buf := make([]byte, 10)
+		for i := 0; i < 10; i++ {
+			msg := fmt.Sprintf("hello%v", i)
+			cli.Write([]byte(msg))
+			if _, err := io.ReadFull(cli, buf[:len(msg)]); err != nil {
+				return err
+			}
+			if string(buf[:len(msg)]) != msg {
+				t.Fatal("echo mismatch")
+			}
+		}
+		return nil
+	}
+
+	// remotes on either key are served during the rollover
+	if err := echo(newKey, 5*time.Second); err != nil {
+		t.Fatal("new key", err)
+	}
+	if err := echo(oldKey, 5*time.Second); err != nil {
+		t.Fatal("old key", err)
+	}
+	if err := echo(otherKey, 500*time.Millisecond); err == nil {
+		t.Fatal("unknown key served")
+	}
+
+	// the old key is dropped once the rollover is over
+	if err := l.SetKeys([]BlockCrypt{newKey}); err != nil {
+		t.Fatal(err)
+	}
+	if err := echo(oldKey, 500*time.Millisecond); err == nil {
+		t.Fatal("old key served after the rollover")
+	}
+	if err := echo(newKey, 5*time.Second); err != nil {
+		t.Fatal("new key", err)
+	}
+}
+
+func TestHeaderCrypt(t *testing.T) {
+	const addr = "127.0.0.1:9979"
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	if _, err := NewHeaderCrypt("tea", pass); err != nil {
+		t.Fatal(err)
+	}
+	block, err := NewHeaderCrypt("hmac-sha256", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ListenWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(s, s)
+		}
+	}()
+	cli, err := DialWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 10)
+	for i := 0; i < 10; i++ {
+		msg := fmt.Sprintf("hello%v", i)
+		cli.Write([]byte(msg))
+		if _, err := io.ReadFull(cli, buf[:len(msg)]); err != nil || string(buf[:len(msg)]) != msg {
+			t.Fatal("echo mismatch", err)
+		}
+	}
+
+	// the kcp header sent in the clear by HMAC-SHA256 is masked
+	overhead := cryptOverhead(block)
+	plain := make([]byte, overhead+headerProtectSize+16)
+	binary.LittleEndian.PutUint32(plain[overhead:], 0x11223344)
+	binary.LittleEndian.PutUint32(plain[overhead+12:], 0x55667788)
+	packet := make([]byte, len(plain), mtuLimit)
+	copy(packet, plain)
+	sealPacket(block, packet)
+	if bytes.Contains(packet, plain[overhead:overhead+4]) || bytes.Contains(packet, plain[overhead+12:overhead+16]) {
+		t.Fatal("conv or sn in the clear")
+	}
+	if !bytes.Equal(packet[overhead+headerProtectSize:], plain[overhead+headerProtectSize:]) {
+		t.Fatal("payload beyond the headers masked")
+	}
+	tampered := append([]byte(nil), packet...)
+	tampered[overhead] ^= 1
+	if _, ok := decryptPacket(block, tampered); ok {
+		t.Fatal("tampered header accepted")
+	}
+	if data, ok := decryptPacket(block, packet); !ok || !bytes.Equal(data, plain[overhead:]) {
+		t.Fatal("decryption mismatch")
+	}
+
+	// the nonce counters of AEADs don't show
+	aead, _ := NewHeaderCrypt("aes-gcm", pass)
+	a := make([]byte, aeadHeaderSize+IKCP_OVERHEAD, mtuLimit)
+	b := make([]byte, aeadHeaderSize+IKCP_OVERHEAD, mtuLimit)
+	sealPacket(aead, a)
+	sealPacket(aead, b)
+	if bytes.Equal(a[:aeadSaltSize], b[:aeadSaltSize]) {
+		t.Fatal("nonce salt in the clear")
+	}
+	replay := append([]byte(nil), b...)
+	if _, ok := decryptPacket(aead, b); !ok {
+		t.Fatal("decryption failed")
+	}
+	if _, ok := decryptPacket(aead, replay); ok {
+		t.Fatal("replay accepted")
+	}
+}
+
+func TestForgedPackets(t *testing.T) {
+	const addr = "127.0.0.1:9978"
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewChaCha20Poly1305Crypt(pass)
+	l, err := ListenWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(s, s)
+		}
+	}()
+
+	cli, err := DialWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetDeadline(time.Now().Add(5 * time.Second))
+	echo := func(msg string) {
+		buf := make([]byte, len(msg))
+		cli.Write([]byte(msg))
+		if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != msg {
+			t.Fatal("echo mismatch", string(buf), err)
+		}
+	}
+	echo("hello")
+
+	// kcp packets of the session in the clear, a window of 0 which would
+	// stall the remote and data which would be echoed, forged with the
+	// session address towards the listener and from anywhere towards the
+	// dialer. The protocol has no close or reset frame, a session only ends
+	// when closed locally, and every packet is authenticated before kcp.
+	forge := func(cmd byte, wnd uint16, sn uint32, data []byte) []byte {
+		pkt := make([]byte, aeadHeaderSize+fecHeaderSizePlus2+IKCP_OVERHEAD+len(data))
+		crand.Read(pkt[:aeadHeaderSize])
+		fec := pkt[aeadHeaderSize:]
+		binary.LittleEndian.PutUint16(fec[4:], typeData)
+		binary.LittleEndian.PutUint16(fec[6:], uint16(IKCP_OVERHEAD+len(data)+2))
+		seg := fec[fecHeaderSizePlus2:]
+		binary.LittleEndian.PutUint32(seg, cli.GetConv())
+		seg[4] = cmd
+		binary.LittleEndian.PutUint16(seg[6:], wnd)
+		binary.LittleEndian.PutUint32(seg[12:], sn)
+		binary.LittleEndian.PutUint32(seg[20:], uint32(len(data)))
+		copy(seg[IKCP_OVERHEAD:], data)
+		return pkt
+	}
+	attacker, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+	before := atomic.LoadUint64(&DefaultSnmp.InAuthErrors)
+	for sn := uint32(0); sn < 8; sn++ {
+		for _, pkt := range [][]byte{
+			forge(IKCP_CMD_WINS, 0, sn, nil),
+			forge(IKCP_CMD_PUSH, 128, sn, []byte("forged")),
+		} {
+			cli.conn.WriteTo(pkt, cli.RemoteAddr())
+			attacker.WriteTo(pkt, cli.conn.LocalAddr())
+		}
+	}
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadUint64(&DefaultSnmp.InAuthErrors)-before < 32 {
+		if time.Now().After(deadline) {
+			t.Fatal("forged packets not rejected", atomic.LoadUint64(&DefaultSnmp.InAuthErrors)-before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the session carries on, untouched by the forgeries
+	for i := 0; i < 10; i++ {
+		echo(fmt.Sprintf("hello%v", i))
+	}
+}
+
+func TestDeadlines(t *testing.T) {
+	// nothing listens, the packets sent are never acknowledged
+	cli, err := DialWithOptions("127.0.0.1:9977", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// every goroutine blocked without a deadline is woken by a deadline in
+	// the past, a write blocks once the send window is full
+	errs := make(chan error, 3)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := cli.Read(make([]byte, 10))
+			errs <- err
+		}()
+	}
+	go func() {
+		for {
+			if _, err := cli.Write(make([]byte, 1024)); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	cli.SetDeadline(time.Now().Add(-time.Second))
+	for i := 0; i < 3; i++ {
+		select {
+		case err := <-errs:
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() || !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal("want a timeout error", err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("blocked call not woken by the deadline")
+		}
+	}
+
+	// an extended deadline lets the calls block again until it passes
+	cli.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	start := time.Now()
+	if _, err := cli.Read(make([]byte, 10)); err != errTimeout {
+		t.Fatal("want a timeout error", err)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatal("read returned before the deadline", elapsed)
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	const addr = "127.0.0.1:9976"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// no remote dials, the accept gives up with its context
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := l.AcceptContext(ctx); err != context.DeadlineExceeded {
+		t.Fatal("want the error of the context", err)
+	}
+
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := DialWithOptionsContext(cancelled, addr, nil, 0, 0); err == nil {
+		t.Fatal("dialed with a cancelled context")
+	}
+
+	// the listener doesn't run the key exchange, the handshake is cancelled
+	// before its first retry
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start := time.Now()
+	if _, err := DialWithKeyExchangeContext(ctx, addr, 0, 0); err != context.Canceled {
+		t.Fatal("want the error of the context", err)
+	}
+	if elapsed := time.Since(start); elapsed >= noiseTimeout {
+		t.Fatal("handshake not cancelled", elapsed)
+	}
+
+	// the session of a dial in time is accepted
+	cli, err := DialWithOptionsContext(context.Background(), addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Write([]byte("hello"))
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	s, err := l.AcceptContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+}
+
+func TestHalfClose(t *testing.T) {
+	const addr = "127.0.0.1:9975"
+	l, err := ListenWithOptions(addr, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	written := make(chan error, 1)
+	go func() {
+		for i := 0; ; i++ {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if i == 0 {
+				// answer once the request is complete
+				go func() {
+					req, err := io.ReadAll(s)
+					if err != nil {
+						return
+					}
+					fmt.Fprintf(s, "got %v bytes", len(req))
+					s.CloseWrite()
+				}()
+			} else {
+				// write more than the windows hold to a remote not reading
+				go func() {
+					_, err := s.Write(make([]byte, 512*1024))
+					written <- err
+				}()
+			}
+		}
+	}()
+
+	cli, err := DialWithOptions(addr, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetDeadline(time.Now().Add(5 * time.Second))
+	cli.Write(make([]byte, 100000))
+	if err := cli.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Write([]byte("late")); err != errBrokenPipe {
+		t.Fatal("write after CloseWrite", err)
+	}
+	resp, err := io.ReadAll(cli)
+	if err != nil || string(resp) != "got 100000 bytes" {
+		t.Fatal("response mismatch", string(resp), err)
+	}
+	if n, err := cli.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Fatal("eof not kept", n, err)
+	}
+
+	// the data received after CloseRead is dropped and acknowledged
+	cli2, err := DialWithOptions(addr, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli2.Close()
+	cli2.Write([]byte("hello"))
+	if err := cli2.CloseRead(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := cli2.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Fatal("read after CloseRead", n, err)
+	}
+	select {
+	case err := <-written:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("remote stalled by a closed reading side")
+	}
+}
+
+func TestCloseGracefully(t *testing.T) {
+	const addr = "127.0.0.1:9974"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan int, 1)
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		data, _ := io.ReadAll(s)
+		received <- len(data)
+	}()
+
+	// the data written before closing reaches the remote
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Write(make([]byte, 100000))
+	if abandoned, err := cli.CloseGracefully(5 * time.Second); abandoned != 0 || err != nil {
+		t.Fatal("data abandoned", abandoned, err)
+	}
+	select {
+	case n := <-received:
+		if n != 100000 {
+			t.Fatal("data lost", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("eof not received")
+	}
+	if _, err := cli.CloseGracefully(time.Second); err != errBrokenPipe {
+		t.Fatal("closed twice", err)
+	}
+
+	// nothing acknowledges the data sent to nowhere, it's abandoned on time
+	cli, err = DialWithOptions("127.0.0.1:9973", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Write(make([]byte, 10000))
+	start := time.Now()
+	if abandoned, err := cli.CloseGracefully(200 * time.Millisecond); abandoned != 10000 || err != nil {
+		t.Fatal("abandoned bytes mismatch", abandoned, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("timeout not honored", elapsed)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	const addr = "127.0.0.1:9972"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	evicted := make(chan *UDPSession, 1)
+	l.SetIdleTimeout(300*time.Millisecond, func(s *UDPSession) { evicted <- s })
+
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Write([]byte("hello"))
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a session receiving keeps alive
+	for i := 0; i < 5; i++ {
+		cli.Write([]byte("hello"))
+		time.Sleep(100 * time.Millisecond)
+	}
+	select {
+	case <-evicted:
+		t.Fatal("active session evicted")
+	default:
+	}
+
+	// the remote disappears silently
+	cli.Close()
+	select {
+	case e := <-evicted:
+		if e != s {
+			t.Fatal("wrong session evicted")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle session not evicted")
+	}
+	if _, err := s.Read(make([]byte, 10)); err != errBrokenPipe {
+		t.Fatal("evicted session not closed", err)
+	}
+}
+
+func TestMigration(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	aead, _ := NewChaCha20Poly1305Crypt(pass)
+	testMigration(t, "127.0.0.1:9971", aead)
+	// without the replay window of an AEAD crypt
+	block, _ := NewAESBlockCrypt(pass)
+	testMigration(t, "127.0.0.1:9927", block)
+}
+
+func testMigration(t *testing.T, addr string, block BlockCrypt) {
+	l, err := ListenWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	type move struct {
+		s        *UDPSession
+		previous net.Addr
+	}
+	moves := make(chan move, 4)
+	l.SetMigration(true, func(s *UDPSession, previous net.Addr) { moves <- move{s, previous} })
+	changes := make(chan move, 4)
+	l.SetEventHandler(SessionEvents{RemoteAddrChanged: func(s *UDPSession, previous net.Addr) {
+		changes <- move{s, previous}
+	}})
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(s, s)
+		}
+	}()
+
+	// a relay in front of the listener switching the path of the client
+	// from one socket to another, as a client changing networks
+	front, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer front.Close()
+	server, _ := net.ResolveUDPAddr("udp", addr)
+	var paths [2]*net.UDPConn
+	for k := range paths {
+		if paths[k], err = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+			t.Fatal(err)
+		}
+		defer paths[k].Close()
+	}
+	var path int32
+	var client atomic.Value
+	var mu sync.Mutex
+	var sent []byte // last packet relayed from the client
+	go func() {
+		buf := make([]byte, mtuLimit)
+		for {
+			n, from, err := front.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			client.Store(from)
+			mu.Lock()
+			sent = append(sent[:0], buf[:n]...)
+			mu.Unlock()
+			paths[atomic.LoadInt32(&path)].WriteTo(buf[:n], server)
+		}
+	}()
+	for _, conn := range paths {
+		go func(conn *net.UDPConn) {
+			buf := make([]byte, mtuLimit)
+			for {
+				n, _, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				front.WriteTo(buf[:n], client.Load().(*net.UDPAddr))
+			}
+		}(conn)
+	}
+
+	cli, err := DialWithOptions(front.LocalAddr().String(), block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetDeadline(time.Now().Add(5 * time.Second))
+	echo := func(msg string) {
+		buf := make([]byte, len(msg))
+		cli.Write([]byte(msg))
+		if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != msg {
+			t.Fatal("echo mismatch", msg, string(buf), err)
+		}
+	}
+	echo("hello")
+
+	// the session follows the client to its new address
+	before := atomic.LoadUint64(&DefaultSnmp.Migrations)
+	atomic.StoreInt32(&path, 1)
+	for i := 0; i < 10; i++ {
+		echo(fmt.Sprintf("hello%v", i))
+	}
+	select {
+	case m := <-moves:
+		if m.previous.String() != paths[0].LocalAddr().String() || m.s.RemoteAddr().String() != paths[1].LocalAddr().String() {
+			t.Fatal("wrong migration", m.previous, m.s.RemoteAddr())
+		}
+	default:
+		t.Fatal("migration not notified")
+	}
+	select {
+	case m := <-changes:
+		if m.previous.String() != paths[0].LocalAddr().String() || m.s.RemoteAddr().String() != paths[1].LocalAddr().String() {
+			t.Fatal("wrong address change", m.previous, m.s.RemoteAddr())
+		}
+	default:
+		t.Fatal("address change not notified")
+	}
+	if atomic.LoadUint64(&DefaultSnmp.Migrations)-before != 1 {
+		t.Fatal("migrations", atomic.LoadUint64(&DefaultSnmp.Migrations)-before)
+	}
+
+	// a packet of the session replayed from elsewhere doesn't move it
+	attacker, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer attacker.Close()
+	mu.Lock()
+	replay := append([]byte(nil), sent...)
+	mu.Unlock()
+	attacker.WriteTo(replay, server)
+	echo("after replay")
+	select {
+	case m := <-moves:
+		t.Fatal("session moved by a replay to", m.s.RemoteAddr())
+	case m := <-changes:
+		t.Fatal("address changed by a replay to", m.s.RemoteAddr())
+	default:
+	}
+}
+
+func TestAcceptBacklog(t *testing.T) {
+	const addr = "127.0.0.1:9970"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.SetAcceptBacklog(0, BacklogDropNew); err != errBacklogParams {
+		t.Fatal("backlog of 0 accepted", err)
+	}
+	if err := l.SetAcceptBacklog(1, BacklogReject+1); err != errBacklogParams {
+		t.Fatal("unknown policy accepted", err)
+	}
+
+	dial := func() *UDPSession {
+		cli, err := DialWithOptions(addr, nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.Write([]byte("hello"))
+		return cli
+	}
+	// waitFor waits for the session of cli to head the backlog
+	waitFor := func(cli *UDPSession) {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			l.backlog.mu.Lock()
+			queued := len(l.backlog.sessions) > 0 && l.backlog.sessions[0].GetConv() == cli.GetConv()
+			l.backlog.mu.Unlock()
+			if queued {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("session not queued for Accept")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	accept := func(cli *UDPSession) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		s, err := l.AcceptContext(ctx)
+		if err != nil || s.GetConv() != cli.GetConv() {
+			t.Fatal("wrong session accepted", err)
+		}
+	}
+
+	// the dialer reads the refusal of the listener
+	l.SetAcceptBacklog(1, BacklogReject)
+	first := dial()
+	defer first.Close()
+	waitFor(first)
+	before := atomic.LoadUint64(&DefaultSnmp.AcceptOverflows)
+	refused := dial()
+	defer refused.Close()
+	refused.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := refused.Read(make([]byte, 10)); err != errConnRefused {
+		t.Fatal("session not refused", err)
+	}
+	if _, err := refused.Write([]byte("hello")); err != errConnRefused {
+		t.Fatal("refused session writable", err)
+	}
+	if atomic.LoadUint64(&DefaultSnmp.AcceptOverflows) == before {
+		t.Fatal("overflow not counted")
+	}
+
+	// the session waiting the longest makes room
+	l.SetAcceptBacklog(1, BacklogDropOldest)
+	newer := dial()
+	defer newer.Close()
+	waitFor(newer)
+	accept(newer)
+
+	// the new session gets in once there's room
+	l.SetAcceptBacklog(1, BacklogDropNew)
+	held := dial()
+	defer held.Close()
+	waitFor(held)
+	before = atomic.LoadUint64(&DefaultSnmp.AcceptOverflows)
+	late := dial()
+	defer late.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadUint64(&DefaultSnmp.AcceptOverflows) == before {
+		if time.Now().After(deadline) {
+			t.Fatal("overflow not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	accept(held)
+	accept(late)
+}
+
+func TestResetTag(t *testing.T) {
+	// a listener which only reads the packets of the dialer
+	srv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9921})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	cli, err := DialWithOptions("127.0.0.1:9921", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.RequestConv(); err != nil {
+		t.Fatal(err)
+	}
+	cli.Write([]byte("hello"))
+	buf := make([]byte, mtuLimit)
+	srv.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, from, err := srv.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reset := func(tag uint64) {
+		pkt := make([]byte, 64)
+		binary.LittleEndian.PutUint32(pkt, resetMagic)
+		binary.LittleEndian.PutUint64(pkt[8:], tag)
+		srv.WriteToUDP(pkt, from)
+	}
+
+	// a blind reset of the conv 0 of the dialer is ignored
+	reset(cookieTag(buf[:n]) + 1)
+	time.Sleep(100 * time.Millisecond)
+	if _, err := cli.Write([]byte("hello")); err != nil {
+		t.Fatal("dialer closed by a blind reset", err)
+	}
+
+	// the reset answering its packet closes it
+	reset(cookieTag(buf[:n]))
+	cli.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := cli.Read(buf); err != errConnRefused {
+		t.Fatal("session not refused", err)
+	}
+}
+
+func TestMessages(t *testing.T) {
+	const addr = "127.0.0.1:9969"
+	l, err := ListenWithOptions(addr, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	eof := make(chan error, 1)
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s.SetNoDelay(1, 10, 2, 1)
+		for {
+			msg, err := s.ReadMessage()
+			if err != nil {
+				eof <- err
+				return
+			}
+			s.WriteMessage(msg)
+		}
+	}()
+
+	cli, err := DialWithOptions(addr, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := cli.WriteMessage(nil); err != errMessageSize {
+		t.Fatal("empty message written", err)
+	}
+	if err := cli.WriteMessage(make([]byte, maxFragments*int(cli.kcp.mss)+1)); err != errMessageSize {
+		t.Fatal("message beyond 255 segments written", err)
+	}
+	cli.SetStreamMode(true)
+	if err := cli.WriteMessage([]byte("hello")); err != errStreamMode {
+		t.Fatal("message written in stream mode", err)
+	}
+	cli.SetStreamMode(false)
+
+	// the messages arrive whole, however the segments split them, even
+	// beyond the default window
+	sizes := []int{1, int(cli.kcp.mss), int(cli.kcp.mss) + 1, 5000, 100000, maxFragments * int(cli.kcp.mss)}
+	msgs := make([][]byte, len(sizes))
+	for k, size := range sizes {
+		msgs[k] = make([]byte, size)
+		crand.Read(msgs[k])
+		if err := cli.WriteMessage(msgs[k]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for k := range msgs {
+		msg, err := cli.ReadMessage()
+		if err != nil || !bytes.Equal(msg, msgs[k]) {
+			t.Fatal("message mismatch", len(msg), sizes[k], err)
+		}
+	}
+
+	cli.CloseWrite()
+	select {
+	case err := <-eof:
+		if err != io.EOF {
+			t.Fatal("want io.EOF", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("eof not read")
+	}
+}
+
+func TestWriteBuffers(t *testing.T) {
+	const addr = "127.0.0.1:9968"
+	l, err := ListenWithOptions(addr, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s.SetWindowSize(1024, 1024)
+		s.SetNoDelay(1, 10, 2, 1)
+		io.Copy(s, s)
+	}()
+
+	cli, err := DialWithOptions(addr, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetWindowSize(1024, 1024)
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+
+	// buffers straddling the segments, empty ones, and one larger than a
+	// write of 255 segments
+	bufs := net.Buffers{[]byte("hello"), nil, make([]byte, 3000), []byte{}, make([]byte, 400*1024), []byte("world")}
+	crand.Read(bufs[2])
+	crand.Read(bufs[4])
+	var want []byte
+	var sizes []int
+	for _, b := range bufs {
+		want = append(want, b...)
+		sizes = append(sizes, len(b))
+	}
+	for _, stream := range []bool{false, true} {
+		cli.SetStreamMode(stream)
+		n, err := cli.WriteBuffers(bufs)
+		if err != nil || n != len(want) {
+			t.Fatal("short write", n, err)
+		}
+		echo := make([]byte, len(want))
+		if _, err := io.ReadFull(cli, echo); err != nil || !bytes.Equal(echo, want) {
+			t.Fatal("echo mismatch, stream mode", stream, err)
+		}
+	}
+	for k := range bufs {
+		if len(bufs[k]) != sizes[k] {
+			t.Fatal("buffers consumed")
+		}
+	}
+}
+
+func TestRequestConv(t *testing.T) {
+	const addr = "127.0.0.1:9967"
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	l, err := ListenWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *UDPSession, 2)
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- s
+			go io.Copy(s, s)
+		}
+	}()
+
+	convs := make(map[uint32]bool)
+	for i := 0; i < 2; i++ {
+		cli, err := DialWithOptions(addr, block, 10, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		if err := cli.RequestConv(); err != nil {
+			t.Fatal(err)
+		}
+		if cli.GetConv() != 0 {
+			t.Fatal("conv before assignment", cli.GetConv())
+		}
+		cli.SetDeadline(time.Now().Add(5 * time.Second))
+		for _, msg := range []string{"hello", "world"} {
+			buf := make([]byte, len(msg))
+			cli.Write([]byte(msg))
+			if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != msg {
+				t.Fatal("echo mismatch", string(buf), err)
+			}
+		}
+		s := <-accepted
+		if cli.GetConv() == 0 || cli.GetConv() != s.GetConv() || convs[cli.GetConv()] {
+			t.Fatal("conv not assigned", cli.GetConv(), s.GetConv())
+		}
+		convs[cli.GetConv()] = true
+		if err := cli.RequestConv(); err != errConvRequest {
+			t.Fatal("conv requested after sending", err)
+		}
+	}
+
+	cli, err := DialWithOptions(addr, NewConvCrypt(1, block), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.RequestConv(); err != errConvRequest {
+		t.Fatal("conv requested with a ConvCrypt", err)
+	}
+}
+
+func TestWriteBackpressure(t *testing.T) {
+	// nothing is acknowledged by a dead address
+	dead, err := DialWithOptions("127.0.0.1:9965", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	mss := int(dead.kcp.mss)
+	full := dead.WriteAvailable()
+	if full != 2*int(dead.kcp.snd_wnd)*mss {
+		t.Fatal("available on an idle session", full)
+	}
+	dead.Write(make([]byte, 10*mss))
+	if available := dead.WriteAvailable(); available != full-10*mss {
+		t.Fatal("available after writing 10 segments", available)
+	}
+
+	const addr = "127.0.0.1:9966"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(io.Discard, s)
+	}()
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	drained := make(chan struct{}, 16)
+	cli.SetWriteWatermark(8, func() { drained <- struct{}{} })
+	cli.Write(make([]byte, 40*mss))
+	select {
+	case <-drained:
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain not notified")
+	}
+	if cli.WaitSnd() >= 8 {
+		t.Fatal("drain notified above the watermark", cli.WaitSnd())
+	}
+	select {
+	case <-drained:
+		t.Fatal("drain notified twice")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestSetMtuLive(t *testing.T) {
+	const addr = "127.0.0.1:9964"
+	l, err := ListenWithOptions(addr, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s.SetNoDelay(1, 10, 2, 1)
+		io.Copy(s, s)
+	}()
+
+	cli, err := DialWithOptions(addr, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetStreamMode(true)
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+	if err := cli.SetMtu(mtuLimit + 1); err != errMTU {
+		t.Fatal("mtu beyond the buffers", err)
+	}
+	if err := cli.SetMtu(cli.headerSize + 49); err != errMTU {
+		t.Fatal("mtu below the kcp minimum", err)
+	}
+	if err := cli.SetFECShardSize(1200); err != nil {
+		t.Fatal(err)
+	}
+
+	// the data queued behind the window is cut again by the new mss
+	data := make([]byte, 512*1024)
+	crand.Read(data)
+	echo := make([]byte, len(data))
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(cli, echo)
+		done <- err
+	}()
+	cli.Write(data)
+	if err := cli.SetMtu(600); err != nil {
+		t.Fatal(err)
+	}
+	cli.mu.Lock()
+	mss, oversized := int(cli.kcp.mss), 0
+	for _, seg := range cli.kcp.snd_queue {
+		if len(seg.data) > mss {
+			oversized++
+		}
+	}
+	spanSize, spanLimit := cli.fecTx.spanSize, cli.spanLimit()
+	cli.mu.Unlock()
+	if oversized > 0 {
+		t.Fatal("queued segments beyond the mss", oversized)
+	}
+	if spanSize > spanLimit {
+		t.Fatal("fec shards beyond the mtu", spanSize)
+	}
+	if err := <-done; err != nil || !bytes.Equal(data, echo) {
+		t.Fatal("echo mismatch", err)
+	}
+
+	// the messages keep their frg count down, the ones needing more than
+	// 255 segments keep theirs
+	kcp := NewKCP(1, func([]byte, int) {})
+	kcp.SetMtu(1000)
+	kcp.Send(make([]byte, 2500))
+	kcp.Send(make([]byte, 255*int(kcp.mss)))
+	kcp.SetMtu(600)
+	var frgs []uint32
+	for _, seg := range kcp.snd_queue[:6] {
+		frgs = append(frgs, seg.frg)
+	}
+	if fmt.Sprint(frgs) != "[4 3 2 1 0 254]" || len(kcp.snd_queue) != 5+255 {
+		t.Fatal("messages split wrong", frgs, len(kcp.snd_queue))
+	}
+}
+
+func TestUnreliable(t *testing.T) {
+	const addr = "127.0.0.1:9963"
+	block, _ := NewAESBlockCrypt(pbkdf2.Key([]byte("datagram"), []byte(salt), 4096, 32, sha1.New))
+	l, err := ListenWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go io.Copy(s, s)
+		for {
+			b, err := s.ReadUnreliable()
+			if err != nil {
+				return
+			}
+			s.SendUnreliable(b)
+		}
+	}()
+
+	cli, err := DialWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if err := cli.SendUnreliable(nil); err != errDatagramSize {
+		t.Fatal("empty datagram", err)
+	}
+	if err := cli.SendUnreliable(make([]byte, IKCP_MTU_DEF)); err != errDatagramSize {
+		t.Fatal("datagram beyond the mtu", err)
+	}
+
+	// the datagrams open the session, and share it with the stream
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < 10; i++ {
+		if err := cli.SendUnreliable([]byte(fmt.Sprint("datagram ", i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := cli.Write([]byte("stream")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		b, err := cli.ReadUnreliable()
+		if err != nil || string(b) != fmt.Sprint("datagram ", i) {
+			t.Fatal("datagram lost", i, string(b), err)
+		}
+	}
+	buf := make([]byte, 6)
+	if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != "stream" {
+		t.Fatal("stream mixed with the datagrams", string(buf), err)
+	}
+
+	// datagrams shorter than a kcp header are padded, the longest fill the mtu
+	largest := make([]byte, int(cli.kcp.mss)+IKCP_OVERHEAD-datagramHeaderSize)
+	for i := range largest {
+		largest[i] = byte(i)
+	}
+	for _, b := range [][]byte{{0}, []byte("x"), make([]byte, IKCP_OVERHEAD-datagramHeaderSize), largest} {
+		if err := cli.SendUnreliable(b); err != nil {
+			t.Fatal(len(b), err)
+		}
+		if echo, err := cli.ReadUnreliable(); err != nil || !bytes.Equal(echo, b) {
+			t.Fatal("datagram mangled", len(b), len(echo), err)
+		}
+	}
+	if err := cli.SendUnreliable(append(largest, 0)); err != errDatagramSize {
+		t.Fatal("datagram beyond the mtu", err)
+	}
+
+	cli.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := cli.ReadUnreliable(); err != errTimeout {
+		t.Fatal("want a timeout error", err)
+	}
+}
+
+// stallConn is a socket whose writes block until released
+type stallConn struct {
+	net.PacketConn
+	release chan struct{}
+}
+
+func (c *stallConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	<-c.release
+	return len(p), nil
+}
+
+func TestUnreliableDrop(t *testing.T) {
+	// datagrams are dropped rather than queued behind a stalled socket
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &stallConn{udp, make(chan struct{})}
+	raddr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:9922")
+	s, err := NewConn(raddr, nil, 0, 0, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	defer s.Close()
+	defer close(conn.release)
+
+	drops := atomic.LoadUint64(&DefaultSnmp.DatagramDrops)
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < txQueueLimit+100; i++ {
+			if err := s.SendUnreliable([]byte("datagram")); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("SendUnreliable blocked on a full output queue")
+	}
+	if n := atomic.LoadUint64(&DefaultSnmp.DatagramDrops) - drops; n < 50 {
+		t.Fatal("drops not counted", n)
+	}
+}
+
+func TestWritePriority(t *testing.T) {
+	// the rest of a message partly sent keeps its place, the writes queue
+	// by priority behind it
+	kcp := NewKCP(1, func([]byte, int) {})
+	kcp.nocwnd = 1
+	kcp.WndSize(2, 32)
+	kcp.sendBuffers(&buffersReader{bufs: [][]byte{make([]byte, 3*kcp.mss)}}, 3*int(kcp.mss), PriorityLow)
+	kcp.Update(currentMs())
+	for _, prio := range []int32{PriorityNormal, PriorityLow, PriorityHigh} {
+		kcp.sendBuffers(&buffersReader{bufs: [][]byte{make([]byte, 10)}}, 10, prio)
+	}
+	var prios []int32
+	for _, seg := range kcp.snd_queue {
+		prios = append(prios, seg.prio)
+	}
+	if fmt.Sprint(prios) != "[-1 1 0 -1]" {
+		t.Fatal("segments queued out of priority", prios)
+	}
+
+	const addr = "127.0.0.1:9962"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	const bulk = 200
+	urgentAt := make(chan int, 1)
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		for i := 0; i <= bulk; i++ {
+			msg, err := s.ReadMessage()
+			if err != nil {
+				return
+			}
+			if string(msg) == "urgent" {
+				urgentAt <- i
+			}
+		}
+	}()
+
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if _, err := cli.WritePriority([]byte("urgent"), PriorityHigh+1); err != errPriority {
+		t.Fatal("priority out of range", err)
+	}
+	mss := int(cli.kcp.mss)
+	go func() {
+		for i := 0; i < bulk; i++ {
+			cli.Write(make([]byte, mss))
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if _, err := cli.WritePriority([]byte("urgent"), PriorityHigh); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case i := <-urgentAt:
+		if i == bulk {
+			t.Fatal("urgent message overtaken by the bulk transfer")
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("urgent message lost")
+	}
+}
+
+func TestSessionEvents(t *testing.T) {
+	const addr = "127.0.0.1:9961"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	events := make(chan string, 16)
+	record := func(name string) func(*UDPSession) {
+		return func(*UDPSession) { events <- name }
+	}
+	l.SetEventHandler(SessionEvents{Established: record("accepted"), Closed: record("server closed")})
+	accepted := make(chan *UDPSession, 1)
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- s
+		io.Copy(s, s)
+	}()
+
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetEventHandler(SessionEvents{
+		Established: record("established"),
+		Closed:      record("closed"),
+		RTOSpike:    func(*UDPSession, time.Duration) { events <- "spike" },
+		Recovered:   record("recovered"),
+	})
+	expect := func(want ...string) {
+		t.Helper()
+		got := make(map[string]bool)
+		for range want {
+			select {
+			case name := <-events:
+				got[name] = true
+			case <-time.After(5 * time.Second):
+				t.Fatal("events missing", want, got)
+			}
+		}
+		for _, name := range want {
+			if !got[name] {
+				t.Fatal("event missing", name, got)
+			}
+		}
+	}
+	cli.Write([]byte("hello"))
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(cli, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	(<-accepted).Close()
+	expect("accepted", "established", "server closed")
+
+	// the rto doubling is a spike, until it falls back
+	cli.mu.Lock()
+	rto := cli.kcp.rx_rto
+	cli.kcp.rx_rto = 4 * cli.rtoBase
+	cli.mu.Unlock()
+	expect("spike")
+	cli.mu.Lock()
+	cli.kcp.rx_rto = rto
+	cli.mu.Unlock()
+	expect("recovered")
+	cli.Close()
+	expect("closed")
+
+	// nothing is acknowledged by a dead address
+	dead, err := DialWithOptions("127.0.0.1:9960", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dead.Close()
+	dead.SetNoDelay(1, 10, 2, 1)
+	dead.mu.Lock()
+	dead.kcp.dead_link = 2
+	dead.mu.Unlock()
+	dead.SetEventHandler(SessionEvents{DeadLink: record("dead")})
+	dead.Write([]byte("hello"))
+	expect("dead")
+}
+
+func TestListenerLimits(t *testing.T) {
+	const addr = "127.0.0.1:9959"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if l.SetMaxSessions(-1) != errLimitParams || l.SetConnRate(1, 0) != errLimitParams {
+		t.Fatal("invalid limits accepted")
+	}
+	accepted := make(chan *UDPSession, 4)
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- s
+		}
+	}()
+	dial := func() {
+		t.Helper()
+		cli, err := DialWithOptions(addr, nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { cli.Close() })
+		cli.SetNoDelay(1, 10, 2, 1)
+		cli.Write([]byte("hello"))
+	}
+	accept := func(want bool) *UDPSession {
+		t.Helper()
+		select {
+		case s := <-accepted:
+			if !want {
+				t.Fatal("session beyond the limits accepted")
+			}
+			return s
+		case <-time.After(300 * time.Millisecond):
+			if want {
+				t.Fatal("session not accepted")
+			}
+		}
+		return nil
+	}
+
+	// a session closing makes room for the one turned away
+	l.SetMaxSessions(1)
+	overflows := atomic.LoadUint64(&DefaultSnmp.SessionOverflows)
+	dial()
+	first := accept(true)
+	dial()
+	accept(false)
+	if atomic.LoadUint64(&DefaultSnmp.SessionOverflows) == overflows {
+		t.Fatal("session overflow not counted")
+	}
+	first.Close()
+	accept(true)
+
+	// the bucket of the IP holds a single session
+	l.SetMaxSessions(0)
+	l.SetConnRate(1, 1)
+	drops := atomic.LoadUint64(&DefaultSnmp.RateLimitDrops)
+	dial()
+	accept(true)
+	dial()
+	if accept(false); atomic.LoadUint64(&DefaultSnmp.RateLimitDrops) == drops {
+		t.Fatal("rate limit drop not counted")
+	}
+	select {
+	case <-accepted: // once the bucket refilled
+	case <-time.After(3 * time.Second):
+		t.Fatal("session not accepted once the bucket refilled")
+	}
+
+	// the token is charged once the session is created, and a full table
+	// of buckets is pruned by a batch
+	remote := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1}
+	var admitted []bool
+	var buckets int
+	l.admin(func() {
+		admitted = append(admitted, l.limit(remote), l.limit(remote))
+		l.spend(remote)
+		admitted = append(admitted, l.limit(remote))
+		now := time.Now()
+		for i := len(l.rateBuckets); i < rateBucketsLimit; i++ {
+			l.rateBuckets[fmt.Sprint("bucket", i)] = &tokenBucket{last: now}
+		}
+		l.limit(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1})
+		buckets = len(l.rateBuckets)
+	})
+	if !admitted[0] || !admitted[1] || admitted[2] {
+		t.Fatal("tokens charged", admitted)
+	}
+	if buckets > rateBucketsLimit-rateBucketsPrune+1 {
+		t.Fatal("buckets after pruning", buckets)
+	}
+}
+
+func TestConnFilter(t *testing.T) {
+	const addr = "127.0.0.1:9958"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetConnFilter(func(remote net.Addr, conv uint32) bool {
+		return remote.(*net.UDPAddr).IP.IsLoopback() && conv%2 == 0
+	})
+	accepted := make(chan uint32, 4)
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- s.GetConv()
+		}
+	}()
+
+	var denied, allowed *UDPSession
+	for allowed == nil || denied == nil {
+		cli, err := DialWithOptions(addr, nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cli.Close()
+		if cli.GetConv()%2 == 0 && allowed == nil {
+			allowed = cli
+		} else if cli.GetConv()%2 == 1 && denied == nil {
+			denied = cli
+		}
+	}
+	denied.Write([]byte("hello"))
+	allowed.Write([]byte("hello"))
+	select {
+	case conv := <-accepted:
+		if conv != allowed.GetConv() {
+			t.Fatal("conversation refused by the filter accepted", conv)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("conversation allowed by the filter not accepted")
+	}
+	select {
+	case conv := <-accepted:
+		t.Fatal("conversation refused by the filter accepted", conv)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// the packets of refused remotes aren't decrypted
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewSalsa20BlockCrypt(pass)
+	counted := &countingCrypt{BlockCrypt: block}
+	sealed, err := ListenWithOptions("127.0.0.1:9929", counted, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sealed.Close()
+	filtered := make(chan uint32, 1)
+	sealed.SetConnFilter(func(remote net.Addr, conv uint32) bool {
+		filtered <- conv
+		return false
+	})
+	cli, err := DialWithOptions("127.0.0.1:9929", block, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Write([]byte("hello"))
+	select {
+	case conv := <-filtered:
+		if conv != 0 {
+			t.Fatal("conv of an encrypted packet", conv)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("filter not called")
+	}
+	if n := atomic.LoadInt32(&counted.decrypts); n != 0 {
+		t.Fatal("refused packets decrypted", n)
+	}
+}
+
+// countingCrypt counts the packets a crypt decrypts
+type countingCrypt struct {
+	BlockCrypt
+	decrypts int32
+}
+
+func (c *countingCrypt) Decrypt(dst, src []byte) {
+	atomic.AddInt32(&c.decrypts, 1)
+	c.BlockCrypt.Decrypt(dst, src)
+}
+
+func TestListenerSessions(t *testing.T) {
+	const addr = "127.0.0.1:9957"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *UDPSession, 2)
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- s
+			go io.Copy(s, s)
+		}
+	}()
+
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	cli.Write([]byte("hello"))
+	if _, err := io.ReadFull(cli, make([]byte, 5)); err != nil {
+		t.Fatal(err)
+	}
+	if info := cli.Info(); info.BytesSent != 5 || info.BytesReceived != 5 {
+		t.Fatal("session info", info)
+	}
+
+	infos := l.Sessions()
+	if len(infos) != 1 {
+		t.Fatal("sessions listed", infos)
+	}
+	info := infos[0]
+	if info.Conv != cli.GetConv() || info.RemoteAddr.(*net.UDPAddr).Port != cli.LocalAddr().(*net.UDPAddr).Port ||
+		info.BytesReceived != 5 || info.Age <= 0 {
+		t.Fatal("listener session info", info)
+	}
+
+	// the kicked remote reads an eof, the session lingers until the eof of
+	// the remote, dropping what the remote still writes rather than letting
+	// it open a fresh session
+	if err := l.CloseSession(cli.GetConv() + 1); err != errNoSession {
+		t.Fatal("unknown conv closed", err)
+	}
+	if err := l.CloseSession(cli.GetConv()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Read(make([]byte, 5)); err != io.EOF {
+		t.Fatal("kicked remote read", err)
+	}
+	<-accepted
+	if _, err := cli.Write([]byte("late")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	if len(l.Sessions()) != 1 {
+		t.Fatal("kicked session stopped before the eof of the remote")
+	}
+	cli.Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(l.Sessions()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session closed still listed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case <-accepted:
+		t.Fatal("kicked remote opened a fresh session")
+	case <-time.After(300 * time.Millisecond):
+	}
+	l.Close()
+	if l.Sessions() != nil || l.CloseSession(cli.GetConv()) != errNoSession {
+		t.Fatal("closed listener administered")
+	}
+}
+
+// pipeAddr is the address of an end of a packet pipe
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn is an end of an in-process packet pipe, the packets written while
+// the other end lags are dropped like datagrams
+type pipeConn struct {
+	local, remote pipeAddr
+	in, out       chan []byte
+	die           chan struct{}
+	once          sync.Once
+}
+
+func packetPipe() (*pipeConn, *pipeConn) {
+	a, b := make(chan []byte, 1024), make(chan []byte, 1024)
+	return &pipeConn{local: "a", remote: "b", in: a, out: b, die: make(chan struct{})},
+		&pipeConn{local: "b", remote: "a", in: b, out: a, die: make(chan struct{})}
+}
+
+func (c *pipeConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case b := <-c.in:
+		return copy(p, b), c.remote, nil
+	case <-c.die:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *pipeConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.die:
+		return 0, net.ErrClosed
+	default:
+	}
+	select {
+	case c.out <- append([]byte(nil), p...):
+	default:
+	}
+	return len(p), nil
+}
+
+func (c *pipeConn) Close() error {
+	c.once.Do(func() { close(c.die) })
+	return nil
+}
+
+func (c *pipeConn) LocalAddr() net.Addr                { return c.local }
+func (c *pipeConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pipeConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pipeConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestPacketConn(t *testing.T) {
+	a, b := packetPipe()
+	block, _ := NewAESBlockCrypt(pbkdf2.Key([]byte("pipe"), []byte(salt), 4096, 32, sha1.New))
+	l, err := ServeConn(block, 10, 3, a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	remotes := make(chan net.Addr, 1)
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		remotes <- s.RemoteAddr()
+		s.SetNoDelay(1, 10, 2, 1)
+		s.SetDSCP(46) // no ip header to mark
+		io.Copy(s, s)
+	}()
+
+	cli, err := NewConn(pipeAddr("a"), block, 10, 3, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetStreamMode(true)
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+	data := make([]byte, 256*1024)
+	crand.Read(data)
+	go cli.Write(data)
+	echo := make([]byte, len(data))
+	if _, err := io.ReadFull(cli, echo); err != nil || !bytes.Equal(data, echo) {
+		t.Fatal("echo mismatch", err)
+	}
+	if remote := <-remotes; remote.String() != "b" || cli.RemoteAddr().String() != "a" {
+		t.Fatal("pipe addresses", remote, cli.RemoteAddr())
+	}
+
+	// the session closes the conn it owns once it stopped lingering
+	cli.Close()
+	select {
+	case <-cli.done:
+	case <-time.After(2 * closeLinger):
+		t.Fatal("session still lingering")
+	}
+	if _, err := b.WriteTo(nil, pipeAddr("a")); err != net.ErrClosed {
+		t.Fatal("conn left open", err)
+	}
+}
+
+func TestDialWithLocalAddr(t *testing.T) {
+	const addr = "127.0.0.1:9956"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	remotes := make(chan net.Addr, 2)
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			remotes <- s.RemoteAddr()
+		}
+	}()
+
+	var loopback string
+	ifaces, _ := net.Interfaces()
+	for _, ifi := range ifaces {
+		if ifi.Flags&net.FlagLoopback != 0 {
+			loopback = ifi.Name
+		}
+	}
+	for _, laddr := range []string{"127.0.0.1:9955", loopback} {
+		cli, err := DialWithLocalAddr(laddr, addr, nil, 0, 0)
+		if err != nil {
+			t.Fatal(laddr, err)
+		}
+		defer cli.Close()
+		cli.Write([]byte("hello"))
+		select {
+		case remote := <-remotes:
+			if ip := remote.(*net.UDPAddr).IP; !ip.Equal(net.IPv4(127, 0, 0, 1)) || remote.String() != cli.LocalAddr().String() {
+				t.Fatal("dialed from", remote, cli.LocalAddr())
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("session not accepted", laddr)
+		}
+	}
+	if _, err := DialWithLocalAddr("nosuchif0", addr, nil, 0, 0); err == nil {
+		t.Fatal("dialed from an unknown interface")
+	}
+}
+
+func TestReconnectingConn(t *testing.T) {
+	const addr = "127.0.0.1:9954"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ReconnectConfig{Timeout: 10 * time.Second, Idle: 2 * time.Second, Window: 256 * 1024}
+	rl, err := ListenReconnecting(l, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+	echoed := make(chan error, 1)
+	go func() {
+		c, err := rl.Accept()
+		if err != nil {
+			echoed <- err
+			return
+		}
+		_, err = io.Copy(c, c)
+		c.Close()
+		echoed <- err
+	}()
+
+	var dials int32
+	cli, err := DialReconnecting(func() (*UDPSession, error) {
+		atomic.AddInt32(&dials, 1)
+		s, err := DialWithOptions(addr, nil, 0, 0)
+		if err == nil {
+			s.SetNoDelay(1, 10, 2, 1)
+		}
+		return s, err
+	}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := make([]byte, 2*1024*1024)
+	crand.Read(data)
+	go cli.Write(data)
+
+	// the sessions die in the middle of the transfer
+	echo := make([]byte, len(data))
+	for n, cut := 0, len(data)/4; n < len(data); {
+		m, err := cli.Read(echo[n:])
+		if err != nil {
+			t.Fatal(n, err)
+		}
+		if n += m; n >= cut && cut < len(data) {
+			cli.mu.Lock()
+			s := cli.sess
+			cli.mu.Unlock()
+			if s != nil {
+				s.Close()
+			}
+			cut += len(data) / 4
+		}
+	}
+	if !bytes.Equal(data, echo) {
+		t.Fatal("echo mismatch")
+	}
+	if n := atomic.LoadInt32(&dials); n < 4 {
+		t.Fatal("sessions dialed", n)
+	}
+
+	// the remote reads an eof after the data, Close returned once the fin
+	// was acknowledged or the session given up
+	cli.Close()
+	select {
+	case err := <-echoed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(config.Timeout):
+		t.Fatal("no eof")
+	}
+	if _, err := cli.Write([]byte("closed")); err == nil {
+		t.Fatal("write after close")
+	}
+}
+
+func TestCloseUnblocks(t *testing.T) {
+	// nothing acknowledges the data sent to nowhere, the writes block once
+	// the window is full and the reads never get data
+	for round := 0; round < 20; round++ {
+		cli, err := DialWithOptions("127.0.0.1:9953", nil, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.SetWindowSize(4, 4)
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				buf := make([]byte, 4096)
+				for {
+					if _, err := cli.Read(buf); err != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				buf := make([]byte, 4096)
+				for {
+					if _, err := cli.Write(buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		// exactly one of the concurrent closes succeeds
+		var closes int32
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if cli.Close() == nil {
+					atomic.AddInt32(&closes, 1)
+				}
+			}()
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("calls blocked after close")
+		}
+		if closes != 1 {
+			t.Fatal("closes succeeded", closes)
+		}
+		if _, err := cli.Read(make([]byte, 10)); err != errBrokenPipe {
+			t.Fatal("read after close", err)
+		}
+	}
+
+	// a deadline passing wakes the blocked reads and writes alike
+	cli, err := DialWithOptions("127.0.0.1:9953", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetWindowSize(4, 4)
+	errs := make(chan error, 8)
+	for i := 0; i < 4; i++ {
+		go func() {
+			buf := make([]byte, 4096)
+			for {
+				if _, err := cli.Read(buf); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+		go func() {
+			buf := make([]byte, 4096)
+			for {
+				if _, err := cli.Write(buf); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond)
+	cli.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	for i := 0; i < 8; i++ {
+		select {
+		case err := <-errs:
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatal("want a timeout", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("calls blocked after the deadline")
+		}
+	}
+}
+
+func TestDialConnected(t *testing.T) {
+	const addr = "127.0.0.1:9952"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(s, s)
+	}()
+	cli, err := DialConnected(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	cli.Write([]byte("hello"))
+	if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("echo mismatch", err)
+	}
+
+	// a single icmp error, which may be forged, is not enough
+	if cli.unreachable(syscall.ECONNREFUSED) {
+		t.Fatal("closed on a single icmp error")
+	}
+	cli.Write([]byte("hello"))
+	if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("echo mismatch", err)
+	}
+
+	// the port is closed, the session fails on the icmp errors
+	l.Close()
+	start := time.Now()
+	for err == nil {
+		_, err = cli.Write([]byte("hello"))
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatal("want connection refused", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatal("failure detected late", elapsed)
+	}
+	if _, err := cli.Read(buf); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatal("want connection refused", err)
+	}
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	const addr = "127.0.0.1:9951"
+	l, err := ListenWithOptions(addr, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			s, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(s, s)
+		}
+	}()
+
+	// nothing answers on the first address, the second one wins
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	cli, err := DialHappyEyeballs(ctx, []string{"127.0.0.1:9950", addr}, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.RemoteAddr().String() != addr {
+		t.Fatal("dialed", cli.RemoteAddr())
+	}
+	cli.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	cli.Write([]byte("hello"))
+	if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != "hello" {
+		t.Fatal("echo mismatch", err)
+	}
+
+	// the context bounds the race
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if _, err := DialHappyEyeballs(ctx, []string{"127.0.0.1:9950"}, nil, 0, 0); err != context.DeadlineExceeded {
+		t.Fatal("want a deadline error", err)
+	}
+	if _, err := DialHappyEyeballs(context.Background(), nil, nil, 0, 0); err != errNoAddress {
+		t.Fatal("dialed no address", err)
+	}
+}
+
+func TestReadFromWriteTo(t *testing.T) {
+	const addr = "127.0.0.1:9949"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		s.SetNoDelay(1, 10, 2, 1)
+		io.Copy(s, s) // WriteTo to the session itself
+		s.CloseWrite()
+	}()
+
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetDeadline(time.Now().Add(10 * time.Second))
+	data := make([]byte, 1024*1024+1)
+	crand.Read(data)
+	go func() {
+		if n, err := cli.ReadFrom(bytes.NewReader(data)); err != nil || n != int64(len(data)) {
+			t.Error("read from", n, err)
+		}
+		cli.CloseWrite()
+	}()
+	var echo bytes.Buffer
+	if n, err := cli.WriteTo(&echo); err != nil || n != int64(len(data)) {
+		t.Fatal("write to", n, err)
+	}
+	if !bytes.Equal(echo.Bytes(), data) {
+		t.Fatal("echo mismatch")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	const addr = "127.0.0.1:9948"
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, err := NewSessionCrypt("aes-gcm", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := ListenWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted := make(chan *UDPSession, 1)
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- s
+		io.Copy(s, s)
+	}()
+	cli, err := DialWithOptions(addr, block, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo := func(cli *UDPSession, msg string) {
+		cli.SetDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, len(msg))
+		cli.Write([]byte(msg))
+		if _, err := io.ReadFull(cli, buf); err != nil || string(buf) != msg {
+			t.Fatal("echo mismatch", msg, err)
+		}
+	}
+	echo(cli, "hello")
+
+	// the dialer moves with its socket
+	f, err := cli.conn.(*net.UDPConn).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := cli.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cli.Write([]byte("gone")); err == nil {
+		t.Fatal("write after export")
+	}
+	conn, err := net.FilePacketConn(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli, err = ImportConn(state, block, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	// the nonces continue, and the nonces of the remote aren't received again
+	st, _, _ := decodeState(state)
+	nc := nonceMoverOf(cli.block, 0)
+	if salt, counter := nc.NonceState(); !bytes.Equal(salt, st.Salt) || counter != st.Counter || st.Counter == 0 {
+		t.Fatal("nonces not restored")
+	}
+	if st.Replay == nil || nc.replay(st.Replay.Salt) == nil {
+		t.Fatal("replay window not restored")
+	}
+	echo(cli, "hello again")
+
+	// the listener moves with its socket, then its session
+	s := <-accepted
+	if f, err = l.conn.(*net.UDPConn).File(); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	if state, err = s.Export(); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err = net.FilePacketConn(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	l, err = ServeConn(block, 10, 3, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if s, err = l.Import(state, block); err != nil {
+		t.Fatal(err)
+	}
+	go io.Copy(s, s)
+	for i := 0; i < 10; i++ {
+		echo(cli, fmt.Sprintf("hello%v", i))
+	}
+	if l.Sessions()[0].Conv != cli.GetConv() {
+		t.Fatal("conv mismatch")
+	}
+
+	// the keys of a noise handshake move with the session
+	nl, err := ListenWithKeyExchange("127.0.0.1:9925", 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nl.Close()
+	go func() {
+		s, err := nl.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(s, s)
+	}()
+	ncli, err := DialWithKeyExchange("127.0.0.1:9925", 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(ncli, "hello")
+	if f, err = ncli.conn.(*net.UDPConn).File(); err != nil {
+		t.Fatal(err)
+	}
+	if state, err = ncli.Export(); err != nil {
+		t.Fatal(err)
+	}
+	if conn, err = net.FilePacketConn(f); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if ncli, err = ImportConn(state, nil, conn); err != nil {
+		t.Fatal(err)
+	}
+	defer ncli.Close()
+	echo(ncli, "hello again")
+}
+
+func TestListenerStreamMode(t *testing.T) {
+	const addr = "127.0.0.1:9947"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	streamCli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer streamCli.Close()
+	streamCli.SetStreamMode(true)
+	msgCli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer msgCli.Close()
+	streamPort := streamCli.LocalAddr().(*net.UDPAddr).Port
+	l.SetStreamMode(func(remote net.Addr, conv uint32) bool {
+		return remote.(*net.UDPAddr).Port == streamPort
+	})
+
+	for _, cli := range []*UDPSession{streamCli, msgCli} {
+		cli.SetDeadline(time.Now().Add(5 * time.Second))
+		cli.Write([]byte("hello"))
+		s, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.StreamMode() != cli.StreamMode() {
+			t.Fatal("mode mismatch", cli.StreamMode())
+		}
+		go io.Copy(s, s)
+	}
+
+	// the writes of the stream session merge, the messages stay whole
+	streamCli.Write([]byte(" world"))
+	buf := make([]byte, 11)
+	if _, err := io.ReadFull(streamCli, buf); err != nil || string(buf) != "hello world" {
+		t.Fatal("stream echo mismatch", string(buf), err)
+	}
+	msgCli.WriteMessage([]byte("a message"))
+	for _, want := range []string{"hello", "a message"} {
+		if msg, err := msgCli.ReadMessage(); err != nil || string(msg) != want {
+			t.Fatal("message echo mismatch", string(msg), err)
+		}
+	}
+}
+
+func TestMaxLifetime(t *testing.T) {
+	const addr = "127.0.0.1:9946"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	expired := make(chan *UDPSession, 1)
+	l.SetMaxLifetime(300*time.Millisecond, func(s *UDPSession) { expired <- s })
+
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Write([]byte("hello"))
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the session expires however active, the remote reads an eof
+	select {
+	case e := <-expired:
+		if e != s {
+			t.Fatal("wrong session expired")
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("session not expired")
+	}
+	if elapsed := time.Since(s.created); elapsed < 300*time.Millisecond {
+		t.Fatal("session expired early", elapsed)
+	}
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cli.Read(make([]byte, 10)); err != io.EOF {
+		t.Fatal("want an eof", err)
+	}
+
+	// a session older than its lifetime expires at once
+	done := make(chan struct{})
+	cli.SetMaxLifetime(time.Millisecond, func(*UDPSession) { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("dialer not expired")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := cli.Write([]byte("hello")); err == nil {
+		t.Fatal("write after expiry")
+	}
+
+	// Close stops the timer, which would keep the session reachable
+	other, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.SetMaxLifetime(time.Hour, nil)
+	other.Close()
+	other.mu.Lock()
+	timer := other.lifetime
+	other.mu.Unlock()
+	if timer != nil {
+		t.Fatal("lifetime timer left running")
+	}
+}
+
+func TestCloseDeliversEOF(t *testing.T) {
+	const addr = "127.0.0.1:9945"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan error, 1)
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			received <- err
+			return
+		}
+		s.SetReadDeadline(time.Now().Add(5 * time.Second))
+		data, err := io.ReadAll(s)
+		if err == nil && len(data) != 100000 {
+			err = fmt.Errorf("%v bytes received", len(data))
+		}
+		received <- err
+	}()
+
+	// the data written right before Close and the eof reach the remote
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Write(make([]byte, 100000))
+	start := time.Now()
+	if err := cli.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Fatal("close blocked", elapsed)
+	}
+	select {
+	case err := <-received:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("eof not received")
+	}
+
+	// the session stops once the eof is acknowledged
+	select {
+	case <-cli.done:
+	case <-time.After(time.Second):
+		t.Fatal("session lingering")
+	}
+}
+
+func TestHeaderExtension(t *testing.T) {
+	const addr = "127.0.0.1:9944"
+	tag := []byte("tenant-1")
+	var stripped, rejected uint64
+	writer := func(b []byte) []byte {
+		return append(append([]byte{}, tag...), b...)
+	}
+	reader := func(b []byte) ([]byte, error) {
+		if !bytes.HasPrefix(b, tag) {
+			atomic.AddUint64(&rejected, 1)
+			return nil, errors.New("untagged")
+		}
+		atomic.AddUint64(&stripped, 1)
+		return b[len(tag):], nil
+	}
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	l.SetHeaderExtension(writer, reader)
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		io.Copy(s, s)
+	}()
+
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetHeaderExtension(writer, reader)
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg := []byte("hello")
+	if _, err := cli.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	if _, err := io.ReadFull(cli, buf); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Fatal("echo mismatch", buf)
+	}
+	if atomic.LoadUint64(&stripped) == 0 {
+		t.Fatal("no packet stripped")
+	}
+
+	// the packets without the tag are dropped
+	raw, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+	before := atomic.LoadUint64(&rejected)
+	raw.Write(make([]byte, 64))
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadUint64(&rejected) == before {
+		t.Fatal("untagged packet accepted")
+	}
+}
+
+func TestOptions(t *testing.T) {
+	const addr = "127.0.0.1:9943"
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewAESBlockCrypt(pass)
+	opts := []Option{
+		WithCrypt(block),
+		WithFEC(10, 3),
+		WithWindowSize(512, 512),
+		WithNoDelay(1, 10, 2, 1),
+		WithBuffers(4<<20, 4<<20),
+		WithDSCP(46),
+	}
+	l, err := Listen(addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan *UDPSession, 1)
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		accepted <- s
+		io.Copy(s, s)
+	}()
+
+	cli, err := Dial(addr, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := cli.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(cli, buf); err != nil {
+		t.Fatal(err)
+	}
+	var s *UDPSession
+	select {
+	case s = <-accepted:
+		defer s.Close()
+	case <-time.After(time.Second):
+		t.Fatal("not accepted")
+	}
+	for _, sess := range []*UDPSession{cli, s} {
+		sess.mu.Lock()
+		sndwnd, nodelay, interval := sess.kcp.snd_wnd, sess.kcp.nodelay, sess.kcp.interval
+		sess.mu.Unlock()
+		if sndwnd != 512 || nodelay != 1 || interval != 10 {
+			t.Fatal("options not applied", sndwnd, nodelay, interval)
+		}
+	}
+
+	if _, err := Dial(addr, WithFEC(-1, 3)); err == nil {
+		t.Fatal("invalid fec accepted")
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	const addr = "127.0.0.1:9942"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan []byte, 1)
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		buf := make([]byte, 16)
+		n, err := s.Read(buf)
+		if err == nil {
+			received <- buf[:n]
+		}
+	}()
+
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Pause()
+	if !cli.Paused() {
+		t.Fatal("not paused")
+	}
+	if _, err := cli.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-received:
+		t.Fatal("sent while paused")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	cli.Resume()
+	select {
+	case data := <-received:
+		if string(data) != "hello" {
+			t.Fatal("received", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not sent after resume")
+	}
+}
+
+func TestPausedAcks(t *testing.T) {
+	const addr = "127.0.0.1:9930"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if _, err := cli.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	cli.Pause()
+	if _, err := s.Write([]byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	cli.SetReadDeadline(time.Now().Add(time.Second))
+	if n, err := cli.Read(buf); err != nil || string(buf[:n]) != "world" {
+		t.Fatal("received", buf[:n], err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mu.Lock()
+		waiting := s.kcp.WaitSnd()
+		s.mu.Unlock()
+		if waiting == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("not acknowledged while paused")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionAccessors(t *testing.T) {
+	pass := pbkdf2.Key(key, []byte(salt), 4096, 32, sha1.New)
+	block, _ := NewHeaderCrypt("aes-gcm", pass)
+	cli, err := Dial("127.0.0.1:9941", WithCrypt(block), WithFEC(10, 3), WithNoDelay(1, 20, 2, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	if cli.Conv() != cli.GetConv() {
+		t.Fatal("conv mismatch")
+	}
+	if mss := cli.MSS(); mss <= 0 || mss >= IKCP_MTU_DEF {
+		t.Fatal("mss", mss)
+	}
+	if name := cli.Cipher(); name != "aes-gcm" {
+		t.Fatal("cipher", name)
+	}
+	if d, p := cli.FECParameters(); d != 10 || p != 3 {
+		t.Fatal("fec", d, p)
+	}
+	if nodelay, interval, resend, nc := cli.NoDelay(); nodelay != 1 || interval != 20 || resend != 2 || nc != 1 {
+		t.Fatal("nodelay", nodelay, interval, resend, nc)
+	}
+
+	chacha, err := NewCryptByName("chacha20", pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	psk, err := Dial("127.0.0.1:9941", WithCrypt(chacha))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer psk.Close()
+	if name := psk.Cipher(); name != "chacha20" {
+		t.Fatal("cipher", name)
+	}
+
+	plain, err := Dial("127.0.0.1:9941")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	if name := plain.Cipher(); name != "" {
+		t.Fatal("cipher", name)
+	}
+	if d, p := plain.FECParameters(); d != 0 || p != 0 {
+		t.Fatal("fec", d, p)
+	}
+}
+
+func TestPing(t *testing.T) {
+	const addr = "127.0.0.1:9940"
+	l, err := ListenWithOptions(addr, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		io.Copy(io.Discard, s)
+	}()
+
+	cli, err := DialWithOptions(addr, nil, 10, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Write([]byte("hello"))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rtt, err := cli.Ping(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt <= 0 || rtt > time.Second {
+		t.Fatal("rtt", rtt)
+	}
+
+	// nobody answers
+	lost, err := DialWithOptions("127.0.0.1:9939", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lost.Close()
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if _, err := lost.Ping(ctx); err != context.DeadlineExceeded {
+		t.Fatal("ping of nobody", err)
+	}
+}
+
+// fixedControl is a CongestionControl with a fixed window and pacing rate
+type fixedControl struct {
+	window, rate int
+	acks, losses int64
+}
+
+func (c *fixedControl) OnAck(acked int, rtt time.Duration, inflight int) {
+	atomic.AddInt64(&c.acks, int64(acked))
+}
+
+func (c *fixedControl) OnLoss(lost int, timeout bool, inflight int) {
+	atomic.AddInt64(&c.losses, int64(lost))
+}
+
+func (c *fixedControl) Window() int     { return c.window }
+func (c *fixedControl) PacingRate() int { return c.rate }
+
+func TestCongestionControl(t *testing.T) {
+	const addr = "127.0.0.1:9938"
+	const size = 64 << 10
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	received := make(chan int, 1)
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		n, _ := io.ReadFull(s, make([]byte, size))
+		received <- n
+	}()
+
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cc := &fixedControl{window: 32, rate: 256 << 10}
+	cli.SetCongestionControl(cc)
+	start := time.Now()
+	cli.Write(make([]byte, size))
+	select {
+	case n := <-received:
+		if n != size {
+			t.Fatal("received", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not received")
+	}
+	// 64KiB at 256KiB/s, less the burst of the first interval
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Fatal("not paced", elapsed)
+	}
+	if atomic.LoadInt64(&cc.acks) == 0 {
+		t.Fatal("no ack reported")
+	}
+
+	cli.SetCongestionControl(nil)
+	cli.mu.Lock()
+	_, builtin := cli.kcp.cc.(*renoControl)
+	cli.mu.Unlock()
+	if !builtin {
+		t.Fatal("builtin congestion control not restored")
+	}
+}
+
+// acceptFrom accepts the session of the client at addr, skipping those of
+// the clients of earlier runs still lingering on the address of l
+func acceptFrom(l *Listener, addr net.Addr) (*UDPSession, error) {
+	for {
+		s, err := l.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if s.RemoteAddr().(*net.UDPAddr).Port == addr.(*net.UDPAddr).Port {
+			return s, nil
+		}
+		s.Close()
+	}
+}
+
+func TestBBRControl(t *testing.T) {
+	const addr = "127.0.0.1:9937"
+	const size = 4 << 20
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	received := make(chan int, 1)
+	go func() {
+		s, err := acceptFrom(l, cli.LocalAddr())
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		s.SetNoDelay(1, 10, 2, 0)
+		s.SetWindowSize(1024, 1024)
+		n, _ := io.ReadFull(s, make([]byte, size))
+		received <- n
+	}()
+
+	cli.SetWindowSize(1024, 1024)
+	cli.SetNoDelay(1, 10, 2, 0)
+	cc := NewBBRControl(cli.MSS()).(*bbrControl)
+	cli.SetCongestionControl(cc)
+	go cli.Write(make([]byte, size))
+	select {
+	case n := <-received:
+		if n != size {
+			t.Fatal("received", n)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("not received")
+	}
+
+	cli.mu.Lock()
+	defer cli.mu.Unlock()
+	if cc.btlBw == 0 || cc.rtprop == 0 {
+		t.Fatal("path not measured", cc.btlBw, cc.rtprop)
+	}
+	if cc.Window() < bbrMinWindow || cc.PacingRate() == 0 {
+		t.Fatal("window", cc.Window(), "pacing rate", cc.PacingRate())
+	}
+}
+
+// delayConn delays the packets written by delay, and records when the
+// full-sized ones were first written, by the sn of their segment
+type delayConn struct {
+	net.PacketConn
+	delay time.Duration
+	mu    sync.Mutex
+	sent  map[uint32]time.Time
+}
+
+func (c *delayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if len(p) >= mtuLimit/2 {
+		sn := binary.LittleEndian.Uint32(p[12:])
+		c.mu.Lock()
+		if _, ok := c.sent[sn]; !ok {
+			c.sent[sn] = time.Now()
+		}
+		c.mu.Unlock()
+	}
+	b := append([]byte(nil), p...)
+	time.AfterFunc(c.delay, func() { c.PacketConn.WriteTo(b, addr) })
+	return len(p), nil
+}
+
+func TestPacing(t *testing.T) {
+	const addr = "127.0.0.1:9936"
+	const size = 1 << 20
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	raddr, _ := net.ResolveUDPAddr("udp", addr)
+	udp, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &delayConn{PacketConn: udp, delay: 20 * time.Millisecond, sent: make(map[uint32]time.Time)}
+	cli, err := NewConn(raddr, nil, 0, 0, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	received := make(chan int, 1)
+	go func() {
+		s, err := acceptFrom(l, udp.LocalAddr())
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		s.SetNoDelay(1, 10, 2, 1)
+		s.SetWindowSize(128, 128)
+		n, _ := io.ReadFull(s, make([]byte, size))
+		received <- n
+	}()
+	cli.SetStreamMode(true)
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetWindowSize(128, 128)
+	cli.SetPacing(true)
+	start := time.Now()
+	go cli.Write(make([]byte, size))
+	select {
+	case n := <-received:
+		if n != size {
+			t.Fatal("received", n)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("not received")
+	}
+
+	// a flush sends the window acked meanwhile in a burst without pacing,
+	// the rate of the window over the rtt is a few segments a millisecond
+	conn.mu.Lock()
+	bursts := make(map[int64]int)
+	for _, at := range conn.sent {
+		if elapsed := at.Sub(start); elapsed > 100*time.Millisecond {
+			bursts[elapsed.Milliseconds()]++
+		}
+	}
+	conn.mu.Unlock()
+	if len(bursts) == 0 {
+		t.Fatal("nothing sent after the first rtt")
+	}
+	for ms, n := range bursts {
+		if n > 32 {
+			t.Fatal("not paced,", n, "segments sent at", ms, "ms")
+		}
+	}
+	cli.mu.Lock()
+	rate := cli.kcp.pace_rate
+	cli.mu.Unlock()
+	if rate == 0 {
+		t.Fatal("no pacing rate")
+	}
+
+	cli.SetPacing(false)
+	cli.mu.Lock()
+	rate = cli.kcp.pace_rate
+	cli.mu.Unlock()
+	if rate != 0 {
+		t.Fatal("pacing not disabled")
+	}
+}
+
+func TestHyStart(t *testing.T) {
+	kcp := NewKCP(1, func([]byte, int) {})
+	kcp.WndSize(1024, 1024)
+	c := kcp.cc.(*renoControl)
+	c.hystart = true
+	kcp.ssthresh = 1024
+	kcp.rmt_wnd = 1024
+	kcp.cwnd = hystartLowWindow
+
+	// a round at 10ms, then a round whose rtt grew by 10ms
+	kcp.snd_nxt = 100
+	for i := 0; i < hystartSamples; i++ {
+		c.OnAck(1, 10*time.Millisecond, 10)
+	}
+	if kcp.ssthresh != 1024 {
+		t.Fatal("slow start left early", kcp.ssthresh)
+	}
+	kcp.snd_una, kcp.snd_nxt = 100, 200
+	for i := 0; i < hystartSamples; i++ {
+		c.OnAck(1, 20*time.Millisecond, 10)
+	}
+	if kcp.ssthresh >= 1024 || kcp.ssthresh != kcp.cwnd && kcp.ssthresh+1 != kcp.cwnd {
+		t.Fatal("slow start not left", kcp.ssthresh, kcp.cwnd)
+	}
+}
+
+func TestCubicControl(t *testing.T) {
+	c := NewCubicControl().(*cubicControl)
+
+	// slow start until the first loss
+	for i := 0; i < 98; i++ {
+		c.OnAck(1, 200*time.Millisecond, c.Window())
+	}
+	if w := c.Window(); w != 100 {
+		t.Fatal("slow start window", w)
+	}
+	c.OnLoss(1, false, 100)
+	if w := c.Window(); w != 70 {
+		t.Fatal("window after loss", w)
+	}
+
+	// concave growth back to wMax after k seconds, then convex beyond
+	c.OnAck(1, 200*time.Millisecond, c.Window())
+	if c.k < 3 || c.k > 5 {
+		t.Fatal("k", c.k)
+	}
+	c.epochStart = time.Now().Add(-time.Duration(c.k * float64(time.Second)))
+	for i := 0; i < 1000; i++ {
+		c.OnAck(1, 200*time.Millisecond, c.Window())
+	}
+	if w := c.Window(); w < 95 || w > 110 {
+		t.Fatal("window at k", w)
+	}
+	c.epochStart = c.epochStart.Add(-4 * time.Second)
+	for i := 0; i < 1000; i++ {
+		c.OnAck(1, 200*time.Millisecond, c.Window())
+	}
+	if w := c.Window(); w < 110 {
+		t.Fatal("window past k", w)
+	}
+
+	// a timeout restarts slow start
+	c.OnLoss(1, true, c.Window())
+	if w := c.Window(); w != 1 {
+		t.Fatal("window after timeout", w)
+	}
+
+	// an application limited flow doesn't grow its window
+	c.cwnd, c.ssthresh = 50, 10
+	c.OnAck(1, 200*time.Millisecond, 5)
+	if w := c.Window(); w != 50 {
+		t.Fatal("application limited window", w)
+	}
+}
+
+func TestRTOBounds(t *testing.T) {
+	cli, err := Dial("127.0.0.1:9935", WithRTOBounds(10*time.Millisecond, 500*time.Millisecond, 1.2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(0, 10, 0, 0) // keeps the floor set
+	cli.mu.Lock()
+	minrto, maxrto := cli.kcp.rx_minrto, cli.kcp.rx_maxrto
+	cli.mu.Unlock()
+	if minrto != 10 || maxrto != 500 {
+		t.Fatal("bounds", minrto, maxrto)
+	}
+
+	for _, bounds := range []struct {
+		min, max time.Duration
+		backoff  float64
+	}{
+		{-time.Millisecond, 0, 0},
+		{time.Second, time.Millisecond, 0},
+		{2 * time.Minute, 0, 0},
+		{time.Microsecond, 0, 0},
+		{0, 0, 0.5},
+	} {
+		if err := cli.SetRTOBounds(bounds.min, bounds.max, bounds.backoff); err == nil {
+			t.Fatal("invalid bounds accepted", bounds)
+		}
+	}
+	if _, err := Dial("127.0.0.1:9935", WithRTOBounds(0, 0, 0.5)); err == nil {
+		t.Fatal("invalid option accepted")
+	}
+
+	// a ceiling below the floor of nodelay lowers the floor
+	if err := cli.SetRTOBounds(0, 20*time.Millisecond, 0); err != nil {
+		t.Fatal(err)
+	}
+	cli.SetNoDelay(1, 10, 0, 0)
+	cli.mu.Lock()
+	minrto, maxrto = cli.kcp.rx_minrto, cli.kcp.rx_maxrto
+	cli.mu.Unlock()
+	if minrto != 20 || maxrto != 20 {
+		t.Fatal("bounds", minrto, maxrto)
+	}
+
+	// the rto of a retransmission is multiplied by the backoff up to the
+	// ceiling
+	kcp := NewKCP(1, func([]byte, int) {})
+	kcp.SetRTO(100, 500, 1.5)
+	kcp.Send([]byte("hello"))
+	kcp.Update(1000) // first sent with the rto of 200ms
+	current := uint32(1000)
+	for _, expected := range []uint32{300, 450, 500, 500} {
+		current += 10000
+		kcp.Update(current)
+		if rto := kcp.snd_buf[0].rto; rto != expected {
+			t.Fatal("rto", rto, "expected", expected)
+		}
+	}
+}
+
+func TestRACK(t *testing.T) {
+	// sender and receiver exchange the packets by hand, the sender drops
+	// the first sends of the segments of lose
+	var toReceiver, toSender [][]byte
+	var lose map[uint32]bool
+	var sent []uint32
+	sender := NewKCP(1, func(buf []byte, size int) {
+		for p := buf[:size]; len(p) >= IKCP_OVERHEAD; {
+			length := binary.LittleEndian.Uint32(p[20:])
+			if p[4] == IKCP_CMD_PUSH {
+				sn := binary.LittleEndian.Uint32(p[12:])
+				sent = append(sent, sn)
+				if lose[sn] {
+					delete(lose, sn)
+					p = p[IKCP_OVERHEAD+length:]
+					continue
+				}
+			}
+			toReceiver = append(toReceiver, append([]byte(nil), p[:IKCP_OVERHEAD+length]...))
+			p = p[IKCP_OVERHEAD+length:]
+		}
+	})
+	receiver := NewKCP(1, func(buf []byte, size int) {
+		toSender = append(toSender, append([]byte(nil), buf[:size]...))
+	})
+	sender.NoDelay(0, IKCP_INTERVAL, 0, 1)
+	sender.SetRACK(true)
+	sender.updated, receiver.updated = 1, 1
+	at := func(current uint32) []uint32 {
+		sender.current, receiver.current = current, current
+		for _, p := range toReceiver {
+			receiver.Input(p)
+		}
+		receiver.flush()
+		for _, p := range toSender {
+			sender.Input(p)
+		}
+		toReceiver, toSender, sent = nil, nil, nil
+		sender.flush()
+		return sent
+	}
+	send := func(current uint32, n int) {
+		for i := 0; i < n; i++ {
+			sender.Send(make([]byte, sender.mss))
+		}
+		if s := at(current); len(s) != n {
+			t.Fatal("sent", s)
+		}
+	}
+
+	// a hole resent once the reordering window of 5ms passed, no earlier
+	lose = map[uint32]bool{2: true}
+	send(1000, 4)
+	at(1020)
+	if s := at(1022); len(s) != 0 {
+		t.Fatal("resent within the reordering window", s)
+	}
+	if s := at(1025); len(s) != 1 || s[0] != 2 {
+		t.Fatal("hole not resent", s)
+	}
+	at(1045)
+	if sender.snd_una != 4 {
+		t.Fatal("snd_una", sender.snd_una)
+	}
+
+	// a lost tail probed after two rtts, long before the rto
+	lose = map[uint32]bool{7: true}
+	send(2000, 4)
+	at(2020)
+	if s := at(2030); len(s) != 0 {
+		t.Fatal("tail resent early", s)
+	}
+	if s := at(2000 + 2*sender.rx_srtt); len(s) != 1 || s[0] != 7 {
+		t.Fatal("tail not probed", s)
+	}
+	at(2100)
+	if sender.snd_una != 8 {
+		t.Fatal("snd_una", sender.snd_una)
+	}
+}
+
+func TestSACK(t *testing.T) {
+	var toReceiver, toSender []byte
+	sender := NewKCP(1, func(buf []byte, size int) {
+		for p := buf[:size]; len(p) >= IKCP_OVERHEAD; {
+			length := binary.LittleEndian.Uint32(p[20:])
+			if sn := binary.LittleEndian.Uint32(p[12:]); p[4] != IKCP_CMD_PUSH || sn != 2 && sn != 5 {
+				toReceiver = append(toReceiver, p[:IKCP_OVERHEAD+length]...)
+			}
+			p = p[IKCP_OVERHEAD+length:]
+		}
+	})
+	receiver := NewKCP(1, func(buf []byte, size int) {
+		toSender = append(toSender, buf[:size]...)
+	})
+	sender.NoDelay(0, IKCP_INTERVAL, 0, 1)
+	sender.SetSACK(true)
+	receiver.SetSACK(true)
+	sender.updated, receiver.updated = 1, 1
+
+	// the capability goes along the first data, the acks come back as
+	// one segment of the ranges received
+	sender.current, receiver.current = 1000, 1000
+	for i := 0; i < 10; i++ {
+		sender.Send(make([]byte, sender.mss))
+	}
+	sender.flush()
+	receiver.Input(toReceiver)
+	if !receiver.sack_peer {
+		t.Fatal("capability not advertised")
+	}
+	receiver.current = 1020
+	receiver.flush()
+	if len(toSender) != IKCP_OVERHEAD+16 || toSender[4] != IKCP_CMD_SACK {
+		t.Fatal("not a sack of two ranges", toSender)
+	}
+	var ranges [4]uint32
+	for i := range ranges {
+		ranges[i] = binary.LittleEndian.Uint32(toSender[IKCP_OVERHEAD+4*i:])
+	}
+	if una := binary.LittleEndian.Uint32(toSender[16:]); una != 2 || ranges != [4]uint32{3, 4, 6, 9} {
+		t.Fatal("sack", una, ranges)
+	}
+
+	sender.current = 1020
+	sender.Input(toSender)
+	if len(sender.snd_buf) != 2 || sender.snd_buf[0].sn != 2 || sender.snd_buf[1].sn != 5 {
+		t.Fatal("snd_buf", len(sender.snd_buf))
+	}
+	if !sender.sack_acked || sender.rx_srtt != 20 {
+		t.Fatal("sack_acked", sender.sack_acked, sender.rx_srtt)
+	}
+}
+
+func TestDeadLink(t *testing.T) {
+	// nobody answers
+	sess, err := DialWithOptions("127.0.0.1:9934", nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sess.Close()
+	if err := sess.SetDeadLink(0, true); err == nil {
+		t.Fatal("threshold 0 accepted")
+	}
+	died := make(chan *DeadLinkError, 1)
+	sess.SetEventHandler(SessionEvents{DeadLinkSegment: func(s *UDPSession, e *DeadLinkError) { died <- e }})
+	sess.SetNoDelay(1, 10, 0, 1)
+	sess.SetDeadLink(3, true)
+	sess.Write([]byte("hello"))
+
+	select {
+	case e := <-died:
+		if e.Sn != 0 || e.Xmit != 3 {
+			t.Fatal("dead segment", e.Sn, e.Xmit)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("link not dead")
+	}
+	var dead *DeadLinkError
+	if _, err := sess.Read(make([]byte, 1)); !errors.As(err, &dead) {
+		t.Fatal("read after the dead link", err)
+	}
+	if _, err := sess.Write([]byte("hello")); !errors.As(err, &dead) {
+		t.Fatal("write after the dead link", err)
+	}
+}
+
+func TestFRTO(t *testing.T) {
+	// the packets of the sender are held in flight until delivered by hand
+	var inflight [][]byte
+	var sent []uint32
+	sender := NewKCP(1, func(buf []byte, size int) {
+		for p := buf[:size]; len(p) >= IKCP_OVERHEAD; {
+			length := binary.LittleEndian.Uint32(p[20:])
+			if p[4] == IKCP_CMD_PUSH {
+				sent = append(sent, binary.LittleEndian.Uint32(p[12:]))
+			}
+			inflight = append(inflight, append([]byte(nil), p[:IKCP_OVERHEAD+length]...))
+			p = p[IKCP_OVERHEAD+length:]
+		}
+	})
+	var acks []byte
+	receiver := NewKCP(1, func(buf []byte, size int) {
+		acks = append(acks, buf[:size]...)
+	})
+	sender.SetFRTO(true)
+	sender.updated, receiver.updated = 1, 1
+	flush := func(current uint32) []uint32 {
+		sender.current = current
+		sent = nil
+		sender.flush()
+		return sent
+	}
+	deliver := func(current uint32, packets [][]byte) {
+		receiver.current, sender.current = current, current
+		for _, p := range packets {
+			receiver.Input(p)
+		}
+		acks = nil
+		receiver.flush()
+		sender.Input(acks)
+	}
+	burst := func(current uint32) [][]byte {
+		sender.cwnd, sender.incr = 8, 8*sender.mss
+		for i := 0; i < 4; i++ {
+			sender.Send(make([]byte, sender.mss))
+		}
+		inflight = nil
+		if s := flush(current); len(s) != 4 {
+			t.Fatal("sent", s)
+		}
+		return inflight
+	}
+
+	// a delay spike: only the first segment is sent again, the late acks of
+	// the originals undo the timeout
+	originals := burst(1000)
+	if s := flush(1230); len(s) != 1 || s[0] != 0 || sender.cwnd != 1 {
+		t.Fatal("timeout", s, sender.cwnd)
+	}
+	deliver(1240, originals[:2])
+	if sender.frto_state != 0 || sender.cwnd < 8 {
+		t.Fatal("spurious timeout not undone", sender.frto_state, sender.cwnd)
+	}
+	if s := flush(1250); len(s) != 0 {
+		t.Fatal("go-back retransmission", s)
+	}
+	deliver(1260, originals[2:])
+	if len(sender.snd_buf) != 0 {
+		t.Fatal("snd_buf", len(sender.snd_buf))
+	}
+
+	// a loss: the ack of the segment sent again releases the others
+	burst(2000)
+	timeout := sender.snd_buf[0].resendts
+	if s := flush(timeout); len(s) != 1 || s[0] != 4 {
+		t.Fatal("timeout", s)
+	}
+	deliver(timeout+10, inflight[len(inflight)-1:])
+	if sender.frto_state != 0 || sender.cwnd > 2 {
+		t.Fatal("genuine timeout undone", sender.frto_state, sender.cwnd)
+	}
+	if s := flush(timeout + 20); len(s) != 3 || sender.cwnd > 2 {
+		t.Fatal("held segments not sent again", s, sender.cwnd)
+	}
+}
+
+func TestIdleUpdates(t *testing.T) {
+	const addr = "127.0.0.1:9933"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		s, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer s.Close()
+		io.Copy(s, s)
+	}()
+
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	echo := func() {
+		if _, err := cli.Write([]byte("hello")); err != nil {
+			t.Fatal(err)
+		}
+		cli.SetReadDeadline(time.Now().Add(time.Second))
+		buf := make([]byte, 16)
+		if n, err := cli.Read(buf); err != nil || string(buf[:n]) != "hello" {
+			t.Fatal("echo", err, buf[:n])
+		}
+	}
+
+	// once everything is acked, nothing needs an update until the next write
+	echo()
+	time.Sleep(300 * time.Millisecond)
+	cli.mu.Lock()
+	idle := cli.kcp.idle()
+	cli.mu.Unlock()
+	if !idle {
+		t.Fatal("not idle")
+	}
+	echo()
+}
+
+func TestDrainFullWindow(t *testing.T) {
+	const addr = "127.0.0.1:9931"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.SetNoDelay(1, 10, 2, 1)
+	cli.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	msg := make([]byte, 1000)
+	const count = 4 * defaultWndSize
+	go func() {
+		for i := 0; i < count; i++ {
+			if _, err := cli.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the receiver filled its window before reading
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		cli.mu.Lock()
+		full := cli.kcp.rmt_wnd == 0
+		cli.mu.Unlock()
+		if full {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("window never full")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// reading reopens the window long before the window probe of the sender
+	s.SetReadDeadline(time.Now().Add(3 * time.Second))
+	buf := make([]byte, len(msg))
+	for i := 0; i < count; i++ {
+		if _, err := s.Read(buf); err != nil {
+			t.Fatal("read", i, err)
+		}
+	}
+}
+
+func TestWindowAutoTune(t *testing.T) {
+	s := &UDPSession{kcp: NewKCP(1, func([]byte, int) {})}
+	if err := s.SetWindowAutoTune(-1); err == nil {
+		t.Fatal("negative budget accepted")
+	}
+	kcp := s.kcp
+	kcp.WndSize(32, 128)
+	s.SetWindowAutoTune(1 << 20)
+	kcp.rx_srtt = 100
+	start := s.autoTune.ts
+
+	// a sender limited by its window of 32 acked a window in an rtt, the
+	// receiver received a window of 128 in an rtt
+	kcp.snd_una, kcp.snd_nxt = 32, 64
+	kcp.snd_queue = make([]Segment, 1)
+	kcp.rcv_nxt = 128
+	s.tuneWindows(start.Add(50 * time.Millisecond))
+	if kcp.snd_wnd != 32 || kcp.rcv_wnd != 128 {
+		t.Fatal("tuned within an rtt", kcp.snd_wnd, kcp.rcv_wnd)
+	}
+	s.tuneWindows(start.Add(100 * time.Millisecond))
+	if kcp.snd_wnd != 64 || kcp.rcv_wnd != 256 {
+		t.Fatal("windows not grown", kcp.snd_wnd, kcp.rcv_wnd)
+	}
+
+	// the budget caps the windows
+	s.SetWindowAutoTune(300 * int(kcp.mss))
+	start = s.autoTune.ts
+	kcp.snd_una, kcp.snd_nxt = 96, 160
+	kcp.rcv_nxt = 384
+	s.tuneWindows(start.Add(100 * time.Millisecond))
+	if kcp.snd_wnd != 128 || kcp.rcv_wnd != 256 {
+		t.Fatal("windows past the budget", kcp.snd_wnd, kcp.rcv_wnd)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	const addr = "127.0.0.1:9932"
+	l, err := ListenWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := l.SetQuarantine(-time.Second); err == nil {
+		t.Fatal("negative period accepted")
+	}
+	l.SetQuarantine(time.Minute)
+
+	cli, err := DialWithOptions(addr, nil, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+	cli.Write([]byte("hello"))
+	s, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+	cli.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := cli.Read(make([]byte, 10)); err != io.EOF {
+		t.Fatal("eof of the closed session", err)
+	}
+	select {
+	case <-s.done:
+	case <-time.After(time.Second):
+		t.Fatal("session not stopped")
+	}
+	time.Sleep(50 * time.Millisecond) // the listener forgets the session
+
+	// the late packets of the remote create no ghost session
+	drops := atomic.LoadUint64(&DefaultSnmp.QuarantineDrops)
+	cli.Write([]byte("hello"))
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	if ghost, err := l.AcceptContext(ctx); err == nil {
+		ghost.Close()
+		t.Fatal("ghost session accepted")
+	}
+	if atomic.LoadUint64(&DefaultSnmp.QuarantineDrops) == drops {
+		t.Fatal("packets not dropped")
+	}
+}
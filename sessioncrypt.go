@@ -0,0 +1,118 @@
+package kcp
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	saltSize          = 8
+	sessionHeaderSize = 4 + saltSize // conv and salt in front of the packets of a SessionCrypt
+	sessionKeySize    = 32           // size of the keys derived for each session
+)
+
+type (
+	// SessionCrypt implements BlockCrypt with a key of its own for each
+	// session, derived with HKDF from a pre-shared key, the conv of the
+	// session and a random salt picked by the dialer, and handed to the
+	// crypt registered by name. The conv and salt are sent in the clear in
+	// front of every packet, so that the listener derives the key from
+	// whichever packet of a new session arrives first.
+	SessionCrypt struct {
+		name     string
+		psk      []byte
+		overhead int
+	}
+
+	// sessionCrypt is the crypt of a single session derived by SessionCrypt
+	// or bound to its conv by ConvCrypt, the header is sent in the clear in
+	// front of every packet
+	sessionCrypt struct {
+		header []byte
+		block  BlockCrypt
+	}
+)
+
+// NewSessionCrypt initiates SessionCrypt over the crypt registered as name,
+// with the pre-shared key the session keys are derived from
+func NewSessionCrypt(name string, psk []byte) (BlockCrypt, error) {
+	c := &SessionCrypt{name: name}
+	c.psk = make([]byte, len(psk))
+	copy(c.psk, psk)
+	sc, err := c.derive(make([]byte, sessionHeaderSize))
+	if err != nil {
+		return nil, err
+	}
+	c.overhead = cryptOverhead(sc)
+	return c, nil
+}
+
+// session returns the crypt of a new session dialed with conv
+func (c *SessionCrypt) session(conv uint32) (BlockCrypt, error) {
+	header := make([]byte, sessionHeaderSize)
+	binary.LittleEndian.PutUint32(header, conv)
+	if _, err := io.ReadFull(crand.Reader, header[4:]); err != nil {
+		return nil, err
+	}
+	return c.derive(header)
+}
+
+// derive returns the crypt of the session announced by the header of a packet
+func (c *SessionCrypt) derive(header []byte) (*sessionCrypt, error) {
+	sc := &sessionCrypt{header: make([]byte, sessionHeaderSize)}
+	copy(sc.header, header)
+	key := make([]byte, sessionKeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, c.psk, sc.header, []byte("kcp-go session")), key); err != nil {
+		return nil, err
+	}
+	bc, err := NewCryptByName(c.name, key)
+	if err != nil {
+		return nil, err
+	}
+	sc.block = bc
+	return sc, nil
+}
+
+// Encrypt implements Encrypt interface, the first bytes of src hold the conv
+// and salt of the session whose key encrypts the rest
+func (c *SessionCrypt) Encrypt(dst, src []byte) {
+	sc, err := c.derive(src)
+	if err != nil {
+		xorBytes(dst, dst, dst)
+		return
+	}
+	sc.Encrypt(dst, src)
+}
+
+// Decrypt implements Decrypt interface, the first bytes of src hold the conv
+// and salt of the session whose key decrypts the rest
+func (c *SessionCrypt) Decrypt(dst, src []byte) {
+	sc, err := c.derive(src)
+	if err != nil {
+		xorBytes(dst, dst, dst)
+		return
+	}
+	sc.Decrypt(dst, src)
+}
+
+// Encrypt implements Encrypt interface
+func (sc *sessionCrypt) Encrypt(dst, src []byte) {
+	copy(dst, sc.header)
+	sc.block.Encrypt(dst[len(sc.header):], src[len(sc.header):])
+}
+
+// Decrypt implements Decrypt interface, dst is zeroed if src belongs to
+// another session
+func (sc *sessionCrypt) Decrypt(dst, src []byte) {
+	if !bytes.Equal(src[:len(sc.header)], sc.header) {
+		xorBytes(dst, dst, dst)
+		return
+	}
+	copy(dst, sc.header)
+	sc.block.Decrypt(dst[len(sc.header):], src[len(sc.header):])
+}
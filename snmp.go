@@ -12,6 +12,8 @@ type Snmp struct {
 	CurrEstab        uint64
 	InErrs           uint64
 	InCsumErrors     uint64 // checksum errors
+	InAuthErrors     uint64 // packets failing authentication
+	InReplays        uint64 // authenticated packets replaying a nonce
 	InSegs           uint64
 	OutSegs          uint64
 	OutBytes         uint64 // udp bytes sent
@@ -23,6 +25,12 @@ type Snmp struct {
 	FECRecovered     uint64
 	FECErrs          uint64
 	FECSegs          uint64 // fec segments received
+	Migrations       uint64 // sessions moved to a new remote address
+	AcceptOverflows  uint64 // packets of new sessions turned away by a full accept backlog
+	SessionOverflows uint64 // packets of new sessions turned away by the session limit
+	RateLimitDrops   uint64 // packets of new sessions turned away by the rate limit of their IP
+	QuarantineDrops  uint64 // packets of closed sessions dropped by the quarantine of their conv
+	DatagramDrops    uint64 // unreliable datagrams dropped by a full output queue
 }
 
 func newSnmp() *Snmp {
@@ -40,6 +48,8 @@ func (s *Snmp) Copy() *Snmp {
 	d.CurrEstab = atomic.LoadUint64(&s.CurrEstab)
 	d.InErrs = atomic.LoadUint64(&s.InErrs)
 	d.InCsumErrors = atomic.LoadUint64(&s.InCsumErrors)
+	d.InAuthErrors = atomic.LoadUint64(&s.InAuthErrors)
+	d.InReplays = atomic.LoadUint64(&s.InReplays)
 	d.InSegs = atomic.LoadUint64(&s.InSegs)
 	d.OutSegs = atomic.LoadUint64(&s.OutSegs)
 	d.OutBytes = atomic.LoadUint64(&s.OutBytes)
@@ -51,6 +61,12 @@ func (s *Snmp) Copy() *Snmp {
 	d.FECSegs = atomic.LoadUint64(&s.FECSegs)
 	d.FECErrs = atomic.LoadUint64(&s.FECErrs)
 	d.FECRecovered = atomic.LoadUint64(&s.FECRecovered)
+	d.Migrations = atomic.LoadUint64(&s.Migrations)
+	d.AcceptOverflows = atomic.LoadUint64(&s.AcceptOverflows)
+	d.SessionOverflows = atomic.LoadUint64(&s.SessionOverflows)
+	d.RateLimitDrops = atomic.LoadUint64(&s.RateLimitDrops)
+	d.QuarantineDrops = atomic.LoadUint64(&s.QuarantineDrops)
+	d.DatagramDrops = atomic.LoadUint64(&s.DatagramDrops)
 	return d
 }
 
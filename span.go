@@ -0,0 +1,211 @@
+package kcp
+
+import "encoding/binary"
+
+const (
+	// fecSizeSpan is set in the size field of data shards cut from the
+	// packet stream, sizes fit in 15 bits as shards never exceed mtuLimit
+	fecSizeSpan    = 0x8000
+	fecSizeMask    = 0x7fff
+	spanHeaderSize = 6      // pos(4) + first(2), after the size field
+	spanNone       = 0xffff // first of a shard where no packet starts
+	spanMinSize    = 64     // smallest stream bytes per shard
+	spanWindow     = 256    // shards kept for reassembly
+)
+
+type (
+	// spanWriter cuts the outgoing packets into data shards of a fixed size.
+	// Packets are prefixed with their 2 bytes length and laid out back to back
+	// in a stream, each shard carries the stream position of its first byte
+	// and the offset of the first packet starting in it, so that the receiver
+	// can resynchronize after an unrecoverable shard.
+	spanWriter struct {
+		size   int    // stream bytes per shard, 0 if spanning is disabled
+		pos    uint32 // stream position of buf[0]
+		buf    []byte
+		starts []int // offsets in buf of the packets starting there
+	}
+
+	// spanReader reassembles the packets of a stream cut by spanWriter
+	spanReader struct {
+		shards map[uint32]*spanShard // by stream position of the first byte
+		ends   map[uint32]*spanShard // by stream position after the last byte
+		order  []*spanShard          // arrival order, the oldest are dropped first
+	}
+
+	spanShard struct {
+		pos   uint32
+		first int // offset of the first packet starting in data, spanNone if none
+		data  []byte
+	}
+)
+
+// write appends a packet to the stream
+func (w *spanWriter) write(pkt []byte) {
+	w.starts = append(w.starts, len(w.buf))
+	var sz [2]byte
+	binary.LittleEndian.PutUint16(sz[:], uint16(len(pkt)))
+	w.buf = append(w.buf, sz[:]...)
+	w.buf = append(w.buf, pkt...)
+}
+
+// cut moves the next shard of the stream into dst, which starts after the
+// size field, and returns its length. A shard shorter than size is only cut
+// if flush is set, 0 is returned if there is nothing to cut.
+func (w *spanWriter) cut(dst []byte, flush bool) int {
+	n := len(w.buf)
+	if n == 0 || n < w.size && !flush {
+		return 0
+	}
+	if n > w.size {
+		n = w.size
+	}
+
+	first := spanNone
+	k := 0
+	for ; k < len(w.starts) && w.starts[k] < n; k++ {
+		if first == spanNone {
+			first = w.starts[k]
+		}
+	}
+	binary.LittleEndian.PutUint32(dst, w.pos)
+	binary.LittleEndian.PutUint16(dst[4:], uint16(first))
+	copy(dst[spanHeaderSize:], w.buf[:n])
+
+	// shift the rest of the stream
+	w.pos += uint32(n)
+	w.buf = w.buf[:copy(w.buf, w.buf[n:])]
+	w.starts = w.starts[:copy(w.starts, w.starts[k:])]
+	for i := range w.starts {
+		w.starts[i] -= n
+	}
+	return spanHeaderSize + n
+}
+
+// isSpan tells if a data shard, starting with its size field, is cut from
+// the packet stream
+func isSpan(shard []byte) bool {
+	return len(shard) >= 2 && binary.LittleEndian.Uint16(shard)&fecSizeSpan != 0
+}
+
+// input takes a data shard starting with its size field, and delivers the
+// packets it completes. Packets spanning a lost shard are dropped.
+func (r *spanReader) input(shard []byte, deliver func([]byte)) {
+	sz := int(binary.LittleEndian.Uint16(shard) & fecSizeMask)
+	if sz <= 2+spanHeaderSize || sz > len(shard) {
+		return
+	}
+	s := &spanShard{
+		pos:   binary.LittleEndian.Uint32(shard[2:]),
+		first: int(binary.LittleEndian.Uint16(shard[6:])),
+	}
+	s.data = make([]byte, sz-2-spanHeaderSize)
+	copy(s.data, shard[2+spanHeaderSize:sz])
+	if s.first != spanNone && s.first > len(s.data) {
+		return
+	}
+	if r.shards == nil {
+		r.shards = make(map[uint32]*spanShard)
+		r.ends = make(map[uint32]*spanShard)
+	}
+	if r.shards[s.pos] != nil { // duplicated
+		return
+	}
+	r.shards[s.pos] = s
+	r.ends[s.pos+uint32(len(s.data))] = s
+	r.order = append(r.order, s)
+	if len(r.order) > spanWindow {
+		r.drop(r.order[0])
+		r.order = r.order[:copy(r.order, r.order[1:])]
+	}
+
+	// the packet crossing into s, started in the nearest shard before it
+	// which has a packet start
+	if s.first != 0 {
+		m := r.ends[s.pos]
+		for m != nil && m.first == spanNone {
+			m = r.ends[m.pos]
+		}
+		if m != nil {
+			r.parse(m, false, deliver)
+		}
+	}
+	if s.first != spanNone {
+		r.parse(s, true, deliver)
+	}
+}
+
+// parse delivers the packets starting in s from its first packet, the ones
+// lying within s are only delivered if all is set, as they were once s arrived.
+func (r *spanReader) parse(s *spanShard, all bool, deliver func([]byte)) {
+	for off := s.first; off < len(s.data); {
+		hdr, ok := r.gather(s, off, 2)
+		if !ok {
+			return
+		}
+		n := int(binary.LittleEndian.Uint16(hdr))
+		if n == 0 || n > mtuLimit {
+			return
+		}
+		if off+2+n <= len(s.data) {
+			if all {
+				deliver(s.data[off+2 : off+2+n])
+			}
+			off += 2 + n
+			continue
+		}
+		if pkt, ok := r.gather(s, off+2, n); ok {
+			deliver(pkt)
+		}
+		return
+	}
+}
+
+// gather returns n bytes of the stream from offset off of s on, false if a
+// shard they span is missing
+func (r *spanReader) gather(s *spanShard, off, n int) ([]byte, bool) {
+	if off+n <= len(s.data) {
+		return s.data[off : off+n], true
+	}
+	buf := make([]byte, 0, n)
+	for len(buf) < n {
+		if s == nil {
+			return nil, false
+		}
+		if off < len(s.data) {
+			end := off + n - len(buf)
+			if end > len(s.data) {
+				end = len(s.data)
+			}
+			buf = append(buf, s.data[off:end]...)
+			off = 0
+		} else {
+			off -= len(s.data)
+		}
+		s = r.shards[s.pos+uint32(len(s.data))]
+	}
+	return buf, true
+}
+
+func (r *spanReader) drop(s *spanShard) {
+	if r.shards[s.pos] == s {
+		delete(r.shards, s.pos)
+	}
+	if end := s.pos + uint32(len(s.data)); r.ends[end] == s {
+		delete(r.ends, end)
+	}
+}
+
+// spanConv returns the conv of the first packet of a stream shard, if it
+// starts there
+func spanConv(shard []byte) (uint32, bool) {
+	if !isSpan(shard) || len(shard) < 2+spanHeaderSize {
+		return 0, false
+	}
+	first := int(binary.LittleEndian.Uint16(shard[6:]))
+	off := 2 + spanHeaderSize + first + 2
+	if first == spanNone || off+4 > len(shard) {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint32(shard[off:]), true
+}
@@ -0,0 +1,107 @@
+package kcp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+)
+
+// spanStream cuts n packets of random sizes into shards of size bytes
+func spanStream(rng *rand.Rand, n, size int) (packets, shards [][]byte) {
+	var w spanWriter
+	w.size = size
+	for i := 0; i < n; i++ {
+		pkt := make([]byte, 4+rng.Intn(3*size))
+		rng.Read(pkt)
+		binary.LittleEndian.PutUint32(pkt, uint32(i))
+		packets = append(packets, pkt)
+		w.write(pkt)
+		for flush := i == n-1 || rng.Intn(4) == 0; ; {
+			shard := make([]byte, mtuLimit)
+			k := w.cut(shard[2:], flush)
+			if k == 0 {
+				break
+			}
+			binary.LittleEndian.PutUint16(shard, uint16(2+k)|fecSizeSpan)
+			shards = append(shards, shard[:2+k])
+		}
+	}
+	return
+}
+
+func TestSpanReorder(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		rng := rand.New(rand.NewSource(seed))
+		packets, shards := spanStream(rng, 100, 100)
+		for _, shard := range shards {
+			if len(shard) > 2+spanHeaderSize+100 {
+				t.Fatal("shard too large", len(shard))
+			}
+		}
+
+		// within the reassembly window every packet is delivered once,
+		// whatever the arrival order
+		var r spanReader
+		delivered := make(map[uint32]int)
+		for _, k := range rng.Perm(len(shards)) {
+			r.input(shards[k], func(pkt []byte) {
+				id := binary.LittleEndian.Uint32(pkt)
+				if !bytes.Equal(pkt, packets[id]) {
+					t.Fatal("packet", id, "corrupted")
+				}
+				delivered[id]++
+			})
+		}
+		for i := range packets {
+			if delivered[uint32(i)] != 1 {
+				t.Fatal("seed", seed, "packet", i, "delivered", delivered[uint32(i)], "times")
+			}
+		}
+	}
+}
+
+func TestSpanLoss(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	packets, shards := spanStream(rng, 200, 100)
+
+	// the packets spanning a lost shard are dropped, the reader
+	// resynchronizes on the next packet start
+	var r spanReader
+	delivered := 0
+	for k := range shards {
+		if k%10 == 5 {
+			continue
+		}
+		r.input(shards[k], func(pkt []byte) {
+			id := binary.LittleEndian.Uint32(pkt)
+			if !bytes.Equal(pkt, packets[id]) {
+				t.Fatal("packet", id, "corrupted")
+			}
+			delivered++
+		})
+	}
+	if delivered == 0 || delivered >= len(packets) {
+		t.Fatal("delivered", delivered, "of", len(packets))
+	}
+	if len(r.order) > spanWindow || len(r.shards) > spanWindow {
+		t.Fatal("reader not bounded", len(r.order))
+	}
+}
+
+func TestSpanConv(t *testing.T) {
+	var w spanWriter
+	w.size = 100
+	pkt := make([]byte, 24)
+	binary.LittleEndian.PutUint32(pkt, 0x12345678)
+	w.write(pkt)
+	shard := make([]byte, mtuLimit)
+	n := w.cut(shard[2:], true)
+	binary.LittleEndian.PutUint16(shard, uint16(2+n)|fecSizeSpan)
+	if conv, ok := spanConv(shard[:2+n]); !ok || conv != 0x12345678 {
+		t.Fatal("conv", conv, ok)
+	}
+	if _, ok := spanConv(shard[:2+spanHeaderSize+3]); ok {
+		t.Fatal("conv read from a truncated shard")
+	}
+}
@@ -0,0 +1,78 @@
+package kcp
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds the handshake of DialTLS
+var tlsHandshakeTimeout = 10 * time.Second
+
+// tlsListener wraps the sessions accepted by a Listener with crypto/tls
+type tlsListener struct {
+	l      *Listener
+	config *tls.Config
+}
+
+// DialTLS connects to raddr like DialWithOptions and runs TLS over the
+// session, so that the stream is encrypted and the peer authenticated by
+// crypto/tls instead of a BlockCrypt. The handshake completes before DialTLS
+// returns, it fails with a timeout error if the peer doesn't answer within
+// ten seconds. A config without ServerName takes the host of raddr.
+func DialTLS(raddr string, config *tls.Config, dataShards, parityShards int) (*tls.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+	defer cancel()
+	return DialTLSContext(ctx, raddr, config, dataShards, parityShards)
+}
+
+// DialTLSContext connects like DialTLS, the handshake is bounded by ctx
+// instead of a timeout and fails with the error of ctx once it is done.
+func DialTLSContext(ctx context.Context, raddr string, config *tls.Config, dataShards, parityShards int) (*tls.Conn, error) {
+	if config == nil {
+		config = new(tls.Config)
+	}
+	if config.ServerName == "" && !config.InsecureSkipVerify {
+		host, _, err := net.SplitHostPort(raddr)
+		if err != nil {
+			return nil, err
+		}
+		config = config.Clone()
+		config.ServerName = host
+	}
+
+	sess, err := DialWithOptionsContext(ctx, raddr, nil, dataShards, parityShards)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(sess, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		sess.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// NewTLSListener returns a net.Listener accepting the sessions of l as TLS
+// server connections, config must hold at least one certificate. The
+// handshake of a connection runs on its first Read or Write, so a deadline set
+// on the connection beforehand bounds the handshake too.
+func NewTLSListener(l *Listener, config *tls.Config) net.Listener {
+	return &tlsListener{l: l, config: config}
+}
+
+// Accept implements the Accept method in the net.Listener interface.
+func (tl *tlsListener) Accept() (net.Conn, error) {
+	sess, err := tl.l.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return tls.Server(sess, tl.config), nil
+}
+
+// Close stops listening on the UDP address.
+func (tl *tlsListener) Close() error { return tl.l.Close() }
+
+// Addr returns the listener's network address.
+func (tl *tlsListener) Addr() net.Addr { return tl.l.Addr() }